@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// latestAPIVersion serves unversioned requests that don't ask for a
+// version.
+const latestAPIVersion = "1"
+
+// apiVersionHeader is set on every API response, and lets clients of the
+// deprecated unversioned paths pick a version. Accept:
+// application/vnd.tubely.v1+json works too.
+const apiVersionHeader = "API-Version"
+
+// apiVersionRouter serves /api/vN/... from the handler registered for
+// version N. Any other /api/ path is a deprecated alias: it's served by
+// the negotiated version (the latest unless the client asked) with a
+// Deprecation header pointing at the versioned path.
+func apiVersionRouter(versions map[string]http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rest := strings.TrimPrefix(r.URL.Path, "/api/")
+		if first, _, _ := strings.Cut(rest, "/"); isVersionSegment(first) {
+			version := strings.TrimPrefix(first, "v")
+			h, ok := versions[version]
+			if !ok {
+				respondWithError(w, http.StatusNotFound, fmt.Sprintf("Unknown API version %s", first), nil)
+				return
+			}
+			w.Header().Set(apiVersionHeader, version)
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		version := negotiateAPIVersion(r)
+		h, ok := versions[version]
+		if !ok {
+			respondWithError(w, http.StatusNotAcceptable, fmt.Sprintf("Unsupported API version %q", version), nil)
+			return
+		}
+		successor := "/api/v" + version + "/" + rest
+
+		w.Header().Set(apiVersionHeader, version)
+		w.Header().Set("Deprecation", "true")
+		w.Header().Add("Link", fmt.Sprintf("<%s>; rel=\"successor-version\"", successor))
+
+		r2 := r.Clone(r.Context())
+		r2.URL.Path = successor
+		r2.URL.RawPath = ""
+		h.ServeHTTP(w, r2)
+	})
+}
+
+func isVersionSegment(s string) bool {
+	if len(s) < 2 || s[0] != 'v' {
+		return false
+	}
+	for _, c := range s[1:] {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// negotiateAPIVersion reads the version a client asked for from the
+// API-Version header or a vendor media type in Accept.
+func negotiateAPIVersion(r *http.Request) string {
+	if v := r.Header.Get(apiVersionHeader); v != "" {
+		return strings.TrimPrefix(v, "v")
+	}
+	for _, part := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		if v, ok := strings.CutPrefix(mediaType, "application/vnd.tubely.v"); ok {
+			v, _, _ = strings.Cut(v, "+")
+			return v
+		}
+	}
+	return latestAPIVersion
+}
@@ -1,4 +1,11 @@
 document.addEventListener('DOMContentLoaded', async () => {
+  // Social login redirects back with the session tokens in the fragment
+  const fragment = new URLSearchParams(window.location.hash.slice(1));
+  if (fragment.get('token')) {
+    localStorage.setItem('token', fragment.get('token'));
+    history.replaceState(null, '', window.location.pathname);
+  }
+
   const token = localStorage.getItem('token');
 
   if (token) {
@@ -26,7 +33,7 @@ async function createVideoDraft() {
   const description = document.getElementById('video-description').value;
 
   try {
-    const res = await fetch('/api/videos', {
+    const res = await fetch('/api/v1/videos', {
       method: 'POST',
       headers: {
         'Content-Type': 'application/json',
@@ -54,7 +61,7 @@ async function login() {
   const password = document.getElementById('password').value;
 
   try {
-    const res = await fetch('/api/login', {
+    const res = await fetch('/api/v1/login', {
       method: 'POST',
       headers: {
         'Content-Type': 'application/json',
@@ -84,7 +91,7 @@ async function signup() {
   const password = document.getElementById('password').value;
 
   try {
-    const res = await fetch('/api/users', {
+    const res = await fetch('/api/v1/users', {
       method: 'POST',
       headers: {
         'Content-Type': 'application/json',
@@ -130,7 +137,7 @@ async function uploadThumbnail(videoID) {
   setUploadButtonState(true, uploadBtnSelector);
 
   try {
-    const res = await fetch(`/api/thumbnail_upload/${videoID}`, {
+    const res = await fetch(`/api/v1/thumbnail_upload/${videoID}`, {
       method: 'POST',
       headers: {
         Authorization: `Bearer ${localStorage.getItem('token')}`,
@@ -163,7 +170,7 @@ async function uploadVideoFile(videoID) {
   setUploadButtonState(true, uploadBtnSelector);
 
   try {
-    const res = await fetch(`/api/video_upload/${videoID}`, {
+    const res = await fetch(`/api/v1/video_upload/${videoID}`, {
       method: 'POST',
       headers: {
         Authorization: `Bearer ${localStorage.getItem('token')}`,
@@ -188,18 +195,26 @@ const videoStateHandler = createVideoStateHandler();
 
 async function getVideos() {
   try {
-    const res = await fetch('/api/videos', {
-      method: 'GET',
-      headers: {
-        Authorization: `Bearer ${localStorage.getItem('token')}`,
-      },
-    });
-    if (!res.ok) {
-      const data = await res.json();
-      throw new Error(`Failed to get videos. Error: ${data.error}`);
-    }
+    const videos = [];
+    let cursor = null;
+    do {
+      const url = cursor ? `/api/v1/videos?cursor=${encodeURIComponent(cursor)}` : '/api/v1/videos';
+      const res = await fetch(url, {
+        method: 'GET',
+        headers: {
+          Authorization: `Bearer ${localStorage.getItem('token')}`,
+        },
+      });
+      if (!res.ok) {
+        const data = await res.json();
+        throw new Error(`Failed to get videos. Error: ${data.error}`);
+      }
+
+      const page = await res.json();
+      videos.push(...page.items);
+      cursor = page.next_cursor;
+    } while (cursor);
 
-    const videos = await res.json();
     const videoList = document.getElementById('video-list');
     videoList.innerHTML = '';
     for (const video of videos) {
@@ -231,7 +246,7 @@ function createVideoStateHandler() {
 
 async function getVideo(videoID) {
   try {
-    const res = await fetch(`/api/videos/${videoID}`, {
+    const res = await fetch(`/api/v1/videos/${videoID}`, {
       method: 'GET',
       headers: {
         Authorization: `Bearer ${localStorage.getItem('token')}`,
@@ -283,7 +298,7 @@ async function deleteVideo() {
   }
 
   try {
-    const res = await fetch(`/api/videos/${currentVideo.id}`, {
+    const res = await fetch(`/api/v1/videos/${currentVideo.id}`, {
       method: 'DELETE',
       headers: {
         Authorization: `Bearer ${localStorage.getItem('token')}`,
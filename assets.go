@@ -1,7 +1,12 @@
 package main
 
 import (
+	"errors"
+	"fmt"
+	"net/url"
 	"os"
+	"path/filepath"
+	"strings"
 )
 
 func (cfg apiConfig) ensureAssetsDir() error {
@@ -10,3 +15,29 @@ func (cfg apiConfig) ensureAssetsDir() error {
 	}
 	return nil
 }
+
+// openLocalAsset opens the file behind an /assets/ URL for reading.
+func (cfg *apiConfig) openLocalAsset(assetURL string) (*os.File, error) {
+	u, err := url.Parse(assetURL)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(u.Path, "/assets/") {
+		return nil, fmt.Errorf("%s isn't a local asset", assetURL)
+	}
+	return os.Open(filepath.Join(cfg.assetsRoot, filepath.Base(u.Path)))
+}
+
+// removeLocalAsset deletes the file behind an /assets/ URL. URLs that
+// point elsewhere and files that are already gone are ignored.
+func (cfg *apiConfig) removeLocalAsset(assetURL string) error {
+	u, err := url.Parse(assetURL)
+	if err != nil || !strings.HasPrefix(u.Path, "/assets/") {
+		return nil
+	}
+	err = os.Remove(filepath.Join(cfg.assetsRoot, filepath.Base(u.Path)))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
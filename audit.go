@@ -0,0 +1,40 @@
+package main
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// audit records a mutating action. r may be nil for background jobs, and
+// actorID is uuid.Nil when no user is behind the action. Failures are logged rather than
+// returned: the action has already happened and the caller's response
+// shouldn't depend on the audit trail.
+func (cfg *apiConfig) audit(r *http.Request, actorID uuid.UUID, action, resourceType, resourceID, summary string) {
+	params := database.CreateAuditEventParams{
+		Action:       action,
+		ResourceType: resourceType,
+		ResourceID:   resourceID,
+		Summary:      summary,
+	}
+	if r != nil {
+		params.IP = clientIP(r)
+	}
+	if actorID != uuid.Nil {
+		params.ActorID = &actorID
+	}
+	err := cfg.db.CreateAuditEvent(params)
+	if err != nil {
+		log.Printf("Couldn't record audit event %s on %s %s: %v", action, resourceType, resourceID, err)
+	}
+}
+
+// stringOrEmpty dereferences optional columns for audit summaries.
+func stringOrEmpty(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
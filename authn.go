@@ -0,0 +1,58 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/google/uuid"
+)
+
+var errTokenRevoked = errors.New("token has been revoked")
+
+// validateJWT checks an access token and makes sure it hasn't been revoked
+// by a logout-all since it was issued.
+func (cfg *apiConfig) validateJWT(token string) (uuid.UUID, error) {
+	claims, err := auth.ParseJWT(token, cfg.jwtSecret)
+	if err != nil {
+		return uuid.Nil, err
+	}
+	user, err := cfg.db.GetUser(claims.UserID)
+	if err != nil {
+		return uuid.Nil, err
+	}
+	if user == nil || user.TokenVersion != claims.TokenVersion {
+		return uuid.Nil, errTokenRevoked
+	}
+	return claims.UserID, nil
+}
+
+// optionalUserID returns the authenticated user for requests that may also
+// be made anonymously, or uuid.Nil when there's no valid token.
+func (cfg *apiConfig) optionalUserID(r *http.Request) uuid.UUID {
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		return uuid.Nil
+	}
+	userID, err := cfg.validateJWT(token)
+	if err != nil {
+		return uuid.Nil
+	}
+	return userID
+}
+
+// authenticate returns the user behind the request's bearer token. On
+// failure it writes the error response itself and returns ok == false.
+func (cfg *apiConfig) authenticate(w http.ResponseWriter, r *http.Request) (uuid.UUID, bool) {
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return uuid.Nil, false
+	}
+	userID, err := cfg.validateJWT(token)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return uuid.Nil, false
+	}
+	return userID, true
+}
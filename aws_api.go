@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+)
+
+// awsJSONClient calls AWS JSON APIs that we don't pull in an SDK module
+// for, signing requests with the same credentials as the S3 client.
+type awsJSONClient struct {
+	awsConfig aws.Config
+	service   string
+	region    string
+	// endpoint is the API's base URL, such as https://events.us-east-1.amazonaws.com
+	endpoint string
+	client   *http.Client
+}
+
+func newAWSJSONClient(awsConfig aws.Config, service, region, endpoint string) awsJSONClient {
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://%s.%s.amazonaws.com", service, region)
+	}
+	return awsJSONClient{
+		awsConfig: awsConfig,
+		service:   service,
+		region:    region,
+		endpoint:  strings.TrimSuffix(endpoint, "/"),
+		client:    &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// do sends in as the JSON body of a signed request and decodes the
+// response into out, which may be nil. headers are set on the request
+// before it's signed.
+func (c awsJSONClient) do(ctx context.Context, method, path string, headers map[string]string, in, out any) error {
+	var body []byte
+	if in != nil {
+		var err error
+		body, err = json.Marshal(in)
+		if err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.endpoint+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+
+	creds, err := c.awsConfig.Credentials.Retrieve(ctx)
+	if err != nil {
+		return fmt.Errorf("couldn't get AWS credentials: %w", err)
+	}
+	hash := sha256.Sum256(body)
+	err = v4.NewSigner().SignHTTP(ctx, creds, req, hex.EncodeToString(hash[:]), c.service, c.region, time.Now())
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return &awsAPIError{service: c.service, status: resp.StatusCode, body: strings.TrimSpace(string(respBody))}
+	}
+	if out == nil {
+		return nil
+	}
+	if err := json.Unmarshal(respBody, out); err != nil {
+		return fmt.Errorf("couldn't decode %s response: %w", c.service, err)
+	}
+	return nil
+}
+
+// awsAPIError is a non-2XX response. It exposes the status so the retry
+// policy treats throttling and 5XX responses as transient.
+type awsAPIError struct {
+	service string
+	status  int
+	body    string
+}
+
+func (e *awsAPIError) Error() string {
+	return fmt.Sprintf("%s returned status %d: %s", e.service, e.status, e.body)
+}
+
+func (e *awsAPIError) HTTPStatusCode() int {
+	return e.status
+}
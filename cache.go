@@ -1,10 +1,52 @@
 package main
 
-import "net/http"
+import (
+	"net/http"
+	"strings"
+)
 
-func cacheMiddleware(next http.Handler) http.Handler {
+// assetCacheControl lets clients and CDNs keep assets for good. Every
+// write gets a fresh random name and files are never changed in place, so
+// a replaced thumbnail or avatar always has a new URL.
+const assetCacheControl = "public, max-age=31536000, immutable"
+
+// assetCacheMiddleware marks successful responses for files as immutable.
+// Errors aren't cached, so a missing asset isn't remembered for a year.
+func assetCacheMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Cache-Control", "max-age=3600")
-		next.ServeHTTP(w, r)
+		// Directory listings change as assets come and go
+		if strings.HasSuffix(r.URL.Path, "/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		next.ServeHTTP(&cacheControlWriter{ResponseWriter: w}, r)
 	})
 }
+
+type cacheControlWriter struct {
+	http.ResponseWriter
+	wroteHeader bool
+}
+
+func (cw *cacheControlWriter) WriteHeader(status int) {
+	if !cw.wroteHeader && status >= 200 {
+		cw.wroteHeader = true
+		if status < 400 {
+			cw.Header().Set("Cache-Control", assetCacheControl)
+		} else {
+			cw.Header().Set("Cache-Control", "no-store")
+		}
+	}
+	cw.ResponseWriter.WriteHeader(status)
+}
+
+func (cw *cacheControlWriter) Write(p []byte) (int, error) {
+	if !cw.wroteHeader {
+		cw.WriteHeader(http.StatusOK)
+	}
+	return cw.ResponseWriter.Write(p)
+}
+
+func (cw *cacheControlWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
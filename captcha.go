@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// captchaTokenHeader carries the token the client got from the CAPTCHA
+// widget.
+const captchaTokenHeader = "X-Captcha-Token"
+
+var (
+	errCaptchaMissing = errors.New("no CAPTCHA token")
+	errCaptchaFailed  = errors.New("CAPTCHA wasn't solved")
+)
+
+// captchaVerifier checks a CAPTCHA token with its provider, returning
+// errCaptchaMissing or errCaptchaFailed if the client didn't pass.
+type captchaVerifier interface {
+	verify(ctx context.Context, token, remoteIP string) error
+}
+
+// siteverifyCaptcha is a captchaVerifier for the siteverify API that
+// reCAPTCHA, hCaptcha and Turnstile all share.
+type siteverifyCaptcha struct {
+	verifyURL string
+	secret    string
+	client    *http.Client
+}
+
+func (c siteverifyCaptcha) verify(ctx context.Context, token, remoteIP string) error {
+	if token == "" {
+		return errCaptchaMissing
+	}
+	form := url.Values{
+		"secret":   {c.secret},
+		"response": {token},
+		"remoteip": {remoteIP},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.verifyURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("CAPTCHA provider returned status %d", resp.StatusCode)
+	}
+
+	var result struct {
+		Success    bool     `json:"success"`
+		ErrorCodes []string `json:"error-codes"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return err
+	}
+	if !result.Success {
+		return fmt.Errorf("%w: %s", errCaptchaFailed, strings.Join(result.ErrorCodes, ", "))
+	}
+	return nil
+}
+
+// checkCaptcha verifies the request's CAPTCHA token if a provider is
+// configured. On failure it writes the error response itself and returns
+// false.
+func (cfg *apiConfig) checkCaptcha(w http.ResponseWriter, r *http.Request) bool {
+	if cfg.captcha == nil {
+		return true
+	}
+	err := cfg.captcha.verify(r.Context(), r.Header.Get(captchaTokenHeader), clientIP(r))
+	if errors.Is(err, errCaptchaMissing) || errors.Is(err, errCaptchaFailed) {
+		respondWithErrorCode(w, http.StatusForbidden, codeCaptchaRequired, "Complete the CAPTCHA and try again", err)
+		return false
+	}
+	if err != nil {
+		respondWithError(w, http.StatusBadGateway, "Couldn't check CAPTCHA", err)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// Cues of automatic captions are cut at sentence ends, pauses and these
+// limits, so each fits on screen in two lines.
+const (
+	maxCueSeconds = 6.0
+	maxCueChars   = 84
+	cuePauseGap   = 1.5
+)
+
+// captionCue is a span of speech, in seconds from the start of the video.
+type captionCue struct {
+	start float64
+	end   float64
+	text  string
+}
+
+// captionWord is a single recognized word. Punctuation is attached to
+// the word before it.
+type captionWord struct {
+	start float64
+	end   float64
+	text  string
+}
+
+// transcript is what a speech recognizer heard in a video.
+type transcript struct {
+	// language is the tag of the spoken language, as set or detected
+	language string
+	cues     []captionCue
+}
+
+// videoCaptionsPrefix is where a video's caption tracks are kept, along
+// with the audio and results of transcriptions in progress.
+func (cfg *apiConfig) videoCaptionsPrefix(video database.Video) string {
+	return video.KeyPrefix + cfg.s3CaptionsPrefix + video.ID.String() + "/"
+}
+
+// startCaptioning extracts the audio of the video and transcribes
+// it in the background, so the video doesn't wait on speech recognition
+// to be ready. It's a nicety: failures are logged and the video goes
+// without automatic captions.
+func (cfg *apiConfig) startCaptioning(ctx context.Context, video database.Video, in mediaInput) {
+	if cfg.speechRecognizer == nil || !cfg.flags.enabled(flagAutoCaptions, video.UserID) {
+		return
+	}
+	// The audio of encrypted videos mustn't leave the server in the clear
+	if _, ok := cfg.speechRecognizer.(*awsTranscribeRecognizer); ok && video.Encrypted {
+		return
+	}
+
+	audioPath, err := cfg.extractAudio(ctx, in)
+	if err != nil {
+		log.Printf("Couldn't extract audio of video %s for captions: %v", video.ID, err)
+		return
+	}
+	go func() {
+		defer os.Remove(audioPath)
+		ctx, cancel := context.WithTimeout(context.Background(), cfg.captionTimeout)
+		defer cancel()
+		if err := cfg.generateCaptions(ctx, video, audioPath); err != nil {
+			log.Printf("Couldn't generate captions for video %s: %v", video.ID, err)
+		}
+	}()
+}
+
+// extractAudio writes the audio of the video to a scratch file once a
+// transcode slot is free and returns its path. The caller removes it.
+// Even small videos held in memory need this file, as recognizers only
+// take audio from disk.
+func (cfg *apiConfig) extractAudio(ctx context.Context, in mediaInput) (string, error) {
+	releaseSlot, err := cfg.transcodes.acquire(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer releaseSlot()
+	ctx, cancel := context.WithTimeout(ctx, cfg.ffmpegTimeout)
+	defer cancel()
+
+	f, err := os.CreateTemp(cfg.scratchDir, tempFilePrefix+"audio-*.wav")
+	if err != nil {
+		return "", err
+	}
+	f.Close()
+	if in.data != nil {
+		err = cfg.mediaTranscoder.ExtractAudioStream(ctx, bytes.NewReader(in.data), f.Name())
+	} else {
+		err = cfg.mediaTranscoder.ExtractAudio(ctx, in.path, f.Name())
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+// generateCaptions transcribes the audio at audioPath and saves the
+// result as the video's automatic captions, replacing earlier ones.
+func (cfg *apiConfig) generateCaptions(ctx context.Context, video database.Video, audioPath string) error {
+	t, err := cfg.speechRecognizer.recognize(ctx, recognizeJob{
+		videoID:    video.ID,
+		workPrefix: cfg.videoCaptionsPrefix(video),
+		audioPath:  audioPath,
+		language:   cfg.captionLanguage,
+	})
+	if err != nil {
+		return err
+	}
+	if len(t.cues) == 0 {
+		log.Printf("No speech recognized in video %s, so it gets no captions", video.ID)
+		return nil
+	}
+	if t.language == "" {
+		t.language = "und"
+	}
+
+	dataKey, err := cfg.videoDataKey(ctx, video)
+	if err != nil {
+		return err
+	}
+	vtt, err := os.CreateTemp(cfg.scratchDir, tempFilePrefix+"captions-*.vtt")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(vtt.Name())
+	_, err = vtt.WriteString(formatWebVTT(t.cues))
+	vtt.Close()
+	if err != nil {
+		return err
+	}
+	vttPath := vtt.Name()
+	if dataKey != nil {
+		vttPath, _, err = cfg.sealFile(vttPath, dataKey)
+		if err != nil {
+			return err
+		}
+		defer os.Remove(vttPath)
+	}
+
+	captionID := uuid.New()
+	key := cfg.videoCaptionsPrefix(video) + captionID.String() + ".vtt"
+	contentType := "text/vtt"
+	err = cfg.retry.do(ctx, "s3_put_object", func() error {
+		f, err := os.Open(vttPath)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = cfg.s3Client.PutObject(ctx, &s3.PutObjectInput{
+			Bucket:      &cfg.s3Bucket,
+			Key:         &key,
+			ContentType: &contentType,
+			Body:        f,
+		})
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("couldn't upload captions: %w", err)
+	}
+
+	old, err := cfg.db.DeleteAutoCaptions(video.ID)
+	if err != nil {
+		return err
+	}
+	caption, err := cfg.db.CreateCaption(database.CreateCaptionParams{
+		ID:            captionID,
+		VideoID:       video.ID,
+		Language:      t.language,
+		AutoGenerated: true,
+		Key:           key,
+	})
+	if err != nil {
+		return err
+	}
+	for _, c := range old {
+		_, err := cfg.s3Client.DeleteObject(ctx, &s3.DeleteObjectInput{
+			Bucket: &cfg.s3Bucket,
+			Key:    &c.Key,
+		})
+		if err != nil {
+			log.Printf("Couldn't delete old captions %s of video %s: %v", c.Key, video.ID, err)
+		}
+	}
+	log.Printf("Saved %s captions %s for video %s", caption.Language, caption.ID, video.ID)
+	return nil
+}
+
+// wordsToCues groups recognized words into cues.
+func wordsToCues(words []captionWord) []captionCue {
+	var cues []captionCue
+	var cur *captionCue
+	for _, w := range words {
+		if cur != nil {
+			long := w.end-cur.start > maxCueSeconds || len(cur.text)+1+len(w.text) > maxCueChars
+			if long || w.start-cur.end > cuePauseGap || strings.ContainsAny(cur.text[len(cur.text)-1:], ".?!") {
+				cues = append(cues, *cur)
+				cur = nil
+			}
+		}
+		if cur == nil {
+			cur = &captionCue{start: w.start, end: w.end, text: w.text}
+			continue
+		}
+		cur.text += " " + w.text
+		cur.end = w.end
+	}
+	if cur != nil {
+		cues = append(cues, *cur)
+	}
+	return cues
+}
+
+// formatWebVTT renders cues as a WebVTT file.
+func formatWebVTT(cues []captionCue) string {
+	var b strings.Builder
+	b.WriteString("WEBVTT\n")
+	escaper := strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+	for i, cue := range cues {
+		text := escaper.Replace(strings.Join(strings.Fields(cue.text), " "))
+		if text == "" {
+			continue
+		}
+		fmt.Fprintf(&b, "\n%d\n%s --> %s\n%s\n", i+1, vttTimestamp(cue.start), vttTimestamp(max(cue.end, cue.start)), text)
+	}
+	return b.String()
+}
+
+// vttTimestamp formats seconds as hh:mm:ss.ttt.
+func vttTimestamp(seconds float64) string {
+	ms := int64(seconds*1000 + 0.5)
+	return fmt.Sprintf("%02d:%02d:%02d.%03d", ms/3_600_000, ms/60_000%60, ms/1000%60, ms%1000)
+}
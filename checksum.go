@@ -0,0 +1,91 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// fileChecksum holds the digests of a file. Both are computed in one pass
+// so either can be sent to S3, which rejects the upload if the bytes it
+// receives don't match.
+type fileChecksum struct {
+	sha256 []byte
+	crc32  []byte
+}
+
+func (c fileChecksum) sha256Hex() string {
+	return hex.EncodeToString(c.sha256)
+}
+
+type checksummer struct {
+	sha hash.Hash
+	crc hash.Hash32
+}
+
+func newChecksummer() *checksummer {
+	return &checksummer{sha: sha256.New(), crc: crc32.NewIEEE()}
+}
+
+func (c *checksummer) Write(p []byte) (int, error) {
+	c.sha.Write(p)
+	c.crc.Write(p)
+	return len(p), nil
+}
+
+func (c *checksummer) sum() fileChecksum {
+	return fileChecksum{sha256: c.sha.Sum(nil), crc32: c.crc.Sum(nil)}
+}
+
+// copyWithChecksum copies src to dst, digesting the bytes on the way.
+func copyWithChecksum(dst io.Writer, src io.Reader) (int64, fileChecksum, error) {
+	c := newChecksummer()
+	n, err := io.Copy(io.MultiWriter(dst, c), src)
+	return n, c.sum(), err
+}
+
+func checksumFile(path string) (fileChecksum, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return fileChecksum{}, err
+	}
+	defer f.Close()
+	_, sum, err := copyWithChecksum(io.Discard, f)
+	return sum, err
+}
+
+// parseChecksumAlgorithm accepts SHA256, CRC32 or NONE.
+func parseChecksumAlgorithm(s string) (types.ChecksumAlgorithm, error) {
+	if strings.EqualFold(s, "none") {
+		return "", nil
+	}
+	switch algo := types.ChecksumAlgorithm(strings.ToUpper(s)); algo {
+	case types.ChecksumAlgorithmSha256, types.ChecksumAlgorithmCrc32:
+		return algo, nil
+	default:
+		return "", fmt.Errorf("unsupported checksum algorithm %q", s)
+	}
+}
+
+// withChecksum sets the configured precomputed checksum on a PutObject
+// request so S3 verifies the upload.
+func (cfg *apiConfig) withChecksum(in *s3.PutObjectInput, sum fileChecksum) *s3.PutObjectInput {
+	switch cfg.s3ChecksumAlgorithm {
+	case types.ChecksumAlgorithmSha256:
+		v := base64.StdEncoding.EncodeToString(sum.sha256)
+		in.ChecksumSHA256 = &v
+	case types.ChecksumAlgorithmCrc32:
+		v := base64.StdEncoding.EncodeToString(sum.crc32)
+		in.ChecksumCRC32 = &v
+	}
+	return in
+}
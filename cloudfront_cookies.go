@@ -0,0 +1,120 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// cloudFrontSigner issues CloudFront signed cookies with a custom policy,
+// using a key from one of the distribution's trusted key groups.
+type cloudFrontSigner struct {
+	keyPairID string
+	key       *rsa.PrivateKey
+	// cookieDomain must cover both the app and the distribution, e.g.
+	// .example.com, for browsers to send the cookies to the CDN
+	cookieDomain string
+}
+
+func newCloudFrontSigner(keyPairID, privateKeyPath, cookieDomain string) (*cloudFrontSigner, error) {
+	if keyPairID == "" || privateKeyPath == "" {
+		return nil, errors.New("CLOUDFRONT_KEY_PAIR_ID and CLOUDFRONT_PRIVATE_KEY_PATH must be set")
+	}
+	data, err := os.ReadFile(privateKeyPath)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s isn't a PEM file", privateKeyPath)
+	}
+	var key any
+	if block.Type == "RSA PRIVATE KEY" {
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	} else {
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("couldn't parse %s: %w", privateKeyPath, err)
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s isn't an RSA key", privateKeyPath)
+	}
+	return &cloudFrontSigner{keyPairID: keyPairID, key: rsaKey, cookieDomain: cookieDomain}, nil
+}
+
+// cookies grant access to every URL starting with resource until expiresAt,
+// from ip only unless it's empty.
+func (s *cloudFrontSigner) cookies(resource, ip string, expiresAt time.Time) ([]*http.Cookie, error) {
+	type condition struct {
+		DateLessThan map[string]int64  `json:"DateLessThan"`
+		IPAddress    map[string]string `json:"IpAddress,omitempty"`
+	}
+	type statement struct {
+		Resource  string    `json:"Resource"`
+		Condition condition `json:"Condition"`
+	}
+	stmt := statement{
+		Resource: resource,
+		Condition: condition{
+			DateLessThan: map[string]int64{"AWS:EpochTime": expiresAt.Unix()},
+		},
+	}
+	if ip != "" {
+		stmt.Condition.IPAddress = map[string]string{"AWS:SourceIp": hostCIDR(ip)}
+	}
+	policy, err := json.Marshal(map[string][]statement{"Statement": {stmt}})
+	if err != nil {
+		return nil, err
+	}
+	hash := sha1.Sum(policy)
+	sig, err := rsa.SignPKCS1v15(rand.Reader, s.key, crypto.SHA1, hash[:])
+	if err != nil {
+		return nil, err
+	}
+
+	values := [][2]string{
+		{"CloudFront-Policy", cloudFrontBase64(policy)},
+		{"CloudFront-Signature", cloudFrontBase64(sig)},
+		{"CloudFront-Key-Pair-Id", s.keyPairID},
+	}
+	cookies := make([]*http.Cookie, 0, len(values))
+	for _, v := range values {
+		cookies = append(cookies, &http.Cookie{
+			Name:     v[0],
+			Value:    v[1],
+			Domain:   s.cookieDomain,
+			Path:     "/",
+			Expires:  expiresAt,
+			Secure:   true,
+			HttpOnly: true,
+			SameSite: http.SameSiteNoneMode,
+		})
+	}
+	return cookies, nil
+}
+
+// cloudFrontBase64 is base64 with the characters CloudFront can't take in
+// cookies swapped out.
+func cloudFrontBase64(b []byte) string {
+	return strings.NewReplacer("+", "-", "=", "_", "/", "~").Replace(base64.StdEncoding.EncodeToString(b))
+}
+
+func hostCIDR(ip string) string {
+	if strings.Contains(ip, ":") {
+		return ip + "/128"
+	}
+	return ip + "/32"
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+type compressConfig struct {
+	// encodings the server offers, most preferred first
+	encodings []string
+	// responses smaller than this are sent as is
+	minSize int
+}
+
+// incompressibleTypes are already compressed, so encoding them again only
+// costs CPU. Matching is on the media type prefix.
+var incompressibleTypes = []string{
+	"video/",
+	"audio/",
+	"image/jpeg",
+	"image/png",
+	"image/gif",
+	"image/webp",
+	"image/avif",
+	"application/zip",
+	"application/gzip",
+	"application/zstd",
+	"application/octet-stream",
+}
+
+func compressible(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	for _, prefix := range incompressibleTypes {
+		if strings.HasPrefix(mediaType, prefix) {
+			return false
+		}
+	}
+	return true
+}
+
+// negotiateEncoding picks the offered encoding the client weights highest
+// in Accept-Encoding, breaking ties by the server's order. It returns ""
+// when the response should go out uncompressed.
+func negotiateEncoding(acceptEncoding string, offered []string) string {
+	weights := map[string]float64{}
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			parsed, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				continue
+			}
+			q = parsed
+		}
+		weights[name] = q
+	}
+
+	best, bestQ := "", 0.0
+	for _, e := range offered {
+		q, ok := weights[e]
+		if !ok {
+			q = weights["*"]
+		}
+		if q > bestQ {
+			best, bestQ = e, q
+		}
+	}
+	return best
+}
+
+var (
+	gzipWriters = sync.Pool{New: func() any {
+		zw, _ := gzip.NewWriterLevel(nil, gzip.DefaultCompression)
+		return zw
+	}}
+	zstdWriters = sync.Pool{New: func() any {
+		zw, _ := zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+		return zw
+	}}
+)
+
+// compressMiddleware encodes responses with gzip or zstd when the client
+// accepts it, skipping small bodies, partial content and media types that
+// are already compressed.
+func compressMiddleware(c compressConfig, next http.Handler) http.Handler {
+	c.encodings = slices.DeleteFunc(slices.Clone(c.encodings), func(e string) bool {
+		if e != "gzip" && e != "zstd" {
+			log.Printf("Ignoring unsupported compression encoding %q", e)
+			return true
+		}
+		return false
+	})
+	if len(c.encodings) == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		encoding := negotiateEncoding(r.Header.Get("Accept-Encoding"), c.encodings)
+		if encoding == "" || r.Method == http.MethodHead || r.Header.Get("Range") != "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		cw := &compressWriter{ResponseWriter: w, encoding: encoding, minSize: c.minSize}
+		defer cw.close()
+		next.ServeHTTP(cw, r)
+	})
+}
+
+// compressWriter decides whether to compress on the first write, once
+// the handler has set its headers.
+type compressWriter struct {
+	http.ResponseWriter
+	encoding string
+	minSize  int
+
+	status  int
+	decided bool
+	enc     encoder
+}
+
+func (cw *compressWriter) WriteHeader(status int) {
+	if cw.status == 0 {
+		cw.status = status
+	}
+	// Informational responses don't end the header phase
+	if status < 200 {
+		cw.ResponseWriter.WriteHeader(status)
+		cw.status = 0
+	}
+}
+
+func (cw *compressWriter) Write(p []byte) (int, error) {
+	if !cw.decided {
+		cw.decide(p)
+	}
+	if cw.enc != nil {
+		return cw.enc.Write(p)
+	}
+	return cw.ResponseWriter.Write(p)
+}
+
+func (cw *compressWriter) decide(p []byte) {
+	cw.decided = true
+	if cw.status == 0 {
+		cw.status = http.StatusOK
+	}
+	h := cw.Header()
+	if h.Get("Content-Type") == "" {
+		h.Set("Content-Type", http.DetectContentType(p))
+	}
+	size := len(p)
+	if v := h.Get("Content-Length"); v != "" {
+		size, _ = strconv.Atoi(v)
+	}
+	ok := cw.status >= 200 &&
+		cw.status != http.StatusNoContent &&
+		cw.status != http.StatusPartialContent &&
+		cw.status != http.StatusNotModified &&
+		h.Get("Content-Encoding") == "" &&
+		size >= cw.minSize &&
+		compressible(h.Get("Content-Type"))
+	if ok {
+		h.Del("Content-Length")
+		h.Set("Content-Encoding", cw.encoding)
+		// The encoded bytes differ, so a strong validator no longer holds
+		if etag := h.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+			h.Set("ETag", "W/"+etag)
+		}
+		cw.enc = newEncoder(cw.encoding, cw.ResponseWriter)
+	}
+	cw.ResponseWriter.WriteHeader(cw.status)
+}
+
+func newEncoder(encoding string, w io.Writer) encoder {
+	switch encoding {
+	case "zstd":
+		zw := zstdWriters.Get().(*zstd.Encoder)
+		zw.Reset(w)
+		return pooledEncoder{zw, func() { zstdWriters.Put(zw) }}
+	default:
+		zw := gzipWriters.Get().(*gzip.Writer)
+		zw.Reset(w)
+		return pooledEncoder{zw, func() { gzipWriters.Put(zw) }}
+	}
+}
+
+// pooledEncoder returns its encoder to the pool once closed.
+type pooledEncoder struct {
+	encoder
+	release func()
+}
+
+type encoder interface {
+	io.WriteCloser
+	Flush() error
+}
+
+func (e pooledEncoder) Close() error {
+	err := e.encoder.Close()
+	e.release()
+	return err
+}
+
+func (cw *compressWriter) close() {
+	if !cw.decided {
+		// Nothing was written, so send the headers the handler set
+		if cw.status != 0 {
+			cw.ResponseWriter.WriteHeader(cw.status)
+		}
+		return
+	}
+	if cw.enc != nil {
+		cw.enc.Close()
+	}
+}
+
+// Flush pushes out what's been encoded so far, which keeps event streams
+// flowing.
+func (cw *compressWriter) Flush() {
+	if !cw.decided {
+		cw.decide(nil)
+	}
+	if cw.enc != nil {
+		cw.enc.Flush()
+	}
+	http.NewResponseController(cw.ResponseWriter).Flush()
+}
+
+func (cw *compressWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
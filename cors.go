@@ -0,0 +1,60 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type corsConfig struct {
+	allowedOrigins []string
+	allowedMethods []string
+	allowedHeaders []string
+	exposedHeaders []string
+	maxAge         time.Duration
+}
+
+func (c corsConfig) originAllowed(origin string) bool {
+	return slices.Contains(c.allowedOrigins, "*") || slices.Contains(c.allowedOrigins, origin)
+}
+
+// corsMiddleware adds CORS headers for allowed origins and answers
+// preflight requests itself, since the mux only registers the real
+// methods for each route. With no allowed origins it is a no-op.
+func corsMiddleware(c corsConfig, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin == "" || len(c.allowedOrigins) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		h := w.Header()
+		h.Add("Vary", "Origin")
+		if !c.originAllowed(origin) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		h.Set("Access-Control-Allow-Origin", origin)
+
+		isPreflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+		if !isPreflight {
+			if len(c.exposedHeaders) > 0 {
+				h.Set("Access-Control-Expose-Headers", strings.Join(c.exposedHeaders, ", "))
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		h.Add("Vary", "Access-Control-Request-Method")
+		h.Add("Vary", "Access-Control-Request-Headers")
+		h.Set("Access-Control-Allow-Methods", strings.Join(c.allowedMethods, ", "))
+		h.Set("Access-Control-Allow-Headers", strings.Join(c.allowedHeaders, ", "))
+		if c.maxAge > 0 {
+			h.Set("Access-Control-Max-Age", strconv.Itoa(int(c.maxAge.Seconds())))
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/media"
+	"github.com/google/uuid"
+)
+
+// recordProcessingFailure counts a failed pipeline run for a video and
+// sends an alert the moment it crosses the dead-letter threshold.
+func (cfg *apiConfig) recordProcessingFailure(videoID uuid.UUID, err error) {
+	params := database.RecordProcessingFailureParams{
+		VideoID:   videoID,
+		Stage:     "unknown",
+		Error:     err.Error(),
+		DeadAfter: cfg.deadLetterAfter,
+	}
+	var pErr *pipelineError
+	if errors.As(err, &pErr) {
+		params.Stage = pErr.stage
+	}
+	var eErr *media.ExecError
+	if errors.As(err, &eErr) {
+		params.Stderr = eErr.Stderr
+	}
+
+	failure, dbErr := cfg.db.RecordProcessingFailure(params)
+	if dbErr != nil {
+		log.Printf("Couldn't record processing failure for video %s: %v", videoID, dbErr)
+		return
+	}
+	if failure.DeadAt == nil || failure.Attempts != cfg.deadLetterAfter {
+		return
+	}
+	log.Printf("Video %s dead-lettered after %d failed attempts at %s", videoID, failure.Attempts, failure.Stage)
+	metricDeadLetters.Add(1)
+	go cfg.sendDeadLetterAlert(failure)
+}
+
+// sendDeadLetterAlert posts the failure as JSON to the configured webhook.
+func (cfg *apiConfig) sendDeadLetterAlert(failure database.ProcessingFailure) {
+	if cfg.deadLetterWebhookURL == "" {
+		return
+	}
+	body, err := json.Marshal(failure)
+	if err != nil {
+		log.Printf("Couldn't encode dead-letter alert: %v", err)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, cfg.deadLetterWebhookURL, bytes.NewReader(body))
+	if err != nil {
+		log.Printf("Couldn't build dead-letter alert: %v", err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		log.Printf("Couldn't send dead-letter alert: %v", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		log.Printf("Dead-letter alert webhook returned status %d", resp.StatusCode)
+	}
+}
+
+// handlerAdminDeadLetters lists dead-lettered videos, or every video with
+// recent processing failures when all=true.
+func (cfg *apiConfig) handlerAdminDeadLetters(w http.ResponseWriter, r *http.Request) {
+	if err := cfg.authorizeAdmin(r); err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't authorize admin", err)
+		return
+	}
+
+	page, err := cfg.parsePage(r.URL.Query())
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid page", err)
+		return
+	}
+
+	failures, next, err := cfg.db.GetProcessingFailures(r.URL.Query().Get("all") == "true", page)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get processing failures", err)
+		return
+	}
+
+	respondWithPage(w, failures, next)
+}
+
+func (cfg *apiConfig) handlerAdminDeadLetterDismiss(w http.ResponseWriter, r *http.Request) {
+	if err := cfg.authorizeAdmin(r); err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't authorize admin", err)
+		return
+	}
+
+	videoID, err := uuid.Parse(r.PathValue("videoID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid ID", err)
+		return
+	}
+
+	err = cfg.db.ClearProcessingFailure(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't dismiss processing failure", err)
+		return
+	}
+	cfg.audit(r, uuid.Nil, "admin.dead_letter_dismiss", "video", videoID.String(), fmt.Sprintf("dismissed processing failures for %s", videoID))
+
+	w.WriteHeader(http.StatusNoContent)
+}
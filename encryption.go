@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/envelope"
+)
+
+// Key providers that can wrap the data keys of encrypted videos.
+const (
+	keyProviderLocal = "local"
+	keyProviderKMS   = "kms"
+)
+
+var errEncryptionDisabled = errors.New("no encryption key provider is configured")
+
+// newKeyring sets up the configured key provider. An empty provider
+// disables encrypted videos.
+func newKeyring(provider, masterKey, kmsKeyID string, kms awsJSONClient) (envelope.Keyring, error) {
+	switch provider {
+	case "":
+		return nil, nil
+	case keyProviderLocal:
+		key, err := base64.StdEncoding.DecodeString(masterKey)
+		if err != nil {
+			return nil, fmt.Errorf("master key isn't base64: %w", err)
+		}
+		return envelope.NewLocalKeyring(key)
+	case keyProviderKMS:
+		if kmsKeyID == "" {
+			return nil, errors.New("a KMS key ID is required")
+		}
+		return &kmsKeyring{api: kms, keyID: kmsKeyID, cache: map[string]cachedDataKey{}}, nil
+	default:
+		return nil, fmt.Errorf("unknown key provider %q, want local or kms", provider)
+	}
+}
+
+// newVideoKey generates a data key for a new encrypted video, wrapped for
+// storage and prefixed with the provider that wrapped it.
+func (cfg *apiConfig) newVideoKey(ctx context.Context) (string, error) {
+	if cfg.keyring == nil {
+		return "", errEncryptionDisabled
+	}
+	key, err := cfg.keyring.GenerateDataKey(ctx)
+	if err != nil {
+		return "", err
+	}
+	return cfg.keyProvider + ":" + base64.StdEncoding.EncodeToString(key.Wrapped), nil
+}
+
+// videoDataKey unwraps an encrypted video's data key. Videos stored in the
+// clear have none.
+func (cfg *apiConfig) videoDataKey(ctx context.Context, video database.Video) ([]byte, error) {
+	if video.WrappedKey == nil {
+		return nil, nil
+	}
+	if cfg.keyring == nil {
+		return nil, fmt.Errorf("video %s is encrypted but %w", video.ID, errEncryptionDisabled)
+	}
+	provider, encoded, _ := strings.Cut(*video.WrappedKey, ":")
+	if provider != cfg.keyProvider {
+		return nil, fmt.Errorf("key of video %s was wrapped by %s, but the %s key provider is configured", video.ID, provider, cfg.keyProvider)
+	}
+	wrapped, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("invalid wrapped key for video %s: %w", video.ID, err)
+	}
+	return cfg.keyring.Unwrap(ctx, wrapped)
+}
+
+// sealFile encrypts the file at path under dataKey into a scratch file
+// and returns its path and checksum. The caller removes it.
+func (cfg *apiConfig) sealFile(path string, dataKey []byte) (string, fileChecksum, error) {
+	src, err := os.Open(path)
+	if err != nil {
+		return "", fileChecksum{}, err
+	}
+	defer src.Close()
+	dst, err := os.CreateTemp(cfg.scratchDir, "tubely-sealed")
+	if err != nil {
+		return "", fileChecksum{}, err
+	}
+	defer dst.Close()
+
+	c := newChecksummer()
+	if err := envelope.Encrypt(io.MultiWriter(dst, c), src, dataKey); err != nil {
+		os.Remove(dst.Name())
+		return "", fileChecksum{}, err
+	}
+	return dst.Name(), c.sum(), nil
+}
+
+// openObject opens the object at key, decrypting it if dataKey isn't nil,
+// and returns its plaintext size.
+func (cfg *apiConfig) openObject(ctx context.Context, key string, dataKey []byte) (io.ReadCloser, int64, error) {
+	src := cfg.objectSource(ctx, key)
+	if dataKey == nil {
+		return src(0)
+	}
+	obj, err := envelope.NewReader(src, dataKey)
+	if err != nil {
+		return nil, 0, err
+	}
+	return obj, obj.Size(), nil
+}
+
+// objectSource reads key from the bucket for an envelope.Reader.
+func (cfg *apiConfig) objectSource(ctx context.Context, key string) envelope.Source {
+	return func(off int64) (io.ReadCloser, int64, error) {
+		input := &s3.GetObjectInput{
+			Bucket: &cfg.s3Bucket,
+			Key:    &key,
+		}
+		if off > 0 {
+			rangeHeader := fmt.Sprintf("bytes=%d-", off)
+			input.Range = &rangeHeader
+		}
+		out, err := cfg.s3Client.GetObject(ctx, input)
+		if err != nil {
+			return nil, 0, err
+		}
+		return out.Body, off + aws.ToInt64(out.ContentLength), nil
+	}
+}
+
+// kmsDataKeyTTL is how long unwrapped data keys are kept in memory, so a
+// player's stream of Range requests doesn't cost a KMS call each.
+const kmsDataKeyTTL = 5 * time.Minute
+
+// kmsKeyring wraps data keys with a KMS key.
+type kmsKeyring struct {
+	api   awsJSONClient
+	keyID string
+
+	mu    sync.Mutex
+	cache map[string]cachedDataKey
+}
+
+type cachedDataKey struct {
+	key       []byte
+	expiresAt time.Time
+}
+
+func (k *kmsKeyring) GenerateDataKey(ctx context.Context) (envelope.DataKey, error) {
+	in := map[string]string{"KeyId": k.keyID, "KeySpec": "AES_256"}
+	var out struct {
+		CiphertextBlob []byte
+		Plaintext      []byte
+	}
+	if err := k.call(ctx, "GenerateDataKey", in, &out); err != nil {
+		return envelope.DataKey{}, err
+	}
+	return envelope.DataKey{Plaintext: out.Plaintext, Wrapped: out.CiphertextBlob}, nil
+}
+
+func (k *kmsKeyring) Unwrap(ctx context.Context, wrapped []byte) ([]byte, error) {
+	cacheKey := string(wrapped)
+	k.mu.Lock()
+	cached, ok := k.cache[cacheKey]
+	k.mu.Unlock()
+	if ok && time.Now().Before(cached.expiresAt) {
+		return cached.key, nil
+	}
+
+	in := map[string]any{"KeyId": k.keyID, "CiphertextBlob": wrapped}
+	var out struct {
+		Plaintext []byte
+	}
+	if err := k.call(ctx, "Decrypt", in, &out); err != nil {
+		return nil, err
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	now := time.Now()
+	for key, c := range k.cache {
+		if now.After(c.expiresAt) {
+			delete(k.cache, key)
+		}
+	}
+	k.cache[cacheKey] = cachedDataKey{key: out.Plaintext, expiresAt: now.Add(kmsDataKeyTTL)}
+	return out.Plaintext, nil
+}
+
+func (k *kmsKeyring) call(ctx context.Context, action string, in, out any) error {
+	headers := map[string]string{
+		"Content-Type": "application/x-amz-json-1.1",
+		"X-Amz-Target": "TrentService." + action,
+	}
+	return k.api.do(ctx, http.MethodPost, "/", headers, in, out)
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sns"
+	snstypes "github.com/aws/aws-sdk-go-v2/service/sns/types"
+)
+
+// eventPublishTimeout bounds publishing one event to every target.
+const eventPublishTimeout = 30 * time.Second
+
+// eventPublisher forwards video events to another system. body is the
+// event encoded as JSON.
+type eventPublisher interface {
+	name() string
+	publish(ctx context.Context, event videoEvent, body []byte) error
+}
+
+// publishEvent sends event to every configured publisher in the
+// background, so a slow or unavailable target never holds up the request
+// that changed the video.
+func (cfg *apiConfig) publishEvent(event videoEvent) {
+	if len(cfg.eventPublishers) == 0 {
+		return
+	}
+	body, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("Couldn't encode %s event: %v", event.Type, err)
+		return
+	}
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), eventPublishTimeout)
+		defer cancel()
+		for _, p := range cfg.eventPublishers {
+			err := cfg.retry.do(ctx, "publish_"+p.name(), func() error {
+				return p.publish(ctx, event, body)
+			})
+			if err != nil {
+				log.Printf("Couldn't publish %s event %s to %s: %v", event.Type, event.ID, p.name(), err)
+				metricEventPublishFailures.Add(p.name(), 1)
+			}
+		}
+	}()
+}
+
+// snsPublisher publishes events to an SNS topic. The event type is sent as
+// the event_type message attribute so subscriptions can filter on it.
+type snsPublisher struct {
+	client   *sns.Client
+	topicARN string
+}
+
+func (p snsPublisher) name() string {
+	return "sns"
+}
+
+func (p snsPublisher) publish(ctx context.Context, event videoEvent, body []byte) error {
+	in := &sns.PublishInput{
+		TopicArn: aws.String(p.topicARN),
+		Message:  aws.String(string(body)),
+		MessageAttributes: map[string]snstypes.MessageAttributeValue{
+			"event_type": {DataType: aws.String("String"), StringValue: aws.String(event.Type)},
+		},
+	}
+	// FIFO topics need a group to order within and a deduplication id
+	if strings.HasSuffix(p.topicARN, ".fifo") {
+		in.MessageGroupId = aws.String(event.Data.VideoID.String())
+		in.MessageDeduplicationId = aws.String(event.ID.String())
+	}
+	_, err := p.client.Publish(ctx, in)
+	return err
+}
+
+// eventBridgePublisher puts events on an EventBridge bus, with the event
+// type as the detail-type.
+type eventBridgePublisher struct {
+	api    awsJSONClient
+	bus    string
+	source string
+}
+
+func (p eventBridgePublisher) name() string {
+	return "eventbridge"
+}
+
+func (p eventBridgePublisher) publish(ctx context.Context, event videoEvent, body []byte) error {
+	type entry struct {
+		Source       string
+		DetailType   string
+		Detail       string
+		EventBusName string
+		Time         int64
+	}
+	in := map[string][]entry{
+		"Entries": {{
+			Source:       p.source,
+			DetailType:   event.Type,
+			Detail:       string(body),
+			EventBusName: p.bus,
+			Time:         event.CreatedAt.Unix(),
+		}},
+	}
+	var out struct {
+		FailedEntryCount int
+		Entries          []struct {
+			ErrorCode    string
+			ErrorMessage string
+		}
+	}
+	headers := map[string]string{
+		"Content-Type": "application/x-amz-json-1.1",
+		"X-Amz-Target": "AWSEvents.PutEvents",
+	}
+	if err := p.api.do(ctx, http.MethodPost, "/", headers, in, &out); err != nil {
+		return err
+	}
+	if out.FailedEntryCount > 0 && len(out.Entries) > 0 {
+		e := out.Entries[0]
+		return fmt.Errorf("EventBridge rejected the event: %s: %s", e.ErrorCode, e.ErrorMessage)
+	}
+	return nil
+}
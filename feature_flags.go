@@ -0,0 +1,342 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// Feature flags gate the riskier stages of processing, so they can be
+// turned off in one environment, or tried out for a few users, without a
+// deploy.
+const (
+	// flagSmallUploads keeps small uploads in memory instead of on disk
+	flagSmallUploads = "small_uploads"
+	// flagDASHPackaging packages videos for DASH when DASH_ENABLED is set
+	flagDASHPackaging = "dash_packaging"
+	// flagAutoCaptions transcribes videos when a captions backend is set
+	flagAutoCaptions = "auto_captions"
+)
+
+// featureFlagDefaults are the known flags and whether each is on when
+// neither FEATURE_FLAGS nor an override says otherwise.
+var featureFlagDefaults = map[string]bool{
+	flagSmallUploads:  true,
+	flagDASHPackaging: true,
+	flagAutoCaptions:  true,
+}
+
+// maintenanceRetryAfter is how long clients turned away during maintenance
+// are told to wait.
+const maintenanceRetryAfter = 5 * time.Minute
+
+const defaultMaintenanceMessage = "Uploads are paused for maintenance, try again in a few minutes"
+
+// featureFlags holds each flag's default for this deployment, along with
+// the overrides and maintenance mode last read from the database, so
+// checking them doesn't cost a query.
+type featureFlags struct {
+	defaults map[string]bool
+
+	mu sync.RWMutex
+	// overrides are by flag and then user, uuid.Nil for everyone
+	overrides   map[string]map[uuid.UUID]bool
+	maintenance database.MaintenanceMode
+}
+
+// newFeatureFlags applies FEATURE_FLAGS entries to the defaults. An entry
+// is a flag's name to turn it on, or name=false to turn it off.
+func newFeatureFlags(entries []string) (*featureFlags, error) {
+	f := &featureFlags{defaults: map[string]bool{}, overrides: map[string]map[uuid.UUID]bool{}}
+	for name, on := range featureFlagDefaults {
+		f.defaults[name] = on
+	}
+	for _, entry := range entries {
+		name, value, hasValue := strings.Cut(entry, "=")
+		if _, ok := f.defaults[name]; !ok {
+			return nil, fmt.Errorf("unknown feature flag %q", name)
+		}
+		on := true
+		if hasValue {
+			var err error
+			on, err = strconv.ParseBool(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid value for feature flag %s: %w", name, err)
+			}
+		}
+		f.defaults[name] = on
+	}
+	return f, nil
+}
+
+// enabled reports whether a flag is on for userID. An override for the
+// user wins over one for everyone, which wins over the default.
+func (f *featureFlags) enabled(name string, userID uuid.UUID) bool {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	if on, ok := f.overrides[name][userID]; ok && userID != uuid.Nil {
+		return on
+	}
+	if on, ok := f.overrides[name][uuid.Nil]; ok {
+		return on
+	}
+	return f.defaults[name]
+}
+
+func (f *featureFlags) maintenanceMode() database.MaintenanceMode {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.maintenance
+}
+
+// refreshFeatureFlags reads the flag overrides and maintenance mode from
+// the database. Each server does so every FEATURE_FLAG_REFRESH_INTERVAL,
+// and the one that changed them right away.
+func (cfg *apiConfig) refreshFeatureFlags(ctx context.Context) error {
+	list, err := cfg.db.GetFeatureFlagOverrides()
+	if err != nil {
+		return fmt.Errorf("couldn't get feature flag overrides: %w", err)
+	}
+	maintenance, err := cfg.db.GetMaintenanceMode()
+	if err != nil {
+		return fmt.Errorf("couldn't get maintenance mode: %w", err)
+	}
+
+	overrides := map[string]map[uuid.UUID]bool{}
+	for _, o := range list {
+		if overrides[o.Name] == nil {
+			overrides[o.Name] = map[uuid.UUID]bool{}
+		}
+		userID := uuid.Nil
+		if o.UserID != nil {
+			userID = *o.UserID
+		}
+		overrides[o.Name][userID] = o.Enabled
+	}
+	cfg.flags.mu.Lock()
+	cfg.flags.overrides = overrides
+	cfg.flags.maintenance = maintenance
+	cfg.flags.mu.Unlock()
+	return nil
+}
+
+// pausedForMaintenance turns requests to h away with a 503 while
+// maintenance mode is on. It wraps the endpoints that take uploads, so
+// everything else, reads included, keeps working.
+func (cfg *apiConfig) pausedForMaintenance(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if cfg.respondIfMaintenance(w) {
+			return
+		}
+		h(w, r)
+	}
+}
+
+// respondIfMaintenance writes the maintenance response and reports true if
+// uploads are paused, for checks partway through a request.
+func (cfg *apiConfig) respondIfMaintenance(w http.ResponseWriter) bool {
+	m := cfg.flags.maintenanceMode()
+	if !m.Enabled {
+		return false
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(int(maintenanceRetryAfter.Seconds())))
+	respondWithErrorCode(w, http.StatusServiceUnavailable, codeMaintenance, maintenanceMessage(m), nil)
+	return true
+}
+
+func maintenanceMessage(m database.MaintenanceMode) string {
+	if m.Message != "" {
+		return m.Message
+	}
+	return defaultMaintenanceMessage
+}
+
+func (cfg *apiConfig) handlerAdminMaintenanceGet(w http.ResponseWriter, r *http.Request) {
+	if err := cfg.authorizeAdmin(r); err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't authorize admin", err)
+		return
+	}
+	m, err := cfg.db.GetMaintenanceMode()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get maintenance mode", err)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, m)
+}
+
+// handlerAdminMaintenanceUpdate turns maintenance mode on or off. The
+// message, if given, is what clients are told instead of the default one.
+func (cfg *apiConfig) handlerAdminMaintenanceUpdate(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Enabled *bool  `json:"enabled"`
+		Message string `json:"message"`
+	}
+
+	if err := cfg.authorizeAdmin(r); err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't authorize admin", err)
+		return
+	}
+	params := parameters{}
+	if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters", err)
+		return
+	}
+	if params.Enabled == nil {
+		respondWithError(w, http.StatusBadRequest, "enabled is required", nil)
+		return
+	}
+	params.Message = strings.TrimSpace(params.Message)
+	if len(params.Message) > 500 {
+		respondWithError(w, http.StatusBadRequest, "message must be at most 500 characters", nil)
+		return
+	}
+
+	m, err := cfg.db.SetMaintenanceMode(*params.Enabled, params.Message)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't set maintenance mode", err)
+		return
+	}
+	if err := cfg.refreshFeatureFlags(r.Context()); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't reload maintenance mode", err)
+		return
+	}
+	cfg.audit(r, uuid.Nil, "admin.maintenance", "maintenance", "", fmt.Sprintf("enabled: %t, message: %q", m.Enabled, m.Message))
+	respondWithJSON(w, http.StatusOK, m)
+}
+
+// featureFlagState is a flag as the admin API shows it.
+type featureFlagState struct {
+	Name string `json:"name"`
+	// Default is the flag's state for this deployment, from FEATURE_FLAGS
+	Default bool `json:"default"`
+	// Enabled is the flag's state for users without an override of their
+	// own
+	Enabled   bool                           `json:"enabled"`
+	Overrides []database.FeatureFlagOverride `json:"overrides"`
+}
+
+// handlerAdminFeatureFlagsList lists the known flags with their overrides.
+func (cfg *apiConfig) handlerAdminFeatureFlagsList(w http.ResponseWriter, r *http.Request) {
+	if err := cfg.authorizeAdmin(r); err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't authorize admin", err)
+		return
+	}
+	overrides, err := cfg.db.GetFeatureFlagOverrides()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get feature flag overrides", err)
+		return
+	}
+
+	flags := []featureFlagState{}
+	for name, on := range cfg.flags.defaults {
+		flag := featureFlagState{Name: name, Default: on, Enabled: on, Overrides: []database.FeatureFlagOverride{}}
+		for _, o := range overrides {
+			if o.Name != name {
+				continue
+			}
+			if o.UserID == nil {
+				flag.Enabled = o.Enabled
+			}
+			flag.Overrides = append(flag.Overrides, o)
+		}
+		flags = append(flags, flag)
+	}
+	slices.SortFunc(flags, func(a, b featureFlagState) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+	respondWithJSON(w, http.StatusOK, flags)
+}
+
+// handlerAdminFeatureFlagUpdate overrides a flag for one user, or for
+// everyone if no user_id is given.
+func (cfg *apiConfig) handlerAdminFeatureFlagUpdate(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Enabled *bool     `json:"enabled"`
+		UserID  uuid.UUID `json:"user_id"`
+	}
+
+	if err := cfg.authorizeAdmin(r); err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't authorize admin", err)
+		return
+	}
+	name := r.PathValue("name")
+	if _, ok := cfg.flags.defaults[name]; !ok {
+		respondWithError(w, http.StatusNotFound, "Unknown feature flag", nil)
+		return
+	}
+	params := parameters{}
+	if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters", err)
+		return
+	}
+	if params.Enabled == nil {
+		respondWithError(w, http.StatusBadRequest, "enabled is required", nil)
+		return
+	}
+
+	if err := cfg.db.SetFeatureFlagOverride(name, params.UserID, *params.Enabled); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't set feature flag", err)
+		return
+	}
+	if err := cfg.refreshFeatureFlags(r.Context()); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't reload feature flags", err)
+		return
+	}
+	cfg.audit(r, uuid.Nil, "admin.feature_flag", "feature_flag", name, fmt.Sprintf("enabled: %t for %s", *params.Enabled, flagAudience(params.UserID)))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handlerAdminFeatureFlagReset removes the override of a flag for the
+// user_id query parameter's user, or for everyone without one.
+func (cfg *apiConfig) handlerAdminFeatureFlagReset(w http.ResponseWriter, r *http.Request) {
+	if err := cfg.authorizeAdmin(r); err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't authorize admin", err)
+		return
+	}
+	name := r.PathValue("name")
+	if _, ok := cfg.flags.defaults[name]; !ok {
+		respondWithError(w, http.StatusNotFound, "Unknown feature flag", nil)
+		return
+	}
+	userID := uuid.Nil
+	if v := r.URL.Query().Get("user_id"); v != "" {
+		var err error
+		userID, err = uuid.Parse(v)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid user_id", err)
+			return
+		}
+	}
+
+	found, err := cfg.db.DeleteFeatureFlagOverride(name, userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't reset feature flag", err)
+		return
+	}
+	if !found {
+		respondWithError(w, http.StatusNotFound, "Feature flag has no such override", nil)
+		return
+	}
+	if err := cfg.refreshFeatureFlags(r.Context()); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't reload feature flags", err)
+		return
+	}
+	cfg.audit(r, uuid.Nil, "admin.feature_flag", "feature_flag", name, fmt.Sprintf("reset for %s", flagAudience(userID)))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func flagAudience(userID uuid.UUID) string {
+	if userID == uuid.Nil {
+		return "everyone"
+	}
+	return "user " + userID.String()
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"slices"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// geoLocator finds the country an address is in, as an ISO 3166-1
+// alpha-2 code. It returns "" when it can't tell.
+type geoLocator interface {
+	country(ip net.IP) (string, error)
+}
+
+// noGeoLocator is used when no GeoIP database is configured. Every viewer
+// is in an unknown country, so allow lists block everyone but the owner.
+type noGeoLocator struct{}
+
+func (noGeoLocator) country(net.IP) (string, error) {
+	return "", nil
+}
+
+// maxMindLocator looks countries up in a MaxMind GeoIP2 or GeoLite2
+// Country or City database.
+type maxMindLocator struct {
+	reader *maxminddb.Reader
+}
+
+func newMaxMindLocator(path string) (*maxMindLocator, error) {
+	reader, err := maxminddb.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return &maxMindLocator{reader: reader}, nil
+}
+
+func (l *maxMindLocator) country(ip net.IP) (string, error) {
+	var record struct {
+		Country struct {
+			ISOCode string `maxminddb:"iso_code"`
+		} `maxminddb:"country"`
+	}
+	if err := l.reader.Lookup(ip, &record); err != nil {
+		return "", err
+	}
+	return record.Country.ISOCode, nil
+}
+
+// geoBlock explains why a viewer can't play a video.
+type geoBlock struct {
+	status  int
+	code    errorCode
+	message string
+	country string
+}
+
+// checkGeoRestriction returns nil if the viewer of r may play video. Its
+// owner, and members of its organization, can always play it.
+func (cfg *apiConfig) checkGeoRestriction(r *http.Request, video database.Video) *geoBlock {
+	rules := video.GeoRestriction
+	if rules == nil || cfg.canViewVideo(video, cfg.optionalUserID(r)) {
+		return nil
+	}
+
+	var country string
+	if ip := net.ParseIP(clientIP(r)); ip != nil {
+		var err error
+		country, err = cfg.geoLocator.country(ip)
+		if err != nil {
+			log.Printf("Couldn't look up country of %s: %v", ip, err)
+		}
+	}
+
+	if country == "" {
+		if len(rules.Allow) == 0 {
+			return nil
+		}
+		return &geoBlock{
+			status:  http.StatusForbidden,
+			code:    codeGeoUnknown,
+			message: "Couldn't determine your location to check where this video is available",
+		}
+	}
+	if slices.Contains(rules.Deny, country) || (len(rules.Allow) > 0 && !slices.Contains(rules.Allow, country)) {
+		return &geoBlock{
+			status:  http.StatusUnavailableForLegalReasons,
+			code:    codeGeoBlocked,
+			message: "This video isn't available in your country",
+			country: country,
+		}
+	}
+	return nil
+}
+
+func respondWithGeoBlock(w http.ResponseWriter, block *geoBlock) {
+	type geoErrorResponse struct {
+		errorResponse
+		Country string `json:"country,omitempty"`
+	}
+	respondWithJSON(w, block.status, geoErrorResponse{
+		errorResponse: errorResponse{
+			Error:     block.message,
+			Code:      block.code,
+			RequestID: w.Header().Get(requestIDHeader),
+		},
+		Country: block.country,
+	})
+}
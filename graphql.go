@@ -0,0 +1,355 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+	graphql "github.com/graph-gophers/graphql-go"
+	"github.com/graph-gophers/graphql-go/relay"
+)
+
+// graphQLSchema is the read model exposed at /graphql. Mutations stay on
+// the REST API.
+const graphQLSchema = `
+schema {
+	query: Query
+}
+
+scalar Time
+
+type Query {
+	# A video, if it's visible to the caller.
+	video(id: ID!): Video
+	# The caller's own videos, newest first, or null with an error when
+	# unauthenticated. Pass the last id seen as after to get the next page.
+	videos(limit: Int, after: ID): [Video!]
+	user(id: ID!): User
+	# The authenticated caller, or null.
+	me: User
+}
+
+type Video {
+	id: ID!
+	createdAt: Time!
+	updatedAt: Time!
+	title: String!
+	description: String!
+	visibility: String!
+	published: Boolean!
+	tags: [String!]!
+	thumbnailUrl: String
+	videoUrl: String
+	dashUrl: String
+	captions: [Caption!]!
+	commentCount: Int!
+	likeCount: Int!
+	owner: User
+	comments(parentId: ID, limit: Int, after: ID): [Comment!]!
+}
+
+type Caption {
+	id: ID!
+	createdAt: Time!
+	language: String!
+	autoGenerated: Boolean!
+	# Where the WebVTT track is served.
+	url: String!
+}
+
+type User {
+	id: ID!
+	createdAt: Time!
+	displayName: String!
+	avatarUrl: String
+	bio: String!
+	# Published public videos.
+	videos(limit: Int, after: ID): [Video!]!
+}
+
+type Comment {
+	id: ID!
+	createdAt: Time!
+	body: String!
+	parentId: ID
+	author: User
+	replies(limit: Int, after: ID): [Comment!]!
+}
+`
+
+var (
+	errGraphQLUnauthenticated = errors.New("authentication required")
+	errGraphQLUnknownAfter    = errors.New("after doesn't match an item in this list")
+)
+
+func (cfg *apiConfig) graphQLHandler() http.Handler {
+	schema := graphql.MustParseSchema(graphQLSchema, &gqlQuery{cfg: cfg}, graphql.UseFieldResolvers())
+	h := &relay.Handler{Schema: schema}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h.ServeHTTP(w, r.WithContext(accessContext(r, cfg.optionalUserID(r))))
+	})
+}
+
+type gqlQuery struct {
+	cfg *apiConfig
+}
+
+func (q *gqlQuery) Video(ctx context.Context, args struct{ ID graphql.ID }) (*gqlVideo, error) {
+	videoID, err := uuid.Parse(string(args.ID))
+	if err != nil {
+		return nil, nil
+	}
+	video, err := q.cfg.db.GetVideo(videoID)
+	if err != nil {
+		return nil, err
+	}
+	// Private videos are hidden from everyone but their owner and members
+	// of their organization
+	if video.ID == uuid.Nil || (video.Visibility == database.VisibilityPrivate && !q.cfg.canViewVideo(video, contextUserID(ctx))) {
+		return nil, nil
+	}
+	return q.cfg.newGQLVideo(ctx, video)
+}
+
+func (q *gqlQuery) Videos(ctx context.Context, args gqlPageArgs) (*[]*gqlVideo, error) {
+	userID := contextUserID(ctx)
+	if userID == uuid.Nil {
+		return nil, errGraphQLUnauthenticated
+	}
+	page, err := args.page(q.cfg, q.cfg.gqlVideoCursor)
+	if err != nil {
+		return nil, err
+	}
+	videos, _, err := q.cfg.db.GetVideos(userID, page)
+	if err != nil {
+		return nil, err
+	}
+	out, err := q.cfg.newGQLVideos(ctx, videos)
+	if err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+func (q *gqlQuery) User(args struct{ ID graphql.ID }) (*gqlUser, error) {
+	userID, err := uuid.Parse(string(args.ID))
+	if err != nil {
+		return nil, nil
+	}
+	return q.cfg.loadGQLUser(userID)
+}
+
+func (q *gqlQuery) Me(ctx context.Context) (*gqlUser, error) {
+	userID := contextUserID(ctx)
+	if userID == uuid.Nil {
+		return nil, nil
+	}
+	return q.cfg.loadGQLUser(userID)
+}
+
+type gqlVideo struct {
+	cfg   *apiConfig
+	video database.Video
+}
+
+func (cfg *apiConfig) newGQLVideo(ctx context.Context, video database.Video) (*gqlVideo, error) {
+	video, err := cfg.signVideo(ctx, video)
+	if err != nil {
+		return nil, err
+	}
+	return &gqlVideo{cfg: cfg, video: video}, nil
+}
+
+func (cfg *apiConfig) newGQLVideos(ctx context.Context, videos []database.Video) ([]*gqlVideo, error) {
+	out := make([]*gqlVideo, 0, len(videos))
+	for _, video := range videos {
+		v, err := cfg.newGQLVideo(ctx, video)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, v)
+	}
+	return out, nil
+}
+
+func (v *gqlVideo) ID() graphql.ID           { return graphql.ID(v.video.ID.String()) }
+func (v *gqlVideo) CreatedAt() graphql.Time  { return graphql.Time{Time: v.video.CreatedAt} }
+func (v *gqlVideo) UpdatedAt() graphql.Time  { return graphql.Time{Time: v.video.UpdatedAt} }
+func (v *gqlVideo) Title() string            { return v.video.Title }
+func (v *gqlVideo) Description() string      { return v.video.Description }
+func (v *gqlVideo) Visibility() string       { return v.video.Visibility }
+func (v *gqlVideo) Published() bool          { return v.video.Published }
+func (v *gqlVideo) Tags() []string           { return v.video.Tags }
+func (v *gqlVideo) ThumbnailURL() *string    { return v.video.ThumbnailURL }
+func (v *gqlVideo) VideoURL() *string        { return v.video.VideoURL }
+func (v *gqlVideo) DashURL() *string         { return v.video.DashURL }
+func (v *gqlVideo) CommentCount() int32      { return int32(v.video.CommentCount) }
+func (v *gqlVideo) LikeCount() int32         { return int32(v.video.LikeCount) }
+func (v *gqlVideo) Owner() (*gqlUser, error) { return v.cfg.loadGQLUser(v.video.UserID) }
+
+func (v *gqlVideo) Captions(ctx context.Context) ([]*gqlCaption, error) {
+	if v.video.Visibility == database.VisibilityPrivate && !v.cfg.canViewVideo(v.video, contextUserID(ctx)) {
+		return []*gqlCaption{}, nil
+	}
+	captions, err := v.cfg.db.GetCaptions(v.video.ID)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]*gqlCaption, 0, len(captions))
+	for _, caption := range captions {
+		out = append(out, &gqlCaption{caption: caption})
+	}
+	return out, nil
+}
+
+// gqlPageArgs pages a list field. GraphQL lists don't carry a next
+// cursor, so clients pass the id of the last item they got as after.
+type gqlPageArgs struct {
+	Limit *int32
+	After *graphql.ID
+}
+
+func (a gqlPageArgs) page(cfg *apiConfig, cursorOf func(uuid.UUID) (*database.Cursor, error)) (database.Page, error) {
+	var p database.Page
+	if a.Limit != nil {
+		p.Limit = int(*a.Limit)
+	}
+	p.Limit = cfg.pageLimit(p.Limit)
+	if a.After != nil {
+		id, err := uuid.Parse(string(*a.After))
+		if err != nil {
+			return p, errGraphQLUnknownAfter
+		}
+		p.After, err = cursorOf(id)
+		if err != nil {
+			return p, err
+		}
+		if p.After == nil {
+			return p, errGraphQLUnknownAfter
+		}
+	}
+	return p, nil
+}
+
+func (cfg *apiConfig) gqlVideoCursor(id uuid.UUID) (*database.Cursor, error) {
+	video, err := cfg.db.GetVideo(id)
+	if err != nil || video.ID == uuid.Nil {
+		return nil, err
+	}
+	return &database.Cursor{CreatedAt: video.CreatedAt, ID: video.ID.String()}, nil
+}
+
+func (cfg *apiConfig) gqlCommentCursor(id uuid.UUID) (*database.Cursor, error) {
+	comment, err := cfg.db.GetComment(id)
+	if err != nil || comment.ID == uuid.Nil {
+		return nil, err
+	}
+	return &database.Cursor{CreatedAt: comment.CreatedAt, ID: comment.ID.String()}, nil
+}
+
+func (v *gqlVideo) Comments(args struct {
+	ParentID *graphql.ID
+	gqlPageArgs
+}) ([]*gqlComment, error) {
+	filter := database.CommentFilter{VideoID: v.video.ID}
+	if args.ParentID != nil {
+		parentID, err := uuid.Parse(string(*args.ParentID))
+		if err != nil {
+			return []*gqlComment{}, nil
+		}
+		filter.ParentID = &parentID
+	}
+	var err error
+	filter.Page, err = args.page(v.cfg, v.cfg.gqlCommentCursor)
+	if err != nil {
+		return nil, err
+	}
+	return v.cfg.loadGQLComments(filter)
+}
+
+type gqlCaption struct {
+	caption database.Caption
+}
+
+func (c *gqlCaption) ID() graphql.ID          { return graphql.ID(c.caption.ID.String()) }
+func (c *gqlCaption) CreatedAt() graphql.Time { return graphql.Time{Time: c.caption.CreatedAt} }
+func (c *gqlCaption) Language() string        { return c.caption.Language }
+func (c *gqlCaption) AutoGenerated() bool     { return c.caption.AutoGenerated }
+func (c *gqlCaption) URL() string {
+	return "/api/v1/videos/" + c.caption.VideoID.String() + "/captions/" + c.caption.ID.String()
+}
+
+type gqlUser struct {
+	cfg  *apiConfig
+	user database.User
+}
+
+func (cfg *apiConfig) loadGQLUser(userID uuid.UUID) (*gqlUser, error) {
+	user, err := cfg.db.GetUser(userID)
+	if err != nil || user == nil {
+		return nil, err
+	}
+	return &gqlUser{cfg: cfg, user: *user}, nil
+}
+
+func (u *gqlUser) ID() graphql.ID          { return graphql.ID(u.user.ID.String()) }
+func (u *gqlUser) CreatedAt() graphql.Time { return graphql.Time{Time: u.user.CreatedAt} }
+func (u *gqlUser) DisplayName() string     { return u.user.DisplayName }
+func (u *gqlUser) AvatarURL() *string      { return u.user.AvatarURL }
+func (u *gqlUser) Bio() string             { return u.user.Bio }
+
+func (u *gqlUser) Videos(ctx context.Context, args gqlPageArgs) ([]*gqlVideo, error) {
+	page, err := args.page(u.cfg, u.cfg.gqlVideoCursor)
+	if err != nil {
+		return nil, err
+	}
+	videos, _, err := u.cfg.db.GetPublicVideos(u.user.ID, page)
+	if err != nil {
+		return nil, err
+	}
+	return u.cfg.newGQLVideos(ctx, videos)
+}
+
+type gqlComment struct {
+	cfg     *apiConfig
+	comment database.Comment
+}
+
+func (cfg *apiConfig) loadGQLComments(filter database.CommentFilter) ([]*gqlComment, error) {
+	comments, _, err := cfg.db.GetComments(filter)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]*gqlComment, 0, len(comments))
+	for _, comment := range comments {
+		out = append(out, &gqlComment{cfg: cfg, comment: comment})
+	}
+	return out, nil
+}
+
+func (c *gqlComment) ID() graphql.ID          { return graphql.ID(c.comment.ID.String()) }
+func (c *gqlComment) CreatedAt() graphql.Time { return graphql.Time{Time: c.comment.CreatedAt} }
+func (c *gqlComment) Body() string            { return c.comment.Body }
+func (c *gqlComment) Author() (*gqlUser, error) {
+	return c.cfg.loadGQLUser(c.comment.UserID)
+}
+
+func (c *gqlComment) ParentID() *graphql.ID {
+	if c.comment.ParentID == nil {
+		return nil
+	}
+	id := graphql.ID(c.comment.ParentID.String())
+	return &id
+}
+
+func (c *gqlComment) Replies(args gqlPageArgs) ([]*gqlComment, error) {
+	filter := database.CommentFilter{VideoID: c.comment.VideoID, ParentID: &c.comment.ID}
+	var err error
+	filter.Page, err = args.page(c.cfg, c.cfg.gqlCommentCursor)
+	if err != nil {
+		return nil, err
+	}
+	return c.cfg.loadGQLComments(filter)
+}
@@ -0,0 +1,347 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/tubelyrpc"
+	"github.com/google/uuid"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// watchPollInterval is how often WatchVideo checks a video for changes.
+const watchPollInterval = 2 * time.Second
+
+type userIDKey struct{}
+
+// grpcServer serves the tubelyrpc Videos service on top of the same
+// database, auth and audit log as the HTTP handlers.
+type grpcServer struct {
+	tubelyrpc.UnimplementedVideosServer
+	cfg *apiConfig
+}
+
+// serveGRPC serves the Videos service on addr, over TLS with the same
+// certificate as HTTPS when one is configured.
+func (cfg *apiConfig) serveGRPC(addr string, tlsCfg tlsConfig) error {
+	opts := []grpc.ServerOption{
+		grpc.UnaryInterceptor(cfg.grpcUnaryAuth),
+		grpc.StreamInterceptor(cfg.grpcStreamAuth),
+	}
+	switch {
+	case tlsCfg.certFile != "" && tlsCfg.keyFile != "":
+		creds, err := credentials.NewServerTLSFromFile(tlsCfg.certFile, tlsCfg.keyFile)
+		if err != nil {
+			return err
+		}
+		opts = append(opts, grpc.Creds(creds))
+	case len(tlsCfg.autocertDomains) > 0:
+		opts = append(opts, grpc.Creds(credentials.NewTLS(tlsCfg.autocertManager().TLSConfig())))
+	}
+
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	srv := grpc.NewServer(opts...)
+	tubelyrpc.RegisterVideosServer(srv, &grpcServer{cfg: cfg})
+	log.Printf("Serving gRPC on %s\n", addr)
+	return srv.Serve(lis)
+}
+
+// grpcAuthenticate validates the bearer token in the call's metadata the
+// same way the HTTP handlers validate the Authorization header.
+func (cfg *apiConfig) grpcAuthenticate(ctx context.Context) (context.Context, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	header := http.Header{"Authorization": md.Get("authorization")}
+	token, err := auth.GetBearerToken(header)
+	if err != nil {
+		return nil, status.Error(codes.Unauthenticated, "Couldn't find JWT")
+	}
+	userID, err := cfg.validateJWT(token)
+	if err != nil {
+		return nil, status.Error(codes.Unauthenticated, "Couldn't validate JWT")
+	}
+	return context.WithValue(ctx, userIDKey{}, userID), nil
+}
+
+func (cfg *apiConfig) grpcUnaryAuth(ctx context.Context, req any, _ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	ctx, err := cfg.grpcAuthenticate(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+type authedStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s authedStream) Context() context.Context {
+	return s.ctx
+}
+
+func (cfg *apiConfig) grpcStreamAuth(srv any, ss grpc.ServerStream, _ *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	ctx, err := cfg.grpcAuthenticate(ss.Context())
+	if err != nil {
+		return err
+	}
+	return handler(srv, authedStream{ServerStream: ss, ctx: ctx})
+}
+
+// contextUserID returns the authenticated user stored on ctx by the gRPC
+// interceptors or the GraphQL handler, or uuid.Nil for anonymous callers.
+func contextUserID(ctx context.Context) uuid.UUID {
+	userID, _ := ctx.Value(userIDKey{}).(uuid.UUID)
+	return userID
+}
+
+func (s *grpcServer) toVideo(ctx context.Context, video database.Video) (*tubelyrpc.Video, error) {
+	video, err := s.cfg.signVideo(ctx, video)
+	if err != nil {
+		return nil, status.Error(codes.Internal, "Couldn't sign video URL")
+	}
+	return &tubelyrpc.Video{
+		Id:           video.ID.String(),
+		CreatedAt:    timestamppb.New(video.CreatedAt),
+		UpdatedAt:    timestamppb.New(video.UpdatedAt),
+		Version:      video.Version,
+		Title:        video.Title,
+		Description:  video.Description,
+		Visibility:   video.Visibility,
+		ThumbnailUrl: stringOrEmpty(video.ThumbnailURL),
+		VideoUrl:     stringOrEmpty(video.VideoURL),
+		Published:    video.Published,
+		UserId:       video.UserID.String(),
+	}, nil
+}
+
+// ownVideo loads a video the caller has at least the need role on, and
+// returns it with the caller's ID.
+func (s *grpcServer) ownVideo(ctx context.Context, id, need string) (database.Video, uuid.UUID, error) {
+	videoID, err := uuid.Parse(id)
+	if err != nil {
+		return database.Video{}, uuid.Nil, status.Error(codes.InvalidArgument, "Invalid ID")
+	}
+	video, err := s.cfg.db.GetVideo(videoID)
+	if err != nil {
+		return database.Video{}, uuid.Nil, status.Error(codes.Internal, "Couldn't get video")
+	}
+	if video.ID == uuid.Nil {
+		return database.Video{}, uuid.Nil, status.Error(codes.NotFound, "Couldn't get video")
+	}
+	userID := contextUserID(ctx)
+	role, err := s.cfg.videoRole(video, userID)
+	if err != nil {
+		return database.Video{}, uuid.Nil, status.Error(codes.Internal, "Couldn't check access to video")
+	}
+	if !roleAtLeast(role, need) {
+		return database.Video{}, uuid.Nil, status.Error(codes.PermissionDenied, "Video not owned by user")
+	}
+	return video, userID, nil
+}
+
+func (s *grpcServer) CreateVideo(ctx context.Context, req *tubelyrpc.CreateVideoRequest) (*tubelyrpc.Video, error) {
+	if req.Visibility != "" && !validVisibility(req.Visibility) {
+		return nil, status.Error(codes.InvalidArgument, "Invalid visibility")
+	}
+	userID := contextUserID(ctx)
+	video, err := s.cfg.createVideo(database.CreateVideoParams{
+		Title:       req.Title,
+		Description: req.Description,
+		Visibility:  req.Visibility,
+		UserID:      userID,
+	})
+	if err != nil {
+		return nil, status.Error(codes.Internal, "Couldn't create video")
+	}
+	s.cfg.audit(nil, userID, "video.create", "video", video.ID.String(), fmt.Sprintf("title: %q", video.Title))
+	s.cfg.publishVideoEvent(eventVideoCreated, video, nil)
+	return s.toVideo(ctx, video)
+}
+
+func (s *grpcServer) GetVideo(ctx context.Context, req *tubelyrpc.GetVideoRequest) (*tubelyrpc.Video, error) {
+	videoID, err := uuid.Parse(req.Id)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, "Invalid video ID")
+	}
+	video, err := s.cfg.db.GetVideo(videoID)
+	if err != nil {
+		return nil, status.Error(codes.Internal, "Couldn't get video")
+	}
+	// Private videos are hidden from everyone but their owner and members
+	// of their organization
+	if video.ID == uuid.Nil || (video.Visibility == database.VisibilityPrivate && !s.cfg.canViewVideo(video, contextUserID(ctx))) {
+		return nil, status.Error(codes.NotFound, "Couldn't get video")
+	}
+	return s.toVideo(ctx, video)
+}
+
+func (s *grpcServer) ListVideos(ctx context.Context, req *tubelyrpc.ListVideosRequest) (*tubelyrpc.ListVideosResponse, error) {
+	page := database.Page{Limit: s.cfg.pageLimit(int(req.PageSize))}
+	if req.PageToken != "" {
+		cursor, err := database.ParseCursor(req.PageToken)
+		if err != nil {
+			return nil, status.Error(codes.InvalidArgument, "Invalid page token")
+		}
+		page.After = &cursor
+	}
+	videos, next, err := s.cfg.db.GetVideos(contextUserID(ctx), page)
+	if err != nil {
+		return nil, status.Error(codes.Internal, "Couldn't retrieve videos")
+	}
+	resp := &tubelyrpc.ListVideosResponse{Videos: make([]*tubelyrpc.Video, 0, len(videos))}
+	if next != nil {
+		resp.NextPageToken = next.String()
+	}
+	for _, video := range videos {
+		v, err := s.toVideo(ctx, video)
+		if err != nil {
+			return nil, err
+		}
+		resp.Videos = append(resp.Videos, v)
+	}
+	return resp, nil
+}
+
+func (s *grpcServer) UpdateVideo(ctx context.Context, req *tubelyrpc.UpdateVideoRequest) (*tubelyrpc.Video, error) {
+	video, userID, err := s.ownVideo(ctx, req.Id, database.OrgRoleEditor)
+	if err != nil {
+		return nil, err
+	}
+	if req.Visibility != nil && !validVisibility(*req.Visibility) {
+		return nil, status.Error(codes.InvalidArgument, "Invalid visibility")
+	}
+	if req.Version != nil && *req.Version != video.Version {
+		return nil, status.Error(codes.Aborted, "Video was changed since you last read it")
+	}
+	if req.Title != nil {
+		video.Title = *req.Title
+	}
+	if req.Description != nil {
+		video.Description = *req.Description
+	}
+	if req.Visibility != nil {
+		video.Visibility = *req.Visibility
+	}
+	video, err = s.cfg.db.UpdateVideo(video)
+	if errors.Is(err, database.ErrVideoConflict) {
+		return nil, status.Error(codes.Aborted, "Video was changed while updating it, try again")
+	}
+	if err != nil {
+		return nil, status.Error(codes.Internal, "Couldn't update video")
+	}
+	s.cfg.audit(nil, userID, "video.update", "video", video.ID.String(), fmt.Sprintf("title: %q, visibility: %s", video.Title, video.Visibility))
+	return s.toVideo(ctx, video)
+}
+
+func (s *grpcServer) DeleteVideo(ctx context.Context, req *tubelyrpc.DeleteVideoRequest) (*tubelyrpc.DeleteVideoResponse, error) {
+	video, userID, err := s.ownVideo(ctx, req.Id, database.OrgRoleOwner)
+	if err != nil {
+		return nil, err
+	}
+	err = s.cfg.db.TrashVideo(video.ID)
+	if err != nil {
+		return nil, status.Error(codes.Internal, "Couldn't delete video")
+	}
+	s.cfg.audit(nil, userID, "video.trash", "video", video.ID.String(), fmt.Sprintf("moved %q to trash", video.Title))
+	s.cfg.publishVideoEvent(eventVideoDeleted, video, nil)
+	return &tubelyrpc.DeleteVideoResponse{}, nil
+}
+
+// CreateUploadSession points the client at the HTTP upload endpoint, since
+// file bytes aren't streamed over gRPC.
+func (s *grpcServer) CreateUploadSession(ctx context.Context, req *tubelyrpc.CreateUploadSessionRequest) (*tubelyrpc.UploadSession, error) {
+	video, userID, err := s.ownVideo(ctx, req.VideoId, database.OrgRoleEditor)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.cfg.ensureCanUpload(userID); err != nil {
+		return nil, status.Error(codes.FailedPrecondition, "Verify your email address before uploading")
+	}
+	if m := s.cfg.flags.maintenanceMode(); m.Enabled {
+		return nil, status.Error(codes.Unavailable, maintenanceMessage(m))
+	}
+	return &tubelyrpc.UploadSession{
+		UploadUrl: "/api/v1/video_upload/" + video.ID.String(),
+		Method:    http.MethodPost,
+		FormField: "video",
+		MaxBytes:  s.cfg.maxVideoUploadSize,
+	}, nil
+}
+
+// WatchVideo sends the video's status right away and again whenever it
+// changes, until the client disconnects.
+func (s *grpcServer) WatchVideo(req *tubelyrpc.WatchVideoRequest, stream grpc.ServerStreamingServer[tubelyrpc.VideoStatus]) error {
+	ctx := stream.Context()
+	video, _, err := s.ownVideo(ctx, req.Id, database.OrgRoleViewer)
+	if err != nil {
+		return err
+	}
+
+	var last *tubelyrpc.VideoStatus
+	ticker := time.NewTicker(watchPollInterval)
+	defer ticker.Stop()
+	for {
+		current, err := s.videoStatus(video.ID)
+		if err != nil {
+			return err
+		}
+		if last == nil || !proto.Equal(current, last) {
+			if err := stream.Send(current); err != nil {
+				return err
+			}
+			last = current
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *grpcServer) videoStatus(videoID uuid.UUID) (*tubelyrpc.VideoStatus, error) {
+	video, err := s.cfg.db.GetVideo(videoID)
+	if err != nil {
+		return nil, status.Error(codes.Internal, "Couldn't get video")
+	}
+	if video.ID == uuid.Nil {
+		return nil, status.Error(codes.NotFound, "Video was deleted")
+	}
+	failure, err := s.cfg.db.GetProcessingFailure(videoID)
+	if err != nil {
+		return nil, status.Error(codes.Internal, "Couldn't get processing status")
+	}
+
+	current := &tubelyrpc.VideoStatus{
+		Id:        videoID.String(),
+		Status:    tubelyrpc.StatusAwaitingUpload,
+		Published: video.Published,
+	}
+	switch {
+	case failure != nil:
+		current.Status = tubelyrpc.StatusFailed
+		current.Error = failure.Error
+	case video.VideoURL != nil:
+		current.Status = tubelyrpc.StatusReady
+	}
+	return current, nil
+}
+
+var _ tubelyrpc.VideosServer = (*grpcServer)(nil)
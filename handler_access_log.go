@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+func parseAccessLogFilter(q url.Values) (database.AccessLogFilter, error) {
+	filter := database.AccessLogFilter{
+		Action: q.Get("action"),
+	}
+	if v := q.Get("user_id"); v != "" {
+		id, err := uuid.Parse(v)
+		if err != nil {
+			return filter, fmt.Errorf("invalid user_id: %w", err)
+		}
+		filter.UserID = &id
+	}
+	if v := q.Get("allowed"); v != "" {
+		allowed, err := strconv.ParseBool(v)
+		if err != nil {
+			return filter, fmt.Errorf("invalid allowed: %w", err)
+		}
+		filter.Allowed = &allowed
+	}
+	if v := q.Get("since"); v != "" {
+		since, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return filter, fmt.Errorf("invalid since: %w", err)
+		}
+		filter.Since = since
+	}
+	if v := q.Get("until"); v != "" {
+		until, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return filter, fmt.Errorf("invalid until: %w", err)
+		}
+		filter.Until = until
+	}
+	return filter, nil
+}
+
+// handlerVideoAccessLog shows a video's owners who got at its files, and
+// who was turned away, newest first.
+func (cfg *apiConfig) handlerVideoAccessLog(w http.ResponseWriter, r *http.Request) {
+	video, _, ok := cfg.videoWithRole(w, r, database.OrgRoleOwner)
+	if !ok {
+		return
+	}
+
+	q := r.URL.Query()
+	filter, err := parseAccessLogFilter(q)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid access log filter", err)
+		return
+	}
+	filter.VideoID = &video.ID
+	page, err := cfg.parsePage(q)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid page", err)
+		return
+	}
+
+	entries, next, err := cfg.db.GetAccessLog(filter, page)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get access log", err)
+		return
+	}
+	respondWithPage(w, entries, next)
+}
+
+// handlerAdminAccessLog searches the access log across all videos, newest
+// first, including videos that have since been deleted.
+func (cfg *apiConfig) handlerAdminAccessLog(w http.ResponseWriter, r *http.Request) {
+	if err := cfg.authorizeAdmin(r); err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't authorize admin", err)
+		return
+	}
+
+	q := r.URL.Query()
+	filter, err := parseAccessLogFilter(q)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid access log filter", err)
+		return
+	}
+	if v := q.Get("video_id"); v != "" {
+		id, err := uuid.Parse(v)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid access log filter", fmt.Errorf("invalid video_id: %w", err))
+			return
+		}
+		filter.VideoID = &id
+	}
+	page, err := cfg.parsePage(q)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid page", err)
+		return
+	}
+
+	entries, next, err := cfg.db.GetAccessLog(filter, page)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get access log", err)
+		return
+	}
+	respondWithPage(w, entries, next)
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/google/uuid"
+)
+
+// authorizeAdmin checks the request for the configured admin API key,
+// sent as "Authorization: ApiKey <key>".
+func (cfg *apiConfig) authorizeAdmin(r *http.Request) error {
+	if cfg.adminAPIKey == "" {
+		return errors.New("admin API is disabled")
+	}
+	key, err := auth.GetAPIKey(r.Header)
+	if err != nil {
+		return err
+	}
+	if subtle.ConstantTimeCompare([]byte(key), []byte(cfg.adminAPIKey)) != 1 {
+		return errors.New("invalid admin API key")
+	}
+	return nil
+}
+
+func (cfg *apiConfig) handlerAdminVideosList(w http.ResponseWriter, r *http.Request) {
+	if err := cfg.authorizeAdmin(r); err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't authorize admin", err)
+		return
+	}
+
+	page, err := cfg.parsePage(r.URL.Query())
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid page", err)
+		return
+	}
+
+	videos, next, err := cfg.db.GetAllVideos(page)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't retrieve videos", err)
+		return
+	}
+
+	respondWithPage(w, videos, next)
+}
+
+// handlerAdminGC reports files in S3 and the assets directory that no video
+// refers to. Orphans are only deleted when called with ?dry_run=false.
+func (cfg *apiConfig) handlerAdminGC(w http.ResponseWriter, r *http.Request) {
+	if err := cfg.authorizeAdmin(r); err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't authorize admin", err)
+		return
+	}
+
+	dryRun := true
+	if v := r.URL.Query().Get("dry_run"); v != "" {
+		var err error
+		dryRun, err = strconv.ParseBool(v)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid dry_run value", err)
+			return
+		}
+	}
+
+	report, err := cfg.findOrphans(r.Context(), !dryRun)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't reconcile storage", err)
+		return
+	}
+	if !dryRun {
+		cfg.audit(r, uuid.Nil, "admin.gc", "storage", cfg.s3Bucket, fmt.Sprintf("deleted %d S3 objects and %d local assets", len(report.S3Objects), len(report.LocalAssets)))
+	}
+
+	respondWithJSON(w, http.StatusOK, report)
+}
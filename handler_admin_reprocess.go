@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// handlerAdminReprocessBatchCreate queues every video matching the filters
+// to go through the current pipeline again, e.g. after the transcode
+// settings changed. Videos are processed in the background one at a
+// time, delay_ms apart.
+func (cfg *apiConfig) handlerAdminReprocessBatchCreate(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		UserID        *uuid.UUID `json:"user_id"`
+		VideoStatus   string     `json:"video_status"`
+		CreatedAfter  *time.Time `json:"created_after"`
+		CreatedBefore *time.Time `json:"created_before"`
+		DelayMS       *int64     `json:"delay_ms"`
+	}
+
+	if err := cfg.authorizeAdmin(r); err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't authorize admin", err)
+		return
+	}
+
+	params := parameters{}
+	if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters", err)
+		return
+	}
+	switch params.VideoStatus {
+	case "", database.VideoStatusReady, database.VideoStatusFailing, database.VideoStatusDeadLettered:
+	default:
+		respondWithError(w, http.StatusBadRequest, "video_status must be ready, failing or dead_lettered", nil)
+		return
+	}
+	if params.CreatedAfter != nil && params.CreatedBefore != nil && !params.CreatedAfter.Before(*params.CreatedBefore) {
+		respondWithError(w, http.StatusBadRequest, "created_after must be before created_before", nil)
+		return
+	}
+	delayMS := cfg.reprocessDelay.Milliseconds()
+	if params.DelayMS != nil {
+		if *params.DelayMS < 0 {
+			respondWithError(w, http.StatusBadRequest, "delay_ms can't be negative", nil)
+			return
+		}
+		delayMS = *params.DelayMS
+	}
+
+	batch, err := cfg.db.CreateReprocessBatch(database.CreateReprocessBatchParams{
+		UserID:        params.UserID,
+		VideoStatus:   params.VideoStatus,
+		CreatedAfter:  params.CreatedAfter,
+		CreatedBefore: params.CreatedBefore,
+		DelayMS:       delayMS,
+	})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create reprocess batch", err)
+		return
+	}
+	cfg.audit(r, uuid.Nil, "admin.reprocess_batch", "reprocess_batch", batch.ID.String(), fmt.Sprintf("queued %d videos", batch.Total))
+
+	respondWithJSON(w, http.StatusCreated, batch)
+}
+
+func (cfg *apiConfig) handlerAdminReprocessBatchesList(w http.ResponseWriter, r *http.Request) {
+	if err := cfg.authorizeAdmin(r); err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't authorize admin", err)
+		return
+	}
+
+	page, err := cfg.parsePage(r.URL.Query())
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid page", err)
+		return
+	}
+
+	batches, next, err := cfg.db.GetReprocessBatches(page)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get reprocess batches", err)
+		return
+	}
+
+	respondWithPage(w, batches, next)
+}
+
+// handlerAdminReprocessBatchGet reports a batch's progress, along with
+// its videos when ?items=true, optionally only those with ?status.
+func (cfg *apiConfig) handlerAdminReprocessBatchGet(w http.ResponseWriter, r *http.Request) {
+	type response struct {
+		database.ReprocessBatch
+		Items []database.ReprocessItem `json:"items,omitempty"`
+	}
+
+	batch, ok := cfg.adminReprocessBatch(w, r)
+	if !ok {
+		return
+	}
+	resp := response{ReprocessBatch: batch}
+	if r.URL.Query().Get("items") == "true" {
+		var err error
+		resp.Items, err = cfg.db.GetReprocessItems(batch.ID, r.URL.Query().Get("status"))
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't get reprocess batch items", err)
+			return
+		}
+	}
+
+	respondWithJSON(w, http.StatusOK, resp)
+}
+
+// handlerAdminReprocessBatchCancel stops a batch after the video it's on.
+func (cfg *apiConfig) handlerAdminReprocessBatchCancel(w http.ResponseWriter, r *http.Request) {
+	batch, ok := cfg.adminReprocessBatch(w, r)
+	if !ok {
+		return
+	}
+	cancelled, err := cfg.db.SetReprocessBatchStatus(batch.ID, database.ReprocessBatchCancelled)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't cancel reprocess batch", err)
+		return
+	}
+	if !cancelled {
+		respondWithError(w, http.StatusConflict, "Reprocess batch isn't running", nil)
+		return
+	}
+	cfg.audit(r, uuid.Nil, "admin.reprocess_batch_cancel", "reprocess_batch", batch.ID.String(), fmt.Sprintf("cancelled with %d videos left", batch.Pending))
+
+	batch, err = cfg.db.GetReprocessBatch(batch.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get reprocess batch", err)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, batch)
+}
+
+// adminReprocessBatch authorizes an admin request and loads the batch in
+// its path, responding with an error if either fails.
+func (cfg *apiConfig) adminReprocessBatch(w http.ResponseWriter, r *http.Request) (database.ReprocessBatch, bool) {
+	if err := cfg.authorizeAdmin(r); err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't authorize admin", err)
+		return database.ReprocessBatch{}, false
+	}
+	batchID, err := uuid.Parse(r.PathValue("batchID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid ID", err)
+		return database.ReprocessBatch{}, false
+	}
+	batch, err := cfg.db.GetReprocessBatch(batchID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get reprocess batch", err)
+		return database.ReprocessBatch{}, false
+	}
+	if batch.ID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, "Couldn't get reprocess batch", nil)
+		return database.ReprocessBatch{}, false
+	}
+	return batch, true
+}
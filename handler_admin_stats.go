@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+const (
+	statsDefaultDays = 30
+	statsMaxDays     = 365
+	// statsTopUsers caps how many of the biggest users storage is broken
+	// down by.
+	statsTopUsers = 20
+)
+
+// uploadActions are the audit actions counted as uploads.
+var uploadActions = []string{"video.upload", "video.import", "video.replace"}
+
+type adminStats struct {
+	GeneratedAt   time.Time             `json:"generated_at"`
+	Days          int                   `json:"days"`
+	Users         int                   `json:"users"`
+	Videos        videoStats            `json:"videos"`
+	Storage       *storageStats         `json:"storage"`
+	UploadsPerDay []database.DailyCount `json:"uploads_per_day"`
+	Processing    processingStats       `json:"processing"`
+}
+
+type videoStats struct {
+	Total    int            `json:"total"`
+	ByStatus map[string]int `json:"by_status"`
+}
+
+type storageStats struct {
+	Objects    int              `json:"objects"`
+	TotalBytes int64            `json:"total_bytes"`
+	ByPrefix   map[string]int64 `json:"by_prefix"`
+	ByUser     []userStorage    `json:"by_user"`
+	// UnattributedBytes are in objects no user owns, such as replaced
+	// files waiting for deletion and orphans.
+	UnattributedBytes int64 `json:"unattributed_bytes"`
+}
+
+type userStorage struct {
+	UserID uuid.UUID `json:"user_id"`
+	Bytes  int64     `json:"bytes"`
+}
+
+type processingStats struct {
+	Runs          int                             `json:"runs"`
+	Failures      int                             `json:"failures"`
+	FailureRate   float64                         `json:"failure_rate"`
+	AvgDurationMS float64                         `json:"avg_duration_ms"`
+	PerDay        []database.DailyProcessingStats `json:"per_day"`
+}
+
+// handlerAdminStats reports totals and daily series for an ops dashboard
+// over the last ?days days. Storage is tallied by listing the bucket,
+// which is slow for large buckets; ?storage=false skips it.
+func (cfg *apiConfig) handlerAdminStats(w http.ResponseWriter, r *http.Request) {
+	if err := cfg.authorizeAdmin(r); err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't authorize admin", err)
+		return
+	}
+
+	days := statsDefaultDays
+	if v := r.URL.Query().Get("days"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > statsMaxDays {
+			respondWithError(w, http.StatusBadRequest, "days must be between 1 and 365", err)
+			return
+		}
+		days = n
+	}
+	withStorage := true
+	if v := r.URL.Query().Get("storage"); v != "" {
+		var err error
+		withStorage, err = strconv.ParseBool(v)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid storage value", err)
+			return
+		}
+	}
+
+	now := time.Now().UTC()
+	// Series start at midnight so the first day is complete
+	since := now.Truncate(24*time.Hour).AddDate(0, 0, -(days - 1))
+	stats := adminStats{GeneratedAt: now, Days: days}
+
+	var err error
+	stats.Users, err = cfg.db.CountUsers()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't count users", err)
+		return
+	}
+	stats.Videos.ByStatus, err = cfg.db.CountVideosByStatus()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't count videos", err)
+		return
+	}
+	for _, n := range stats.Videos.ByStatus {
+		stats.Videos.Total += n
+	}
+
+	stats.UploadsPerDay, err = cfg.db.CountAuditEventsByDay(uploadActions, since)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't count uploads", err)
+		return
+	}
+
+	stats.Processing.PerDay, err = cfg.db.GetProcessingStatsByDay(since)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get processing stats", err)
+		return
+	}
+	var totalMS float64
+	for _, d := range stats.Processing.PerDay {
+		stats.Processing.Runs += d.Runs
+		stats.Processing.Failures += d.Failures
+		totalMS += d.AvgDurationMS * float64(d.Runs)
+	}
+	if stats.Processing.Runs > 0 {
+		stats.Processing.FailureRate = float64(stats.Processing.Failures) / float64(stats.Processing.Runs)
+		stats.Processing.AvgDurationMS = totalMS / float64(stats.Processing.Runs)
+	}
+
+	if withStorage {
+		storage, err := cfg.storageStats(r.Context())
+		if err != nil {
+			respondWithError(w, http.StatusBadGateway, "Couldn't list bucket", err)
+			return
+		}
+		stats.Storage = &storage
+	}
+
+	respondWithJSON(w, http.StatusOK, stats)
+}
+
+// storageStats adds up the size of every object in the bucket by its top
+// level prefix and by the user whose video or export it belongs to.
+func (cfg *apiConfig) storageStats(ctx context.Context) (storageStats, error) {
+	stats := storageStats{ByPrefix: map[string]int64{}, ByUser: []userStorage{}}
+
+	owners, _, err := cfg.loadObjectOwners()
+	if err != nil {
+		return stats, err
+	}
+
+	byUser := map[uuid.UUID]int64{}
+	paginator := s3.NewListObjectsV2Paginator(cfg.s3Client, &s3.ListObjectsV2Input{
+		Bucket: &cfg.s3Bucket,
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return stats, err
+		}
+		for _, obj := range page.Contents {
+			if obj.Key == nil {
+				continue
+			}
+			key := *obj.Key
+			var size int64
+			if obj.Size != nil {
+				size = *obj.Size
+			}
+			stats.Objects++
+			stats.TotalBytes += size
+
+			prefix := "/"
+			if i := strings.Index(key, "/"); i >= 0 {
+				prefix = key[:i+1]
+			}
+			stats.ByPrefix[prefix] += size
+
+			owner, ok := owners.owner(key)
+			if ok {
+				byUser[owner] += size
+			} else {
+				stats.UnattributedBytes += size
+			}
+		}
+	}
+
+	for userID, bytes := range byUser {
+		stats.ByUser = append(stats.ByUser, userStorage{userID, bytes})
+	}
+	slices.SortFunc(stats.ByUser, func(a, b userStorage) int {
+		switch {
+		case a.Bytes > b.Bytes:
+			return -1
+		case a.Bytes < b.Bytes:
+			return 1
+		}
+		return strings.Compare(a.UserID.String(), b.UserID.String())
+	})
+	if len(stats.ByUser) > statsTopUsers {
+		stats.ByUser = stats.ByUser[:statsTopUsers]
+	}
+	return stats, nil
+}
+
+// exportOwner returns the user an export archive at key was built for.
+func (cfg *apiConfig) exportOwner(key string) (uuid.UUID, bool) {
+	rest, ok := strings.CutPrefix(key, cfg.s3ExportsPrefix)
+	if !ok {
+		return uuid.Nil, false
+	}
+	userID, _, _ := strings.Cut(rest, "/")
+	id, err := uuid.Parse(userID)
+	return id, err == nil
+}
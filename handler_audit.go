@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// auditPollInterval is how often the stream endpoint checks for new events.
+// Polling the table keeps the stream correct across multiple app instances.
+const auditPollInterval = 2 * time.Second
+
+func parseAuditFilter(q url.Values) (database.AuditEventFilter, error) {
+	filter := database.AuditEventFilter{
+		Action:     q.Get("action"),
+		ResourceID: q.Get("resource_id"),
+	}
+	if v := q.Get("actor_id"); v != "" {
+		id, err := uuid.Parse(v)
+		if err != nil {
+			return filter, fmt.Errorf("invalid actor_id: %w", err)
+		}
+		filter.ActorID = &id
+	}
+	if v := q.Get("after_id"); v != "" {
+		id, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return filter, fmt.Errorf("invalid after_id: %w", err)
+		}
+		filter.AfterID = id
+	}
+	if v := q.Get("since"); v != "" {
+		since, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return filter, fmt.Errorf("invalid since: %w", err)
+		}
+		filter.Since = since
+	}
+	if v := q.Get("cursor"); v != "" {
+		cursor, err := database.ParseCursor(v)
+		if err != nil {
+			return filter, err
+		}
+		filter.AfterID, err = strconv.ParseInt(cursor.ID, 10, 64)
+		if err != nil {
+			return filter, database.ErrInvalidCursor
+		}
+	}
+	if v := q.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil {
+			return filter, fmt.Errorf("invalid limit: %w", err)
+		}
+		filter.Limit = limit
+	}
+	return filter, nil
+}
+
+// handlerAdminAuditList returns audit events matching the query filters,
+// oldest first. Pages follow the event id, so cursor and after_id are
+// interchangeable.
+func (cfg *apiConfig) handlerAdminAuditList(w http.ResponseWriter, r *http.Request) {
+	if err := cfg.authorizeAdmin(r); err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't authorize admin", err)
+		return
+	}
+
+	filter, err := parseAuditFilter(r.URL.Query())
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid audit filter", err)
+		return
+	}
+	filter.Limit = cfg.pageLimit(filter.Limit)
+
+	events, err := cfg.db.GetAuditEvents(filter)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get audit events", err)
+		return
+	}
+
+	var next *database.Cursor
+	if len(events) == filter.Limit {
+		last := events[len(events)-1]
+		next = &database.Cursor{CreatedAt: last.CreatedAt, ID: strconv.FormatInt(last.ID, 10)}
+	}
+	respondWithPage(w, events, next)
+}
+
+// handlerAdminAuditStream follows the audit log as Server-Sent Events,
+// starting after after_id (or with new events only when it's omitted).
+func (cfg *apiConfig) handlerAdminAuditStream(w http.ResponseWriter, r *http.Request) {
+	if err := cfg.authorizeAdmin(r); err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't authorize admin", err)
+		return
+	}
+
+	filter, err := parseAuditFilter(r.URL.Query())
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid audit filter", err)
+		return
+	}
+	// Browsers resend the last id they saw when reconnecting
+	if v := r.Header.Get("Last-Event-ID"); v != "" {
+		if id, err := strconv.ParseInt(v, 10, 64); err == nil {
+			filter.AfterID = id
+		}
+	}
+	if filter.AfterID == 0 && filter.Since.IsZero() {
+		filter.Since = time.Now()
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		respondWithError(w, http.StatusInternalServerError, "Streaming isn't supported", nil)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	ticker := time.NewTicker(auditPollInterval)
+	defer ticker.Stop()
+	for {
+		events, err := cfg.db.GetAuditEvents(filter)
+		if err != nil {
+			fmt.Fprintf(w, "event: error\ndata: %q\n\n", "couldn't get audit events")
+			flusher.Flush()
+			return
+		}
+		for _, event := range events {
+			dat, err := json.Marshal(event)
+			if err != nil {
+				continue
+			}
+			fmt.Fprintf(w, "id: %d\ndata: %s\n\n", event.ID, dat)
+			filter.AfterID = event.ID
+		}
+		if len(events) > 0 {
+			flusher.Flush()
+		}
+
+		select {
+		case <-r.Context().Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// viewableVideo loads the video in the path for anyone who may watch it.
+// On failure it writes the error response itself and returns ok == false.
+func (cfg *apiConfig) viewableVideo(w http.ResponseWriter, r *http.Request) (database.Video, bool) {
+	videoID, err := uuid.Parse(r.PathValue("videoID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid video ID", err)
+		return database.Video{}, false
+	}
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return database.Video{}, false
+	}
+	if video.ID == uuid.Nil || (video.Visibility == database.VisibilityPrivate && !cfg.canViewVideo(video, cfg.optionalUserID(r))) {
+		respondWithError(w, http.StatusNotFound, "Couldn't get video", nil)
+		return database.Video{}, false
+	}
+	return video, true
+}
+
+// handlerCaptionsList lists a video's caption tracks. Each is fetched as
+// WebVTT from the caption endpoint.
+func (cfg *apiConfig) handlerCaptionsList(w http.ResponseWriter, r *http.Request) {
+	video, ok := cfg.viewableVideo(w, r)
+	if !ok {
+		return
+	}
+	captions, err := cfg.db.GetCaptions(video.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get captions", err)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, captions)
+}
+
+// handlerCaptionGet serves a caption track as WebVTT. It goes through the
+// app, like the stream endpoint, so the captions of encrypted videos can
+// be decrypted and private videos' checked on every request.
+func (cfg *apiConfig) handlerCaptionGet(w http.ResponseWriter, r *http.Request) {
+	video, ok := cfg.viewableVideo(w, r)
+	if !ok {
+		return
+	}
+	captionID, err := uuid.Parse(r.PathValue("captionID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid caption ID", err)
+		return
+	}
+	caption, err := cfg.db.GetCaption(captionID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get caption", err)
+		return
+	}
+	if caption.ID == uuid.Nil || caption.VideoID != video.ID {
+		respondWithError(w, http.StatusNotFound, "Couldn't get caption", nil)
+		return
+	}
+
+	dataKey, err := cfg.videoDataKey(r.Context(), video)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video key", err)
+		return
+	}
+	w.Header().Set("Cache-Control", "private, no-store")
+	cfg.streamObject(w, r, caption.Key, dataKey)
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+const maxCommentLength = 2000
+
+func (cfg *apiConfig) handlerCommentCreate(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Body     string     `json:"body"`
+		ParentID *uuid.UUID `json:"parent_id"`
+	}
+
+	videoIDString := r.PathValue("videoID")
+	videoID, err := uuid.Parse(videoIDString)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid ID", err)
+		return
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := cfg.validateJWT(token)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err = decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters", err)
+		return
+	}
+	params.Body = strings.TrimSpace(params.Body)
+	if params.Body == "" || len(params.Body) > maxCommentLength {
+		respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Comment must be between 1 and %d characters", maxCommentLength), nil)
+		return
+	}
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+	if video.ID == uuid.Nil || (video.Visibility == database.VisibilityPrivate && !cfg.canViewVideo(video, userID)) {
+		respondWithError(w, http.StatusNotFound, "Couldn't get video", nil)
+		return
+	}
+
+	// Replies are one level deep: the parent must be a top-level comment
+	// on the same video.
+	if params.ParentID != nil {
+		parent, err := cfg.db.GetComment(*params.ParentID)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't get parent comment", err)
+			return
+		}
+		if parent.ID == uuid.Nil || parent.VideoID != videoID || parent.ParentID != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid parent comment", nil)
+			return
+		}
+	}
+
+	comment, err := cfg.db.CreateComment(database.CreateCommentParams{
+		VideoID:  videoID,
+		UserID:   userID,
+		ParentID: params.ParentID,
+		Body:     params.Body,
+	})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create comment", err)
+		return
+	}
+	cfg.audit(r, userID, "comment.create", "comment", comment.ID.String(), fmt.Sprintf("on video %s", videoID))
+	cfg.notifyComment(video, comment)
+
+	respondWithJSON(w, http.StatusCreated, comment)
+}
+
+// handlerCommentsList pages through a video's top-level comments, or the
+// replies to parent_id when it's given.
+func (cfg *apiConfig) handlerCommentsList(w http.ResponseWriter, r *http.Request) {
+	videoIDString := r.PathValue("videoID")
+	videoID, err := uuid.Parse(videoIDString)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid ID", err)
+		return
+	}
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+	if video.ID == uuid.Nil || (video.Visibility == database.VisibilityPrivate && !cfg.canViewVideo(video, cfg.optionalUserID(r))) {
+		respondWithError(w, http.StatusNotFound, "Couldn't get video", nil)
+		return
+	}
+
+	filter := database.CommentFilter{VideoID: videoID}
+	q := r.URL.Query()
+	if v := q.Get("parent_id"); v != "" {
+		parentID, err := uuid.Parse(v)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid parent_id", err)
+			return
+		}
+		filter.ParentID = &parentID
+	}
+	filter.Page, err = cfg.parsePage(q)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid page", err)
+		return
+	}
+
+	comments, next, err := cfg.db.GetComments(filter)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get comments", err)
+		return
+	}
+
+	respondWithPage(w, comments, next)
+}
+
+func (cfg *apiConfig) handlerCommentDelete(w http.ResponseWriter, r *http.Request) {
+	commentIDString := r.PathValue("commentID")
+	commentID, err := uuid.Parse(commentIDString)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid ID", err)
+		return
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := cfg.validateJWT(token)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	comment, err := cfg.db.GetComment(commentID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get comment", err)
+		return
+	}
+	if comment.ID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, "Comment not found", nil)
+		return
+	}
+	if comment.UserID != userID {
+		respondWithErrorCode(w, http.StatusForbidden, codeNotOwner, "You can't delete this comment", nil)
+		return
+	}
+
+	err = cfg.db.DeleteComment(commentID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't delete comment", err)
+		return
+	}
+	cfg.audit(r, userID, "comment.delete", "comment", commentID.String(), fmt.Sprintf("on video %s", comment.VideoID))
+
+	w.WriteHeader(http.StatusNoContent)
+}
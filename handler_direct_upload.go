@@ -0,0 +1,228 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// Ways a client can send a video straight to the bucket: a presigned PUT,
+// or a POST policy for contexts that can only submit a form.
+const (
+	directUploadPut  = "put"
+	directUploadPost = "post"
+)
+
+// directUploadPrefix is where a video's direct uploads land until they're
+// completed. Ones that never are get collected as orphans.
+func (cfg *apiConfig) directUploadPrefix(video database.Video) string {
+	return video.KeyPrefix + cfg.s3DirectUploadPrefix + video.ID.String() + "/"
+}
+
+// handlerDirectUploadCreate lets the owner upload a video's file to S3
+// without it passing through the app. The file is processed once the
+// client reports it's there with handlerDirectUploadComplete.
+func (cfg *apiConfig) handlerDirectUploadCreate(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Method      string `json:"method"`
+		ContentType string `json:"content_type"`
+		// Size is required for PUT, whose URL is only good for that length
+		Size int64 `json:"size"`
+	}
+	type response struct {
+		Method string `json:"method"`
+		URL    string `json:"url"`
+		Key    string `json:"key"`
+		// Headers go on the PUT request
+		Headers map[string]string `json:"headers,omitempty"`
+		// Fields go in the POST form, before the file
+		Fields    map[string]string `json:"fields,omitempty"`
+		ExpiresAt time.Time         `json:"expires_at"`
+	}
+
+	video, userID, ok := cfg.ownVideo(w, r)
+	if !ok {
+		return
+	}
+	if err := cfg.ensureCanUpload(userID); err != nil {
+		respondWithErrorCode(w, http.StatusForbidden, codeEmailUnverified, "Verify your email address before uploading", err)
+		return
+	}
+	// The app encrypts files on their way to the bucket, so it has to see them
+	if video.Encrypted {
+		respondWithError(w, http.StatusConflict, "Encrypted videos can't be uploaded directly to storage", nil)
+		return
+	}
+
+	params := parameters{Method: directUploadPut, ContentType: "video/mp4"}
+	if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters", err)
+		return
+	}
+	if params.ContentType != "video/mp4" {
+		respondWithError(w, http.StatusUnsupportedMediaType, "Invalid file type", nil)
+		return
+	}
+	if params.Size < 0 {
+		respondWithError(w, http.StatusBadRequest, "size can't be negative", nil)
+		return
+	}
+	if params.Size > cfg.maxVideoUploadSize {
+		respondWithError(w, http.StatusRequestEntityTooLarge, "Video exceeds the upload size limit", nil)
+		return
+	}
+
+	key := cfg.directUploadPrefix(video) + uuid.NewString() + ".mp4"
+	resp := response{
+		Method:    params.Method,
+		Key:       key,
+		ExpiresAt: time.Now().UTC().Add(cfg.signedURLTTL).Truncate(time.Second),
+	}
+	switch params.Method {
+	case directUploadPut:
+		if params.Size == 0 {
+			respondWithError(w, http.StatusBadRequest, "size is required for PUT uploads", nil)
+			return
+		}
+		req, err := cfg.s3PresignClient.PresignPutObject(r.Context(), &s3.PutObjectInput{
+			Bucket:        &cfg.s3Bucket,
+			Key:           &key,
+			ContentType:   &params.ContentType,
+			ContentLength: &params.Size,
+		}, s3.WithPresignExpires(cfg.signedURLTTL))
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't create upload URL", err)
+			return
+		}
+		resp.URL = req.URL
+		resp.Headers = map[string]string{"Content-Type": params.ContentType}
+	case directUploadPost:
+		req, err := cfg.s3PresignClient.PresignPostObject(r.Context(), &s3.PutObjectInput{
+			Bucket: &cfg.s3Bucket,
+			Key:    &key,
+		}, func(o *s3.PresignPostOptions) {
+			o.Expires = cfg.signedURLTTL
+			o.Conditions = []any{
+				[]any{"starts-with", "$key", cfg.directUploadPrefix(video)},
+				map[string]string{"Content-Type": params.ContentType},
+				[]any{"content-length-range", 1, cfg.maxVideoUploadSize},
+			}
+		})
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't create upload policy", err)
+			return
+		}
+		resp.URL = req.URL
+		resp.Fields = req.Values
+		resp.Fields["Content-Type"] = params.ContentType
+	default:
+		respondWithError(w, http.StatusBadRequest, "method must be put or post", nil)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	respondWithJSON(w, http.StatusCreated, resp)
+}
+
+// handlerDirectUploadComplete processes a file the client uploaded
+// straight to the bucket, whichever method it used. The object is staged
+// like any other upload and removed once the video is ready.
+func (cfg *apiConfig) handlerDirectUploadComplete(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Key          string `json:"key"`
+		Filename     string `json:"filename"`
+		StorageClass string `json:"storage_class"`
+	}
+
+	dbVideo, userID, ok := cfg.ownVideo(w, r)
+	if !ok {
+		return
+	}
+	if err := cfg.ensureCanUpload(userID); err != nil {
+		respondWithErrorCode(w, http.StatusForbidden, codeEmailUnverified, "Verify your email address before uploading", err)
+		return
+	}
+
+	params := parameters{}
+	if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters", err)
+		return
+	}
+	prefix := cfg.directUploadPrefix(dbVideo)
+	if !strings.HasPrefix(params.Key, prefix) || len(params.Key) == len(prefix) {
+		respondWithError(w, http.StatusBadRequest, "key isn't a direct upload of this video", nil)
+		return
+	}
+	storageClass := cfg.s3StorageClass
+	if params.StorageClass != "" {
+		var err error
+		storageClass, err = parseStorageClass(params.StorageClass)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid storage class", err)
+			return
+		}
+	}
+
+	ctx, release, ok := cfg.claimVideoUpload(w, r, dbVideo.ID)
+	if !ok {
+		return
+	}
+	defer release()
+
+	// S3 held the client to the size and type it signed for, but the
+	// contents still need checking
+	path, checksum, err := cfg.downloadVerified(ctx, params.Key, nil, nil)
+	if isScratchFull(err) {
+		respondWithScratchFull(w, err)
+		return
+	}
+	if err != nil {
+		respondWithObjectError(w, err)
+		return
+	}
+	defer os.Remove(path)
+
+	f, err := os.Open(path)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't read upload", err)
+		return
+	}
+	head, err := readHead(f)
+	f.Close()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't read upload", err)
+		return
+	}
+	if sniffed := sniffVideoType(head); sniffed != "video/mp4" {
+		cfg.deleteObjectQuietly(params.Key)
+		respondWithError(w, http.StatusUnsupportedMediaType, "File contents don't match declared type", fmt.Errorf("detected %q", sniffed))
+		return
+	}
+	fmt.Println("uploading video for video", dbVideo.ID, "by user", userID, "from direct upload", params.Key)
+
+	dbVideo, err = cfg.stageOriginal(ctx, dbVideo, func(v *database.Video) {
+		v.OriginalFilename = originalFilename(params.Filename)
+	}, path, "video/mp4", checksum)
+	if err != nil {
+		respondWithPipelineError(w, uploadFailure(ctx, &pipelineError{"stage", http.StatusInternalServerError, "Couldn't stage original video", err}))
+		return
+	}
+
+	oldVideoKey := stringOrEmpty(dbVideo.VideoKey)
+	dbVideo, err = cfg.processVideo(ctx, dbVideo, path, "video/mp4", storageClass)
+	if err != nil {
+		respondWithPipelineError(w, uploadFailure(ctx, err))
+		return
+	}
+	cfg.deleteObjectQuietly(params.Key)
+	cfg.audit(r, userID, "video.upload", "video", dbVideo.ID.String(), fmt.Sprintf("video_key: %q -> %q, storage_class: %s, direct upload: %s", oldVideoKey, stringOrEmpty(dbVideo.VideoKey), storageClass, params.Key))
+
+	cfg.respondWithVideo(w, r, http.StatusOK, dbVideo)
+}
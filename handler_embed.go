@@ -0,0 +1,230 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+const (
+	oEmbedDefaultWidth = 640
+	providerName       = "Tubely"
+)
+
+// embedVideo loads a video that may be embedded on other sites: anything
+// that isn't private. Embeds are loaded without credentials, so owners
+// can't embed their own private videos either.
+func (cfg *apiConfig) embedVideo(videoID uuid.UUID) (database.Video, bool, error) {
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		return database.Video{}, false, err
+	}
+	if video.ID == uuid.Nil || video.Visibility == database.VisibilityPrivate {
+		return database.Video{}, false, nil
+	}
+	return video, true, nil
+}
+
+func (cfg *apiConfig) embedURL(videoID uuid.UUID) string {
+	return cfg.publicBaseURL + "/embed/" + videoID.String()
+}
+
+// handlerOEmbed describes an embed URL in oEmbed JSON, so sites and chat
+// apps that support oEmbed can show the player.
+func (cfg *apiConfig) handlerOEmbed(w http.ResponseWriter, r *http.Request) {
+	type response struct {
+		Version         string `json:"version"`
+		Type            string `json:"type"`
+		Title           string `json:"title"`
+		AuthorName      string `json:"author_name,omitempty"`
+		ProviderName    string `json:"provider_name"`
+		ProviderURL     string `json:"provider_url"`
+		ThumbnailURL    string `json:"thumbnail_url,omitempty"`
+		ThumbnailWidth  int    `json:"thumbnail_width,omitempty"`
+		ThumbnailHeight int    `json:"thumbnail_height,omitempty"`
+		HTML            string `json:"html"`
+		Width           int    `json:"width"`
+		Height          int    `json:"height"`
+	}
+
+	query := r.URL.Query()
+	if format := query.Get("format"); format != "" && format != "json" {
+		respondWithError(w, http.StatusNotImplemented, "Only the json format is supported", nil)
+		return
+	}
+	videoID, ok := cfg.parseEmbedURL(query.Get("url"))
+	if !ok {
+		respondWithError(w, http.StatusNotFound, "Not an embeddable video URL", nil)
+		return
+	}
+
+	width := oEmbedDefaultWidth
+	for _, param := range []string{"maxwidth", "maxheight"} {
+		v := query.Get(param)
+		if v == "" {
+			continue
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Invalid %s", param), err)
+			return
+		}
+		if param == "maxheight" {
+			n = n * 16 / 9
+		}
+		width = min(width, n)
+	}
+	height := width * 9 / 16
+
+	video, ok, err := cfg.embedVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+	if !ok {
+		respondWithError(w, http.StatusNotFound, "Couldn't get video", nil)
+		return
+	}
+
+	resp := response{
+		Version:      "1.0",
+		Type:         "video",
+		Title:        video.Title,
+		ProviderName: providerName,
+		ProviderURL:  cfg.publicBaseURL,
+		HTML: fmt.Sprintf(`<iframe src="%s" width="%d" height="%d" frameborder="0" allow="autoplay; fullscreen" allowfullscreen></iframe>`,
+			template.HTMLEscapeString(cfg.embedURL(video.ID)), width, height),
+		Width:  width,
+		Height: height,
+	}
+	author, err := cfg.db.GetUser(video.UserID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get author", err)
+		return
+	}
+	if author != nil {
+		resp.AuthorName = author.DisplayName
+	}
+	if video.ThumbnailURL != nil {
+		resp.ThumbnailURL = *video.ThumbnailURL
+		resp.ThumbnailWidth = thumbnailCard.width
+		resp.ThumbnailHeight = thumbnailCard.height
+	}
+
+	w.Header().Set("Cache-Control", "max-age=300")
+	respondWithJSON(w, http.StatusOK, resp)
+}
+
+// parseEmbedURL returns the video an embed URL on this server is for.
+func (cfg *apiConfig) parseEmbedURL(raw string) (uuid.UUID, bool) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return uuid.Nil, false
+	}
+	base, err := url.Parse(cfg.publicBaseURL)
+	if err != nil || !strings.EqualFold(u.Host, base.Host) {
+		return uuid.Nil, false
+	}
+	rest, ok := strings.CutPrefix(u.Path, "/embed/")
+	if !ok {
+		return uuid.Nil, false
+	}
+	videoID, err := uuid.Parse(rest)
+	if err != nil {
+		return uuid.Nil, false
+	}
+	return videoID, true
+}
+
+var embedTemplate = template.Must(template.New("embed").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{.Title}}</title>
+<link rel="alternate" type="application/json+oembed" href="{{.OEmbedURL}}" title="{{.Title}}">
+<meta property="og:type" content="video.other">
+<meta property="og:site_name" content="{{.ProviderName}}">
+<meta property="og:title" content="{{.Title}}">
+<meta property="og:description" content="{{.Description}}">
+<meta property="og:url" content="{{.EmbedURL}}">
+{{if .ThumbnailURL}}<meta property="og:image" content="{{.ThumbnailURL}}">
+{{end}}<meta name="twitter:card" content="player">
+<meta name="twitter:player" content="{{.EmbedURL}}">
+<meta name="twitter:player:width" content="{{.Width}}">
+<meta name="twitter:player:height" content="{{.Height}}">
+<style>
+html, body { margin: 0; height: 100%; background: #000; color: #fff; font-family: sans-serif; }
+video { width: 100%; height: 100%; }
+p { position: absolute; top: 50%; width: 100%; margin: 0; text-align: center; }
+</style>
+</head>
+<body>
+<video controls playsinline {{if .ThumbnailURL}}poster="{{.ThumbnailURL}}"{{end}}></video>
+<p hidden></p>
+<script>
+(async () => {
+  const message = document.querySelector("p");
+  const res = await fetch({{.PlaybackURL}});
+  const body = await res.json();
+  if (!res.ok) {
+    document.querySelector("video").hidden = true;
+    message.textContent = body.error;
+    message.hidden = false;
+    return;
+  }
+  document.querySelector("video").src = body.video_url;
+})();
+</script>
+</body>
+</html>
+`))
+
+// handlerEmbed serves a bare player page for iframes. Playback goes through
+// the playback endpoint from the viewer's browser, so its tokens and geo
+// restrictions apply to the viewer.
+func (cfg *apiConfig) handlerEmbed(w http.ResponseWriter, r *http.Request) {
+	videoID, err := uuid.Parse(r.PathValue("videoID"))
+	if err != nil {
+		http.Error(w, "Invalid video ID", http.StatusBadRequest)
+		return
+	}
+	video, ok, err := cfg.embedVideo(videoID)
+	if err != nil {
+		http.Error(w, "Couldn't get video", http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		http.Error(w, "Video not found", http.StatusNotFound)
+		return
+	}
+
+	embedURL := cfg.embedURL(video.ID)
+	data := struct {
+		Title, Description, ProviderName string
+		EmbedURL, OEmbedURL, PlaybackURL string
+		ThumbnailURL                     string
+		Width, Height                    int
+	}{
+		Title:        video.Title,
+		Description:  video.Description,
+		ProviderName: providerName,
+		EmbedURL:     embedURL,
+		OEmbedURL:    cfg.publicBaseURL + "/api/v1/oembed?url=" + url.QueryEscape(embedURL),
+		PlaybackURL:  "/api/v1/videos/" + video.ID.String() + "/playback",
+		ThumbnailURL: stringOrEmpty(video.ThumbnailURL),
+		Width:        oEmbedDefaultWidth,
+		Height:       oEmbedDefaultWidth * 9 / 16,
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := embedTemplate.Execute(w, data); err != nil {
+		log.Printf("Couldn't render embed page for video %s: %v", video.ID, err)
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"mime"
+	"net/http"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// userExportResponse adds a short-lived download link to ready exports.
+type userExportResponse struct {
+	database.UserExport
+	DownloadURL *string `json:"download_url"`
+}
+
+// handlerUserExportCreate queues an archive of everything the user has
+// stored. It's built in the background and the user is emailed once it's
+// ready.
+func (cfg *apiConfig) handlerUserExportCreate(w http.ResponseWriter, r *http.Request) {
+	userID, ok := cfg.authenticate(w, r)
+	if !ok {
+		return
+	}
+
+	exports, err := cfg.db.GetUserExports(userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get exports", err)
+		return
+	}
+	for _, e := range exports {
+		if e.Status == database.UserExportPending {
+			respondWithError(w, http.StatusConflict, "An export is already in progress", nil)
+			return
+		}
+	}
+
+	export, err := cfg.db.CreateUserExport(userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create export", err)
+		return
+	}
+	cfg.audit(r, userID, "user.export_request", "user", userID.String(), "export "+export.ID.String())
+
+	respondWithJSON(w, http.StatusAccepted, userExportResponse{UserExport: export})
+}
+
+func (cfg *apiConfig) handlerUserExportsList(w http.ResponseWriter, r *http.Request) {
+	userID, ok := cfg.authenticate(w, r)
+	if !ok {
+		return
+	}
+	exports, err := cfg.db.GetUserExports(userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get exports", err)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, exports)
+}
+
+func (cfg *apiConfig) handlerUserExportGet(w http.ResponseWriter, r *http.Request) {
+	exportID, err := uuid.Parse(r.PathValue("exportID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid ID", err)
+		return
+	}
+	userID, ok := cfg.authenticate(w, r)
+	if !ok {
+		return
+	}
+
+	export, err := cfg.db.GetUserExport(exportID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get export", err)
+		return
+	}
+	if export.UserID != userID {
+		respondWithError(w, http.StatusNotFound, "Couldn't find export", nil)
+		return
+	}
+
+	resp := userExportResponse{UserExport: export}
+	if export.Status == database.UserExportReady && export.Key != nil {
+		filename := "tubely-export-" + export.CreatedAt.UTC().Format("2006-01-02") + ".zip"
+		disposition := mime.FormatMediaType("attachment", map[string]string{"filename": filename})
+		downloadURL, err := cfg.presignDownload(r.Context(), *export.Key, disposition)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't create download link", err)
+			return
+		}
+		resp.DownloadURL = &downloadURL
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	respondWithJSON(w, http.StatusOK, resp)
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// handlerImportVideo downloads a video from a remote URL and runs it
+// through the same pipeline as a direct upload.
+func (cfg *apiConfig) handlerImportVideo(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		URL          string `json:"url"`
+		StorageClass string `json:"storage_class"`
+	}
+
+	videoIDString := r.PathValue("videoID")
+	videoID, err := uuid.Parse(videoIDString)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid ID", err)
+		return
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := cfg.validateJWT(token)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err = decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters", err)
+		return
+	}
+	sourceURL, err := url.Parse(params.URL)
+	if err != nil || (sourceURL.Scheme != "http" && sourceURL.Scheme != "https") || sourceURL.Host == "" {
+		respondWithError(w, http.StatusBadRequest, "url must be an absolute http or https URL", err)
+		return
+	}
+	storageClass := cfg.s3StorageClass
+	if params.StorageClass != "" {
+		storageClass, err = parseStorageClass(params.StorageClass)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid storage class", err)
+			return
+		}
+	}
+
+	dbVideo, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+	if dbVideo.ID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, "Couldn't get video", nil)
+		return
+	}
+	if !cfg.authorizeVideo(w, dbVideo, userID, database.OrgRoleEditor, "Video not owned by user") {
+		return
+	}
+	if err := cfg.ensureCanUpload(userID); err != nil {
+		respondWithErrorCode(w, http.StatusForbidden, codeEmailUnverified, "Verify your email address before uploading", err)
+		return
+	}
+
+	ctx, release, ok := cfg.claimVideoUpload(w, r, videoID)
+	if !ok {
+		return
+	}
+	defer release()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, sourceURL.String(), nil)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't build import request", err)
+		return
+	}
+	resp, err := cfg.importClient.Do(req)
+	if errors.Is(err, errAddressNotAllowed) {
+		respondWithError(w, http.StatusBadRequest, "Import URL points to a private address", err)
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusBadGateway, "Couldn't fetch import URL", err)
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		respondWithError(w, http.StatusBadGateway, fmt.Sprintf("Import URL returned status %d", resp.StatusCode), nil)
+		return
+	}
+	if resp.ContentLength > cfg.maxVideoUploadSize {
+		respondWithError(w, http.StatusRequestEntityTooLarge, "Video exceeds the upload size limit", nil)
+		return
+	}
+	// Servers often label files generically, so only an explicit non-video
+	// type is rejected here; the contents are sniffed below either way
+	if ct := resp.Header.Get("Content-Type"); ct != "" {
+		mediaType, _, err := mime.ParseMediaType(ct)
+		if err == nil && mediaType != "video/mp4" && mediaType != "application/octet-stream" {
+			respondWithErrorCode(w, http.StatusUnsupportedMediaType, codeUnsupportedMediaType, "Invalid file type", fmt.Errorf("remote content type %s", mediaType))
+			return
+		}
+	}
+
+	if err := cfg.checkScratchSpace(resp.ContentLength); err != nil {
+		respondWithScratchFull(w, err)
+		return
+	}
+
+	tmpFile, err := os.CreateTemp(cfg.scratchDir, "tubely-video-import.mp4")
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create temp dir", err)
+		return
+	}
+	defer os.Remove(tmpFile.Name())
+	defer tmpFile.Close()
+	n, checksum, err := copyWithChecksum(tmpFile, io.LimitReader(resp.Body, cfg.maxVideoUploadSize+1))
+	if isScratchFull(err) {
+		respondWithScratchFull(w, err)
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusBadGateway, "Couldn't download video", err)
+		return
+	}
+	if n > cfg.maxVideoUploadSize {
+		respondWithError(w, http.StatusRequestEntityTooLarge, "Video exceeds the upload size limit", nil)
+		return
+	}
+
+	head, err := readHead(tmpFile)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't read file", err)
+		return
+	}
+	if sniffed := sniffVideoType(head); sniffed != "video/mp4" {
+		respondWithErrorCode(w, http.StatusUnsupportedMediaType, codeUnsupportedMediaType, "Imported file isn't an MP4 video", fmt.Errorf("detected %q", sniffed))
+		return
+	}
+
+	// Keep the original in S3 so it can be reprocessed if anything below fails
+	filename := originalFilename(path.Base(sourceURL.Path))
+	dbVideo, err = cfg.stageOriginal(ctx, dbVideo, func(v *database.Video) {
+		v.OriginalFilename = filename
+	}, tmpFile.Name(), "video/mp4", checksum)
+	if err != nil {
+		respondWithPipelineError(w, uploadFailure(ctx, &pipelineError{"stage", http.StatusInternalServerError, "Couldn't stage original video", err}))
+		return
+	}
+
+	oldVideoKey := stringOrEmpty(dbVideo.VideoKey)
+	dbVideo, err = cfg.processVideo(ctx, dbVideo, tmpFile.Name(), "video/mp4", storageClass)
+	if err != nil {
+		respondWithPipelineError(w, uploadFailure(ctx, err))
+		return
+	}
+	cfg.audit(r, userID, "video.import", "video", videoID.String(), fmt.Sprintf("video_key: %q -> %q, source host: %s", oldVideoKey, stringOrEmpty(dbVideo.VideoKey), sourceURL.Host))
+
+	cfg.respondWithVideo(w, r, http.StatusOK, dbVideo)
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+func (cfg *apiConfig) handlerVideoLike(w http.ResponseWriter, r *http.Request) {
+	cfg.setVideoLike(w, r, true)
+}
+
+func (cfg *apiConfig) handlerVideoUnlike(w http.ResponseWriter, r *http.Request) {
+	cfg.setVideoLike(w, r, false)
+}
+
+// setVideoLike likes or unlikes a video for the caller and responds with
+// the video's updated counts. Both directions are idempotent.
+func (cfg *apiConfig) setVideoLike(w http.ResponseWriter, r *http.Request, like bool) {
+	videoIDString := r.PathValue("videoID")
+	videoID, err := uuid.Parse(videoIDString)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid ID", err)
+		return
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := cfg.validateJWT(token)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+	if video.ID == uuid.Nil || (video.Visibility == database.VisibilityPrivate && !cfg.canViewVideo(video, userID)) {
+		respondWithError(w, http.StatusNotFound, "Couldn't get video", nil)
+		return
+	}
+
+	action := "video.like"
+	if like {
+		err = cfg.db.LikeVideo(videoID, userID)
+	} else {
+		action = "video.unlike"
+		err = cfg.db.UnlikeVideo(videoID, userID)
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't update like", err)
+		return
+	}
+	cfg.audit(r, userID, action, "video", videoID.String(), "")
+
+	video, err = cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+	if video.ID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, "Couldn't get video", nil)
+		return
+	}
+
+	cfg.respondWithVideo(w, r, http.StatusOK, video)
+}
+
+func (cfg *apiConfig) handlerLikedVideosRetrieve(w http.ResponseWriter, r *http.Request) {
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := cfg.validateJWT(token)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	page, err := cfg.parsePage(r.URL.Query())
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid page", err)
+		return
+	}
+
+	videos, next, err := cfg.db.GetLikedVideos(userID, page)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't retrieve videos", err)
+		return
+	}
+	videos, err = cfg.signVideos(accessContext(r, userID), videos)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't sign video URLs", err)
+		return
+	}
+
+	respondWithPage(w, videos, next)
+}
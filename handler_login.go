@@ -2,6 +2,7 @@ package main
 
 import (
 	"encoding/json"
+	"fmt"
 	"net/http"
 	"time"
 
@@ -28,6 +29,21 @@ func (cfg *apiConfig) handlerLogin(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// A locked out account or IP doesn't get its password checked at all,
+	// so guessing on can't tell when it's right
+	retryAfter, failures, err := cfg.checkLoginLockout(r, params.Email)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't check failed logins", err)
+		return
+	}
+	if retryAfter > 0 {
+		respondWithLoginLocked(w, retryAfter)
+		return
+	}
+	if failures >= cfg.captchaAfterFailures && !cfg.checkCaptcha(w, r) {
+		return
+	}
+
 	user, err := cfg.db.GetUserByEmail(params.Email)
 	if err != nil {
 		respondWithError(w, http.StatusUnauthorized, "Incorrect email or password", err)
@@ -36,28 +52,48 @@ func (cfg *apiConfig) handlerLogin(w http.ResponseWriter, r *http.Request) {
 
 	match, err := auth.CheckPasswordHash(params.Password, user.Password)
 	if err != nil {
+		cfg.recordLoginFailure(r, params.Email, user.ID)
 		respondWithError(w, http.StatusUnauthorized, "Incorrect email or password", err)
 		return
 	}
 	if !match {
+		cfg.recordLoginFailure(r, params.Email, user.ID)
 		respondWithError(w, http.StatusUnauthorized, "Incorrect email or password", nil)
 		return
 	}
+	cfg.clearLoginFailures(params.Email)
 
-	accessToken, err := auth.MakeJWT(
+	accessToken, refreshToken, err := cfg.issueTokens(user)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create session tokens", err)
+		return
+	}
+
+	cfg.audit(r, user.ID, "user.login", "user", user.ID.String(), "password login")
+
+	respondWithJSON(w, http.StatusOK, response{
+		User:         user,
+		Token:        accessToken,
+		RefreshToken: refreshToken,
+	})
+}
+
+// issueTokens creates an access JWT and a stored refresh token for a
+// freshly authenticated user.
+func (cfg *apiConfig) issueTokens(user database.User) (accessToken, refreshToken string, err error) {
+	accessToken, err = auth.MakeJWT(
 		user.ID,
+		user.TokenVersion,
 		cfg.jwtSecret,
 		time.Hour*24*30,
 	)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't create access JWT", err)
-		return
+		return "", "", fmt.Errorf("couldn't create access JWT: %w", err)
 	}
 
-	refreshToken, err := auth.MakeRefreshToken()
+	refreshToken, err = auth.MakeRefreshToken()
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't create refresh token", err)
-		return
+		return "", "", fmt.Errorf("couldn't create refresh token: %w", err)
 	}
 
 	_, err = cfg.db.CreateRefreshToken(database.CreateRefreshTokenParams{
@@ -66,13 +102,7 @@ func (cfg *apiConfig) handlerLogin(w http.ResponseWriter, r *http.Request) {
 		ExpiresAt: time.Now().UTC().Add(time.Hour * 24 * 60),
 	})
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't save refresh token", err)
-		return
+		return "", "", fmt.Errorf("couldn't save refresh token: %w", err)
 	}
-
-	respondWithJSON(w, http.StatusOK, response{
-		User:         user,
-		Token:        accessToken,
-		RefreshToken: refreshToken,
-	})
+	return accessToken, refreshToken, nil
 }
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// notificationPollInterval is how often the stream checks for new
+// notifications. Like the audit stream it polls the table, so it sees
+// notifications created by any app instance.
+const notificationPollInterval = 2 * time.Second
+
+// handlerNotificationsList pages through the user's notifications, newest
+// first. unread=true leaves out the ones already read.
+func (cfg *apiConfig) handlerNotificationsList(w http.ResponseWriter, r *http.Request) {
+	userID, ok := cfg.authenticate(w, r)
+	if !ok {
+		return
+	}
+
+	q := r.URL.Query()
+	unreadOnly := false
+	if v := q.Get("unread"); v != "" {
+		var err error
+		unreadOnly, err = strconv.ParseBool(v)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid unread filter", err)
+			return
+		}
+	}
+	page, err := cfg.parsePage(q)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid page", err)
+		return
+	}
+
+	notifications, next, err := cfg.db.GetNotifications(userID, unreadOnly, page)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get notifications", err)
+		return
+	}
+	respondWithPage(w, notifications, next)
+}
+
+// handlerNotificationsUnreadCount is what a notification bell shows.
+func (cfg *apiConfig) handlerNotificationsUnreadCount(w http.ResponseWriter, r *http.Request) {
+	type response struct {
+		Unread int `json:"unread"`
+	}
+
+	userID, ok := cfg.authenticate(w, r)
+	if !ok {
+		return
+	}
+	n, err := cfg.db.CountUnreadNotifications(userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't count notifications", err)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, response{Unread: n})
+}
+
+func (cfg *apiConfig) handlerNotificationRead(w http.ResponseWriter, r *http.Request) {
+	userID, ok := cfg.authenticate(w, r)
+	if !ok {
+		return
+	}
+	id, err := strconv.ParseInt(r.PathValue("notificationID"), 10, 64)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid notification ID", err)
+		return
+	}
+
+	found, err := cfg.db.MarkNotificationRead(userID, id)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't mark notification read", err)
+		return
+	}
+	if !found {
+		respondWithError(w, http.StatusNotFound, "Couldn't get notification", nil)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (cfg *apiConfig) handlerNotificationsReadAll(w http.ResponseWriter, r *http.Request) {
+	userID, ok := cfg.authenticate(w, r)
+	if !ok {
+		return
+	}
+	if err := cfg.db.MarkAllNotificationsRead(userID); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't mark notifications read", err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handlerNotificationsStream sends the user's notifications as
+// server-sent events as they're created. Each event's id is the
+// notification's, so a reconnecting browser picks up where it left off.
+func (cfg *apiConfig) handlerNotificationsStream(w http.ResponseWriter, r *http.Request) {
+	userID, ok := cfg.authenticate(w, r)
+	if !ok {
+		return
+	}
+
+	var afterID int64
+	if v := r.Header.Get("Last-Event-ID"); v != "" {
+		id, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid Last-Event-ID", err)
+			return
+		}
+		afterID = id
+	} else {
+		// New streams start from now; earlier ones are in the list
+		latest, err := cfg.db.LatestNotificationID(userID)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't get notifications", err)
+			return
+		}
+		afterID = latest
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		respondWithError(w, http.StatusInternalServerError, "Streaming isn't supported", nil)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	ticker := time.NewTicker(notificationPollInterval)
+	defer ticker.Stop()
+	for {
+		notifications, err := cfg.db.GetNotificationsAfter(userID, afterID, 100)
+		if err != nil {
+			fmt.Fprintf(w, "event: error\ndata: %q\n\n", "couldn't get notifications")
+			flusher.Flush()
+			return
+		}
+		for _, n := range notifications {
+			dat, err := json.Marshal(n)
+			if err != nil {
+				continue
+			}
+			fmt.Fprintf(w, "id: %d\ndata: %s\n\n", n.ID, dat)
+			afterID = n.ID
+		}
+		if len(notifications) > 0 {
+			flusher.Flush()
+		}
+
+		select {
+		case <-r.Context().Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
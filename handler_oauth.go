@@ -0,0 +1,161 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"golang.org/x/oauth2"
+)
+
+const oauthCookieName = "tubely_oauth"
+
+// handlerOAuthLogin redirects the browser to the provider's consent page.
+// The state and PKCE verifier are kept in a short-lived cookie so the
+// callback can be handled by any app instance.
+func (cfg *apiConfig) handlerOAuthLogin(w http.ResponseWriter, r *http.Request) {
+	provider, ok := cfg.oauthProviders[r.PathValue("provider")]
+	if !ok {
+		respondWithError(w, http.StatusNotFound, "Unknown login provider", nil)
+		return
+	}
+
+	state, err := auth.MakeRefreshToken()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create login state", err)
+		return
+	}
+	verifier := oauth2.GenerateVerifier()
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     oauthCookieName,
+		Value:    state + "." + verifier,
+		Path:     "/api/",
+		MaxAge:   int((10 * time.Minute).Seconds()),
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	redirectURL := provider.config.AuthCodeURL(state, oauth2.S256ChallengeOption(verifier))
+	http.Redirect(w, r, redirectURL, http.StatusFound)
+}
+
+// handlerOAuthCallback finishes the login, linking the provider account to
+// an existing user by verified email or creating a new user, and hands the
+// session tokens to the web app in the URL fragment.
+func (cfg *apiConfig) handlerOAuthCallback(w http.ResponseWriter, r *http.Request) {
+	providerName := r.PathValue("provider")
+	provider, ok := cfg.oauthProviders[providerName]
+	if !ok {
+		respondWithError(w, http.StatusNotFound, "Unknown login provider", nil)
+		return
+	}
+
+	cookie, err := r.Cookie(oauthCookieName)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Login session expired", err)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{Name: oauthCookieName, Path: "/api/", MaxAge: -1})
+
+	state, verifier, ok := strings.Cut(cookie.Value, ".")
+	if !ok || state == "" || r.URL.Query().Get("state") != state {
+		respondWithError(w, http.StatusBadRequest, "Invalid login state", nil)
+		return
+	}
+	if errMsg := r.URL.Query().Get("error"); errMsg != "" {
+		respondWithError(w, http.StatusUnauthorized, "Login was not approved", errors.New(errMsg))
+		return
+	}
+
+	token, err := provider.config.Exchange(r.Context(), r.URL.Query().Get("code"), oauth2.VerifierOption(verifier))
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't complete login", err)
+		return
+	}
+
+	identity, err := provider.fetchIdentity(r.Context(), provider.config.Client(r.Context(), token))
+	if err != nil {
+		respondWithError(w, http.StatusBadGateway, "Couldn't fetch account from provider", err)
+		return
+	}
+
+	user, err := cfg.db.GetUserByIdentity(providerName, identity.Subject)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't look up user", err)
+		return
+	}
+	if user == nil {
+		// Linking by email is only safe when the provider vouches for it
+		if identity.Email == "" || !identity.EmailVerified {
+			respondWithError(w, http.StatusForbidden, "Provider account has no verified email", nil)
+			return
+		}
+		user, err = cfg.findOrCreateOAuthUser(identity.Email)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't create user", err)
+			return
+		}
+		err = cfg.db.CreateUserIdentity(database.CreateUserIdentityParams{
+			Provider: providerName,
+			Subject:  identity.Subject,
+			UserID:   user.ID,
+			Email:    identity.Email,
+		})
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't link account", err)
+			return
+		}
+		cfg.audit(r, user.ID, "user.link_identity", "user", user.ID.String(), "linked "+providerName+" account")
+
+		// The provider confirmed the address, so there's nothing left to verify
+		err = cfg.db.SetUserVerified(user.ID)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't verify user", err)
+			return
+		}
+	}
+
+	accessToken, refreshToken, err := cfg.issueTokens(*user)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create session tokens", err)
+		return
+	}
+
+	cfg.audit(r, user.ID, "user.login", "user", user.ID.String(), "oauth login via "+providerName)
+
+	fragment := url.Values{}
+	fragment.Set("token", accessToken)
+	fragment.Set("refresh_token", refreshToken)
+	http.Redirect(w, r, "/app/#"+fragment.Encode(), http.StatusFound)
+}
+
+// findOrCreateOAuthUser returns the user registered with email, creating
+// one with an unusable random password if there is none.
+func (cfg *apiConfig) findOrCreateOAuthUser(email string) (*database.User, error) {
+	existing, err := cfg.db.GetUserByEmail(email)
+	if err != nil {
+		return nil, err
+	}
+	if existing.Email != "" {
+		return &existing, nil
+	}
+
+	randomPassword, err := auth.MakeRefreshToken()
+	if err != nil {
+		return nil, err
+	}
+	hashedPassword, err := auth.HashPassword(randomPassword)
+	if err != nil {
+		return nil, err
+	}
+	return cfg.db.CreateUser(database.CreateUserParams{
+		Email:    email,
+		Password: hashedPassword,
+	})
+}
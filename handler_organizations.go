@@ -0,0 +1,419 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/mail"
+	"strings"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+const (
+	maxOrganizationNameLength = 100
+	orgInvitationTTL          = 7 * 24 * time.Hour
+)
+
+// handlerOrganizationCreate creates an organization with the user as its
+// owner.
+func (cfg *apiConfig) handlerOrganizationCreate(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Name string `json:"name"`
+	}
+
+	userID, ok := cfg.authenticate(w, r)
+	if !ok {
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err := decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters", err)
+		return
+	}
+	params.Name = strings.TrimSpace(params.Name)
+	if params.Name == "" {
+		respondWithError(w, http.StatusBadRequest, "Organization name is required", nil)
+		return
+	}
+	if len(params.Name) > maxOrganizationNameLength {
+		respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Organization name can be at most %d characters", maxOrganizationNameLength), nil)
+		return
+	}
+
+	org, err := cfg.db.CreateOrganization(params.Name, userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create organization", err)
+		return
+	}
+	org.Role = database.OrgRoleOwner
+	cfg.audit(r, userID, "org.create", "organization", org.ID.String(), fmt.Sprintf("name: %q", org.Name))
+
+	respondWithJSON(w, http.StatusCreated, org)
+}
+
+// handlerOrganizationsList lists the organizations the user is a member
+// of, with their role in each.
+func (cfg *apiConfig) handlerOrganizationsList(w http.ResponseWriter, r *http.Request) {
+	userID, ok := cfg.authenticate(w, r)
+	if !ok {
+		return
+	}
+
+	orgs, err := cfg.db.GetUserOrganizations(userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get organizations", err)
+		return
+	}
+	// Users belong to few enough organizations that they fit on one page
+	respondWithPage(w, orgs, nil)
+}
+
+func (cfg *apiConfig) handlerOrganizationGet(w http.ResponseWriter, r *http.Request) {
+	type response struct {
+		database.Organization
+		Members []database.OrganizationMember `json:"members"`
+	}
+
+	org, _, ok := cfg.orgMember(w, r, database.OrgRoleViewer)
+	if !ok {
+		return
+	}
+	members, err := cfg.db.GetOrganizationMembers(org.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get organization members", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, response{Organization: org, Members: members})
+}
+
+// handlerOrganizationVideosList lists an organization's videos for its
+// members, private ones included.
+func (cfg *apiConfig) handlerOrganizationVideosList(w http.ResponseWriter, r *http.Request) {
+	org, userID, ok := cfg.orgMember(w, r, database.OrgRoleViewer)
+	if !ok {
+		return
+	}
+
+	page, err := cfg.parsePage(r.URL.Query())
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid page", err)
+		return
+	}
+
+	videos, next, err := cfg.db.GetOrganizationVideos(org.ID, page)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't retrieve videos", err)
+		return
+	}
+	videos, err = cfg.signVideos(accessContext(r, userID), videos)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't sign video URLs", err)
+		return
+	}
+
+	respondWithPage(w, videos, next)
+}
+
+// handlerOrganizationInvitationCreate emails a single-use token that adds
+// whoever has the address to the organization, once they accept it while
+// logged in.
+func (cfg *apiConfig) handlerOrganizationInvitationCreate(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Email string `json:"email"`
+		// Role defaults to viewer
+		Role string `json:"role"`
+	}
+
+	org, userID, ok := cfg.orgMember(w, r, database.OrgRoleOwner)
+	if !ok {
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err := decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters", err)
+		return
+	}
+	if _, err := mail.ParseAddress(params.Email); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid email address", err)
+		return
+	}
+	if params.Role == "" {
+		params.Role = database.OrgRoleViewer
+	}
+	if !validOrgRole(params.Role) {
+		respondWithError(w, http.StatusBadRequest, "Role must be owner, editor or viewer", nil)
+		return
+	}
+
+	// Invitations are matched to accounts ignoring case, so members are too
+	members, err := cfg.db.GetOrganizationMembers(org.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get organization members", err)
+		return
+	}
+	for _, m := range members {
+		if strings.EqualFold(m.Email, params.Email) {
+			respondWithError(w, http.StatusConflict, "User is already a member of the organization", nil)
+			return
+		}
+	}
+
+	token, err := auth.MakeRefreshToken()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create invitation token", err)
+		return
+	}
+	invitation, err := cfg.db.CreateOrganizationInvitation(database.CreateOrganizationInvitationParams{
+		OrgID:     org.ID,
+		Email:     params.Email,
+		Role:      params.Role,
+		InvitedBy: userID,
+		TokenHash: auth.HashToken(token),
+		ExpiresAt: time.Now().Add(orgInvitationTTL),
+	})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create invitation", err)
+		return
+	}
+	cfg.audit(r, userID, "org.invite", "organization", org.ID.String(), fmt.Sprintf("invited %s as %s", invitation.Email, invitation.Role))
+
+	go func() {
+		body := fmt.Sprintf(
+			"You've been invited to join %q on Tubely with the %s role. Accept within %s by logging in and using this token:\n\n%s\n\nIf you weren't expecting this, you can ignore this email.",
+			org.Name, invitation.Role, orgInvitationTTL, token,
+		)
+		err := cfg.mailer.Send(context.Background(), invitation.Email, "You're invited to a Tubely organization", body)
+		if err != nil {
+			log.Printf("Couldn't send organization invitation email: %v", err)
+		}
+	}()
+
+	respondWithJSON(w, http.StatusCreated, invitation)
+}
+
+func (cfg *apiConfig) handlerOrganizationInvitationsList(w http.ResponseWriter, r *http.Request) {
+	org, _, ok := cfg.orgMember(w, r, database.OrgRoleOwner)
+	if !ok {
+		return
+	}
+	invitations, err := cfg.db.GetOrganizationInvitations(org.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get invitations", err)
+		return
+	}
+	respondWithPage(w, invitations, nil)
+}
+
+func (cfg *apiConfig) handlerOrganizationInvitationDelete(w http.ResponseWriter, r *http.Request) {
+	org, userID, ok := cfg.orgMember(w, r, database.OrgRoleOwner)
+	if !ok {
+		return
+	}
+	invitationID, err := uuid.Parse(r.PathValue("invitationID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid invitation ID", err)
+		return
+	}
+	invitation, err := cfg.db.GetOrganizationInvitation(invitationID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get invitation", err)
+		return
+	}
+	if invitation.ID == uuid.Nil || invitation.OrgID != org.ID {
+		respondWithError(w, http.StatusNotFound, "Couldn't get invitation", nil)
+		return
+	}
+	if err := cfg.db.DeleteOrganizationInvitation(invitation.ID); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't delete invitation", err)
+		return
+	}
+	cfg.audit(r, userID, "org.invite_revoke", "organization", org.ID.String(), fmt.Sprintf("revoked invitation of %s", invitation.Email))
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handlerOrganizationInvitationAccept adds the user to the organization
+// of an invitation sent to their email address. Members who already have
+// a role at least as high keep it.
+func (cfg *apiConfig) handlerOrganizationInvitationAccept(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Token string `json:"token"`
+	}
+
+	userID, ok := cfg.authenticate(w, r)
+	if !ok {
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err := decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters", err)
+		return
+	}
+
+	invitation, err := cfg.db.GetOrganizationInvitationByToken(auth.HashToken(params.Token))
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get invitation", err)
+		return
+	}
+	if invitation.ID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, "Invitation is invalid or has expired", nil)
+		return
+	}
+	user, err := cfg.db.GetUser(userID)
+	if err != nil || user == nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get user", err)
+		return
+	}
+	if !strings.EqualFold(user.Email, invitation.Email) {
+		respondWithError(w, http.StatusForbidden, "Invitation was sent to a different email address", nil)
+		return
+	}
+
+	role, err := cfg.db.GetOrganizationRole(invitation.OrgID, userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get organization", err)
+		return
+	}
+	if !roleAtLeast(role, invitation.Role) {
+		if err := cfg.db.SetOrganizationMemberRole(invitation.OrgID, userID, invitation.Role); err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't add organization member", err)
+			return
+		}
+		role = invitation.Role
+	}
+	if err := cfg.db.DeleteOrganizationInvitation(invitation.ID); err != nil {
+		log.Printf("Couldn't delete accepted invitation %s: %v", invitation.ID, err)
+	}
+	cfg.audit(r, userID, "org.join", "organization", invitation.OrgID.String(), fmt.Sprintf("joined as %s", role))
+
+	org, err := cfg.db.GetOrganization(invitation.OrgID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get organization", err)
+		return
+	}
+	org.Role = role
+	respondWithJSON(w, http.StatusOK, org)
+}
+
+// handlerOrganizationMemberUpdate changes a member's role. The last owner
+// can't be demoted, so someone can always manage the organization.
+func (cfg *apiConfig) handlerOrganizationMemberUpdate(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Role string `json:"role"`
+	}
+
+	org, userID, ok := cfg.orgMember(w, r, database.OrgRoleOwner)
+	if !ok {
+		return
+	}
+	memberID, err := uuid.Parse(r.PathValue("userID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid user ID", err)
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err = decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters", err)
+		return
+	}
+	if !validOrgRole(params.Role) {
+		respondWithError(w, http.StatusBadRequest, "Role must be owner, editor or viewer", nil)
+		return
+	}
+
+	role, ok := cfg.orgMemberRole(w, org.ID, memberID)
+	if !ok {
+		return
+	}
+	if role == database.OrgRoleOwner && params.Role != database.OrgRoleOwner && !cfg.hasOtherOwner(w, org.ID) {
+		return
+	}
+	if err := cfg.db.SetOrganizationMemberRole(org.ID, memberID, params.Role); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't update organization member", err)
+		return
+	}
+	cfg.audit(r, userID, "org.member_role", "organization", org.ID.String(), fmt.Sprintf("member %s: %s -> %s", memberID, role, params.Role))
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handlerOrganizationMemberRemove removes a member. Owners can remove
+// anyone and any member can remove themselves, except the last owner.
+func (cfg *apiConfig) handlerOrganizationMemberRemove(w http.ResponseWriter, r *http.Request) {
+	org, userID, ok := cfg.orgMember(w, r, database.OrgRoleViewer)
+	if !ok {
+		return
+	}
+	memberID, err := uuid.Parse(r.PathValue("userID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid user ID", err)
+		return
+	}
+	if memberID != userID && org.Role != database.OrgRoleOwner {
+		respondWithErrorCode(w, http.StatusForbidden, codeNotOwner, "Only owners can remove other members", nil)
+		return
+	}
+
+	role, ok := cfg.orgMemberRole(w, org.ID, memberID)
+	if !ok {
+		return
+	}
+	if role == database.OrgRoleOwner && !cfg.hasOtherOwner(w, org.ID) {
+		return
+	}
+	if err := cfg.db.RemoveOrganizationMember(org.ID, memberID); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't remove organization member", err)
+		return
+	}
+	cfg.audit(r, userID, "org.member_remove", "organization", org.ID.String(), fmt.Sprintf("member %s (%s) removed", memberID, role))
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// orgMemberRole returns a member's role, writing a 404 if they aren't one.
+func (cfg *apiConfig) orgMemberRole(w http.ResponseWriter, orgID, memberID uuid.UUID) (string, bool) {
+	role, err := cfg.db.GetOrganizationRole(orgID, memberID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get organization member", err)
+		return "", false
+	}
+	if role == "" {
+		respondWithError(w, http.StatusNotFound, "Couldn't get organization member", nil)
+		return "", false
+	}
+	return role, true
+}
+
+// hasOtherOwner reports whether an organization has more than one owner,
+// writing a 409 if one of them is about to stop being one and it doesn't.
+func (cfg *apiConfig) hasOtherOwner(w http.ResponseWriter, orgID uuid.UUID) bool {
+	owners, err := cfg.db.CountOrganizationOwners(orgID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get organization members", err)
+		return false
+	}
+	if owners <= 1 {
+		respondWithError(w, http.StatusConflict, "An organization needs at least one owner", nil)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+const passwordResetTokenTTL = time.Hour
+
+// handlerPasswordResetRequest emails a reset token to the given address.
+// It responds the same way whether or not the account exists so it can't be
+// used to discover registered emails.
+func (cfg *apiConfig) handlerPasswordResetRequest(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Email string `json:"email"`
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err := decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters", err)
+		return
+	}
+	if params.Email == "" {
+		respondWithError(w, http.StatusBadRequest, "Email is required", nil)
+		return
+	}
+
+	if !cfg.passwordResetLimiter.allow("ip:"+clientIP(r)) ||
+		!cfg.passwordResetLimiter.allow("email:"+strings.ToLower(params.Email)) {
+		respondWithError(w, http.StatusTooManyRequests, "Too many password reset requests, try again later", nil)
+		return
+	}
+
+	user, err := cfg.db.GetUserByEmail(params.Email)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't look up user", err)
+		return
+	}
+	if user.Email != "" {
+		token, err := auth.MakeRefreshToken()
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't create reset token", err)
+			return
+		}
+		err = cfg.db.CreateUserToken(database.CreateUserTokenParams{
+			TokenHash: auth.HashToken(token),
+			Purpose:   database.TokenPurposePasswordReset,
+			UserID:    user.ID,
+			ExpiresAt: time.Now().Add(passwordResetTokenTTL),
+		})
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't save reset token", err)
+			return
+		}
+
+		cfg.audit(r, user.ID, "user.password_reset_request", "user", user.ID.String(), "reset email requested")
+
+		// Send in the background so response time doesn't reveal whether
+		// the account exists
+		go func() {
+			body := fmt.Sprintf(
+				"Someone asked to reset your Tubely password. Use this token within %s to choose a new one:\n\n%s\n\nIf this wasn't you, you can ignore this email.",
+				passwordResetTokenTTL, token,
+			)
+			err := cfg.mailer.Send(context.Background(), user.Email, "Reset your Tubely password", body)
+			if err != nil {
+				log.Printf("Couldn't send password reset email: %v", err)
+			}
+		}()
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (cfg *apiConfig) handlerPasswordResetConfirm(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Token    string `json:"token"`
+		Password string `json:"password"`
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err := decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters", err)
+		return
+	}
+	if params.Token == "" || params.Password == "" {
+		respondWithError(w, http.StatusBadRequest, "Token and password are required", nil)
+		return
+	}
+
+	userID, err := cfg.db.ConsumeUserToken(auth.HashToken(params.Token), database.TokenPurposePasswordReset)
+	if errors.Is(err, database.ErrTokenInvalid) {
+		respondWithError(w, http.StatusBadRequest, "Reset token is invalid or expired", err)
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't check reset token", err)
+		return
+	}
+
+	hashedPassword, err := auth.HashPassword(params.Password)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't hash password", err)
+		return
+	}
+	err = cfg.db.UpdateUserPassword(userID, hashedPassword)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't update password", err)
+		return
+	}
+
+	// Whoever had the old password may still be signed in
+	err = cfg.revokeAllSessions(userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't revoke sessions", err)
+		return
+	}
+	cfg.audit(r, userID, "user.password_reset", "user", userID.String(), "password changed with reset token")
+
+	// Whoever reset the password owns the email, so their lockout can go
+	user, err := cfg.db.GetUser(userID)
+	if err != nil {
+		log.Printf("Couldn't get user %s to clear failed logins: %v", userID, err)
+	} else if user != nil {
+		cfg.clearLoginFailures(user.Email)
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/envelope"
+	"github.com/google/uuid"
+)
+
+const (
+	// playbackProxy streams playback through the app with the token in
+	// the URL
+	playbackProxy = "proxy"
+	// playbackCloudFront sets CloudFront signed cookies and plays from
+	// the CDN
+	playbackCloudFront = "cloudfront"
+)
+
+// handlerVideoPlayback authorizes the caller to watch a video and returns
+// URLs that only work for them, from their address, until expires_at.
+func (cfg *apiConfig) handlerVideoPlayback(w http.ResponseWriter, r *http.Request) {
+	type response struct {
+		VideoURL  string    `json:"video_url"`
+		DashURL   *string   `json:"dash_url"`
+		ExpiresAt time.Time `json:"expires_at"`
+	}
+
+	videoIDString := r.PathValue("videoID")
+	videoID, err := uuid.Parse(videoIDString)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid video ID", err)
+		return
+	}
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+	if video.ID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, "Couldn't get video", nil)
+		return
+	}
+	viewerID := cfg.optionalUserID(r)
+	if video.Visibility == database.VisibilityPrivate && !cfg.canViewVideo(video, viewerID) {
+		cfg.logRequestAccess(r, viewerID, video.ID, accessPlayback, accessDeniedPrivate)
+		respondWithError(w, http.StatusNotFound, "Couldn't get video", nil)
+		return
+	}
+	if block := cfg.checkGeoRestriction(r, video); block != nil {
+		cfg.logRequestAccess(r, viewerID, video.ID, accessPlayback, string(block.code))
+		respondWithGeoBlock(w, block)
+		return
+	}
+	key, ok := videoObjectKey(video)
+	if !ok {
+		respondWithErrorCode(w, http.StatusConflict, codeVideoNotUploaded, "Video has no uploaded file yet", nil)
+		return
+	}
+
+	expiresAt := time.Now().UTC().Add(cfg.playbackTokenTTL).Truncate(time.Second)
+	var ip string
+	if cfg.playbackBindIP {
+		ip = clientIP(r)
+	}
+
+	// The CDN would hand out encrypted bytes, so encrypted videos always
+	// play through the app
+	mode := cfg.playbackMode
+	if video.Encrypted {
+		mode = playbackProxy
+	}
+
+	var resp response
+	resp.ExpiresAt = expiresAt
+	switch mode {
+	case playbackCloudFront:
+		// One policy covers both the MP4 and the DASH files next to it
+		base := fmt.Sprintf("https://%s/", cfg.s3CfDistribution)
+		resource := base + strings.TrimSuffix(key, ".mp4") + "*"
+		cookies, err := cfg.cloudFrontSigner.cookies(resource, ip, expiresAt)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't sign playback cookies", err)
+			return
+		}
+		for _, c := range cookies {
+			http.SetCookie(w, c)
+		}
+		resp.VideoURL = base + key
+		if video.DashKey != nil {
+			dashURL := base + *video.DashKey
+			resp.DashURL = &dashURL
+		}
+	default:
+		token, err := auth.MakePlaybackToken(auth.PlaybackClaims{
+			VideoID:   video.ID,
+			UserID:    viewerID,
+			IP:        ip,
+			ExpiresAt: expiresAt,
+		}, cfg.jwtSecret)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't create playback token", err)
+			return
+		}
+		// The manifest refers to its segments relative to itself, so they
+		// resolve under the same token
+		base := "/api/v1/playback/" + token + "/"
+		resp.VideoURL = base + "video.mp4"
+		if video.DashKey != nil {
+			dashURL := base + "dash/" + dashManifestName
+			resp.DashURL = &dashURL
+		}
+	}
+
+	cfg.logRequestAccess(r, viewerID, video.ID, accessPlayback, "")
+	cfg.recordView(r, viewerID, video.ID)
+	w.Header().Set("Cache-Control", "no-store")
+	respondWithJSON(w, http.StatusOK, resp)
+}
+
+// handlerPlaybackStream serves a video's files to the holder of a playback
+// token, checking the token on every request.
+func (cfg *apiConfig) handlerPlaybackStream(w http.ResponseWriter, r *http.Request) {
+	claims, err := auth.ParsePlaybackToken(r.PathValue("token"), cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Invalid playback token", err)
+		return
+	}
+	if claims.IP != "" && claims.IP != clientIP(r) {
+		cfg.logRequestAccess(r, claims.UserID, claims.VideoID, accessProxy, accessDeniedIPMismatch)
+		respondWithError(w, http.StatusForbidden, "Playback token was issued to another address", nil)
+		return
+	}
+
+	video, err := cfg.db.GetVideo(claims.VideoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+	if video.ID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, "Couldn't get video", nil)
+		return
+	}
+	// The video may have been made private since the token was issued.
+	// Share links work for private videos, so their tokens still do.
+	if video.Visibility == database.VisibilityPrivate && !claims.Shared && !cfg.canViewVideo(video, claims.UserID) {
+		cfg.logRequestAccess(r, claims.UserID, video.ID, accessProxy, accessDeniedPrivate)
+		respondWithError(w, http.StatusNotFound, "Couldn't get video", nil)
+		return
+	}
+
+	var key string
+	var ok bool
+	file := r.PathValue("file")
+	switch {
+	case file == "video.mp4":
+		key, ok = videoObjectKey(video)
+	case strings.HasPrefix(file, "dash/"):
+		var prefix string
+		prefix, ok = videoDashPrefix(video)
+		name := strings.TrimPrefix(file, "dash/")
+		ok = ok && name != "" && !strings.Contains(name, "/")
+		key = prefix + name
+	}
+	if !ok {
+		respondWithError(w, http.StatusNotFound, "Couldn't find file", nil)
+		return
+	}
+
+	dataKey, err := cfg.videoDataKey(r.Context(), video)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video key", err)
+		return
+	}
+
+	cfg.logRequestAccess(r, claims.UserID, video.ID, accessProxy, "")
+	w.Header().Set("Cache-Control", "private, no-store")
+	cfg.streamObject(w, r, key, dataKey)
+}
+
+// streamObject copies an S3 object to the response, passing the client's
+// Range header through so players can seek. Objects of encrypted videos
+// are decrypted with dataKey on the way, fetching only the chunks the
+// requested range covers.
+func (cfg *apiConfig) streamObject(w http.ResponseWriter, r *http.Request, key string, dataKey []byte) {
+	if dataKey != nil {
+		cfg.streamDecrypted(w, r, key, dataKey)
+		return
+	}
+	input := &s3.GetObjectInput{
+		Bucket: &cfg.s3Bucket,
+		Key:    &key,
+	}
+	if rangeHeader := r.Header.Get("Range"); rangeHeader != "" {
+		input.Range = &rangeHeader
+	}
+	out, err := cfg.s3Client.GetObject(r.Context(), input)
+	if err != nil {
+		respondWithObjectError(w, err)
+		return
+	}
+	defer out.Body.Close()
+
+	h := w.Header()
+	h.Set("Accept-Ranges", "bytes")
+	if out.ContentType != nil {
+		h.Set("Content-Type", *out.ContentType)
+	}
+	if out.ContentLength != nil {
+		h.Set("Content-Length", strconv.FormatInt(*out.ContentLength, 10))
+	}
+	if out.ETag != nil {
+		h.Set("ETag", *out.ETag)
+	}
+	if out.LastModified != nil {
+		h.Set("Last-Modified", out.LastModified.UTC().Format(http.TimeFormat))
+	}
+	status := http.StatusOK
+	if out.ContentRange != nil {
+		h.Set("Content-Range", *out.ContentRange)
+		status = http.StatusPartialContent
+	}
+	w.WriteHeader(status)
+	if _, err := io.Copy(w, out.Body); err != nil && r.Context().Err() == nil {
+		log.Printf("Couldn't stream %s: %v", key, err)
+	}
+}
+
+// streamDecrypted serves an encrypted object decrypted. http.ServeContent
+// handles the Range header, seeking the decrypting reader to it.
+func (cfg *apiConfig) streamDecrypted(w http.ResponseWriter, r *http.Request, key string, dataKey []byte) {
+	obj, err := envelope.NewReader(cfg.objectSource(r.Context(), key), dataKey)
+	if errors.Is(err, envelope.ErrInvalid) {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't decrypt file", err)
+		return
+	}
+	if err != nil {
+		respondWithObjectError(w, err)
+		return
+	}
+	defer obj.Close()
+
+	contentType := "video/mp4"
+	switch path.Ext(key) {
+	case ".mpd":
+		contentType = "application/dash+xml"
+	case ".vtt":
+		contentType = "text/vtt"
+	}
+	w.Header().Set("Content-Type", contentType)
+	http.ServeContent(w, r, "", time.Time{}, obj)
+}
+
+// respondWithObjectError reports a failed GetObject.
+func respondWithObjectError(w http.ResponseWriter, err error) {
+	var respErr interface{ HTTPStatusCode() int }
+	if errors.As(err, &respErr) {
+		switch respErr.HTTPStatusCode() {
+		case http.StatusNotFound:
+			respondWithError(w, http.StatusNotFound, "Couldn't find file", err)
+			return
+		case http.StatusRequestedRangeNotSatisfiable:
+			respondWithError(w, http.StatusRequestedRangeNotSatisfiable, "Range not satisfiable", err)
+			return
+		}
+	}
+	respondWithError(w, http.StatusBadGateway, "Couldn't get file", err)
+}
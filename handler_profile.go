@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+const (
+	maxDisplayNameLength = 50
+	maxBioLength         = 500
+)
+
+// profile is the public view of a user. It leaves out the email address
+// and anything else private to the account.
+type profile struct {
+	ID          uuid.UUID `json:"id"`
+	CreatedAt   time.Time `json:"created_at"`
+	DisplayName string    `json:"display_name"`
+	AvatarURL   *string   `json:"avatar_url"`
+	Bio         string    `json:"bio"`
+}
+
+func publicProfile(user database.User) profile {
+	return profile{
+		ID:          user.ID,
+		CreatedAt:   user.CreatedAt,
+		DisplayName: user.DisplayName,
+		AvatarURL:   user.AvatarURL,
+		Bio:         user.Bio,
+	}
+}
+
+func (cfg *apiConfig) handlerProfileGet(w http.ResponseWriter, r *http.Request) {
+	userIDString := r.PathValue("userID")
+	userID, err := uuid.Parse(userIDString)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid ID", err)
+		return
+	}
+
+	user, err := cfg.db.GetUser(userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get user", err)
+		return
+	}
+	if user == nil {
+		respondWithError(w, http.StatusNotFound, "User not found", nil)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, publicProfile(*user))
+}
+
+// handlerChannelVideosRetrieve lists a user's published public videos.
+func (cfg *apiConfig) handlerChannelVideosRetrieve(w http.ResponseWriter, r *http.Request) {
+	userIDString := r.PathValue("userID")
+	userID, err := uuid.Parse(userIDString)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid ID", err)
+		return
+	}
+
+	page, err := cfg.parsePage(r.URL.Query())
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid page", err)
+		return
+	}
+
+	videos, next, err := cfg.db.GetPublicVideos(userID, page)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't retrieve videos", err)
+		return
+	}
+
+	respondWithPage(w, videos, next)
+}
+
+func (cfg *apiConfig) handlerProfileUpdate(w http.ResponseWriter, r *http.Request) {
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := cfg.validateJWT(token)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := database.UpdateUserProfileParams{}
+	err = decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters", err)
+		return
+	}
+	params.DisplayName = strings.TrimSpace(params.DisplayName)
+	params.Bio = strings.TrimSpace(params.Bio)
+	if len(params.DisplayName) > maxDisplayNameLength {
+		respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Display name can be at most %d characters", maxDisplayNameLength), nil)
+		return
+	}
+	if len(params.Bio) > maxBioLength {
+		respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Bio can be at most %d characters", maxBioLength), nil)
+		return
+	}
+
+	err = cfg.db.UpdateUserProfile(userID, params)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't update profile", err)
+		return
+	}
+	cfg.audit(r, userID, "user.profile_update", "user", userID.String(), fmt.Sprintf("display_name: %q", params.DisplayName))
+
+	cfg.respondWithProfile(w, userID)
+}
+
+// handlerAvatarUpload stores an avatar through the same checks and
+// metadata stripping as video thumbnails.
+func (cfg *apiConfig) handlerAvatarUpload(w http.ResponseWriter, r *http.Request) {
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := cfg.validateJWT(token)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	fileData, mediaType, ok := cfg.readImageUpload(w, r, "avatar", "Avatar", cfg.maxThumbnailUploadSize)
+	if !ok {
+		return
+	}
+	if mediaTypeToFileExt(mediaType) == "" {
+		respondWithError(w, http.StatusUnsupportedMediaType, "Unsupported media type", nil)
+		return
+	}
+	user, err := cfg.db.GetUser(userID)
+	if err != nil || user == nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get user", err)
+		return
+	}
+	avatarURL, err := cfg.saveImageAsset(bytes.NewReader(fileData), mediaType)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't save avatar file", err)
+		return
+	}
+
+	err = cfg.db.SetUserAvatar(userID, avatarURL)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't update avatar", err)
+		return
+	}
+	if user.AvatarURL != nil {
+		if err := cfg.removeLocalAsset(*user.AvatarURL); err != nil {
+			log.Printf("Couldn't remove old avatar %s: %v", *user.AvatarURL, err)
+		}
+	}
+	cfg.audit(r, userID, "user.avatar_upload", "user", userID.String(), fmt.Sprintf("avatar_url: %q", avatarURL))
+
+	cfg.respondWithProfile(w, userID)
+}
+
+func (cfg *apiConfig) respondWithProfile(w http.ResponseWriter, userID uuid.UUID) {
+	user, err := cfg.db.GetUser(userID)
+	if err != nil || user == nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get user", err)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, publicProfile(*user))
+}
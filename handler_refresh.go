@@ -5,6 +5,7 @@ import (
 	"time"
 
 	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/google/uuid"
 )
 
 func (cfg *apiConfig) handlerRefresh(w http.ResponseWriter, r *http.Request) {
@@ -23,9 +24,14 @@ func (cfg *apiConfig) handlerRefresh(w http.ResponseWriter, r *http.Request) {
 		respondWithError(w, http.StatusUnauthorized, "Couldn't get user for refresh token", err)
 		return
 	}
+	if user == nil {
+		respondWithError(w, http.StatusUnauthorized, "Refresh token is invalid, expired or revoked", nil)
+		return
+	}
 
 	accessToken, err := auth.MakeJWT(
 		user.ID,
+		user.TokenVersion,
 		cfg.jwtSecret,
 		time.Hour,
 	)
@@ -46,11 +52,20 @@ func (cfg *apiConfig) handlerRevoke(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	storedToken, err := cfg.db.GetRefreshToken(refreshToken)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get session", err)
+		return
+	}
+
 	err = cfg.db.RevokeRefreshToken(refreshToken)
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Couldn't revoke session", err)
 		return
 	}
+	if storedToken.UserID != uuid.Nil {
+		cfg.audit(r, storedToken.UserID, "user.revoke_session", "user", storedToken.UserID.String(), "revoked refresh token")
+	}
 
 	w.WriteHeader(http.StatusNoContent)
 }
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// handlerReprocessVideo runs the staged original of a video through the
+// processing pipeline again, e.g. after ffmpeg or S3 failed mid-upload.
+// Admins can reprocess many videos at once with a reprocess batch.
+func (cfg *apiConfig) handlerReprocessVideo(w http.ResponseWriter, r *http.Request) {
+	videoIDString := r.PathValue("videoID")
+	videoID, err := uuid.Parse(videoIDString)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid ID", err)
+		return
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := cfg.validateJWT(token)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	dbVideo, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+	if dbVideo.ID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, "Couldn't get video", nil)
+		return
+	}
+	if !cfg.authorizeVideo(w, dbVideo, userID, database.OrgRoleEditor, "Video not owned by user") {
+		return
+	}
+	if dbVideo.StagingKey == nil {
+		respondWithError(w, http.StatusConflict, "Video has no staged original to reprocess", nil)
+		return
+	}
+	ctx, release, ok := cfg.claimVideoUpload(w, r, videoID)
+	if !ok {
+		return
+	}
+	defer release()
+
+	oldVideoKey := stringOrEmpty(dbVideo.VideoKey)
+	dbVideo, err = cfg.reprocessVideo(ctx, dbVideo)
+	if isScratchFull(err) {
+		respondWithScratchFull(w, err)
+		return
+	}
+	if err != nil {
+		respondWithPipelineError(w, uploadFailure(ctx, err))
+		return
+	}
+	cfg.audit(r, userID, "video.reprocess", "video", videoID.String(), fmt.Sprintf("video_key: %q -> %q", oldVideoKey, stringOrEmpty(dbVideo.VideoKey)))
+
+	cfg.respondWithVideo(w, r, http.StatusOK, dbVideo)
+}
+
+// reprocessVideo runs a video's original through the current pipeline and
+// queues its old files for deletion. Videos uploaded before originals were
+// staged are reprocessed from their current file, which is staged first
+// so later runs have an original to start from.
+func (cfg *apiConfig) reprocessVideo(ctx context.Context, video database.Video) (database.Video, error) {
+	var path string
+	if video.StagingKey != nil {
+		var err error
+		path, err = cfg.downloadStaged(ctx, video)
+		if err != nil {
+			return database.Video{}, &pipelineError{"download", http.StatusInternalServerError, "Couldn't download staged original", err}
+		}
+	} else {
+		key, ok := videoObjectKey(video)
+		if !ok {
+			return database.Video{}, &pipelineError{"download", http.StatusConflict, "Video has no file to reprocess", fmt.Errorf("video %s was never uploaded", video.ID)}
+		}
+		dataKey, err := cfg.videoDataKey(ctx, video)
+		if err != nil {
+			return database.Video{}, &pipelineError{"encrypt", http.StatusInternalServerError, "Couldn't get video key", err}
+		}
+		var checksum fileChecksum
+		path, checksum, err = cfg.downloadVerified(ctx, key, video.ChecksumSHA256, dataKey)
+		if err != nil {
+			return database.Video{}, &pipelineError{"download", http.StatusInternalServerError, "Couldn't download video", err}
+		}
+		video, err = cfg.stageOriginal(ctx, video, nil, path, "video/mp4", checksum)
+		if err != nil {
+			os.Remove(path)
+			return database.Video{}, &pipelineError{"stage", http.StatusInternalServerError, "Couldn't stage original video", err}
+		}
+	}
+	defer os.Remove(path)
+
+	storageClass := cfg.s3StorageClass
+	if video.StorageClass != "" {
+		storageClass = types.StorageClass(video.StorageClass)
+	}
+
+	old := video
+	video, err := cfg.processVideo(ctx, video, path, "video/mp4", storageClass)
+	if err != nil {
+		return database.Video{}, err
+	}
+	cfg.scheduleReplacedFiles(old, false)
+	return video, nil
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+const (
+	defaultShareLinkTTL = 7 * 24 * time.Hour
+	maxShareLinkTTL     = 30 * 24 * time.Hour
+)
+
+// handlerShareLinkCreate mints a link that lets anyone holding it watch the
+// video, regardless of its visibility, until it expires or runs out of views.
+func (cfg *apiConfig) handlerShareLinkCreate(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		ExpiresInSeconds int  `json:"expires_in_seconds"`
+		MaxViews         *int `json:"max_views"`
+	}
+	type response struct {
+		URL       string    `json:"url"`
+		ExpiresAt time.Time `json:"expires_at"`
+		MaxViews  *int      `json:"max_views"`
+	}
+
+	videoIDString := r.PathValue("videoID")
+	videoID, err := uuid.Parse(videoIDString)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid ID", err)
+		return
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := cfg.validateJWT(token)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err = decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters", err)
+		return
+	}
+	ttl := defaultShareLinkTTL
+	if params.ExpiresInSeconds != 0 {
+		ttl = time.Duration(params.ExpiresInSeconds) * time.Second
+	}
+	if ttl <= 0 || ttl > maxShareLinkTTL {
+		respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Expiry must be between 1 second and %s", maxShareLinkTTL), nil)
+		return
+	}
+	if params.MaxViews != nil && *params.MaxViews < 1 {
+		respondWithError(w, http.StatusBadRequest, "max_views must be at least 1", nil)
+		return
+	}
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+	if video.ID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, "Couldn't get video", nil)
+		return
+	}
+	if !cfg.authorizeVideo(w, video, userID, database.OrgRoleEditor, "You can't share this video") {
+		return
+	}
+
+	shareToken, err := auth.MakeRefreshToken()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create share token", err)
+		return
+	}
+	expiresAt := time.Now().UTC().Add(ttl)
+	err = cfg.db.CreateShareLink(database.CreateShareLinkParams{
+		TokenHash: auth.HashToken(shareToken),
+		VideoID:   videoID,
+		CreatedBy: userID,
+		ExpiresAt: expiresAt,
+		MaxViews:  params.MaxViews,
+	})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't save share link", err)
+		return
+	}
+	cfg.audit(r, userID, "video.share", "video", videoID.String(), fmt.Sprintf("share link expiring %s", expiresAt.Format(time.RFC3339)))
+
+	respondWithJSON(w, http.StatusCreated, response{
+		URL:       "/api/v1/share/" + shareToken,
+		ExpiresAt: expiresAt,
+		MaxViews:  params.MaxViews,
+	})
+}
+
+// handlerShareLinkResolve counts a view and redirects to a presigned URL
+// for the shared video, or to a playback token URL for encrypted ones.
+// Players fetch the video from there in ranges without coming back, so
+// each visit uses up a single view.
+func (cfg *apiConfig) handlerShareLinkResolve(w http.ResponseWriter, r *http.Request) {
+	shareToken := r.PathValue("token")
+
+	videoID, err := cfg.db.UseShareLink(auth.HashToken(shareToken))
+	if errors.Is(err, database.ErrTokenInvalid) {
+		respondWithError(w, http.StatusNotFound, "Share link is invalid or expired", err)
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't check share link", err)
+		return
+	}
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+	if video.ID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, "Couldn't get video", nil)
+		return
+	}
+	viewerID := cfg.optionalUserID(r)
+	if block := cfg.checkGeoRestriction(r, video); block != nil {
+		cfg.logRequestAccess(r, viewerID, video.ID, accessShare, string(block.code))
+		respondWithGeoBlock(w, block)
+		return
+	}
+	key, ok := videoObjectKey(video)
+	if !ok {
+		respondWithError(w, http.StatusNotFound, "Video has no uploaded file", nil)
+		return
+	}
+
+	// S3 only has the encrypted bytes of encrypted videos, so they play
+	// through the app's playback proxy rather than a presigned link
+	var videoURL string
+	if video.Encrypted {
+		var ip string
+		if cfg.playbackBindIP {
+			ip = clientIP(r)
+		}
+		token, err := auth.MakePlaybackToken(auth.PlaybackClaims{
+			VideoID:   video.ID,
+			UserID:    viewerID,
+			IP:        ip,
+			Shared:    true,
+			ExpiresAt: time.Now().UTC().Add(cfg.playbackTokenTTL).Truncate(time.Second),
+		}, cfg.jwtSecret)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't create playback token", err)
+			return
+		}
+		videoURL = "/api/v1/playback/" + token + "/video.mp4"
+	} else {
+		videoURL, err = cfg.presignObject(r.Context(), key)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't sign video URL", err)
+			return
+		}
+	}
+	cfg.logRequestAccess(r, viewerID, video.ID, accessShare, "")
+	cfg.recordView(r, viewerID, video.ID)
+
+	w.Header().Set("Cache-Control", "no-store")
+	http.Redirect(w, r, videoURL, http.StatusFound)
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/envelope"
+)
+
+// A player fetches a shared encrypted video in many Range requests, which
+// mustn't use up the share link's views.
+func TestShareLinkEncryptedRangeRequests(t *testing.T) {
+	ctx := context.Background()
+	db, err := database.NewClient(database.DriverSQLite, filepath.Join(t.TempDir(), "tubely.db"), database.PoolConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	masterKey := make([]byte, 32)
+	rand.Read(masterKey)
+	keyring, err := newKeyring(keyProviderLocal, base64.StdEncoding.EncodeToString(masterKey), "", awsJSONClient{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &apiConfig{
+		db:               db,
+		jwtSecret:        "secret",
+		keyring:          keyring,
+		keyProvider:      keyProviderLocal,
+		s3Bucket:         "tubely",
+		playbackTokenTTL: time.Hour,
+	}
+
+	user, err := db.CreateUser(database.CreateUserParams{Email: "owner@example.com", Password: "password"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	wrappedKey, err := cfg.newVideoKey(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	video, err := db.CreateVideo(database.CreateVideoParams{
+		Title:      "Shared",
+		Visibility: database.VisibilityPrivate,
+		UserID:     user.ID,
+		Encrypted:  true,
+		WrappedKey: &wrappedKey,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	videoKey := "videos/shared.mp4"
+	video.VideoKey = &videoKey
+	if _, err := db.UpdateVideo(video); err != nil {
+		t.Fatal(err)
+	}
+
+	// S3 holds the video encrypted, served with Range support
+	plaintext := make([]byte, 200<<10)
+	rand.Read(plaintext)
+	dataKey, err := cfg.videoDataKey(ctx, video)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sealed bytes.Buffer
+	if err := envelope.Encrypt(&sealed, bytes.NewReader(plaintext), dataKey); err != nil {
+		t.Fatal(err)
+	}
+	s3Server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/tubely/"+videoKey {
+			http.NotFound(w, r)
+			return
+		}
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(sealed.Bytes()))
+	}))
+	defer s3Server.Close()
+	cfg.s3Client = s3.New(s3.Options{
+		Region:       "us-east-1",
+		BaseEndpoint: aws.String(s3Server.URL),
+		UsePathStyle: true,
+		Credentials:  aws.AnonymousCredentials{},
+	})
+
+	shareToken := "share-token"
+	maxViews := 1
+	err = db.CreateShareLink(database.CreateShareLinkParams{
+		TokenHash: auth.HashToken(shareToken),
+		VideoID:   video.ID,
+		CreatedBy: user.ID,
+		ExpiresAt: time.Now().Add(time.Hour),
+		MaxViews:  &maxViews,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	openShareLink := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/share/"+shareToken, nil)
+		req.SetPathValue("token", shareToken)
+		rec := httptest.NewRecorder()
+		cfg.handlerShareLinkResolve(rec, req)
+		return rec
+	}
+
+	rec := openShareLink()
+	if rec.Code != http.StatusFound {
+		t.Fatalf("opening share link: got status %d, want %d: %s", rec.Code, http.StatusFound, rec.Body)
+	}
+	location := rec.Header().Get("Location")
+	playbackToken, ok := strings.CutPrefix(location, "/api/v1/playback/")
+	playbackToken, ok2 := strings.CutSuffix(playbackToken, "/video.mp4")
+	if !ok || !ok2 {
+		t.Fatalf("share link redirected to %q, want the playback proxy", location)
+	}
+
+	for _, r := range []struct{ start, end int }{{0, 1023}, {1024, 65535}, {150 << 10, 200<<10 - 1}, {100, 199}} {
+		req := httptest.NewRequest(http.MethodGet, location, nil)
+		req.SetPathValue("token", playbackToken)
+		req.SetPathValue("file", "video.mp4")
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", r.start, r.end))
+		rec := httptest.NewRecorder()
+		cfg.handlerPlaybackStream(rec, req)
+		if rec.Code != http.StatusPartialContent {
+			t.Fatalf("range %d-%d: got status %d, want %d: %s", r.start, r.end, rec.Code, http.StatusPartialContent, rec.Body)
+		}
+		got, _ := io.ReadAll(rec.Body)
+		if !bytes.Equal(got, plaintext[r.start:r.end+1]) {
+			t.Fatalf("range %d-%d: got %d bytes that don't match the video", r.start, r.end, len(got))
+		}
+	}
+
+	// The one view was used by opening the link, not by the ranges
+	if rec := openShareLink(); rec.Code != http.StatusNotFound {
+		t.Fatalf("reopening share link: got status %d, want %d", rec.Code, http.StatusNotFound)
+	}
+}
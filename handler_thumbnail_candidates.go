@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/google/uuid"
+)
+
+func (cfg *apiConfig) handlerThumbnailCandidatesList(w http.ResponseWriter, r *http.Request) {
+	video, _, ok := cfg.ownVideo(w, r)
+	if !ok {
+		return
+	}
+	candidates, err := cfg.db.GetThumbnailCandidates(video.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get thumbnail candidates", err)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, candidates)
+}
+
+// handlerThumbnailSelect makes one of the video's candidate frames its
+// thumbnail.
+func (cfg *apiConfig) handlerThumbnailSelect(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		CandidateID uuid.UUID `json:"candidate_id"`
+	}
+
+	video, userID, ok := cfg.ownVideo(w, r)
+	if !ok {
+		return
+	}
+	if !checkVideoIfMatch(w, r, video) {
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err := decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters", err)
+		return
+	}
+
+	candidate, err := cfg.db.GetThumbnailCandidate(params.CandidateID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get thumbnail candidate", err)
+		return
+	}
+	if candidate.VideoID != video.ID {
+		respondWithError(w, http.StatusNotFound, "Couldn't find thumbnail candidate", nil)
+		return
+	}
+
+	oldThumbnailURL := stringOrEmpty(video.ThumbnailURL)
+	err = cfg.applyThumbnailAsset(&video, candidate.URL, defaultThumbnailCrop)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't generate thumbnail variants", err)
+		return
+	}
+	video, err = cfg.db.UpdateVideo(video)
+	if err != nil {
+		respondWithVideoUpdateError(w, "Couldn't update video with thumbnail URL", err)
+		return
+	}
+	cfg.audit(r, userID, "video.thumbnail_select", "video", video.ID.String(), fmt.Sprintf("thumbnail_url: %q -> %q", oldThumbnailURL, *video.ThumbnailURL))
+
+	cfg.respondWithVideo(w, r, http.StatusOK, video)
+}
@@ -0,0 +1,419 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// handlerUploadSessionOptions tells tus clients what the server supports.
+func (cfg *apiConfig) handlerUploadSessionOptions(w http.ResponseWriter, r *http.Request) {
+	h := w.Header()
+	h.Set("Tus-Resumable", tusVersion)
+	h.Set("Tus-Version", tusVersion)
+	h.Set("Tus-Extension", tusExtensions)
+	h.Set("Tus-Max-Size", strconv.FormatInt(cfg.maxVideoUploadSize, 10))
+	h.Set("Tus-Checksum-Algorithm", tusChecksumAlgorithmList)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handlerUploadSessionCreate starts a resumable upload of a video's file.
+// The client then PATCHes the bytes to the returned Location, picking up
+// from the offset HEAD reports after a dropped connection.
+func (cfg *apiConfig) handlerUploadSessionCreate(w http.ResponseWriter, r *http.Request) {
+	if !checkTusResumable(w, r) {
+		return
+	}
+	userID, ok := cfg.authenticate(w, r)
+	if !ok {
+		return
+	}
+
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		respondWithError(w, http.StatusBadRequest, "Invalid Upload-Length", err)
+		return
+	}
+	if length > cfg.maxVideoUploadSize {
+		respondWithError(w, http.StatusRequestEntityTooLarge, "Video exceeds the upload size limit", nil)
+		return
+	}
+	if err := cfg.checkScratchSpace(length); err != nil {
+		respondWithScratchFull(w, err)
+		return
+	}
+	metadata := r.Header.Get("Upload-Metadata")
+	meta, err := cfg.parseTusMetadata(metadata)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Invalid Upload-Metadata: %v", err), err)
+		return
+	}
+
+	video, err := cfg.db.GetVideo(meta.videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+	if video.ID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, "Couldn't get video", nil)
+		return
+	}
+	if !cfg.authorizeVideo(w, video, userID, database.OrgRoleEditor, "Video not owned by user") {
+		return
+	}
+	if err := cfg.ensureCanUpload(userID); err != nil {
+		respondWithErrorCode(w, http.StatusForbidden, codeEmailUnverified, "Verify your email address before uploading", err)
+		return
+	}
+
+	session, err := cfg.db.CreateUploadSession(database.CreateUploadSessionParams{
+		UserID:    userID,
+		VideoID:   video.ID,
+		Length:    length,
+		Metadata:  metadata,
+		ExpiresAt: time.Now().Add(cfg.uploadSessionTTL),
+	})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create upload", err)
+		return
+	}
+	f, err := os.OpenFile(cfg.uploadSessionPath(session.ID), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		cfg.removeUploadSession(session)
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create upload", err)
+		return
+	}
+	f.Close()
+
+	w.Header().Set("Location", "/api/v1/uploads/"+session.ID.String())
+	w.Header().Set("Upload-Expires", session.ExpiresAt.UTC().Format(http.TimeFormat))
+	w.WriteHeader(http.StatusCreated)
+}
+
+// handlerUploadSessionHead reports how much of an upload has arrived.
+func (cfg *apiConfig) handlerUploadSessionHead(w http.ResponseWriter, r *http.Request) {
+	session, _, ok := cfg.ownUploadSession(w, r)
+	if !ok {
+		return
+	}
+	h := w.Header()
+	h.Set("Cache-Control", "no-store")
+	h.Set("Upload-Offset", strconv.FormatInt(session.Offset, 10))
+	h.Set("Upload-Length", strconv.FormatInt(session.Length, 10))
+	h.Set("Upload-Expires", session.ExpiresAt.UTC().Format(http.TimeFormat))
+	if session.Metadata != "" {
+		h.Set("Upload-Metadata", session.Metadata)
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// handlerUploadSessionPatch appends a chunk at the upload's offset. The
+// chunk that completes the upload also runs the video through the same
+// pipeline as a form upload. If that fails the session is kept, and an
+// empty PATCH at the final offset tries again.
+func (cfg *apiConfig) handlerUploadSessionPatch(w http.ResponseWriter, r *http.Request) {
+	session, userID, ok := cfg.ownUploadSession(w, r)
+	if !ok {
+		return
+	}
+	if r.Header.Get("Content-Type") != tusContentType {
+		respondWithError(w, http.StatusUnsupportedMediaType, "Content-Type must be "+tusContentType, nil)
+		return
+	}
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		respondWithError(w, http.StatusBadRequest, "Invalid Upload-Offset", err)
+		return
+	}
+	checksum, err := parseUploadChecksum(r.Header.Get("Upload-Checksum"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Invalid Upload-Checksum: %v", err), err)
+		return
+	}
+
+	unlock, ok := cfg.uploadLocks.tryLock(session.ID)
+	if !ok {
+		respondWithError(w, http.StatusLocked, "Upload is already being written to", nil)
+		return
+	}
+	defer unlock()
+	// Another request may have moved the offset on before we got the lock
+	session, err = cfg.db.GetUploadSession(session.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get upload", err)
+		return
+	}
+	if session.ID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, "Couldn't find upload", nil)
+		return
+	}
+	if offset != session.Offset {
+		w.Header().Set("Upload-Offset", strconv.FormatInt(session.Offset, 10))
+		respondWithErrorCode(w, http.StatusConflict, codeOffsetMismatch, "Upload-Offset doesn't match the upload's offset", fmt.Errorf("sent %d, at %d", offset, session.Offset))
+		return
+	}
+
+	// The slot is held through processing, like a form upload's
+	releaseIngest, err := cfg.ingest.begin(userID)
+	if err != nil {
+		respondWithIngestError(w, err)
+		return
+	}
+	defer releaseIngest()
+
+	path := cfg.uploadSessionPath(session.ID)
+	f, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if errors.Is(err, os.ErrNotExist) {
+		cfg.removeUploadSession(session)
+		respondWithError(w, http.StatusGone, "Upload expired", err)
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't open upload", err)
+		return
+	}
+	// Drop anything past the offset left by a write that failed midway
+	if err := f.Truncate(offset); err != nil {
+		f.Close()
+		respondWithError(w, http.StatusInternalServerError, "Couldn't write upload", err)
+		return
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		f.Close()
+		respondWithError(w, http.StatusInternalServerError, "Couldn't write upload", err)
+		return
+	}
+
+	body := cfg.ingest.throttle(r.Context(), userID, http.MaxBytesReader(w, r.Body, session.Length-offset))
+	var dst io.Writer = f
+	if checksum != nil {
+		dst = io.MultiWriter(f, checksum)
+	}
+	n, copyErr := io.Copy(dst, body)
+	if err := f.Close(); err != nil && copyErr == nil {
+		copyErr = err
+	}
+
+	switch {
+	case isBodyTooLarge(copyErr):
+		os.Truncate(path, offset)
+		respondWithError(w, http.StatusRequestEntityTooLarge, "Chunk runs past the end of the upload", copyErr)
+		return
+	case isScratchFull(copyErr):
+		os.Truncate(path, offset)
+		respondWithScratchFull(w, copyErr)
+		return
+	// A chunk can only be checked whole, so a partial one is dropped
+	case checksum != nil && copyErr != nil:
+		os.Truncate(path, offset)
+		respondWithError(w, http.StatusBadRequest, "Couldn't read chunk", copyErr)
+		return
+	case checksum != nil && !checksum.matches():
+		os.Truncate(path, offset)
+		respondWithErrorCode(w, statusChecksumMismatch, codeChecksumMismatch, "Chunk doesn't match Upload-Checksum", nil)
+		return
+	}
+
+	// Without a checksum whatever arrived before a dropped connection is
+	// kept, so the client resumes from there
+	session.Offset = offset + n
+	session.ExpiresAt = time.Now().Add(cfg.uploadSessionTTL)
+	err = cfg.db.UpdateUploadSessionOffset(session.ID, session.Offset, session.ExpiresAt)
+	if err != nil {
+		os.Truncate(path, offset)
+		respondWithError(w, http.StatusInternalServerError, "Couldn't update upload", err)
+		return
+	}
+	w.Header().Set("Upload-Offset", strconv.FormatInt(session.Offset, 10))
+	w.Header().Set("Upload-Expires", session.ExpiresAt.UTC().Format(http.TimeFormat))
+	if copyErr != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't read chunk", copyErr)
+		return
+	}
+	if session.Offset < session.Length {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	cfg.finishUploadSession(w, r, session, userID)
+}
+
+// finishUploadSession processes a fully received upload into its video.
+func (cfg *apiConfig) finishUploadSession(w http.ResponseWriter, r *http.Request, session database.UploadSession, userID uuid.UUID) {
+	meta, err := cfg.parseTusMetadata(session.Metadata)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't read upload metadata", err)
+		return
+	}
+	dbVideo, err := cfg.db.GetVideo(session.VideoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+	if dbVideo.ID == uuid.Nil {
+		cfg.removeUploadSession(session)
+		respondWithError(w, http.StatusNotFound, "Couldn't get video", nil)
+		return
+	}
+	// The caller's role, verification and maintenance mode may all have
+	// changed since the upload was created
+	if !cfg.authorizeVideo(w, dbVideo, userID, database.OrgRoleEditor, "Video not owned by user") {
+		return
+	}
+	if err := cfg.ensureCanUpload(userID); err != nil {
+		respondWithErrorCode(w, http.StatusForbidden, codeEmailUnverified, "Verify your email address before uploading", err)
+		return
+	}
+	if cfg.respondIfMaintenance(w) {
+		return
+	}
+
+	path := cfg.uploadSessionPath(session.ID)
+	f, err := os.Open(path)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't read upload", err)
+		return
+	}
+	head, err := readHead(f)
+	f.Close()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't read upload", err)
+		return
+	}
+	// Check the file's contents rather than trusting the declared type
+	if sniffed := sniffVideoType(head); sniffed != meta.mediaType {
+		cfg.removeUploadSession(session)
+		respondWithError(w, http.StatusUnsupportedMediaType, "File contents don't match declared type", fmt.Errorf("declared %s, detected %q", meta.mediaType, sniffed))
+		return
+	}
+	checksum, err := checksumFile(path)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't read upload", err)
+		return
+	}
+	ctx, release, ok := cfg.claimVideoUpload(w, r, dbVideo.ID)
+	if !ok {
+		return
+	}
+	defer release()
+
+	var metadataChanges []string
+	dbVideo, err = cfg.stageOriginal(ctx, dbVideo, func(v *database.Video) {
+		metadataChanges = meta.fields.apply(v)
+		v.OriginalFilename = meta.filename
+	}, path, meta.mediaType, checksum)
+	if err != nil {
+		respondWithPipelineError(w, uploadFailure(ctx, &pipelineError{"stage", http.StatusInternalServerError, "Couldn't stage original video", err}))
+		return
+	}
+
+	oldVideoKey := stringOrEmpty(dbVideo.VideoKey)
+	dbVideo, err = cfg.processVideo(ctx, dbVideo, path, meta.mediaType, meta.storageClass)
+	if err != nil {
+		respondWithPipelineError(w, uploadFailure(ctx, err))
+		return
+	}
+	summary := fmt.Sprintf("video_key: %q -> %q, storage_class: %s, upload: %s", oldVideoKey, stringOrEmpty(dbVideo.VideoKey), meta.storageClass, session.ID)
+	for _, change := range metadataChanges {
+		summary += ", " + change
+	}
+	cfg.audit(r, userID, "video.upload", "video", dbVideo.ID.String(), summary)
+
+	cfg.removeUploadSession(session)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handlerUploadSessionDelete abandons an upload and frees its space.
+func (cfg *apiConfig) handlerUploadSessionDelete(w http.ResponseWriter, r *http.Request) {
+	session, _, ok := cfg.ownUploadSession(w, r)
+	if !ok {
+		return
+	}
+	unlock, ok := cfg.uploadLocks.tryLock(session.ID)
+	if !ok {
+		respondWithError(w, http.StatusLocked, "Upload is already being written to", nil)
+		return
+	}
+	defer unlock()
+	if err := cfg.removeUploadSession(session); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't delete upload", err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ownUploadSession checks the tus version and loads the unexpired upload
+// session in the path for its authenticated owner. On failure it writes
+// the error response itself and returns ok == false.
+func (cfg *apiConfig) ownUploadSession(w http.ResponseWriter, r *http.Request) (database.UploadSession, uuid.UUID, bool) {
+	if !checkTusResumable(w, r) {
+		return database.UploadSession{}, uuid.Nil, false
+	}
+	uploadID, err := uuid.Parse(r.PathValue("uploadID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid ID", err)
+		return database.UploadSession{}, uuid.Nil, false
+	}
+	userID, ok := cfg.authenticate(w, r)
+	if !ok {
+		return database.UploadSession{}, uuid.Nil, false
+	}
+
+	session, err := cfg.db.GetUploadSession(uploadID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get upload", err)
+		return database.UploadSession{}, uuid.Nil, false
+	}
+	if session.ID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, "Couldn't find upload", nil)
+		return database.UploadSession{}, uuid.Nil, false
+	}
+	if session.UserID != userID {
+		respondWithErrorCode(w, http.StatusForbidden, codeNotOwner, "Upload not owned by user", nil)
+		return database.UploadSession{}, uuid.Nil, false
+	}
+	if session.ExpiresAt.Before(time.Now()) {
+		respondWithError(w, http.StatusGone, "Upload expired", nil)
+		return database.UploadSession{}, uuid.Nil, false
+	}
+	return session, userID, true
+}
+
+// removeUploadSession deletes a session along with the bytes received.
+func (cfg *apiConfig) removeUploadSession(session database.UploadSession) error {
+	if err := os.Remove(cfg.uploadSessionPath(session.ID)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		log.Printf("Couldn't remove file of upload %s: %v", session.ID, err)
+	}
+	return cfg.db.DeleteUploadSession(session.ID)
+}
+
+// expireUploadSessions removes uploads left unfinished past their expiry.
+func (cfg *apiConfig) expireUploadSessions(ctx context.Context) error {
+	sessions, err := cfg.db.GetUploadSessionsExpiredBefore(time.Now())
+	if err != nil {
+		return err
+	}
+	for _, session := range sessions {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		// A session still being written to is left for the next run
+		unlock, ok := cfg.uploadLocks.tryLock(session.ID)
+		if !ok {
+			continue
+		}
+		if err := cfg.removeUploadSession(session); err != nil {
+			log.Printf("Couldn't expire upload %s: %v", session.ID, err)
+		}
+		unlock()
+	}
+	return nil
+}
@@ -1,15 +1,17 @@
 package main
 
 import (
-	"crypto/rand"
-	"encoding/base64"
+	"bytes"
+	"encoding/json"
 	"fmt"
-	"mime"
+	"image"
+	"io"
 	"net/http"
 	"os"
 	"path/filepath"
 
 	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
 	"github.com/google/uuid"
 )
 
@@ -27,41 +29,36 @@ func (cfg *apiConfig) handlerUploadThumbnail(w http.ResponseWriter, r *http.Requ
 		return
 	}
 
-	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	userID, err := cfg.validateJWT(token)
 	if err != nil {
 		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
 		return
 	}
 
+	if err := cfg.ensureCanUpload(userID); err != nil {
+		respondWithErrorCode(w, http.StatusForbidden, codeEmailUnverified, "Verify your email address before uploading", err)
+		return
+	}
+
 	fmt.Println("uploading thumbnail for video", videoID, "by user", userID)
 
-	// TODO: implement the upload here
-	const maxMemory = 10 << 20 // 10 MB
-	err = r.ParseMultipartForm(maxMemory)
-	if err != nil {
-		respondWithError(w, http.StatusBadRequest, "Couldn't parse multipart form", err)
+	fileData, mediaType, ok := cfg.readImageUpload(w, r, "thumbnail", "Thumbnail", cfg.maxThumbnailUploadSize)
+	if !ok {
 		return
 	}
-
-	file, header, err := r.FormFile("thumbnail")
+	cropParams, err := thumbnailCropForm(r)
 	if err != nil {
-		respondWithError(w, http.StatusBadRequest, "Couldn't get thumbnail file from form", err)
+		respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Invalid crop: %v", err), err)
 		return
 	}
-	defer file.Close()
-
-	// Get the media type
-	mediaType, _, err := mime.ParseMediaType(header.Header.Get("Content-Type"))
+	imgConfig, _, err := image.DecodeConfig(bytes.NewReader(fileData))
 	if err != nil {
-		respondWithError(w, http.StatusBadRequest, "Couldn't parse media type", err)
+		respondWithError(w, http.StatusBadRequest, "Couldn't read thumbnail image", err)
 		return
 	}
-
-	// Read the file data
-	fileData := make([]byte, header.Size)
-	_, err = file.Read(fileData)
+	crop, err := cropParams.crop(imgConfig.Width, imgConfig.Height)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't read thumbnail file", err)
+		respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Invalid crop: %v", err), err)
 		return
 	}
 
@@ -71,36 +68,103 @@ func (cfg *apiConfig) handlerUploadThumbnail(w http.ResponseWriter, r *http.Requ
 		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
 		return
 	}
-	if dbVideo.UserID != userID {
-		respondWithError(w, http.StatusUnauthorized, "You don't have permission to upload thumbnail for this video", nil)
+	if dbVideo.ID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, "Couldn't get video", nil)
+		return
+	}
+	if !cfg.authorizeVideo(w, dbVideo, userID, database.OrgRoleEditor, "You don't have permission to upload thumbnail for this video") {
+		return
+	}
+	if !checkVideoIfMatch(w, r, dbVideo) {
 		return
 	}
 
 	// Save the thumbnail file locally
-	fileExt := mediaTypeToFileExt(mediaType)
-	if fileExt == "" {
-		respondWithError(w, http.StatusBadRequest, "Unsupported media type", nil)
+	if mediaTypeToFileExt(mediaType) == "" {
+		respondWithError(w, http.StatusUnsupportedMediaType, "Unsupported media type", nil)
 		return
 	}
-	key := make([]byte, 32)
-	rand.Read(key)
-	filename := fmt.Sprintf("%s.%s", base64.RawURLEncoding.EncodeToString(key), fileExt)
-	err = saveFileLocally(cfg.assetsRoot, filename, fileData)
+	sourceURL, err := cfg.saveImageAsset(bytes.NewReader(fileData), mediaType)
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Couldn't save thumbnail file", err)
 		return
 	}
 
-	// Update video thumbnail URL pointing to local assets
-	thumbnailURL := fmt.Sprintf("http://localhost:%s/assets/%s", cfg.port, filename)
-	dbVideo.ThumbnailURL = &thumbnailURL
-	err = cfg.db.UpdateVideo(dbVideo)
+	// Update video thumbnail URLs pointing to local assets
+	oldThumbnailURL := stringOrEmpty(dbVideo.ThumbnailURL)
+	err = cfg.applyThumbnail(&dbVideo, sourceURL, bytes.NewReader(fileData), mediaType, crop)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't generate thumbnail variants", err)
+		return
+	}
+	dbVideo, err = cfg.db.UpdateVideo(dbVideo)
+	if err != nil {
+		respondWithVideoUpdateError(w, "Couldn't update video with thumbnail URL", err)
+		return
+	}
+	cfg.audit(r, userID, "video.thumbnail_upload", "video", videoID.String(), fmt.Sprintf("thumbnail_url: %q -> %q", oldThumbnailURL, *dbVideo.ThumbnailURL))
+
+	cfg.respondWithVideo(w, r, http.StatusOK, dbVideo)
+}
+
+// handlerThumbnailCrop regenerates a video's thumbnail variants from its
+// source image with a new crop and focal point.
+func (cfg *apiConfig) handlerThumbnailCrop(w http.ResponseWriter, r *http.Request) {
+	video, userID, ok := cfg.ownVideo(w, r)
+	if !ok {
+		return
+	}
+	if !checkVideoIfMatch(w, r, video) {
+		return
+	}
+	if video.ThumbnailSourceURL == nil {
+		respondWithError(w, http.StatusConflict, "Video has no thumbnail source image to crop", nil)
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := thumbnailCropParams{}
+	err := decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters", err)
+		return
+	}
+
+	source, err := cfg.openLocalAsset(*video.ThumbnailSourceURL)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't read thumbnail source image", err)
+		return
+	}
+	defer source.Close()
+	head, err := readHead(source)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't read thumbnail source image", err)
+		return
+	}
+	imgConfig, err := checkImageSize(source, cfg.maxImagePixels)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't read thumbnail source image", err)
+		return
+	}
+	crop, err := params.crop(imgConfig.Width, imgConfig.Height)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't update video with thumbnail URL", err)
+		respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Invalid crop: %v", err), err)
 		return
 	}
 
-	respondWithJSON(w, http.StatusOK, dbVideo)
+	err = cfg.applyThumbnail(&video, *video.ThumbnailSourceURL, source, sniffImageType(head), crop)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't generate thumbnail variants", err)
+		return
+	}
+	video, err = cfg.db.UpdateVideo(video)
+	if err != nil {
+		respondWithVideoUpdateError(w, "Couldn't update video with thumbnail URL", err)
+		return
+	}
+	cfg.audit(r, userID, "video.thumbnail_crop", "video", video.ID.String(), fmt.Sprintf("crop: %+v", crop))
+
+	cfg.respondWithVideo(w, r, http.StatusOK, video)
 }
 
 func mediaTypeToFileExt(mediaType string) string {
@@ -111,19 +175,34 @@ func mediaTypeToFileExt(mediaType string) string {
 		return "png"
 	case "image/gif":
 		return "gif"
+	case "image/webp":
+		return "webp"
+	case "image/avif":
+		return "avif"
 	default:
 		return ""
 	}
 }
 
-func saveFileLocally(dir, filename string, data []byte) error {
-	filePath := filepath.Join(dir, filename)
-	file, err := os.Create(filePath)
+// saveFileLocally copies r to a temp file and renames it into place, so a
+// half-written asset is never served and cached.
+func saveFileLocally(dir, filename string, r io.Reader) error {
+	file, err := os.CreateTemp(dir, "."+filename+".*.tmp")
 	if err != nil {
 		return err
 	}
+	defer os.Remove(file.Name())
 	defer file.Close()
 
-	_, err = file.Write(data)
-	return err
+	if _, err := io.Copy(file, r); err != nil {
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	// CreateTemp makes the file private; assets are public
+	if err := os.Chmod(file.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(file.Name(), filepath.Join(dir, filename))
 }
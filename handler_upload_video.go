@@ -2,26 +2,35 @@ package main
 
 import (
 	"bytes"
-	"context"
-	"crypto/rand"
-	"encoding/base64"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"mime"
 	"net/http"
+	"net/url"
 	"os"
-	"os/exec"
 
-	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
 	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
 	"github.com/google/uuid"
 )
 
 func (cfg *apiConfig) handlerUploadVideo(w http.ResponseWriter, r *http.Request) {
-	// Set an upload limit of 1 GB (1 << 30 bytes) using http.MaxBytesReader.
-	const maxMemory = 10 << 30 // 1 GB
-	http.MaxBytesReader(w, r.Body, maxMemory)
+	cfg.uploadVideo(w, r, formVideoSource)
+}
+
+// handlerUploadVideoContent takes the video as the raw request body, for
+// clients that would rather not build a multipart form. Metadata and
+// storage_class come from query parameters and the filename from
+// Content-Disposition; otherwise it's the same as a form upload.
+func (cfg *apiConfig) handlerUploadVideoContent(w http.ResponseWriter, r *http.Request) {
+	cfg.uploadVideo(w, r, rawVideoSource)
+}
+
+func (cfg *apiConfig) uploadVideo(w http.ResponseWriter, r *http.Request, src videoSource) {
+	// Reject bodies larger than the configured video upload limit
+	r.Body = http.MaxBytesReader(w, r.Body, cfg.maxVideoUploadSize)
 
 	// Extract the videoID from the URL path parameters and parse it as a UUID
 	videoIDString := r.PathValue("videoID")
@@ -37,172 +46,363 @@ func (cfg *apiConfig) handlerUploadVideo(w http.ResponseWriter, r *http.Request)
 		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
 		return
 	}
-	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	userID, err := cfg.validateJWT(token)
 	if err != nil {
 		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
 		return
 	}
 
-	// Get the dbVideo metadata from the database, if the user is not the dbVideo owner, return a http.StatusUnauthorized response
+	// Get the dbVideo metadata from the database, if the user is not the dbVideo owner, return a http.StatusForbidden response
 	dbVideo, err := cfg.db.GetVideo(videoID)
 	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, "Couldn't get video", err)
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
 		return
 	}
-	if dbVideo.UserID != userID {
-		respondWithError(w, http.StatusUnauthorized, "Video not owned by user", err)
+	if dbVideo.ID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, "Couldn't get video", nil)
 		return
 	}
-
-	// Parse the uploaded video file from the form data
-	fmt.Println("uploading video for video", videoID, "by user", userID)
-	videoFile, videoHeaders, err := r.FormFile("video")
-	if err != nil {
-		respondWithError(w, http.StatusBadRequest, "Couldn't get video file from form", err)
+	if !cfg.authorizeVideo(w, dbVideo, userID, database.OrgRoleEditor, "Video not owned by user") {
 		return
 	}
-	defer videoFile.Close()
-
-	// Validate the uploaded file to ensure it's an MP4 video
-	mediaType, _, err := mime.ParseMediaType(videoHeaders.Header.Get("Content-Type"))
-	if err != nil {
-		respondWithError(w, http.StatusBadRequest, "Couldn't parse media type", err)
+	if err := cfg.ensureCanUpload(userID); err != nil {
+		respondWithErrorCode(w, http.StatusForbidden, codeEmailUnverified, "Verify your email address before uploading", err)
 		return
 	}
-	if mediaType != "video/mp4" {
-		respondWithError(w, http.StatusBadRequest, "Invalid file type", err)
+	ctx, release, ok := cfg.claimVideoUpload(w, r, videoID)
+	if !ok {
 		return
 	}
-	fileExt := "mp4"
+	defer release()
 
-	// Save the uploaded file to a temporary file on disk.
-	tmpFile, err := os.CreateTemp("", "tubely-video-upload.mp4")
-	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't create temp dir", err)
+	// Small uploads are kept in memory throughout, unless the video is
+	// encrypted, which is done from a file
+	upload, cleanup, ok := cfg.receiveVideoUpload(w, r, userID, src, cfg.flags.enabled(flagSmallUploads, dbVideo.UserID))
+	if !ok {
 		return
 	}
-	defer os.Remove(tmpFile.Name())
-	defer tmpFile.Close()
-	_, err = io.Copy(tmpFile, videoFile)
+	defer cleanup()
+	if upload.data != nil && dbVideo.Encrypted {
+		path, err := cfg.spillToScratch(upload.data)
+		if isScratchFull(err) {
+			respondWithScratchFull(w, err)
+			return
+		}
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't write video to disk", err)
+			return
+		}
+		defer os.Remove(path)
+		upload.path, upload.data = path, nil
+	}
+	metadata, err := readUploadMetadata(upload.fields)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't copy file", err)
+		respondWithError(w, http.StatusBadRequest, "Invalid visibility", err)
 		return
 	}
+	fmt.Println("uploading video for video", videoID, "by user", userID)
 
-	// Reset the tempFile's file pointer to the beginning with .Seek(0, io.SeekStart) - this will allow us to read the file again from the beginning
-	_, err = tmpFile.Seek(0, io.SeekStart)
+	// Keep the original in S3 so it can be reprocessed if anything below
+	// fails. Metadata is saved along with it.
+	var metadataChanges []string
+	in := mediaInput{path: upload.path, data: upload.data}
+	dbVideo, err = cfg.stageInput(ctx, dbVideo, func(v *database.Video) {
+		metadataChanges = metadata.apply(v)
+		v.OriginalFilename = upload.filename
+	}, in, upload.mediaType, upload.checksum)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't seek file", err)
+		respondWithPipelineError(w, uploadFailure(ctx, &pipelineError{"stage", http.StatusInternalServerError, "Couldn't stage original video", err}))
 		return
 	}
 
-	// Determine video aspect ratio using ffprobe
-	aspectRatio, err := getVideoAspectRatio(tmpFile.Name())
+	oldVideoKey := stringOrEmpty(dbVideo.VideoKey)
+	dbVideo, err = cfg.processInput(ctx, dbVideo, in, upload.mediaType, upload.storageClass)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't get video aspect ratio", err)
+		respondWithPipelineError(w, uploadFailure(ctx, err))
 		return
 	}
+	summary := fmt.Sprintf("video_key: %q -> %q, storage_class: %s", oldVideoKey, stringOrEmpty(dbVideo.VideoKey), upload.storageClass)
+	for _, change := range metadataChanges {
+		summary += ", " + change
+	}
+	cfg.audit(r, userID, "video.upload", "video", videoID.String(), summary)
 
-	// Process the video for fast start using ffmpeg
-	processedFilePath, err := processVideoForFastStart(tmpFile.Name())
-	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't process video for fast start", err)
-		return
+	cfg.respondWithVideo(w, r, http.StatusOK, dbVideo)
+}
+
+// uploadMetadata holds the optional title, description and visibility
+// fields of an upload form. Nil fields weren't sent and leave the video as
+// it is.
+type uploadMetadata struct {
+	title       *string
+	description *string
+	visibility  *string
+}
+
+// readUploadMetadata reads the metadata fields of an upload.
+func readUploadMetadata(fields url.Values) (uploadMetadata, error) {
+	var metadata uploadMetadata
+	field := func(name string) *string {
+		if !fields.Has(name) {
+			return nil
+		}
+		v := fields.Get(name)
+		return &v
+	}
+	metadata.title = field("title")
+	metadata.description = field("description")
+	metadata.visibility = field("visibility")
+	if metadata.visibility != nil && !validVisibility(*metadata.visibility) {
+		return uploadMetadata{}, errors.New("invalid visibility")
+	}
+	return metadata, nil
+}
+
+// apply sets the sent fields on video and describes what changed for the
+// audit log.
+func (m uploadMetadata) apply(video *database.Video) []string {
+	var changes []string
+	if m.title != nil && *m.title != video.Title {
+		changes = append(changes, fmt.Sprintf("title: %q -> %q", video.Title, *m.title))
+		video.Title = *m.title
 	}
-	defer os.Remove(processedFilePath)
+	if m.description != nil && *m.description != video.Description {
+		changes = append(changes, "description changed")
+		video.Description = *m.description
+	}
+	if m.visibility != nil && *m.visibility != video.Visibility {
+		changes = append(changes, fmt.Sprintf("visibility: %s -> %s", video.Visibility, *m.visibility))
+		video.Visibility = *m.visibility
+	}
+	return changes
+}
+
+// videoUpload is a video file read from an upload into a temp file.
+type videoUpload struct {
+	path string
+	// data holds small uploads kept in memory instead of at path
+	data         []byte
+	mediaType    string
+	checksum     fileChecksum
+	storageClass types.StorageClass
+	// filename is the name the client gave the file, nil if it gave none
+	filename *string
+	// fields holds the upload's metadata fields, for readUploadMetadata
+	fields url.Values
+}
+
+// uploadError is a rejected upload along with the response it should
+// produce.
+type uploadError struct {
+	status  int
+	message string
+	err     error
+}
+
+func (e *uploadError) Error() string {
+	return fmt.Sprintf("%s: %v", e.message, e.err)
+}
+
+// videoSource finds the video in an upload request. It returns the body
+// to read the file from and what the client said about it.
+type videoSource func(cfg *apiConfig, r *http.Request) (io.Reader, videoUpload, error)
 
-	// Reopen the processed file
-	tmpFile, err = os.Open(processedFilePath)
+// readVideoUpload reads the "video" form file of an upload by userID to a
+// temp file and checks it's an MP4. The caller runs cleanup once done with
+// the file. On failure it writes the error response itself and returns
+// ok == false.
+func (cfg *apiConfig) readVideoUpload(w http.ResponseWriter, r *http.Request, userID uuid.UUID) (upload videoUpload, cleanup func(), ok bool) {
+	return cfg.receiveVideoUpload(w, r, userID, formVideoSource, false)
+}
+
+func formVideoSource(cfg *apiConfig, r *http.Request) (io.Reader, videoUpload, error) {
+	// Parse the uploaded video file from the form data
+	videoFile, videoHeaders, err := r.FormFile("video")
+	if isBodyTooLarge(err) {
+		return nil, videoUpload{}, &uploadError{http.StatusRequestEntityTooLarge, "Video exceeds the upload size limit", err}
+	}
+	if isScratchFull(err) {
+		return nil, videoUpload{}, &uploadError{http.StatusInsufficientStorage, "Not enough disk space to take this upload right now", err}
+	}
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't open processed video file", err)
-		return
+		return nil, videoUpload{}, &uploadError{http.StatusBadRequest, "Couldn't get video file from form", err}
 	}
-	defer tmpFile.Close()
-
-	// Put the object into S3 using PutObject.
-	key := make([]byte, 32)
-	rand.Read(key)
-	var objName string
-	switch aspectRatio {
-	case "16:9":
-		objName = fmt.Sprintf("landscape/%s.%s", base64.RawURLEncoding.EncodeToString(key), fileExt)
-	case "9:16":
-		objName = fmt.Sprintf("portrait/%s.%s", base64.RawURLEncoding.EncodeToString(key), fileExt)
-	default:
-		objName = fmt.Sprintf("other/%s.%s", base64.RawURLEncoding.EncodeToString(key), fileExt)
-	}
-
-	// Use the S3 client to upload the file
-	fmt.Printf("Uploading video to S3 bucket %s with key %s\n", cfg.s3Bucket, objName)
-	_, err = cfg.s3Client.PutObject(context.Background(), &s3.PutObjectInput{
-		Bucket:      &cfg.s3Bucket,
-		Key:         &objName,
-		ContentType: &mediaType,
-		Body:        tmpFile,
-	})
+
+	// Validate the uploaded file to ensure it's an MP4 video
+	mediaType, _, err := mime.ParseMediaType(videoHeaders.Header.Get("Content-Type"))
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't upload to S3", err)
-		return
+		videoFile.Close()
+		return nil, videoUpload{}, &uploadError{http.StatusBadRequest, "Couldn't parse media type", err}
 	}
 
-	// Store an actual URL again in the video_url column, but this time, use the cloudfront URL. Use your distribution's domain name (including the https:// protocol)
-	videoURL := fmt.Sprintf("https://%s/%s", cfg.s3CfDistribution, objName)
-	dbVideo.VideoURL = &videoURL
-	err = cfg.db.UpdateVideo(dbVideo)
+	// An optional storage_class form field overrides the configured default
+	storageClass := cfg.s3StorageClass
+	if v := r.FormValue("storage_class"); v != "" {
+		storageClass, err = parseStorageClass(v)
+		if err != nil {
+			videoFile.Close()
+			return nil, videoUpload{}, &uploadError{http.StatusBadRequest, "Invalid storage class", err}
+		}
+	}
+
+	return videoFile, videoUpload{
+		mediaType:    mediaType,
+		storageClass: storageClass,
+		filename:     originalFilename(videoHeaders.Filename),
+		fields:       r.PostForm,
+	}, nil
+}
+
+func rawVideoSource(cfg *apiConfig, r *http.Request) (io.Reader, videoUpload, error) {
+	// Without a length an oversized body would only be caught partway in
+	if r.ContentLength < 0 {
+		return nil, videoUpload{}, &uploadError{http.StatusLengthRequired, "Content-Length is required", nil}
+	}
+	if r.ContentLength > cfg.maxVideoUploadSize {
+		return nil, videoUpload{}, &uploadError{http.StatusRequestEntityTooLarge, "Video exceeds the upload size limit", nil}
+	}
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't update video URL in database", err)
-		return
+		return nil, videoUpload{}, &uploadError{http.StatusBadRequest, "Couldn't parse media type", err}
 	}
 
-	respondWithJSON(w, http.StatusOK, dbVideo)
+	query := r.URL.Query()
+	storageClass := cfg.s3StorageClass
+	if v := query.Get("storage_class"); v != "" {
+		storageClass, err = parseStorageClass(v)
+		if err != nil {
+			return nil, videoUpload{}, &uploadError{http.StatusBadRequest, "Invalid storage class", err}
+		}
+	}
+
+	var filename *string
+	if _, params, err := mime.ParseMediaType(r.Header.Get("Content-Disposition")); err == nil {
+		filename = originalFilename(params["filename"])
+	}
+
+	return r.Body, videoUpload{
+		mediaType:    mediaType,
+		storageClass: storageClass,
+		filename:     filename,
+		fields:       query,
+	}, nil
 }
 
-func getVideoAspectRatio(filePath string) (string, error) {
-	// Use ffprobe to get video dimensions
-	cmd := exec.Command("ffprobe", "-v", "error", "-print_format", "json", "-show_streams", filePath)
-	var b bytes.Buffer
-	cmd.Stdout = &b
-	err := cmd.Run()
+// receiveVideoUpload copies the video src finds to a temp file, checking
+// its contents match the declared type. If allowMemory is set, a small
+// enough upload is read into a buffer from cfg.smallUploads instead,
+// which cleanup gives back.
+func (cfg *apiConfig) receiveVideoUpload(w http.ResponseWriter, r *http.Request, userID uuid.UUID, src videoSource, allowMemory bool) (upload videoUpload, cleanup func(), ok bool) {
+	var cleanups []func()
+	cleanup = func() {
+		for i := len(cleanups) - 1; i >= 0; i-- {
+			cleanups[i]()
+		}
+	}
+	fail := func(code int, msg string, err error) (videoUpload, func(), bool) {
+		cleanup()
+		respondWithError(w, code, msg, err)
+		return videoUpload{}, nil, false
+	}
+
+	// Pace the body so one user can't take the whole uplink. The slot is
+	// held until processing is done, since that's when the temp file goes.
+	releaseIngest, err := cfg.ingest.begin(userID)
 	if err != nil {
-		return "", err
+		cleanup()
+		respondWithIngestError(w, err)
+		return videoUpload{}, nil, false
 	}
+	cleanups = append(cleanups, releaseIngest)
+	r.Body = cfg.ingest.throttle(r.Context(), userID, r.Body)
 
-	// Parse the JSON output to extract width and height
-	type VideoFormat struct {
-		Streams []struct {
-			Width  int `json:"width"`
-			Height int `json:"height"`
-		} `json:"streams"`
+	// The length bounds the file in a form as well as a raw body
+	var buf []byte
+	if allowMemory {
+		if b, ok := cfg.smallUploads.get(r.ContentLength); ok {
+			buf = b
+			cleanups = append(cleanups, func() { cfg.smallUploads.put(b) })
+		}
+	}
+
+	// Turn away what won't fit before reading any of it, since a form is
+	// spooled to disk as it's parsed. Oversized bodies get a 413 instead.
+	if buf == nil && r.ContentLength <= cfg.maxVideoUploadSize {
+		if err := cfg.checkScratchSpace(r.ContentLength); err != nil {
+			cleanup()
+			respondWithScratchFull(w, err)
+			return videoUpload{}, nil, false
+		}
+	}
+
+	body, upload, err := src(cfg, r)
+	var uErr *uploadError
+	if errors.As(err, &uErr) {
+		return fail(uErr.status, uErr.message, uErr.err)
 	}
-	videoFormat := &VideoFormat{}
-	err = json.Unmarshal(b.Bytes(), videoFormat)
 	if err != nil {
-		return "", err
+		return fail(http.StatusBadRequest, "Couldn't read upload", err)
 	}
-	if len(videoFormat.Streams) == 0 {
-		return "", fmt.Errorf("no video streams found")
+	if c, ok := body.(io.Closer); ok {
+		cleanups = append(cleanups, func() { c.Close() })
+	}
+	if upload.mediaType != "video/mp4" {
+		return fail(http.StatusUnsupportedMediaType, "Invalid file type", nil)
 	}
-	width := videoFormat.Streams[0].Width
-	height := videoFormat.Streams[0].Height
 
-	// Calculate aspect ratio
-	aspectRatio := float32(width) / float32(height)
-	if 1.77 < aspectRatio && aspectRatio < 1.78 {
-		return "16:9", nil
-	} else if 0.56 < aspectRatio && aspectRatio < 0.57 {
-		return "9:16", nil
+	// Save the uploaded file to a temporary file on disk, or the buffer
+	var head []byte
+	var checksum fileChecksum
+	if buf != nil {
+		sum := newChecksummer()
+		n, err := io.ReadFull(io.TeeReader(body, sum), buf)
+		if err == io.ErrUnexpectedEOF || err == io.EOF {
+			err = nil
+		}
+		if isBodyTooLarge(err) {
+			return fail(http.StatusRequestEntityTooLarge, "Video exceeds the upload size limit", err)
+		}
+		if err != nil {
+			return fail(http.StatusInternalServerError, "Couldn't read file", err)
+		}
+		upload.data, checksum = buf[:n], sum.sum()
+		head, err = readHead(bytes.NewReader(upload.data))
+		if err != nil {
+			return fail(http.StatusInternalServerError, "Couldn't read file", err)
+		}
 	} else {
-		return "other", nil
+		tmpFile, err := os.CreateTemp(cfg.scratchDir, "tubely-video-upload.mp4")
+		if err != nil {
+			return fail(http.StatusInternalServerError, "Couldn't create temp dir", err)
+		}
+		cleanups = append(cleanups, func() {
+			tmpFile.Close()
+			os.Remove(tmpFile.Name())
+		})
+		_, checksum, err = copyWithChecksum(tmpFile, body)
+		if isBodyTooLarge(err) {
+			return fail(http.StatusRequestEntityTooLarge, "Video exceeds the upload size limit", err)
+		}
+		if isScratchFull(err) {
+			cleanup()
+			respondWithScratchFull(w, err)
+			return videoUpload{}, nil, false
+		}
+		if err != nil {
+			return fail(http.StatusInternalServerError, "Couldn't copy file", err)
+		}
+		upload.path = tmpFile.Name()
+		head, err = readHead(tmpFile)
+		if err != nil {
+			return fail(http.StatusInternalServerError, "Couldn't read file", err)
+		}
 	}
-}
 
-// processes the video file at filePath to enable fast start using ffmpeg.
-func processVideoForFastStart(filePath string) (string, error) {
-	outputFilepath := filePath + ".processing"
-	cmd := exec.Command("ffmpeg", "-i", filePath, "-c", "copy", "-movflags", "faststart", "-f", "mp4", outputFilepath)
-	err := cmd.Run()
-	if err != nil {
-		return "", err
+	// Check the file's contents rather than trusting the declared type
+	if sniffed := sniffVideoType(head); sniffed != upload.mediaType {
+		return fail(http.StatusUnsupportedMediaType, "File contents don't match declared type", fmt.Errorf("declared %s, detected %q", upload.mediaType, sniffed))
 	}
-	return outputFilepath, nil
+
+	upload.checksum = checksum
+	return upload, cleanup, true
 }
@@ -2,10 +2,13 @@ package main
 
 import (
 	"encoding/json"
+	"fmt"
+	"log"
 	"net/http"
 
 	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
 	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
 )
 
 func (cfg *apiConfig) handlerUsersCreate(w http.ResponseWriter, r *http.Request) {
@@ -26,6 +29,14 @@ func (cfg *apiConfig) handlerUsersCreate(w http.ResponseWriter, r *http.Request)
 		respondWithError(w, http.StatusBadRequest, "Email and password are required", nil)
 		return
 	}
+	if !cfg.signupLimiter.allow(clientIP(r)) {
+		cfg.audit(r, uuid.Nil, "user.signup_limited", "user", "", fmt.Sprintf("email: %q", params.Email))
+		respondWithError(w, http.StatusTooManyRequests, "Too many signups from your address, try again later", nil)
+		return
+	}
+	if !cfg.checkCaptcha(w, r) {
+		return
+	}
 
 	hashedPassword, err := auth.HashPassword(params.Password)
 	if err != nil {
@@ -42,5 +53,46 @@ func (cfg *apiConfig) handlerUsersCreate(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
+	cfg.audit(r, user.ID, "user.create", "user", user.ID.String(), "signed up as "+user.Email)
+
+	// The account is usable right away, so a failed email is only logged;
+	// the user can ask for another one
+	err = cfg.sendVerificationEmail(r.Context(), *user)
+	if err != nil {
+		log.Printf("Couldn't send verification email to new user %s: %v", user.ID, err)
+	}
+
 	respondWithJSON(w, http.StatusCreated, user)
 }
+
+// handlerLogoutAll signs the user out everywhere by revoking all refresh
+// tokens and invalidating every access token issued so far.
+func (cfg *apiConfig) handlerLogoutAll(w http.ResponseWriter, r *http.Request) {
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := cfg.validateJWT(token)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	err = cfg.revokeAllSessions(userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't revoke sessions", err)
+		return
+	}
+	cfg.audit(r, userID, "user.logout_all", "user", userID.String(), "revoked all sessions")
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (cfg *apiConfig) revokeAllSessions(userID uuid.UUID) error {
+	err := cfg.db.IncrementUserTokenVersion(userID)
+	if err != nil {
+		return err
+	}
+	return cfg.db.RevokeUserRefreshTokens(userID)
+}
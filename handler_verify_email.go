@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+const emailVerificationTokenTTL = 48 * time.Hour
+
+var errEmailNotVerified = errors.New("email address is not verified")
+
+// sendVerificationEmail issues a new verification token for user and
+// emails it to them.
+func (cfg *apiConfig) sendVerificationEmail(ctx context.Context, user database.User) error {
+	token, err := auth.MakeRefreshToken()
+	if err != nil {
+		return err
+	}
+	err = cfg.db.CreateUserToken(database.CreateUserTokenParams{
+		TokenHash: auth.HashToken(token),
+		Purpose:   database.TokenPurposeEmailVerification,
+		UserID:    user.ID,
+		ExpiresAt: time.Now().Add(emailVerificationTokenTTL),
+	})
+	if err != nil {
+		return err
+	}
+
+	body := fmt.Sprintf(
+		"Welcome to Tubely! Confirm your email address with this token within %s:\n\n%s",
+		emailVerificationTokenTTL, token,
+	)
+	return cfg.mailer.Send(ctx, user.Email, "Confirm your Tubely email address", body)
+}
+
+// ensureCanUpload rejects uploads from unverified accounts when email
+// verification is required.
+func (cfg *apiConfig) ensureCanUpload(userID uuid.UUID) error {
+	if !cfg.requireVerifiedEmail {
+		return nil
+	}
+	user, err := cfg.db.GetUser(userID)
+	if err != nil {
+		return err
+	}
+	if user == nil || !user.Verified {
+		return errEmailNotVerified
+	}
+	return nil
+}
+
+func (cfg *apiConfig) handlerVerifyEmail(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Token string `json:"token"`
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err := decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters", err)
+		return
+	}
+
+	userID, err := cfg.db.ConsumeUserToken(auth.HashToken(params.Token), database.TokenPurposeEmailVerification)
+	if errors.Is(err, database.ErrTokenInvalid) {
+		respondWithError(w, http.StatusBadRequest, "Verification token is invalid or expired", err)
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't check verification token", err)
+		return
+	}
+
+	err = cfg.db.SetUserVerified(userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't verify user", err)
+		return
+	}
+	cfg.audit(r, userID, "user.verify_email", "user", userID.String(), "email verified")
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (cfg *apiConfig) handlerVerifyEmailResend(w http.ResponseWriter, r *http.Request) {
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := cfg.validateJWT(token)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	if !cfg.verificationLimiter.allow(userID.String()) {
+		respondWithError(w, http.StatusTooManyRequests, "Too many verification emails, try again later", nil)
+		return
+	}
+
+	user, err := cfg.db.GetUser(userID)
+	if err != nil || user == nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get user", err)
+		return
+	}
+	if user.Verified {
+		respondWithError(w, http.StatusConflict, "Email is already verified", nil)
+		return
+	}
+
+	err = cfg.sendVerificationEmail(r.Context(), *user)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't send verification email", err)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// maxFilenameLength caps stored original filenames; longer names are
+// truncated.
+const maxFilenameLength = 255
+
+// originalFilename cleans up a client-supplied filename for storage,
+// returning nil if there's nothing usable left.
+func originalFilename(name string) *string {
+	name = strings.TrimSpace(filepath.Base(strings.ReplaceAll(name, `\`, "/")))
+	if name == "." || name == "/" || name == "" {
+		return nil
+	}
+	if len(name) > maxFilenameLength {
+		name = strings.ToValidUTF8(name[:maxFilenameLength], "")
+	}
+	return &name
+}
+
+// handlerVideoDownload sends the owner, or any member of the video's
+// organization, to a short-lived link to the original upload, saved under
+// the name it was uploaded with. Originals of encrypted videos are
+// streamed instead.
+func (cfg *apiConfig) handlerVideoDownload(w http.ResponseWriter, r *http.Request) {
+	videoID, err := uuid.Parse(r.PathValue("videoID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid ID", err)
+		return
+	}
+	userID, ok := cfg.authenticate(w, r)
+	if !ok {
+		cfg.logRequestAccess(r, uuid.Nil, videoID, accessDownload, accessDeniedUnauthenticated)
+		return
+	}
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+	if video.ID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, "Couldn't get video", nil)
+		return
+	}
+	// Not videoWithRole, so denials make it into the access log
+	role, err := cfg.videoRole(video, userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't check access to video", err)
+		return
+	}
+	if !roleAtLeast(role, database.OrgRoleViewer) {
+		cfg.logRequestAccess(r, userID, video.ID, accessDownload, accessDeniedRole)
+		respondWithErrorCode(w, http.StatusForbidden, codeNotOwner, "Video not owned by user", nil)
+		return
+	}
+	if video.StagingKey == nil {
+		respondWithError(w, http.StatusConflict, "Video has no original to download", nil)
+		return
+	}
+
+	filename := video.ID.String() + ".mp4"
+	if video.OriginalFilename != nil {
+		filename = *video.OriginalFilename
+	}
+	disposition := mime.FormatMediaType("attachment", map[string]string{"filename": filename})
+
+	// S3 only has the encrypted bytes of encrypted videos, so they're
+	// decrypted here rather than downloaded from a presigned link
+	if video.Encrypted {
+		dataKey, err := cfg.videoDataKey(r.Context(), video)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't get video key", err)
+			return
+		}
+		cfg.audit(r, userID, "video.download", "video", video.ID.String(), "original: "+filename)
+		cfg.logRequestAccess(r, userID, video.ID, accessDownload, "")
+		w.Header().Set("Cache-Control", "no-store")
+		w.Header().Set("Content-Disposition", disposition)
+		cfg.streamObject(w, r, *video.StagingKey, dataKey)
+		return
+	}
+
+	downloadURL, err := cfg.presignDownload(r.Context(), *video.StagingKey, disposition)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create download link", err)
+		return
+	}
+	cfg.audit(r, userID, "video.download", "video", video.ID.String(), "original: "+filename)
+	cfg.logRequestAccess(r, userID, video.ID, accessDownload, "")
+
+	w.Header().Set("Cache-Control", "no-store")
+	http.Redirect(w, r, downloadURL, http.StatusFound)
+}
+
+// presignDownload is presignObject for a link S3 serves with the given
+// Content-Disposition.
+func (cfg *apiConfig) presignDownload(ctx context.Context, key, disposition string) (string, error) {
+	req, err := cfg.s3PresignClient.PresignGetObject(ctx, &s3.GetObjectInput{
+		Bucket:                     &cfg.s3Bucket,
+		Key:                        &key,
+		ResponseContentDisposition: &disposition,
+	}, s3.WithPresignExpires(cfg.signedURLTTL))
+	if err != nil {
+		return "", err
+	}
+	return req.URL, nil
+}
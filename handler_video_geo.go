@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+// handlerVideoGeoRestrictionUpdate sets the countries a video plays in.
+// Sending two empty lists lifts the restriction.
+func (cfg *apiConfig) handlerVideoGeoRestrictionUpdate(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Allow []string `json:"allow"`
+		Deny  []string `json:"deny"`
+	}
+
+	video, userID, ok := cfg.ownVideo(w, r)
+	if !ok {
+		return
+	}
+	if !checkVideoIfMatch(w, r, video) {
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err := decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters", err)
+		return
+	}
+
+	allow, err := countryCodes(params.Allow)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Invalid allow list: %v", err), err)
+		return
+	}
+	deny, err := countryCodes(params.Deny)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Invalid deny list: %v", err), err)
+		return
+	}
+
+	video.GeoRestriction = nil
+	if len(allow) > 0 || len(deny) > 0 {
+		video.GeoRestriction = &database.GeoRestriction{Allow: allow, Deny: deny}
+	}
+	video, err = cfg.db.UpdateVideo(video)
+	if err != nil {
+		respondWithVideoUpdateError(w, "Couldn't update video", err)
+		return
+	}
+	cfg.audit(r, userID, "video.geo_restriction", "video", video.ID.String(), fmt.Sprintf("allow: %v, deny: %v", allow, deny))
+
+	cfg.respondWithVideo(w, r, http.StatusOK, video)
+}
+
+// countryCodes upper-cases, sorts and dedupes ISO 3166-1 alpha-2 codes.
+func countryCodes(codes []string) ([]string, error) {
+	out := make([]string, 0, len(codes))
+	for _, code := range codes {
+		code = strings.ToUpper(strings.TrimSpace(code))
+		if len(code) != 2 || code[0] < 'A' || code[0] > 'Z' || code[1] < 'A' || code[1] > 'Z' {
+			return nil, fmt.Errorf("%q isn't an ISO 3166-1 alpha-2 country code", code)
+		}
+		out = append(out, code)
+	}
+	slices.Sort(out)
+	return slices.Compact(out), nil
+}
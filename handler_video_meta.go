@@ -2,7 +2,10 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
+	"strings"
 
 	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
 	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
@@ -19,7 +22,7 @@ func (cfg *apiConfig) handlerVideoMetaCreate(w http.ResponseWriter, r *http.Requ
 		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
 		return
 	}
-	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	userID, err := cfg.validateJWT(token)
 	if err != nil {
 		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
 		return
@@ -33,14 +36,53 @@ func (cfg *apiConfig) handlerVideoMetaCreate(w http.ResponseWriter, r *http.Requ
 		return
 	}
 	params.UserID = userID
+	if params.Visibility != "" && !validVisibility(params.Visibility) {
+		respondWithError(w, http.StatusBadRequest, "Invalid visibility", nil)
+		return
+	}
+	params.Tags, err = normalizeTags(params.Tags)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid tags", err)
+		return
+	}
+	if params.OrgID != nil {
+		role, err := cfg.db.GetOrganizationRole(*params.OrgID, userID)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't get organization", err)
+			return
+		}
+		if role == "" {
+			respondWithError(w, http.StatusNotFound, "Couldn't get organization", nil)
+			return
+		}
+		if !roleAtLeast(role, database.OrgRoleEditor) {
+			respondWithErrorCode(w, http.StatusForbidden, codeNotOwner, "Only editors can add videos to the organization", nil)
+			return
+		}
+	}
+	params.WrappedKey = nil
+	if params.Encrypted {
+		wrappedKey, err := cfg.newVideoKey(r.Context())
+		if errors.Is(err, errEncryptionDisabled) {
+			respondWithError(w, http.StatusBadRequest, "Encrypted videos aren't enabled on this server", err)
+			return
+		}
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't create video key", err)
+			return
+		}
+		params.WrappedKey = &wrappedKey
+	}
 
-	video, err := cfg.db.CreateVideo(params.CreateVideoParams)
+	video, err := cfg.createVideo(params.CreateVideoParams)
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Couldn't create video", err)
 		return
 	}
+	cfg.audit(r, userID, "video.create", "video", video.ID.String(), fmt.Sprintf("title: %q", video.Title))
+	cfg.publishVideoEvent(eventVideoCreated, video, nil)
 
-	respondWithJSON(w, http.StatusCreated, video)
+	cfg.respondWithVideo(w, r, http.StatusCreated, video)
 }
 
 func (cfg *apiConfig) handlerVideoMetaDelete(w http.ResponseWriter, r *http.Request) {
@@ -56,7 +98,7 @@ func (cfg *apiConfig) handlerVideoMetaDelete(w http.ResponseWriter, r *http.Requ
 		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
 		return
 	}
-	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	userID, err := cfg.validateJWT(token)
 	if err != nil {
 		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
 		return
@@ -64,23 +106,130 @@ func (cfg *apiConfig) handlerVideoMetaDelete(w http.ResponseWriter, r *http.Requ
 
 	video, err := cfg.db.GetVideo(videoID)
 	if err != nil {
-		respondWithError(w, http.StatusNotFound, "Couldn't get video", err)
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+	if video.ID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, "Couldn't get video", nil)
 		return
 	}
-	if video.UserID != userID {
-		respondWithError(w, http.StatusForbidden, "You can't delete this video", err)
+	if !cfg.authorizeVideo(w, video, userID, database.OrgRoleOwner, "You can't delete this video") {
 		return
 	}
 
-	err = cfg.db.DeleteVideo(videoID)
+	err = cfg.db.TrashVideo(videoID)
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Couldn't delete video", err)
 		return
 	}
+	cfg.audit(r, userID, "video.trash", "video", videoID.String(), fmt.Sprintf("moved %q to trash", video.Title))
+	cfg.publishVideoEvent(eventVideoDeleted, video, nil)
 
 	w.WriteHeader(http.StatusNoContent)
 }
 
+func (cfg *apiConfig) handlerVideoRestore(w http.ResponseWriter, r *http.Request) {
+	videoIDString := r.PathValue("videoID")
+	videoID, err := uuid.Parse(videoIDString)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid ID", err)
+		return
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := cfg.validateJWT(token)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	video, err := cfg.db.GetTrashedVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+	if video.ID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, "Video not found in trash", nil)
+		return
+	}
+	if !cfg.authorizeVideo(w, video, userID, database.OrgRoleOwner, "You can't restore this video") {
+		return
+	}
+
+	err = cfg.db.RestoreVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't restore video", err)
+		return
+	}
+	cfg.audit(r, userID, "video.restore", "video", videoID.String(), fmt.Sprintf("restored %q from trash", video.Title))
+
+	video, err = cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+	if video.ID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, "Couldn't get video", nil)
+		return
+	}
+
+	cfg.respondWithVideo(w, r, http.StatusOK, video)
+}
+
+func (cfg *apiConfig) handlerVideoPublish(w http.ResponseWriter, r *http.Request) {
+	videoIDString := r.PathValue("videoID")
+	videoID, err := uuid.Parse(videoIDString)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid ID", err)
+		return
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := cfg.validateJWT(token)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+	if video.ID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, "Couldn't get video", nil)
+		return
+	}
+	if !cfg.authorizeVideo(w, video, userID, database.OrgRoleEditor, "You can't publish this video") {
+		return
+	}
+	if !checkVideoIfMatch(w, r, video) {
+		return
+	}
+	if video.VideoURL == nil {
+		respondWithErrorCode(w, http.StatusConflict, codeVideoNotUploaded, "Video has no uploaded file yet", nil)
+		return
+	}
+
+	video.Published = true
+	video, err = cfg.db.UpdateVideo(video)
+	if err != nil {
+		respondWithVideoUpdateError(w, "Couldn't publish video", err)
+		return
+	}
+	cfg.audit(r, userID, "video.publish", "video", videoID.String(), "published: false -> true")
+
+	cfg.respondWithVideo(w, r, http.StatusOK, video)
+}
+
 func (cfg *apiConfig) handlerVideoGet(w http.ResponseWriter, r *http.Request) {
 	videoIDString := r.PathValue("videoID")
 	videoID, err := uuid.Parse(videoIDString)
@@ -91,11 +240,149 @@ func (cfg *apiConfig) handlerVideoGet(w http.ResponseWriter, r *http.Request) {
 
 	dbVideo, err := cfg.db.GetVideo(videoID)
 	if err != nil {
-		respondWithError(w, http.StatusNotFound, "Couldn't get video", err)
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+	if dbVideo.ID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, "Couldn't get video", nil)
+		return
+	}
+
+	// Private videos are hidden from everyone but their owner and members
+	// of their organization
+	if viewerID := cfg.optionalUserID(r); dbVideo.Visibility == database.VisibilityPrivate && !cfg.canViewVideo(dbVideo, viewerID) {
+		cfg.logRequestAccess(r, viewerID, dbVideo.ID, accessPresign, accessDeniedPrivate)
+		respondWithError(w, http.StatusNotFound, "Couldn't get video", nil)
 		return
 	}
 
-	respondWithJSON(w, http.StatusOK, dbVideo)
+	cfg.respondWithVideo(w, r, http.StatusOK, dbVideo)
+}
+
+func (cfg *apiConfig) handlerVideoVisibilityUpdate(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Visibility string `json:"visibility"`
+	}
+
+	videoIDString := r.PathValue("videoID")
+	videoID, err := uuid.Parse(videoIDString)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid ID", err)
+		return
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := cfg.validateJWT(token)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err = decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters", err)
+		return
+	}
+	if !validVisibility(params.Visibility) {
+		respondWithError(w, http.StatusBadRequest, "Invalid visibility", nil)
+		return
+	}
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+	if video.ID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, "Couldn't get video", nil)
+		return
+	}
+	if !cfg.authorizeVideo(w, video, userID, database.OrgRoleEditor, "You can't change this video") {
+		return
+	}
+	if !checkVideoIfMatch(w, r, video) {
+		return
+	}
+
+	oldVisibility := video.Visibility
+	video.Visibility = params.Visibility
+	video, err = cfg.db.UpdateVideo(video)
+	if err != nil {
+		respondWithVideoUpdateError(w, "Couldn't update video", err)
+		return
+	}
+	cfg.audit(r, userID, "video.visibility", "video", videoID.String(), fmt.Sprintf("visibility: %s -> %s", oldVisibility, video.Visibility))
+
+	cfg.respondWithVideo(w, r, http.StatusOK, video)
+}
+
+func (cfg *apiConfig) handlerVideoTagsUpdate(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Tags []string `json:"tags"`
+	}
+
+	videoIDString := r.PathValue("videoID")
+	videoID, err := uuid.Parse(videoIDString)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid ID", err)
+		return
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := cfg.validateJWT(token)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err = decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters", err)
+		return
+	}
+	tags, err := normalizeTags(params.Tags)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid tags", err)
+		return
+	}
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+	if video.ID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, "Couldn't get video", nil)
+		return
+	}
+	if !cfg.authorizeVideo(w, video, userID, database.OrgRoleEditor, "You can't change this video") {
+		return
+	}
+	if !checkVideoIfMatch(w, r, video) {
+		return
+	}
+
+	video.Tags = tags
+	video, err = cfg.db.UpdateVideo(video)
+	if err != nil {
+		respondWithVideoUpdateError(w, "Couldn't update video", err)
+		return
+	}
+	cfg.audit(r, userID, "video.tags", "video", videoID.String(), fmt.Sprintf("tags: %s", strings.Join(tags, ", ")))
+
+	cfg.respondWithVideo(w, r, http.StatusOK, video)
 }
 
 func (cfg *apiConfig) handlerVideosRetrieve(w http.ResponseWriter, r *http.Request) {
@@ -104,17 +391,28 @@ func (cfg *apiConfig) handlerVideosRetrieve(w http.ResponseWriter, r *http.Reque
 		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
 		return
 	}
-	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	userID, err := cfg.validateJWT(token)
 	if err != nil {
 		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
 		return
 	}
 
-	videos, err := cfg.db.GetVideos(userID)
+	page, err := cfg.parsePage(r.URL.Query())
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid page", err)
+		return
+	}
+
+	videos, next, err := cfg.db.GetVideos(userID, page)
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Couldn't retrieve videos", err)
 		return
 	}
+	videos, err = cfg.signVideos(accessContext(r, userID), videos)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't sign video URLs", err)
+		return
+	}
 
-	respondWithJSON(w, http.StatusOK, videos)
+	respondWithPage(w, videos, next)
 }
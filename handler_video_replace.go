@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// handlerVideoReplace swaps a video's file for a new upload while keeping
+// its ID, so links, stats and comments carry over. The old files stay
+// playable until the new one is ready and are deleted after
+// cfg.replacedObjectGrace, except for the source which is kept as a
+// version.
+func (cfg *apiConfig) handlerVideoReplace(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, cfg.maxVideoUploadSize)
+
+	video, userID, ok := cfg.ownVideo(w, r)
+	if !ok {
+		return
+	}
+	if err := cfg.ensureCanUpload(userID); err != nil {
+		respondWithErrorCode(w, http.StatusForbidden, codeEmailUnverified, "Verify your email address before uploading", err)
+		return
+	}
+	if _, ok := videoObjectKey(video); !ok {
+		respondWithError(w, http.StatusConflict, "Video has no file to replace, upload one instead", nil)
+		return
+	}
+	ctx, release, ok := cfg.claimVideoUpload(w, r, video.ID)
+	if !ok {
+		return
+	}
+	defer release()
+
+	upload, cleanup, ok := cfg.readVideoUpload(w, r, userID)
+	if !ok {
+		return
+	}
+	defer cleanup()
+	if r.FormValue("storage_class") == "" && video.StorageClass != "" {
+		upload.storageClass = types.StorageClass(video.StorageClass)
+	}
+
+	old := video
+	video, err := cfg.replaceVideoFile(ctx, video, upload)
+	if err != nil {
+		respondWithPipelineError(w, uploadFailure(ctx, err))
+		return
+	}
+	cfg.audit(r, userID, "video.replace", "video", video.ID.String(), fmt.Sprintf("video_key: %q -> %q", stringOrEmpty(old.VideoKey), stringOrEmpty(video.VideoKey)))
+
+	cfg.respondWithVideo(w, r, http.StatusOK, video)
+}
+
+// replaceVideoFile runs the uploaded file through the pipeline as the
+// video's new source. The current source is kept as a version and the rest
+// of the old files are scheduled for deletion.
+func (cfg *apiConfig) replaceVideoFile(ctx context.Context, video database.Video, upload videoUpload) (database.Video, error) {
+	// Stage under a fresh key so the current original survives a failed
+	// replacement. Nothing is written to the database until the pipeline's
+	// final update flips every URL at once.
+	old := video
+	stagingKey := fmt.Sprintf("%s%s%s-%s.mp4", video.KeyPrefix, cfg.s3StagingPrefix, video.ID, uuid.New())
+	err := cfg.putStagingObject(ctx, video, stagingKey, mediaInput{path: upload.path}, upload.mediaType, upload.checksum)
+	if err != nil {
+		return database.Video{}, &pipelineError{"stage", http.StatusInternalServerError, "Couldn't stage original video", err}
+	}
+	digest := upload.checksum.sha256Hex()
+	video.StagingKey = &stagingKey
+	video.StagingChecksumSHA256 = &digest
+	video.OriginalFilename = upload.filename
+
+	video, err = cfg.processVideo(ctx, video, upload.path, upload.mediaType, upload.storageClass)
+	if err != nil {
+		cfg.deleteObjectQuietly(stagingKey)
+		return database.Video{}, err
+	}
+
+	archived := true
+	if err := cfg.archiveSource(ctx, old); err != nil {
+		log.Printf("Couldn't keep source of video %s as a version, leaving it at %s: %v", old.ID, stringOrEmpty(old.StagingKey), err)
+		archived = false
+	}
+	cfg.scheduleReplacedFiles(old, archived)
+	return video, nil
+}
+
+// archiveSource copies a video's staged original under the versions
+// prefix and records it so the video can be rolled back to it.
+func (cfg *apiConfig) archiveSource(ctx context.Context, video database.Video) error {
+	if video.StagingKey == nil {
+		return nil
+	}
+	key := fmt.Sprintf("%s%s.mp4", cfg.videoVersionsPrefix(video), uuid.New())
+	copySource := cfg.s3Bucket + "/" + *video.StagingKey
+	err := cfg.retry.do(ctx, "s3_copy_version_object", func() error {
+		_, err := cfg.s3Client.CopyObject(ctx, &s3.CopyObjectInput{
+			Bucket:     &cfg.s3Bucket,
+			Key:        &key,
+			CopySource: &copySource,
+		})
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	_, err = cfg.db.CreateVideoVersion(database.CreateVideoVersionParams{
+		VideoID:          video.ID,
+		Key:              key,
+		ChecksumSHA256:   video.StagingChecksumSHA256,
+		OriginalFilename: video.OriginalFilename,
+	})
+	return err
+}
+
+// videoVersionsPrefix is where the earlier sources of a video are kept.
+func (cfg *apiConfig) videoVersionsPrefix(video database.Video) string {
+	return video.KeyPrefix + cfg.s3VersionsPrefix + video.ID.String() + "/"
+}
+
+// scheduleReplacedFiles queues the S3 objects of a video's previous
+// version for deletion once cfg.replacedObjectGrace has passed. The staged
+// original is only included once it's been archived as a version.
+func (cfg *apiConfig) scheduleReplacedFiles(old database.Video, archived bool) {
+	deleteAfter := time.Now().Add(cfg.replacedObjectGrace)
+	schedule := func(key string, prefix bool) {
+		if err := cfg.db.ScheduleObjectDeletion(key, prefix, deleteAfter); err != nil {
+			log.Printf("Couldn't schedule deletion of replaced object %s of video %s: %v", key, old.ID, err)
+		}
+	}
+	if key, ok := videoObjectKey(old); ok {
+		schedule(key, false)
+	}
+	if old.StagingKey != nil && archived {
+		schedule(*old.StagingKey, false)
+	}
+	if prefix, ok := videoDashPrefix(old); ok {
+		schedule(prefix, true)
+	}
+}
+
+// deleteObjectQuietly removes an object that's no longer needed, logging
+// rather than returning failures. Orphan collection catches anything left
+// behind.
+func (cfg *apiConfig) deleteObjectQuietly(key string) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	_, err := cfg.s3Client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: &cfg.s3Bucket,
+		Key:    &key,
+	})
+	if err != nil {
+		log.Printf("Couldn't delete object %s: %v", key, err)
+	}
+}
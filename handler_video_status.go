@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+// videoStatusProcessing is the status of a video whose pipeline is
+// running, alongside the ones the admin stats count.
+const videoStatusProcessing = "processing"
+
+type videoStatusResponse struct {
+	Status string `json:"status"`
+	// Processing is how far along a running pipeline is
+	Processing *database.ProcessingProgress `json:"processing,omitempty"`
+	// Error is why the last run failed
+	Error string `json:"error,omitempty"`
+}
+
+// handlerVideoStatus tells the owner where their video is in processing,
+// so clients can show progress like "Transcoding 42%" while they wait.
+func (cfg *apiConfig) handlerVideoStatus(w http.ResponseWriter, r *http.Request) {
+	video, _, ok := cfg.videoWithRole(w, r, database.OrgRoleViewer)
+	if !ok {
+		return
+	}
+
+	progress, err := cfg.db.GetProcessingProgress(video.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get processing progress", err)
+		return
+	}
+	failure, err := cfg.db.GetProcessingFailure(video.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get processing failure", err)
+		return
+	}
+
+	var resp videoStatusResponse
+	switch {
+	case video.DeletedAt != nil:
+		resp.Status = database.VideoStatusTrashed
+	// Progress stops being refreshed if its server dies mid-run
+	case progress != nil && time.Since(progress.UpdatedAt) < progressStaleAfter:
+		resp.Status = videoStatusProcessing
+		resp.Processing = progress
+	case failure != nil && failure.DeadAt != nil:
+		resp.Status = database.VideoStatusDeadLettered
+		resp.Error = failure.Error
+	case failure != nil:
+		resp.Status = database.VideoStatusFailing
+		resp.Error = failure.Error
+	case video.VideoURL != nil:
+		resp.Status = database.VideoStatusReady
+	default:
+		resp.Status = database.VideoStatusAwaitingUpload
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	respondWithJSON(w, http.StatusOK, resp)
+}
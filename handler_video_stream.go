@@ -0,0 +1,55 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// handlerVideoStream streams a video's MP4 through the app for deployments
+// that can't hand out presigned or CDN URLs. Unlike the playback endpoint
+// it needs no token, so the caller's access is checked on every request.
+func (cfg *apiConfig) handlerVideoStream(w http.ResponseWriter, r *http.Request) {
+	videoID, err := uuid.Parse(r.PathValue("videoID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid video ID", err)
+		return
+	}
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+	if video.ID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, "Couldn't get video", nil)
+		return
+	}
+	viewerID := cfg.optionalUserID(r)
+	if video.Visibility == database.VisibilityPrivate && !cfg.canViewVideo(video, viewerID) {
+		cfg.logRequestAccess(r, viewerID, video.ID, accessStream, accessDeniedPrivate)
+		respondWithError(w, http.StatusNotFound, "Couldn't get video", nil)
+		return
+	}
+	if block := cfg.checkGeoRestriction(r, video); block != nil {
+		cfg.logRequestAccess(r, viewerID, video.ID, accessStream, string(block.code))
+		respondWithGeoBlock(w, block)
+		return
+	}
+	key, ok := videoObjectKey(video)
+	if !ok {
+		respondWithErrorCode(w, http.StatusConflict, codeVideoNotUploaded, "Video has no uploaded file yet", nil)
+		return
+	}
+
+	dataKey, err := cfg.videoDataKey(r.Context(), video)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video key", err)
+		return
+	}
+
+	cfg.logRequestAccess(r, viewerID, video.ID, accessStream, "")
+	w.Header().Set("Cache-Control", "private, no-store")
+	cfg.streamObject(w, r, key, dataKey)
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+func (cfg *apiConfig) handlerVideoVersionsList(w http.ResponseWriter, r *http.Request) {
+	video, _, ok := cfg.videoWithRole(w, r, database.OrgRoleViewer)
+	if !ok {
+		return
+	}
+	versions, err := cfg.db.GetVideoVersions(video.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video versions", err)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, versions)
+}
+
+func (cfg *apiConfig) handlerVideoRollback(w http.ResponseWriter, r *http.Request) {
+	video, userID, ok := cfg.ownVideo(w, r)
+	if !ok {
+		return
+	}
+	cfg.rollbackVideo(w, r, video, userID)
+}
+
+func (cfg *apiConfig) handlerAdminVideoRollback(w http.ResponseWriter, r *http.Request) {
+	if err := cfg.authorizeAdmin(r); err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't authorize admin", err)
+		return
+	}
+	videoID, err := uuid.Parse(r.PathValue("videoID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid ID", err)
+		return
+	}
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+	if video.ID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, "Couldn't get video", nil)
+		return
+	}
+	cfg.rollbackVideo(w, r, video, uuid.Nil)
+}
+
+// rollbackVideo makes the version in the path the video's source again.
+// The source it replaces becomes a version itself, so a rollback can be
+// undone.
+func (cfg *apiConfig) rollbackVideo(w http.ResponseWriter, r *http.Request, video database.Video, actorID uuid.UUID) {
+	versionID, err := uuid.Parse(r.PathValue("versionID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid version ID", err)
+		return
+	}
+	version, err := cfg.db.GetVideoVersion(versionID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video version", err)
+		return
+	}
+	if version.VideoID != video.ID {
+		respondWithError(w, http.StatusNotFound, "Couldn't find video version", nil)
+		return
+	}
+	ctx, release, ok := cfg.claimVideoUpload(w, r, video.ID)
+	if !ok {
+		return
+	}
+	defer release()
+
+	dataKey, err := cfg.videoDataKey(ctx, video)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video key", err)
+		return
+	}
+	path, checksum, err := cfg.downloadVerified(ctx, version.Key, version.ChecksumSHA256, dataKey)
+	if isScratchFull(err) {
+		respondWithScratchFull(w, err)
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't download video version", err)
+		return
+	}
+	defer os.Remove(path)
+
+	storageClass := cfg.s3StorageClass
+	if video.StorageClass != "" {
+		storageClass = types.StorageClass(video.StorageClass)
+	}
+
+	oldVideoKey := stringOrEmpty(video.VideoKey)
+	video, err = cfg.replaceVideoFile(ctx, video, videoUpload{
+		path:         path,
+		mediaType:    "video/mp4",
+		checksum:     checksum,
+		storageClass: storageClass,
+		filename:     version.OriginalFilename,
+	})
+	if err != nil {
+		respondWithPipelineError(w, uploadFailure(ctx, err))
+		return
+	}
+	cfg.audit(r, actorID, "video.rollback", "video", video.ID.String(), fmt.Sprintf("version: %s, video_key: %q -> %q", version.ID, oldVideoKey, stringOrEmpty(video.VideoKey)))
+
+	cfg.respondWithVideo(w, r, http.StatusOK, video)
+}
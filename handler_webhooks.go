@@ -0,0 +1,230 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+const maxWebhookEndpointsPerUser = 10
+
+// handlerWebhookCreate registers a URL to receive the user's video events.
+// The signing secret is only returned here.
+func (cfg *apiConfig) handlerWebhookCreate(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		URL string `json:"url"`
+		// Events defaults to every event type
+		Events []string `json:"events"`
+	}
+	type response struct {
+		database.WebhookEndpoint
+		Secret string `json:"secret"`
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := cfg.validateJWT(token)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err = decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters", err)
+		return
+	}
+	u, err := url.Parse(params.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		respondWithError(w, http.StatusBadRequest, "Webhook URL must be an absolute http or https URL", err)
+		return
+	}
+	for _, event := range params.Events {
+		if !slices.Contains(videoEventTypes, event) {
+			respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Unknown event %q", event), nil)
+			return
+		}
+	}
+
+	existing, err := cfg.db.GetWebhookEndpoints(userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get webhooks", err)
+		return
+	}
+	if len(existing) >= maxWebhookEndpointsPerUser {
+		respondWithError(w, http.StatusConflict, fmt.Sprintf("You can't have more than %d webhooks", maxWebhookEndpointsPerUser), nil)
+		return
+	}
+
+	secret := newWebhookSecret()
+	endpoint, err := cfg.db.CreateWebhookEndpoint(database.CreateWebhookEndpointParams{
+		UserID: userID,
+		URL:    u.String(),
+		Secret: secret,
+		Events: slices.Compact(slices.Sorted(slices.Values(params.Events))),
+	})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create webhook", err)
+		return
+	}
+	cfg.audit(r, userID, "webhook.create", "webhook", endpoint.ID.String(), fmt.Sprintf("url: %s", endpoint.URL))
+
+	respondWithJSON(w, http.StatusCreated, response{WebhookEndpoint: endpoint, Secret: secret})
+}
+
+func (cfg *apiConfig) handlerWebhooksList(w http.ResponseWriter, r *http.Request) {
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := cfg.validateJWT(token)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	endpoints, err := cfg.db.GetWebhookEndpoints(userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get webhooks", err)
+		return
+	}
+	// Users have few enough webhooks that they always fit on one page
+	respondWithPage(w, endpoints, nil)
+}
+
+func (cfg *apiConfig) handlerWebhookDelete(w http.ResponseWriter, r *http.Request) {
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := cfg.validateJWT(token)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	endpoint, ok := cfg.ownWebhookEndpoint(w, r, userID)
+	if !ok {
+		return
+	}
+	err = cfg.db.DeleteWebhookEndpoint(endpoint.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't delete webhook", err)
+		return
+	}
+	cfg.audit(r, userID, "webhook.delete", "webhook", endpoint.ID.String(), fmt.Sprintf("url: %s", endpoint.URL))
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handlerWebhookDeliveriesList pages through an endpoint's delivery log,
+// newest first.
+func (cfg *apiConfig) handlerWebhookDeliveriesList(w http.ResponseWriter, r *http.Request) {
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := cfg.validateJWT(token)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	endpoint, ok := cfg.ownWebhookEndpoint(w, r, userID)
+	if !ok {
+		return
+	}
+	page, err := cfg.parsePage(r.URL.Query())
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid page", err)
+		return
+	}
+
+	deliveries, next, err := cfg.db.GetWebhookDeliveries(endpoint.ID, page)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get webhook deliveries", err)
+		return
+	}
+	respondWithPage(w, deliveries, next)
+}
+
+// handlerWebhookRedeliver queues a logged delivery to be sent again, for
+// receivers that missed or mishandled it.
+func (cfg *apiConfig) handlerWebhookRedeliver(w http.ResponseWriter, r *http.Request) {
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := cfg.validateJWT(token)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	endpoint, ok := cfg.ownWebhookEndpoint(w, r, userID)
+	if !ok {
+		return
+	}
+	deliveryID, err := uuid.Parse(r.PathValue("deliveryID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid delivery ID", err)
+		return
+	}
+	delivery, err := cfg.db.GetWebhookDelivery(deliveryID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get webhook delivery", err)
+		return
+	}
+	if delivery.ID == uuid.Nil || delivery.EndpointID != endpoint.ID {
+		respondWithError(w, http.StatusNotFound, "Webhook delivery not found", nil)
+		return
+	}
+
+	err = cfg.db.RedeliverWebhook(delivery.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't redeliver webhook", err)
+		return
+	}
+	cfg.audit(r, userID, "webhook.redeliver", "webhook", endpoint.ID.String(), fmt.Sprintf("delivery %s of %s", delivery.ID, delivery.Event))
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// ownWebhookEndpoint loads the endpoint named in the path and checks that
+// userID owns it, responding with an error if not.
+func (cfg *apiConfig) ownWebhookEndpoint(w http.ResponseWriter, r *http.Request, userID uuid.UUID) (database.WebhookEndpoint, bool) {
+	endpointID, err := uuid.Parse(r.PathValue("webhookID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid ID", err)
+		return database.WebhookEndpoint{}, false
+	}
+	endpoint, err := cfg.db.GetWebhookEndpoint(endpointID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get webhook", err)
+		return database.WebhookEndpoint{}, false
+	}
+	if endpoint.ID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, "Webhook not found", nil)
+		return database.WebhookEndpoint{}, false
+	}
+	if endpoint.UserID != userID {
+		respondWithErrorCode(w, http.StatusForbidden, codeNotOwner, "You can't manage this webhook", nil)
+		return database.WebhookEndpoint{}, false
+	}
+	return endpoint, true
+}
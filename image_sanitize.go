@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+
+	_ "golang.org/x/image/webp"
+)
+
+// thumbnailJPEGQuality is used when re-encoding JPEG thumbnails.
+const thumbnailJPEGQuality = 90
+
+var errImageTooLarge = errors.New("image has too many pixels")
+
+// checkImageSize reads the dimensions in the header of the image r holds
+// and rewinds it. Images over maxPixels fail with errImageTooLarge, since a
+// small file can declare a canvas that takes gigabytes to decode.
+func checkImageSize(r io.ReadSeeker, maxPixels int64) (image.Config, error) {
+	config, _, err := image.DecodeConfig(r)
+	if err != nil {
+		return image.Config{}, err
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return image.Config{}, err
+	}
+	if pixels := int64(config.Width) * int64(config.Height); pixels > maxPixels {
+		return image.Config{}, fmt.Errorf("%w: %dx%d", errImageTooLarge, config.Width, config.Height)
+	}
+	return config, nil
+}
+
+// stripImageMetadata decodes and re-encodes an image of mediaType so that
+// only pixel data survives. EXIF (including GPS location), XMP, comments
+// and text chunks are all dropped in the process. JPEG, PNG and GIF keep
+// their format; anything else image.Decode reads is converted to
+// convertType, which is returned as the result's type.
+func stripImageMetadata(r io.Reader, mediaType, convertType string) ([]byte, string, error) {
+	var buf bytes.Buffer
+	switch mediaType {
+	case "image/gif":
+		// DecodeAll keeps every frame so animated thumbnails still animate
+		g, err := gif.DecodeAll(r)
+		if err != nil {
+			return nil, "", err
+		}
+		err = gif.EncodeAll(&buf, g)
+		if err != nil {
+			return nil, "", err
+		}
+		return buf.Bytes(), mediaType, nil
+	case "image/jpeg", "image/png":
+		convertType = mediaType
+	}
+	img, _, err := image.Decode(r)
+	if err != nil {
+		return nil, "", err
+	}
+	if err := encodeImage(&buf, img, convertType); err != nil {
+		return nil, "", err
+	}
+	return buf.Bytes(), convertType, nil
+}
+
+// encodeImage writes img as a JPEG or PNG.
+func encodeImage(w io.Writer, img image.Image, mediaType string) error {
+	switch mediaType {
+	case "image/jpeg":
+		return jpeg.Encode(w, img, &jpeg.Options{Quality: thumbnailJPEGQuality})
+	case "image/png":
+		return png.Encode(w, img)
+	default:
+		return fmt.Errorf("can't encode %s", mediaType)
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+// readImageUpload reads the image in form field, checks its contents
+// against the declared type and strips its metadata. The file is decoded
+// straight from the form, which keeps only small files in memory. On
+// failure it writes the error response itself and returns ok == false.
+// label names the image in error messages.
+func (cfg *apiConfig) readImageUpload(w http.ResponseWriter, r *http.Request, field, label string, maxSize int64) (data []byte, mediaType string, ok bool) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxSize)
+	const maxMemory = 1 << 20 // 1 MB
+	err := r.ParseMultipartForm(maxMemory)
+	if isBodyTooLarge(err) {
+		respondWithError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("%s exceeds the upload size limit", label), err)
+		return nil, "", false
+	}
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't parse multipart form", err)
+		return nil, "", false
+	}
+
+	file, header, err := r.FormFile(field)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Couldn't get %s file from form", field), err)
+		return nil, "", false
+	}
+	defer file.Close()
+
+	// Get the media type
+	mediaType, _, err = mime.ParseMediaType(header.Header.Get("Content-Type"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't parse media type", err)
+		return nil, "", false
+	}
+
+	// Check the file's contents rather than trusting the declared type
+	head, err := readHead(file)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Couldn't read %s file", field), err)
+		return nil, "", false
+	}
+	if sniffed := sniffImageType(head); sniffed != mediaType {
+		respondWithError(w, http.StatusUnsupportedMediaType, "File contents don't match declared type", fmt.Errorf("declared %s, detected %q", mediaType, sniffed))
+		return nil, "", false
+	}
+	var src io.ReadSeeker = file
+	if mediaType == "image/avif" {
+		converted, cleanup, err := cfg.convertAVIF(r.Context(), file)
+		if errors.Is(err, errImageTooLarge) {
+			respondWithError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("%s exceeds the image dimension limit", label), err)
+			return nil, "", false
+		}
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Couldn't process %s image", field), err)
+			return nil, "", false
+		}
+		defer cleanup()
+		src = converted
+	}
+	_, err = checkImageSize(src, cfg.maxImagePixels)
+	if errors.Is(err, errImageTooLarge) {
+		respondWithError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("%s exceeds the image dimension limit", label), err)
+		return nil, "", false
+	}
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Couldn't process %s image", field), err)
+		return nil, "", false
+	}
+
+	// Re-encode so EXIF and other personal metadata never reach the
+	// assets, converting formats the variants can't be written in
+	data, mediaType, err = stripImageMetadata(src, mediaType, cfg.imageConvertType)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Couldn't process %s image", field), err)
+		return nil, "", false
+	}
+	return data, mediaType, true
+}
+
+// convertAVIF has ffmpeg turn the AVIF image r holds into a PNG, which
+// the standard library can decode. Its dimensions are checked first so a
+// huge canvas is never decoded. The caller runs cleanup once done with the
+// PNG.
+func (cfg *apiConfig) convertAVIF(ctx context.Context, r io.Reader) (png *os.File, cleanup func(), err error) {
+	releaseSlot, err := cfg.transcodes.acquire(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer releaseSlot()
+	ctx, cancel := context.WithTimeout(ctx, cfg.ffprobeTimeout)
+	defer cancel()
+
+	dir, err := os.MkdirTemp(cfg.scratchDir, "tubely-avif")
+	if err != nil {
+		return nil, nil, err
+	}
+	removeDir := func() { os.RemoveAll(dir) }
+	in := filepath.Join(dir, "in.avif")
+	if err := saveFileLocally(dir, "in.avif", r); err != nil {
+		removeDir()
+		return nil, nil, err
+	}
+	info, err := cfg.prober.Probe(ctx, in)
+	if err != nil {
+		removeDir()
+		return nil, nil, err
+	}
+	if pixels := int64(info.Width) * int64(info.Height); pixels > cfg.maxImagePixels {
+		removeDir()
+		return nil, nil, fmt.Errorf("%w: %dx%d", errImageTooLarge, info.Width, info.Height)
+	}
+	out := filepath.Join(dir, "out.png")
+	if err := cfg.mediaTranscoder.ConvertImage(ctx, in, out); err != nil {
+		removeDir()
+		return nil, nil, err
+	}
+	png, err = os.Open(out)
+	if err != nil {
+		removeDir()
+		return nil, nil, err
+	}
+	return png, func() {
+		png.Close()
+		removeDir()
+	}, nil
+}
+
+// saveImageAsset writes the image r holds under a random name in the
+// assets directory and returns the URL it's served from.
+func (cfg *apiConfig) saveImageAsset(r io.Reader, mediaType string) (string, error) {
+	fileExt := mediaTypeToFileExt(mediaType)
+	if fileExt == "" {
+		return "", fmt.Errorf("unsupported media type %s", mediaType)
+	}
+	key := make([]byte, 32)
+	rand.Read(key)
+	filename := fmt.Sprintf("%s.%s", base64.RawURLEncoding.EncodeToString(key), fileExt)
+	err := saveFileLocally(cfg.assetsRoot, filename, r)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("http://localhost:%s/assets/%s", cfg.port, filename), nil
+}
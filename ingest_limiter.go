@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"golang.org/x/time/rate"
+)
+
+// ingestRetryAfter is what clients are told to wait when every ingest
+// slot is taken.
+const ingestRetryAfter = 30 * time.Second
+
+var (
+	errIngestBusy = errors.New("every ingest slot is taken")
+	// errUserIngestLimit means the user already has as many uploads in
+	// flight as they're allowed
+	errUserIngestLimit = errors.New("too many uploads in progress for user")
+)
+
+// ingestLimiter throttles upload bodies with token buckets per user and
+// across the instance, and caps how many uploads are in flight at once,
+// in total and per user. A zero rate or slot count leaves that dimension
+// unlimited.
+type ingestLimiter struct {
+	global        *rate.Limiter
+	userRate      rate.Limit
+	userBurst     int
+	slots         chan struct{}
+	maxUserActive int
+
+	mu    sync.Mutex
+	users map[uuid.UUID]*userIngest
+}
+
+type userIngest struct {
+	limiter *rate.Limiter
+	active  int
+}
+
+type ingestConfig struct {
+	// bytes per second
+	userRate   int
+	userBurst  int
+	globalRate int
+	// bytes the global bucket can hand out at once
+	globalBurst int
+	// concurrent uploads across all users
+	maxActive int
+	// concurrent uploads of any one user
+	maxActivePerUser int
+}
+
+func newIngestLimiter(c ingestConfig) *ingestLimiter {
+	l := &ingestLimiter{
+		users:         map[uuid.UUID]*userIngest{},
+		maxUserActive: c.maxActivePerUser,
+	}
+	if c.globalRate > 0 {
+		l.global = rate.NewLimiter(rate.Limit(c.globalRate), max(c.globalBurst, 1))
+	}
+	if c.userRate > 0 {
+		l.userRate = rate.Limit(c.userRate)
+		l.userBurst = max(c.userBurst, 1)
+	}
+	if c.maxActive > 0 {
+		l.slots = make(chan struct{}, c.maxActive)
+	}
+	return l
+}
+
+// begin claims an ingest slot for userID. Without waiting, it returns
+// errUserIngestLimit when the user is at their cap and errIngestBusy when
+// all slots are taken; otherwise release must be called once the upload
+// is done with.
+func (l *ingestLimiter) begin(userID uuid.UUID) (release func(), err error) {
+	l.mu.Lock()
+	u := l.users[userID]
+	if u != nil && l.maxUserActive > 0 && u.active >= l.maxUserActive {
+		l.mu.Unlock()
+		return nil, errUserIngestLimit
+	}
+	if l.slots != nil {
+		select {
+		case l.slots <- struct{}{}:
+		default:
+			l.mu.Unlock()
+			return nil, errIngestBusy
+		}
+	}
+	if u == nil {
+		u = &userIngest{}
+		if l.userRate > 0 {
+			u.limiter = rate.NewLimiter(l.userRate, l.userBurst)
+		}
+		l.users[userID] = u
+	}
+	u.active++
+	l.mu.Unlock()
+
+	return func() {
+		l.mu.Lock()
+		u.active--
+		// Idle users start over with a full bucket next time
+		if u.active == 0 {
+			delete(l.users, userID)
+		}
+		l.mu.Unlock()
+		if l.slots != nil {
+			<-l.slots
+		}
+	}, nil
+}
+
+// respondWithIngestError answers a request begin turned away.
+func respondWithIngestError(w http.ResponseWriter, err error) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(ingestRetryAfter.Seconds())))
+	if errors.Is(err, errUserIngestLimit) {
+		respondWithErrorCode(w, http.StatusTooManyRequests, codeUserUploadLimit, "You have too many uploads in progress, wait for one to finish", err)
+		return
+	}
+	respondWithErrorCode(w, http.StatusTooManyRequests, codeTooManyUploads, "Too many uploads in progress, try again later", err)
+}
+
+// throttle wraps an upload body so reads are paced by the user's and the
+// global buckets. It must be called between begin and release.
+func (l *ingestLimiter) throttle(ctx context.Context, userID uuid.UUID, body io.ReadCloser) io.ReadCloser {
+	l.mu.Lock()
+	var limiters []*rate.Limiter
+	if u := l.users[userID]; u != nil && u.limiter != nil {
+		limiters = append(limiters, u.limiter)
+	}
+	l.mu.Unlock()
+	if l.global != nil {
+		limiters = append(limiters, l.global)
+	}
+	if len(limiters) == 0 {
+		return body
+	}
+
+	chunk := 32 << 10
+	for _, lim := range limiters {
+		chunk = min(chunk, lim.Burst())
+	}
+	return &throttledReader{ReadCloser: body, ctx: ctx, limiters: limiters, chunk: chunk}
+}
+
+type throttledReader struct {
+	io.ReadCloser
+	ctx      context.Context
+	limiters []*rate.Limiter
+	// reads are split so no wait asks a bucket for more than its burst
+	chunk int
+}
+
+func (t *throttledReader) Read(p []byte) (int, error) {
+	if len(p) > t.chunk {
+		p = p[:t.chunk]
+	}
+	n, err := t.ReadCloser.Read(p)
+	if n > 0 {
+		for _, lim := range t.limiters {
+			if werr := lim.WaitN(t.ctx, n); werr != nil {
+				return n, werr
+			}
+		}
+	}
+	return n, err
+}
@@ -2,6 +2,7 @@ package auth
 
 import (
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/hex"
 	"errors"
 	"fmt"
@@ -38,50 +39,81 @@ func CheckPasswordHash(password, hash string) (bool, error) {
 	return match, nil
 }
 
+// Claims are the values carried in an access token.
+type Claims struct {
+	UserID uuid.UUID
+	// TokenVersion must match the user's current token version for the
+	// token to be accepted. Bumping the stored version revokes every
+	// access token issued before it.
+	TokenVersion int
+}
+
+type jwtClaims struct {
+	jwt.RegisteredClaims
+	TokenVersion int `json:"ver"`
+}
+
 func MakeJWT(
 	userID uuid.UUID,
+	tokenVersion int,
 	tokenSecret string,
 	expiresIn time.Duration,
 ) (string, error) {
 	signingKey := []byte(tokenSecret)
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.RegisteredClaims{
-		Issuer:    string(TokenTypeAccess),
-		IssuedAt:  jwt.NewNumericDate(time.Now().UTC()),
-		ExpiresAt: jwt.NewNumericDate(time.Now().UTC().Add(expiresIn)),
-		Subject:   userID.String(),
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwtClaims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    string(TokenTypeAccess),
+			IssuedAt:  jwt.NewNumericDate(time.Now().UTC()),
+			ExpiresAt: jwt.NewNumericDate(time.Now().UTC().Add(expiresIn)),
+			Subject:   userID.String(),
+		},
+		TokenVersion: tokenVersion,
 	})
 	return token.SignedString(signingKey)
 }
 
-func ValidateJWT(tokenString, tokenSecret string) (uuid.UUID, error) {
-	claimsStruct := jwt.RegisteredClaims{}
+// ParseJWT checks an access token's signature, expiry and issuer and
+// returns its claims.
+func ParseJWT(tokenString, tokenSecret string) (Claims, error) {
+	claimsStruct := jwtClaims{}
 	token, err := jwt.ParseWithClaims(
 		tokenString,
 		&claimsStruct,
 		func(token *jwt.Token) (interface{}, error) { return []byte(tokenSecret), nil },
 	)
 	if err != nil {
-		return uuid.Nil, err
+		return Claims{}, err
 	}
 
 	userIDString, err := token.Claims.GetSubject()
 	if err != nil {
-		return uuid.Nil, err
+		return Claims{}, err
 	}
 
 	issuer, err := token.Claims.GetIssuer()
 	if err != nil {
-		return uuid.Nil, err
+		return Claims{}, err
 	}
 	if issuer != string(TokenTypeAccess) {
-		return uuid.Nil, errors.New("invalid issuer")
+		return Claims{}, errors.New("invalid issuer")
 	}
 
 	id, err := uuid.Parse(userIDString)
 	if err != nil {
-		return uuid.Nil, fmt.Errorf("invalid user ID: %w", err)
+		return Claims{}, fmt.Errorf("invalid user ID: %w", err)
 	}
-	return id, nil
+	return Claims{UserID: id, TokenVersion: claimsStruct.TokenVersion}, nil
+}
+
+// ValidateJWT returns the user ID from a valid access token. It doesn't
+// check the token version; callers that need revocation must compare
+// ParseJWT's TokenVersion themselves.
+func ValidateJWT(tokenString, tokenSecret string) (uuid.UUID, error) {
+	claims, err := ParseJWT(tokenString, tokenSecret)
+	if err != nil {
+		return uuid.Nil, err
+	}
+	return claims.UserID, nil
 }
 
 func GetBearerToken(headers http.Header) (string, error) {
@@ -106,6 +138,13 @@ func MakeRefreshToken() (string, error) {
 	return hex.EncodeToString(token), nil
 }
 
+// HashToken returns a hex SHA-256 digest of a random token for storage.
+// Tokens are high-entropy, so a fast unsalted hash is sufficient.
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
 func GetAPIKey(headers http.Header) (string, error) {
 	authHeader := headers.Get("Authorization")
 	if authHeader == "" {
@@ -0,0 +1,86 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+)
+
+const TokenTypePlayback TokenType = "tubely-playback"
+
+// PlaybackClaims bind a playback token to one video and the viewer it was
+// issued to.
+type PlaybackClaims struct {
+	VideoID uuid.UUID
+	// UserID is uuid.Nil for anonymous viewers
+	UserID uuid.UUID
+	// IP is the viewer's address, empty if the token isn't bound to one
+	IP string
+	// Shared is set for tokens issued through a share link, which grant
+	// access to private videos too
+	Shared    bool
+	ExpiresAt time.Time
+}
+
+type playbackJWTClaims struct {
+	jwt.RegisteredClaims
+	VideoID uuid.UUID `json:"vid"`
+	IP      string    `json:"ip,omitempty"`
+	Shared  bool      `json:"shr,omitempty"`
+}
+
+func MakePlaybackToken(claims PlaybackClaims, tokenSecret string) (string, error) {
+	registered := jwt.RegisteredClaims{
+		Issuer:    string(TokenTypePlayback),
+		IssuedAt:  jwt.NewNumericDate(time.Now().UTC()),
+		ExpiresAt: jwt.NewNumericDate(claims.ExpiresAt),
+	}
+	if claims.UserID != uuid.Nil {
+		registered.Subject = claims.UserID.String()
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, playbackJWTClaims{
+		RegisteredClaims: registered,
+		VideoID:          claims.VideoID,
+		IP:               claims.IP,
+		Shared:           claims.Shared,
+	})
+	return token.SignedString([]byte(tokenSecret))
+}
+
+// ParsePlaybackToken checks a playback token's signature, expiry and issuer
+// and returns its claims. Access tokens aren't accepted.
+func ParsePlaybackToken(tokenString, tokenSecret string) (PlaybackClaims, error) {
+	claimsStruct := playbackJWTClaims{}
+	_, err := jwt.ParseWithClaims(
+		tokenString,
+		&claimsStruct,
+		func(token *jwt.Token) (interface{}, error) { return []byte(tokenSecret), nil },
+		jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Name}),
+	)
+	if err != nil {
+		return PlaybackClaims{}, err
+	}
+	if claimsStruct.Issuer != string(TokenTypePlayback) {
+		return PlaybackClaims{}, errors.New("invalid issuer")
+	}
+	if claimsStruct.ExpiresAt == nil {
+		return PlaybackClaims{}, errors.New("token has no expiry")
+	}
+
+	claims := PlaybackClaims{
+		VideoID:   claimsStruct.VideoID,
+		IP:        claimsStruct.IP,
+		Shared:    claimsStruct.Shared,
+		ExpiresAt: claimsStruct.ExpiresAt.Time,
+	}
+	if claimsStruct.Subject != "" {
+		claims.UserID, err = uuid.Parse(claimsStruct.Subject)
+		if err != nil {
+			return PlaybackClaims{}, fmt.Errorf("invalid user ID: %w", err)
+		}
+	}
+	return claims, nil
+}
@@ -0,0 +1,117 @@
+package database
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// AccessLogEntry records a decision on whether someone could get at a
+// video's files: presigning its URL, handing out playback access,
+// serving it through the app or downloading its original.
+type AccessLogEntry struct {
+	ID        int64     `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	CreateAccessLogEntryParams
+}
+
+type CreateAccessLogEntryParams struct {
+	VideoID uuid.UUID `json:"video_id"`
+	// UserID is nil for anonymous access
+	UserID  *uuid.UUID `json:"user_id"`
+	IP      string     `json:"ip"`
+	Action  string     `json:"action"`
+	Allowed bool       `json:"allowed"`
+	// Reason says why access was denied, empty when it was allowed
+	Reason string `json:"reason"`
+}
+
+// AccessLogFilter narrows GetAccessLog. Zero values match everything.
+type AccessLogFilter struct {
+	VideoID *uuid.UUID
+	UserID  *uuid.UUID
+	Action  string
+	Allowed *bool
+	Since   time.Time
+	Until   time.Time
+}
+
+func (c Client) CreateAccessLogEntry(params CreateAccessLogEntryParams) error {
+	query := `
+		INSERT INTO access_log
+		    (created_at, video_id, user_id, ip, action, allowed, reason)
+		VALUES
+		    (CURRENT_TIMESTAMP, ?, ?, ?, ?, ?, ?)
+	`
+	_, err := c.db.Exec(query, params.VideoID.String(), params.UserID, params.IP, params.Action, params.Allowed, params.Reason)
+	return err
+}
+
+// GetAccessLog returns matching entries, newest first.
+func (c Client) GetAccessLog(filter AccessLogFilter, page Page) ([]AccessLogEntry, *Cursor, error) {
+	query := `
+		SELECT id, created_at, video_id, user_id, ip, action, allowed, reason
+		FROM access_log
+		WHERE 1 = 1
+	`
+	var args []any
+	if filter.VideoID != nil {
+		query += " AND video_id = ?"
+		args = append(args, filter.VideoID.String())
+	}
+	if filter.UserID != nil {
+		query += " AND user_id = ?"
+		args = append(args, filter.UserID.String())
+	}
+	if filter.Action != "" {
+		query += " AND action = ?"
+		args = append(args, filter.Action)
+	}
+	if filter.Allowed != nil {
+		query += " AND allowed = ?"
+		args = append(args, *filter.Allowed)
+	}
+	if !filter.Since.IsZero() {
+		query += " AND created_at >= ?"
+		args = append(args, filter.Since.UTC().Format(time.DateTime))
+	}
+	if !filter.Until.IsZero() {
+		query += " AND created_at < ?"
+		args = append(args, filter.Until.UTC().Format(time.DateTime))
+	}
+	query, args = page.keyset(query, args, "created_at", "id", true)
+
+	rows, err := c.db.Query(query, args...)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	entries := []AccessLogEntry{}
+	for rows.Next() {
+		var e AccessLogEntry
+		err := rows.Scan(&e.ID, &e.CreatedAt, &e.VideoID, &e.UserID, &e.IP, &e.Action, &e.Allowed, &e.Reason)
+		if err != nil {
+			return nil, nil, err
+		}
+		entries = append(entries, e)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, err
+	}
+	entries, next := paginate(page, entries, func(e AccessLogEntry) Cursor {
+		return Cursor{CreatedAt: e.CreatedAt, ID: strconv.FormatInt(e.ID, 10)}
+	})
+	return entries, next, nil
+}
+
+// DeleteAccessLogBefore deletes entries older than cutoff, returning how
+// many there were.
+func (c Client) DeleteAccessLogBefore(cutoff time.Time) (int64, error) {
+	res, err := c.db.Exec(`DELETE FROM access_log WHERE created_at < ?`, cutoff.UTC().Format(time.DateTime))
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
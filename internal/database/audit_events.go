@@ -0,0 +1,116 @@
+package database
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type AuditEvent struct {
+	ID        int64     `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	CreateAuditEventParams
+}
+
+type CreateAuditEventParams struct {
+	// ActorID is nil for anonymous or admin API key requests.
+	ActorID      *uuid.UUID `json:"actor_id"`
+	Action       string     `json:"action"`
+	ResourceType string     `json:"resource_type"`
+	ResourceID   string     `json:"resource_id"`
+	IP           string     `json:"ip"`
+	Summary      string     `json:"summary"`
+}
+
+// AuditEventFilter narrows GetAuditEvents. Zero values match everything.
+type AuditEventFilter struct {
+	ActorID    *uuid.UUID
+	Action     string
+	ResourceID string
+	AfterID    int64
+	Since      time.Time
+	Limit      int
+}
+
+func (c Client) CreateAuditEvent(params CreateAuditEventParams) error {
+	query := `
+		INSERT INTO audit_events
+		    (created_at, actor_id, action, resource_type, resource_id, ip, summary)
+		VALUES
+		    (CURRENT_TIMESTAMP, ?, ?, ?, ?, ?, ?)
+	`
+	var actorID *string
+	if params.ActorID != nil {
+		s := params.ActorID.String()
+		actorID = &s
+	}
+	_, err := c.db.Exec(query, actorID, params.Action, params.ResourceType, params.ResourceID, params.IP, params.Summary)
+	return err
+}
+
+// GetAuditEvents returns matching events in ascending id order, so callers
+// can page or follow the log by passing the last seen id as AfterID.
+func (c Client) GetAuditEvents(filter AuditEventFilter) ([]AuditEvent, error) {
+	query := `
+		SELECT id, created_at, actor_id, action, resource_type, resource_id, ip, summary
+		FROM audit_events
+		WHERE id > ?
+	`
+	args := []any{filter.AfterID}
+	if filter.ActorID != nil {
+		query += " AND actor_id = ?"
+		args = append(args, filter.ActorID.String())
+	}
+	if filter.Action != "" {
+		query += " AND action = ?"
+		args = append(args, filter.Action)
+	}
+	if filter.ResourceID != "" {
+		query += " AND resource_id = ?"
+		args = append(args, filter.ResourceID)
+	}
+	if !filter.Since.IsZero() {
+		query += " AND created_at >= ?"
+		args = append(args, filter.Since.UTC().Format(time.DateTime))
+	}
+	limit := filter.Limit
+	if limit <= 0 || limit > 1000 {
+		limit = 100
+	}
+	query += " ORDER BY id LIMIT ?"
+	args = append(args, limit)
+
+	rows, err := c.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := []AuditEvent{}
+	for rows.Next() {
+		var event AuditEvent
+		var actorID *string
+		err := rows.Scan(
+			&event.ID,
+			&event.CreatedAt,
+			&actorID,
+			&event.Action,
+			&event.ResourceType,
+			&event.ResourceID,
+			&event.IP,
+			&event.Summary,
+		)
+		if err != nil {
+			return nil, err
+		}
+		if actorID != nil {
+			id, err := uuid.Parse(*actorID)
+			if err != nil {
+				return nil, err
+			}
+			event.ActorID = &id
+		}
+		events = append(events, event)
+	}
+	return events, rows.Err()
+}
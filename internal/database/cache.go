@@ -0,0 +1,133 @@
+package database
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+
+	"github.com/google/uuid"
+)
+
+// Cache holds encoded video rows and lists in front of the database.
+// Implementations report failures as misses, so an unavailable cache
+// only costs speed.
+type Cache interface {
+	Get(key string) ([]byte, bool)
+	Set(key string, value []byte)
+	Delete(keys ...string)
+}
+
+// WithCache returns a client that reads videos through cache. Writes go
+// to the database and then invalidate the affected entries.
+func (c Client) WithCache(cache Cache) Client {
+	c.cache = cache
+	return c
+}
+
+// Lists are cached under generation numbers rather than deleted one by
+// one: bumping a user's generation orphans every page of their lists,
+// and bumping the global one (on Reset) orphans everything. Orphaned
+// entries expire on their own.
+const globalGenerationKey = "gen:all"
+
+func userGenerationKey(userID uuid.UUID) string {
+	return "gen:user:" + userID.String()
+}
+
+func (c Client) generation(key string) string {
+	if gen, ok := c.cache.Get(key); ok {
+		return string(gen)
+	}
+	return c.bumpGeneration(key)
+}
+
+func (c Client) bumpGeneration(key string) string {
+	gen := uuid.NewString()
+	c.cache.Set(key, []byte(gen))
+	return gen
+}
+
+func (c Client) videoCacheKey(id uuid.UUID) string {
+	return fmt.Sprintf("video:%s:%s", c.generation(globalGenerationKey), id)
+}
+
+func (c Client) videoListCacheKey(kind string, userID uuid.UUID, page Page) string {
+	after := ""
+	if page.After != nil {
+		after = page.After.String()
+	}
+	return fmt.Sprintf("videos:%s:%s:%s:%s:%d:%s",
+		c.generation(globalGenerationKey), c.generation(userGenerationKey(userID)),
+		kind, userID, page.Limit, after)
+}
+
+type cachedVideoPage struct {
+	Videos []Video
+	Next   *Cursor
+}
+
+func cacheGet[T any](c Client, key string) (T, bool) {
+	var v T
+	data, ok := c.cache.Get(key)
+	if !ok {
+		return v, false
+	}
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&v); err != nil {
+		return v, false
+	}
+	return v, true
+}
+
+func cacheSet(c Client, key string, v any) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return
+	}
+	c.cache.Set(key, buf.Bytes())
+}
+
+// cachedVideoPage serves a user's video list from the cache, falling back
+// to query on a miss.
+func (c Client) cachedVideoPage(kind string, userID uuid.UUID, page Page, query func() ([]Video, *Cursor, error)) ([]Video, *Cursor, error) {
+	if c.cache == nil {
+		return query()
+	}
+	key := c.videoListCacheKey(kind, userID, page)
+	if cached, ok := cacheGet[cachedVideoPage](c, key); ok {
+		if cached.Videos == nil {
+			cached.Videos = []Video{}
+		}
+		return cached.Videos, cached.Next, nil
+	}
+	videos, next, err := query()
+	if err != nil {
+		return nil, nil, err
+	}
+	cacheSet(c, key, cachedVideoPage{Videos: videos, Next: next})
+	return videos, next, nil
+}
+
+// videoOwner looks up who owns a video so their lists can be invalidated.
+// It's only needed, and only queried, when a cache is configured.
+func (c Client) videoOwner(id uuid.UUID) uuid.UUID {
+	if c.cache == nil {
+		return uuid.Nil
+	}
+	var owner uuid.UUID
+	c.db.QueryRow(`SELECT user_id FROM videos WHERE id = ?`, id).Scan(&owner)
+	return owner
+}
+
+// invalidateVideo drops a video's cached row and the lists of the users
+// it appears under.
+func (c Client) invalidateVideo(id uuid.UUID, owners ...uuid.UUID) {
+	if c.cache == nil {
+		return
+	}
+	c.cache.Delete(c.videoCacheKey(id))
+	for _, owner := range owners {
+		if owner != uuid.Nil {
+			c.bumpGeneration(userGenerationKey(owner))
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Caption is a WebVTT captions track for a video, stored in the bucket at
+// Key.
+type Caption struct {
+	ID        uuid.UUID `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	VideoID   uuid.UUID `json:"video_id"`
+	// Language is the track's language tag, such as "en" or "en-US"
+	Language string `json:"language"`
+	// AutoGenerated captions were transcribed by speech recognition
+	AutoGenerated bool   `json:"auto_generated"`
+	Key           string `json:"-"`
+}
+
+type CreateCaptionParams struct {
+	ID            uuid.UUID
+	VideoID       uuid.UUID
+	Language      string
+	AutoGenerated bool
+	Key           string
+}
+
+const captionColumns = `id, created_at, video_id, language, auto_generated, key`
+
+func scanCaption(row rowScanner) (Caption, error) {
+	var c Caption
+	err := row.Scan(&c.ID, &c.CreatedAt, &c.VideoID, &c.Language, &c.AutoGenerated, &c.Key)
+	return c, err
+}
+
+func (c Client) queryCaptions(query string, args ...any) ([]Caption, error) {
+	rows, err := c.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	captions := []Caption{}
+	for rows.Next() {
+		caption, err := scanCaption(rows)
+		if err != nil {
+			return nil, err
+		}
+		captions = append(captions, caption)
+	}
+	return captions, rows.Err()
+}
+
+func (c Client) CreateCaption(params CreateCaptionParams) (Caption, error) {
+	query := `
+		INSERT INTO captions
+		    (id, created_at, video_id, language, auto_generated, key)
+		VALUES
+		    (?, CURRENT_TIMESTAMP, ?, ?, ?, ?)
+	`
+	_, err := c.db.Exec(query, params.ID.String(), params.VideoID.String(), params.Language, params.AutoGenerated, params.Key)
+	if err != nil {
+		return Caption{}, err
+	}
+	return c.GetCaption(params.ID)
+}
+
+// GetCaptions returns a video's captions by language.
+func (c Client) GetCaptions(videoID uuid.UUID) ([]Caption, error) {
+	query := `SELECT ` + captionColumns + ` FROM captions WHERE video_id = ? ORDER BY language, auto_generated, created_at`
+	return c.queryCaptions(query, videoID.String())
+}
+
+// GetCaption returns a zero Caption if it doesn't exist.
+func (c Client) GetCaption(id uuid.UUID) (Caption, error) {
+	query := `SELECT ` + captionColumns + ` FROM captions WHERE id = ?`
+	caption, err := scanCaption(c.db.QueryRow(query, id.String()))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return Caption{}, nil
+		}
+		return Caption{}, err
+	}
+	return caption, nil
+}
+
+// DeleteAutoCaptions deletes a video's auto-generated captions, returning
+// them so their objects can be removed.
+func (c Client) DeleteAutoCaptions(videoID uuid.UUID) ([]Caption, error) {
+	captions, err := c.queryCaptions(`SELECT `+captionColumns+` FROM captions WHERE video_id = ? AND auto_generated = ?`, videoID.String(), true)
+	if err != nil {
+		return nil, err
+	}
+	_, err = c.db.Exec(`DELETE FROM captions WHERE video_id = ? AND auto_generated = ?`, videoID.String(), true)
+	if err != nil {
+		return nil, err
+	}
+	return captions, nil
+}
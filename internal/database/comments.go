@@ -0,0 +1,161 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type Comment struct {
+	ID        uuid.UUID `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	CreateCommentParams
+}
+
+type CreateCommentParams struct {
+	VideoID uuid.UUID `json:"video_id"`
+	UserID  uuid.UUID `json:"user_id"`
+	// ParentID is set on replies and points at a top-level comment.
+	ParentID *uuid.UUID `json:"parent_id"`
+	Body     string     `json:"body"`
+}
+
+// CommentFilter narrows GetComments. A nil ParentID lists top-level
+// comments only.
+type CommentFilter struct {
+	VideoID  uuid.UUID
+	ParentID *uuid.UUID
+	Page
+}
+
+const commentColumns = `id, created_at, video_id, user_id, parent_id, body`
+
+func scanComment(row rowScanner) (Comment, error) {
+	var comment Comment
+	var parentID *string
+	err := row.Scan(
+		&comment.ID,
+		&comment.CreatedAt,
+		&comment.VideoID,
+		&comment.UserID,
+		&parentID,
+		&comment.Body,
+	)
+	if err != nil {
+		return Comment{}, err
+	}
+	if parentID != nil {
+		id, err := uuid.Parse(*parentID)
+		if err != nil {
+			return Comment{}, err
+		}
+		comment.ParentID = &id
+	}
+	return comment, nil
+}
+
+func (c Client) CreateComment(params CreateCommentParams) (Comment, error) {
+	id := uuid.New()
+	query := `
+		INSERT INTO comments
+		    (id, created_at, video_id, user_id, parent_id, body)
+		VALUES
+		    (?, CURRENT_TIMESTAMP, ?, ?, ?, ?)
+	`
+	var parentID *string
+	if params.ParentID != nil {
+		s := params.ParentID.String()
+		parentID = &s
+	}
+	_, err := c.db.Exec(query, id.String(), params.VideoID.String(), params.UserID.String(), parentID, params.Body)
+	if err != nil {
+		return Comment{}, err
+	}
+	c.invalidateVideo(params.VideoID, c.videoOwner(params.VideoID))
+	return c.GetComment(id)
+}
+
+// GetComment returns a zero Comment if it doesn't exist.
+func (c Client) GetComment(id uuid.UUID) (Comment, error) {
+	query := `SELECT ` + commentColumns + ` FROM comments WHERE id = ?`
+	comment, err := scanComment(c.db.QueryRow(query, id.String()))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return Comment{}, nil
+		}
+		return Comment{}, err
+	}
+	return comment, nil
+}
+
+// GetComments returns comments oldest first.
+func (c Client) GetComments(filter CommentFilter) ([]Comment, *Cursor, error) {
+	query := `SELECT ` + commentColumns + ` FROM comments WHERE video_id = ?`
+	args := []any{filter.VideoID.String()}
+	if filter.ParentID != nil {
+		query += " AND parent_id = ?"
+		args = append(args, filter.ParentID.String())
+	} else {
+		query += " AND parent_id IS NULL"
+	}
+	query, args = filter.keyset(query, args, "created_at", "id", false)
+
+	rows, err := c.db.Query(query, args...)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	comments := []Comment{}
+	for rows.Next() {
+		comment, err := scanComment(rows)
+		if err != nil {
+			return nil, nil, err
+		}
+		comments = append(comments, comment)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, err
+	}
+	comments, next := paginate(filter.Page, comments, func(c Comment) Cursor {
+		return Cursor{CreatedAt: c.CreatedAt, ID: c.ID.String()}
+	})
+	return comments, next, nil
+}
+
+// GetUserComments returns every comment a user has written, oldest first.
+func (c Client) GetUserComments(userID uuid.UUID) ([]Comment, error) {
+	query := `SELECT ` + commentColumns + ` FROM comments WHERE user_id = ? ORDER BY created_at, id`
+	rows, err := c.db.Query(query, userID.String())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	comments := []Comment{}
+	for rows.Next() {
+		comment, err := scanComment(rows)
+		if err != nil {
+			return nil, err
+		}
+		comments = append(comments, comment)
+	}
+	return comments, rows.Err()
+}
+
+// DeleteComment removes a comment along with its replies.
+func (c Client) DeleteComment(id uuid.UUID) error {
+	if c.cache != nil {
+		if comment, err := c.GetComment(id); err == nil && comment.ID != uuid.Nil {
+			defer c.invalidateVideo(comment.VideoID, c.videoOwner(comment.VideoID))
+		}
+	}
+	_, err := c.db.Exec(`DELETE FROM comments WHERE parent_id = ?`, id.String())
+	if err != nil {
+		return err
+	}
+	_, err = c.db.Exec(`DELETE FROM comments WHERE id = ?`, id.String())
+	return err
+}
@@ -3,20 +3,51 @@ package database
 import (
 	"database/sql"
 	"fmt"
+	"time"
 
+	_ "github.com/lib/pq"
 	_ "github.com/mattn/go-sqlite3"
 )
 
 type Client struct {
-	db *sql.DB
+	db    *conn
+	cache Cache
 }
 
-func NewClient(pathToDB string) (Client, error) {
-	db, err := sql.Open("sqlite3", pathToDB)
+// PoolConfig tunes the connection pool. Zero values keep the
+// database/sql defaults.
+type PoolConfig struct {
+	MaxOpenConns    int
+	MaxIdleConns    int
+	ConnMaxLifetime time.Duration
+}
+
+// NewClient opens a database using driver (DriverSQLite or
+// DriverPostgres). dataSource is a file path for SQLite and a connection
+// URL for Postgres.
+func NewClient(driver, dataSource string, pool PoolConfig) (Client, error) {
+	if driver != DriverSQLite && driver != DriverPostgres {
+		return Client{}, fmt.Errorf("unsupported database driver %q", driver)
+	}
+	db, err := sql.Open(driver, dataSource)
+	if err != nil {
+		return Client{}, err
+	}
+	if pool.MaxOpenConns > 0 {
+		db.SetMaxOpenConns(pool.MaxOpenConns)
+	}
+	if pool.MaxIdleConns > 0 {
+		db.SetMaxIdleConns(pool.MaxIdleConns)
+	}
+	if pool.ConnMaxLifetime > 0 {
+		db.SetConnMaxLifetime(pool.ConnMaxLifetime)
+	}
+	err = db.Ping()
 	if err != nil {
 		return Client{}, err
 	}
-	c := Client{db}
+
+	c := Client{db: &conn{DB: db, driver: driver}}
 	err = c.autoMigrate()
 	if err != nil {
 		return Client{}, err
@@ -32,7 +63,9 @@ func (c *Client) autoMigrate() error {
 		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
 		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
 		password TEXT NOT NULL,
-		email TEXT UNIQUE NOT NULL
+		email TEXT UNIQUE NOT NULL,
+		verified BOOLEAN NOT NULL DEFAULT FALSE,
+		token_version INTEGER NOT NULL DEFAULT 0
 	);
 	`
 	_, err := c.db.Exec(userTable)
@@ -63,8 +96,13 @@ func (c *Client) autoMigrate() error {
 		title TEXT NOT NULL,
 		description TEXT,
 		thumbnail_url TEXT,
-		video_url TEXT TEXT,
-		user_id INTEGER,
+		video_url TEXT,
+		video_key TEXT,
+		storage_class TEXT NOT NULL DEFAULT 'STANDARD',
+		published BOOLEAN NOT NULL DEFAULT FALSE,
+		deleted_at TIMESTAMP,
+		visibility TEXT NOT NULL DEFAULT 'public',
+		user_id TEXT,
 		FOREIGN KEY(user_id) REFERENCES users(id)
 	);
 	`
@@ -72,6 +110,576 @@ func (c *Client) autoMigrate() error {
 	if err != nil {
 		return err
 	}
+
+	userIdentityTable := `
+	CREATE TABLE IF NOT EXISTS user_identities (
+		provider TEXT NOT NULL,
+		subject TEXT NOT NULL,
+		user_id TEXT NOT NULL,
+		email TEXT NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY(provider, subject),
+		FOREIGN KEY(user_id) REFERENCES users(id)
+	);
+	`
+	_, err = c.db.Exec(userIdentityTable)
+	if err != nil {
+		return err
+	}
+
+	userTokenTable := `
+	CREATE TABLE IF NOT EXISTS user_tokens (
+		token_hash TEXT PRIMARY KEY,
+		purpose TEXT NOT NULL,
+		user_id TEXT NOT NULL,
+		expires_at TIMESTAMP NOT NULL,
+		used_at TIMESTAMP,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY(user_id) REFERENCES users(id)
+	);
+	`
+	_, err = c.db.Exec(userTokenTable)
+	if err != nil {
+		return err
+	}
+
+	auditEventTable := `
+	CREATE TABLE IF NOT EXISTS audit_events (
+		id ` + c.db.autoIncrementPK() + `,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		actor_id TEXT,
+		action TEXT NOT NULL,
+		resource_type TEXT NOT NULL,
+		resource_id TEXT NOT NULL,
+		ip TEXT NOT NULL,
+		summary TEXT NOT NULL
+	);
+	CREATE INDEX IF NOT EXISTS audit_events_resource_idx ON audit_events(resource_id);
+	`
+	_, err = c.db.Exec(auditEventTable)
+	if err != nil {
+		return err
+	}
+
+	shareLinkTable := `
+	CREATE TABLE IF NOT EXISTS share_links (
+		token_hash TEXT PRIMARY KEY,
+		video_id TEXT NOT NULL,
+		created_by TEXT NOT NULL,
+		expires_at TIMESTAMP NOT NULL,
+		max_views INTEGER,
+		view_count INTEGER NOT NULL DEFAULT 0,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY(video_id) REFERENCES videos(id)
+	);
+	`
+	_, err = c.db.Exec(shareLinkTable)
+	if err != nil {
+		return err
+	}
+
+	commentTable := `
+	CREATE TABLE IF NOT EXISTS comments (
+		id TEXT PRIMARY KEY,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		video_id TEXT NOT NULL,
+		user_id TEXT NOT NULL,
+		parent_id TEXT,
+		body TEXT NOT NULL,
+		FOREIGN KEY(video_id) REFERENCES videos(id),
+		FOREIGN KEY(user_id) REFERENCES users(id)
+	);
+	CREATE INDEX IF NOT EXISTS comments_video_idx ON comments(video_id, parent_id);
+	`
+	_, err = c.db.Exec(commentTable)
+	if err != nil {
+		return err
+	}
+
+	videoLikeTable := `
+	CREATE TABLE IF NOT EXISTS video_likes (
+		video_id TEXT NOT NULL,
+		user_id TEXT NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY(video_id, user_id),
+		FOREIGN KEY(video_id) REFERENCES videos(id),
+		FOREIGN KEY(user_id) REFERENCES users(id)
+	);
+	CREATE INDEX IF NOT EXISTS video_likes_user_idx ON video_likes(user_id);
+	`
+	_, err = c.db.Exec(videoLikeTable)
+	if err != nil {
+		return err
+	}
+
+	processingFailureTable := `
+	CREATE TABLE IF NOT EXISTS processing_failures (
+		video_id TEXT PRIMARY KEY,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		attempts INTEGER NOT NULL DEFAULT 0,
+		stage TEXT NOT NULL,
+		error TEXT NOT NULL,
+		stderr TEXT NOT NULL,
+		dead_at TIMESTAMP,
+		FOREIGN KEY(video_id) REFERENCES videos(id)
+	);
+	`
+	_, err = c.db.Exec(processingFailureTable)
+	if err != nil {
+		return err
+	}
+
+	webhookTables := `
+	CREATE TABLE IF NOT EXISTS webhook_endpoints (
+		id TEXT PRIMARY KEY,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		user_id TEXT NOT NULL,
+		url TEXT NOT NULL,
+		secret TEXT NOT NULL,
+		events TEXT NOT NULL,
+		FOREIGN KEY(user_id) REFERENCES users(id)
+	);
+	CREATE INDEX IF NOT EXISTS webhook_endpoints_user_idx ON webhook_endpoints(user_id);
+	CREATE TABLE IF NOT EXISTS webhook_deliveries (
+		id TEXT PRIMARY KEY,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		endpoint_id TEXT NOT NULL,
+		event TEXT NOT NULL,
+		payload TEXT NOT NULL,
+		status TEXT NOT NULL,
+		attempts INTEGER NOT NULL DEFAULT 0,
+		next_attempt_at TIMESTAMP,
+		response_status INTEGER,
+		error TEXT NOT NULL DEFAULT '',
+		FOREIGN KEY(endpoint_id) REFERENCES webhook_endpoints(id)
+	);
+	CREATE INDEX IF NOT EXISTS webhook_deliveries_endpoint_idx ON webhook_deliveries(endpoint_id);
+	CREATE INDEX IF NOT EXISTS webhook_deliveries_due_idx ON webhook_deliveries(status, next_attempt_at);
+	`
+	_, err = c.db.Exec(webhookTables)
+	if err != nil {
+		return err
+	}
+
+	thumbnailCandidateTable := `
+	CREATE TABLE IF NOT EXISTS thumbnail_candidates (
+		id TEXT PRIMARY KEY,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		video_id TEXT NOT NULL,
+		position INTEGER NOT NULL,
+		url TEXT NOT NULL,
+		FOREIGN KEY(video_id) REFERENCES videos(id)
+	);
+	CREATE INDEX IF NOT EXISTS thumbnail_candidates_video_idx ON thumbnail_candidates(video_id);
+	`
+	_, err = c.db.Exec(thumbnailCandidateTable)
+	if err != nil {
+		return err
+	}
+
+	videoVersionTable := `
+	CREATE TABLE IF NOT EXISTS video_versions (
+		id TEXT PRIMARY KEY,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		video_id TEXT NOT NULL,
+		key TEXT NOT NULL,
+		checksum_sha256 TEXT,
+		FOREIGN KEY(video_id) REFERENCES videos(id)
+	);
+	CREATE INDEX IF NOT EXISTS video_versions_video_idx ON video_versions(video_id);
+	`
+	_, err = c.db.Exec(videoVersionTable)
+	if err != nil {
+		return err
+	}
+
+	userExportTable := `
+	CREATE TABLE IF NOT EXISTS user_exports (
+		id TEXT PRIMARY KEY,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		user_id TEXT NOT NULL,
+		status TEXT NOT NULL,
+		key TEXT,
+		size_bytes INTEGER NOT NULL DEFAULT 0,
+		error TEXT NOT NULL DEFAULT '',
+		expires_at TIMESTAMP,
+		FOREIGN KEY(user_id) REFERENCES users(id)
+	);
+	CREATE INDEX IF NOT EXISTS user_exports_user_idx ON user_exports(user_id);
+	CREATE INDEX IF NOT EXISTS user_exports_status_idx ON user_exports(status);
+	`
+	_, err = c.db.Exec(userExportTable)
+	if err != nil {
+		return err
+	}
+
+	processingRunTable := `
+	CREATE TABLE IF NOT EXISTS processing_runs (
+		id TEXT PRIMARY KEY,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		video_id TEXT NOT NULL,
+		duration_ms INTEGER NOT NULL,
+		succeeded BOOLEAN NOT NULL,
+		stage TEXT NOT NULL DEFAULT ''
+	);
+	CREATE INDEX IF NOT EXISTS processing_runs_created_idx ON processing_runs(created_at);
+	`
+	_, err = c.db.Exec(processingRunTable)
+	if err != nil {
+		return err
+	}
+
+	objectDeletionTable := `
+	CREATE TABLE IF NOT EXISTS object_deletions (
+		id TEXT PRIMARY KEY,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		key TEXT NOT NULL,
+		prefix BOOLEAN NOT NULL DEFAULT FALSE,
+		delete_after TIMESTAMP NOT NULL
+	);
+	CREATE INDEX IF NOT EXISTS object_deletions_delete_after_idx ON object_deletions(delete_after);
+	`
+	_, err = c.db.Exec(objectDeletionTable)
+	if err != nil {
+		return err
+	}
+
+	processingProgressTable := `
+	CREATE TABLE IF NOT EXISTS processing_progress (
+		video_id TEXT PRIMARY KEY,
+		stage TEXT NOT NULL,
+		percent INTEGER NOT NULL DEFAULT 0,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY(video_id) REFERENCES videos(id)
+	);
+	`
+	_, err = c.db.Exec(processingProgressTable)
+	if err != nil {
+		return err
+	}
+
+	uploadSessionTable := `
+	CREATE TABLE IF NOT EXISTS upload_sessions (
+		id TEXT PRIMARY KEY,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		expires_at TIMESTAMP NOT NULL,
+		user_id TEXT NOT NULL,
+		video_id TEXT NOT NULL,
+		length INTEGER NOT NULL,
+		upload_offset INTEGER NOT NULL DEFAULT 0,
+		metadata TEXT NOT NULL DEFAULT '',
+		FOREIGN KEY(user_id) REFERENCES users(id),
+		FOREIGN KEY(video_id) REFERENCES videos(id)
+	);
+	CREATE INDEX IF NOT EXISTS upload_sessions_expires_at_idx ON upload_sessions(expires_at);
+	`
+	_, err = c.db.Exec(uploadSessionTable)
+	if err != nil {
+		return err
+	}
+
+	loginFailureTable := `
+	CREATE TABLE IF NOT EXISTS login_failures (
+		subject TEXT PRIMARY KEY,
+		failures INTEGER NOT NULL,
+		last_failure_at TIMESTAMP NOT NULL,
+		locked_until TIMESTAMP
+	);
+	`
+	_, err = c.db.Exec(loginFailureTable)
+	if err != nil {
+		return err
+	}
+
+	videoUploadLockTable := `
+	CREATE TABLE IF NOT EXISTS video_upload_locks (
+		video_id TEXT PRIMARY KEY,
+		token TEXT NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		expires_at TIMESTAMP NOT NULL,
+		FOREIGN KEY(video_id) REFERENCES videos(id)
+	);
+	`
+	_, err = c.db.Exec(videoUploadLockTable)
+	if err != nil {
+		return err
+	}
+
+	processedUploadTable := `
+	CREATE TABLE IF NOT EXISTS processed_uploads (
+		video_id TEXT PRIMARY KEY,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		source_checksum TEXT NOT NULL,
+		dir TEXT NOT NULL,
+		object_key TEXT NOT NULL,
+		storage_class TEXT NOT NULL DEFAULT '',
+		upload_id TEXT NOT NULL DEFAULT '',
+		FOREIGN KEY(video_id) REFERENCES videos(id)
+	);
+	`
+	_, err = c.db.Exec(processedUploadTable)
+	if err != nil {
+		return err
+	}
+
+	reprocessBatchTable := `
+	CREATE TABLE IF NOT EXISTS reprocess_batches (
+		id TEXT PRIMARY KEY,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		status TEXT NOT NULL,
+		user_id TEXT,
+		video_status TEXT NOT NULL DEFAULT '',
+		created_after TIMESTAMP,
+		created_before TIMESTAMP,
+		delay_ms INTEGER NOT NULL DEFAULT 0
+	);
+	CREATE INDEX IF NOT EXISTS reprocess_batches_status_idx ON reprocess_batches(status);
+	CREATE TABLE IF NOT EXISTS reprocess_items (
+		batch_id TEXT NOT NULL,
+		video_id TEXT NOT NULL,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		status TEXT NOT NULL,
+		error TEXT NOT NULL DEFAULT '',
+		PRIMARY KEY (batch_id, video_id),
+		FOREIGN KEY(batch_id) REFERENCES reprocess_batches(id),
+		FOREIGN KEY(video_id) REFERENCES videos(id)
+	);
+	`
+	_, err = c.db.Exec(reprocessBatchTable)
+	if err != nil {
+		return err
+	}
+
+	organizationTables := `
+	CREATE TABLE IF NOT EXISTS organizations (
+		id TEXT PRIMARY KEY,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		name TEXT NOT NULL
+	);
+	CREATE TABLE IF NOT EXISTS organization_members (
+		org_id TEXT NOT NULL,
+		user_id TEXT NOT NULL,
+		role TEXT NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY (org_id, user_id),
+		FOREIGN KEY(org_id) REFERENCES organizations(id),
+		FOREIGN KEY(user_id) REFERENCES users(id)
+	);
+	CREATE INDEX IF NOT EXISTS organization_members_user_idx ON organization_members(user_id);
+	CREATE TABLE IF NOT EXISTS organization_invitations (
+		id TEXT PRIMARY KEY,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		expires_at TIMESTAMP NOT NULL,
+		org_id TEXT NOT NULL,
+		email TEXT NOT NULL,
+		role TEXT NOT NULL,
+		invited_by TEXT NOT NULL,
+		token_hash TEXT NOT NULL UNIQUE,
+		FOREIGN KEY(org_id) REFERENCES organizations(id),
+		FOREIGN KEY(invited_by) REFERENCES users(id)
+	);
+	CREATE INDEX IF NOT EXISTS organization_invitations_org_idx ON organization_invitations(org_id);
+	`
+	_, err = c.db.Exec(organizationTables)
+	if err != nil {
+		return err
+	}
+
+	notificationTable := `
+	CREATE TABLE IF NOT EXISTS notifications (
+		id ` + c.db.autoIncrementPK() + `,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		user_id TEXT NOT NULL,
+		type TEXT NOT NULL,
+		message TEXT NOT NULL,
+		video_id TEXT,
+		read_at TIMESTAMP,
+		FOREIGN KEY(user_id) REFERENCES users(id)
+	);
+	CREATE INDEX IF NOT EXISTS notifications_user_idx ON notifications(user_id, created_at);
+	`
+	_, err = c.db.Exec(notificationTable)
+	if err != nil {
+		return err
+	}
+
+	videoTagTable := `
+	CREATE TABLE IF NOT EXISTS video_tags (
+		video_id TEXT NOT NULL,
+		tag TEXT NOT NULL,
+		PRIMARY KEY(video_id, tag),
+		FOREIGN KEY(video_id) REFERENCES videos(id)
+	);
+	CREATE INDEX IF NOT EXISTS video_tags_tag_idx ON video_tags(tag);
+	`
+	_, err = c.db.Exec(videoTagTable)
+	if err != nil {
+		return err
+	}
+
+	// viewer is "user:" and the user's ID, or "ip:" and a hash of the
+	// anonymous viewer's address
+	videoViewTable := `
+	CREATE TABLE IF NOT EXISTS video_views (
+		id ` + c.db.autoIncrementPK() + `,
+		video_id TEXT NOT NULL,
+		viewer TEXT NOT NULL,
+		viewed_at TIMESTAMP NOT NULL,
+		FOREIGN KEY(video_id) REFERENCES videos(id)
+	);
+	CREATE INDEX IF NOT EXISTS video_views_video_idx ON video_views(video_id, viewer, viewed_at);
+	CREATE INDEX IF NOT EXISTS video_views_viewed_at_idx ON video_views(viewed_at);
+
+	CREATE TABLE IF NOT EXISTS video_trending (
+		video_id TEXT PRIMARY KEY,
+		score REAL NOT NULL,
+		computed_at TIMESTAMP NOT NULL,
+		FOREIGN KEY(video_id) REFERENCES videos(id)
+	);
+	CREATE INDEX IF NOT EXISTS video_trending_score_idx ON video_trending(score);
+	`
+	_, err = c.db.Exec(videoViewTable)
+	if err != nil {
+		return err
+	}
+
+	captionTable := `
+	CREATE TABLE IF NOT EXISTS captions (
+		id TEXT PRIMARY KEY,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		video_id TEXT NOT NULL,
+		language TEXT NOT NULL,
+		auto_generated BOOLEAN NOT NULL DEFAULT FALSE,
+		key TEXT NOT NULL,
+		FOREIGN KEY(video_id) REFERENCES videos(id)
+	);
+	CREATE INDEX IF NOT EXISTS captions_video_idx ON captions(video_id);
+	`
+	_, err = c.db.Exec(captionTable)
+	if err != nil {
+		return err
+	}
+
+	// access_log outlives the videos it's about, for compliance, so it
+	// has no foreign key to them
+	accessLogTable := `
+	CREATE TABLE IF NOT EXISTS access_log (
+		id ` + c.db.autoIncrementPK() + `,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		video_id TEXT NOT NULL,
+		user_id TEXT,
+		ip TEXT NOT NULL,
+		action TEXT NOT NULL,
+		allowed BOOLEAN NOT NULL,
+		reason TEXT NOT NULL DEFAULT ''
+	);
+	CREATE INDEX IF NOT EXISTS access_log_video_idx ON access_log(video_id, created_at);
+	CREATE INDEX IF NOT EXISTS access_log_created_at_idx ON access_log(created_at);
+	`
+	_, err = c.db.Exec(accessLogTable)
+	if err != nil {
+		return err
+	}
+
+	// user_id is empty for the override that applies to everyone
+	featureFlagTable := `
+	CREATE TABLE IF NOT EXISTS feature_flags (
+		name TEXT NOT NULL,
+		user_id TEXT NOT NULL DEFAULT '',
+		enabled BOOLEAN NOT NULL,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY(name, user_id)
+	);
+	`
+	_, err = c.db.Exec(featureFlagTable)
+	if err != nil {
+		return err
+	}
+
+	// maintenance_mode has at most the one row, with id 1
+	maintenanceModeTable := `
+	CREATE TABLE IF NOT EXISTS maintenance_mode (
+		id INTEGER PRIMARY KEY,
+		enabled BOOLEAN NOT NULL,
+		message TEXT NOT NULL,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);
+	`
+	_, err = c.db.Exec(maintenanceModeTable)
+	if err != nil {
+		return err
+	}
+
+	// Columns added after the initial schema. CREATE TABLE IF NOT EXISTS
+	// leaves older databases untouched, so add them explicitly.
+	videoColumns := []struct{ name, definition string }{
+		{"storage_class", "TEXT NOT NULL DEFAULT 'STANDARD'"},
+		{"video_key", "TEXT"},
+		{"published", "BOOLEAN NOT NULL DEFAULT FALSE"},
+		{"deleted_at", "TIMESTAMP"},
+		{"visibility", "TEXT NOT NULL DEFAULT 'public'"},
+		{"staging_key", "TEXT"},
+		{"checksum_sha256", "TEXT"},
+		{"staging_checksum_sha256", "TEXT"},
+		{"dash_url", "TEXT"},
+		{"dash_key", "TEXT"},
+		{"thumbnail_source_url", "TEXT"},
+		{"thumbnail_square_url", "TEXT"},
+		{"thumbnail_crop", "TEXT"},
+		{"original_filename", "TEXT"},
+		{"geo_restriction", "TEXT"},
+		{"hdr_format", "TEXT"},
+		{"wrapped_key", "TEXT"},
+		{"version", "INTEGER NOT NULL DEFAULT 1"},
+		{"org_id", "TEXT"},
+		{"key_prefix", "TEXT NOT NULL DEFAULT ''"},
+	}
+	for _, col := range videoColumns {
+		err = c.addColumnIfMissing("videos", col.name, col.definition)
+		if err != nil {
+			return err
+		}
+	}
+	userColumns := []struct{ name, definition string }{
+		{"verified", "BOOLEAN NOT NULL DEFAULT FALSE"},
+		{"token_version", "INTEGER NOT NULL DEFAULT 0"},
+		{"display_name", "TEXT NOT NULL DEFAULT ''"},
+		{"avatar_url", "TEXT"},
+		{"bio", "TEXT NOT NULL DEFAULT ''"},
+	}
+	for _, col := range userColumns {
+		err = c.addColumnIfMissing("users", col.name, col.definition)
+		if err != nil {
+			return err
+		}
+	}
+	err = c.addColumnIfMissing("video_versions", "original_filename", "TEXT")
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+func (c *Client) addColumnIfMissing(table, column, definition string) error {
+	exists, err := c.db.columnExists(table, column)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return nil
+	}
+
+	_, err = c.db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+	if err != nil {
+		return fmt.Errorf("failed to add column %s.%s: %w", table, column, err)
+	}
 	return nil
 }
 
@@ -79,11 +687,104 @@ func (c Client) Reset() error {
 	if _, err := c.db.Exec("DELETE FROM refresh_tokens"); err != nil {
 		return fmt.Errorf("failed to reset table refresh_tokens: %w", err)
 	}
-	if _, err := c.db.Exec("DELETE FROM users"); err != nil {
-		return fmt.Errorf("failed to reset table users: %w", err)
+	if _, err := c.db.Exec("DELETE FROM audit_events"); err != nil {
+		return fmt.Errorf("failed to reset table audit_events: %w", err)
+	}
+	if _, err := c.db.Exec("DELETE FROM notifications"); err != nil {
+		return fmt.Errorf("failed to reset table notifications: %w", err)
+	}
+	for _, table := range []string{"video_trending", "video_views", "video_tags"} {
+		if _, err := c.db.Exec("DELETE FROM " + table); err != nil {
+			return fmt.Errorf("failed to reset table %s: %w", table, err)
+		}
+	}
+	if _, err := c.db.Exec("DELETE FROM captions"); err != nil {
+		return fmt.Errorf("failed to reset table captions: %w", err)
+	}
+	if _, err := c.db.Exec("DELETE FROM access_log"); err != nil {
+		return fmt.Errorf("failed to reset table access_log: %w", err)
+	}
+	// Overrides for everyone are deployment settings rather than data
+	if _, err := c.db.Exec("DELETE FROM feature_flags WHERE user_id != ''"); err != nil {
+		return fmt.Errorf("failed to reset table feature_flags: %w", err)
+	}
+	if _, err := c.db.Exec("DELETE FROM user_tokens"); err != nil {
+		return fmt.Errorf("failed to reset table user_tokens: %w", err)
+	}
+	if _, err := c.db.Exec("DELETE FROM user_identities"); err != nil {
+		return fmt.Errorf("failed to reset table user_identities: %w", err)
+	}
+	if _, err := c.db.Exec("DELETE FROM webhook_deliveries"); err != nil {
+		return fmt.Errorf("failed to reset table webhook_deliveries: %w", err)
+	}
+	if _, err := c.db.Exec("DELETE FROM webhook_endpoints"); err != nil {
+		return fmt.Errorf("failed to reset table webhook_endpoints: %w", err)
+	}
+	if _, err := c.db.Exec("DELETE FROM processing_runs"); err != nil {
+		return fmt.Errorf("failed to reset table processing_runs: %w", err)
+	}
+	if _, err := c.db.Exec("DELETE FROM user_exports"); err != nil {
+		return fmt.Errorf("failed to reset table user_exports: %w", err)
+	}
+	if _, err := c.db.Exec("DELETE FROM video_versions"); err != nil {
+		return fmt.Errorf("failed to reset table video_versions: %w", err)
+	}
+	if _, err := c.db.Exec("DELETE FROM object_deletions"); err != nil {
+		return fmt.Errorf("failed to reset table object_deletions: %w", err)
+	}
+	if _, err := c.db.Exec("DELETE FROM processing_progress"); err != nil {
+		return fmt.Errorf("failed to reset table processing_progress: %w", err)
+	}
+	if _, err := c.db.Exec("DELETE FROM login_failures"); err != nil {
+		return fmt.Errorf("failed to reset table login_failures: %w", err)
+	}
+	if _, err := c.db.Exec("DELETE FROM video_upload_locks"); err != nil {
+		return fmt.Errorf("failed to reset table video_upload_locks: %w", err)
+	}
+	if _, err := c.db.Exec("DELETE FROM processed_uploads"); err != nil {
+		return fmt.Errorf("failed to reset table processed_uploads: %w", err)
+	}
+	if _, err := c.db.Exec("DELETE FROM reprocess_items"); err != nil {
+		return fmt.Errorf("failed to reset table reprocess_items: %w", err)
+	}
+	if _, err := c.db.Exec("DELETE FROM reprocess_batches"); err != nil {
+		return fmt.Errorf("failed to reset table reprocess_batches: %w", err)
+	}
+	if _, err := c.db.Exec("DELETE FROM upload_sessions"); err != nil {
+		return fmt.Errorf("failed to reset table upload_sessions: %w", err)
+	}
+	if _, err := c.db.Exec("DELETE FROM thumbnail_candidates"); err != nil {
+		return fmt.Errorf("failed to reset table thumbnail_candidates: %w", err)
+	}
+	if _, err := c.db.Exec("DELETE FROM processing_failures"); err != nil {
+		return fmt.Errorf("failed to reset table processing_failures: %w", err)
+	}
+	if _, err := c.db.Exec("DELETE FROM video_likes"); err != nil {
+		return fmt.Errorf("failed to reset table video_likes: %w", err)
+	}
+	if _, err := c.db.Exec("DELETE FROM comments"); err != nil {
+		return fmt.Errorf("failed to reset table comments: %w", err)
+	}
+	if _, err := c.db.Exec("DELETE FROM share_links"); err != nil {
+		return fmt.Errorf("failed to reset table share_links: %w", err)
 	}
 	if _, err := c.db.Exec("DELETE FROM videos"); err != nil {
 		return fmt.Errorf("failed to reset table videos: %w", err)
 	}
+	if _, err := c.db.Exec("DELETE FROM organization_invitations"); err != nil {
+		return fmt.Errorf("failed to reset table organization_invitations: %w", err)
+	}
+	if _, err := c.db.Exec("DELETE FROM organization_members"); err != nil {
+		return fmt.Errorf("failed to reset table organization_members: %w", err)
+	}
+	if _, err := c.db.Exec("DELETE FROM organizations"); err != nil {
+		return fmt.Errorf("failed to reset table organizations: %w", err)
+	}
+	if _, err := c.db.Exec("DELETE FROM users"); err != nil {
+		return fmt.Errorf("failed to reset table users: %w", err)
+	}
+	if c.cache != nil {
+		c.bumpGeneration(globalGenerationKey)
+	}
 	return nil
 }
@@ -0,0 +1,127 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Driver names accepted by NewClient.
+const (
+	DriverSQLite   = "sqlite3"
+	DriverPostgres = "postgres"
+)
+
+// conn wraps *sql.DB so queries can be written once with "?" placeholders
+// and rewritten for drivers that use numbered placeholders.
+type conn struct {
+	*sql.DB
+	driver string
+}
+
+func (c *conn) rebind(query string) string {
+	if c.driver != DriverPostgres {
+		return query
+	}
+	var b strings.Builder
+	n := 0
+	for _, r := range query {
+		if r == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+func (c *conn) Exec(query string, args ...any) (sql.Result, error) {
+	return c.DB.Exec(c.rebind(query), args...)
+}
+
+func (c *conn) Query(query string, args ...any) (*sql.Rows, error) {
+	return c.DB.Query(c.rebind(query), args...)
+}
+
+func (c *conn) QueryRow(query string, args ...any) *sql.Row {
+	return c.DB.QueryRow(c.rebind(query), args...)
+}
+
+func (c *conn) ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error) {
+	return c.DB.ExecContext(ctx, c.rebind(query), args...)
+}
+
+func (c *conn) QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error) {
+	return c.DB.QueryContext(ctx, c.rebind(query), args...)
+}
+
+func (c *conn) QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row {
+	return c.DB.QueryRowContext(ctx, c.rebind(query), args...)
+}
+
+// autoIncrementPK returns the column definition for a generated integer
+// primary key.
+func (c *conn) autoIncrementPK() string {
+	if c.driver == DriverPostgres {
+		return "BIGSERIAL PRIMARY KEY"
+	}
+	return "INTEGER PRIMARY KEY AUTOINCREMENT"
+}
+
+// hour returns an expression formatting a timestamp column as
+// YYYY-MM-DD HH.
+func (c *conn) hour(column string) string {
+	if c.driver == DriverPostgres {
+		return fmt.Sprintf("to_char(%s, 'YYYY-MM-DD HH24')", column)
+	}
+	return fmt.Sprintf("strftime('%%Y-%%m-%%d %%H', %s)", column)
+}
+
+// day returns an expression formatting a timestamp column as YYYY-MM-DD.
+func (c *conn) day(column string) string {
+	if c.driver == DriverPostgres {
+		return fmt.Sprintf("to_char(%s, 'YYYY-MM-DD')", column)
+	}
+	return fmt.Sprintf("strftime('%%Y-%%m-%%d', %s)", column)
+}
+
+// columnExists reports whether table already has the named column.
+func (c *conn) columnExists(table, column string) (bool, error) {
+	if c.driver == DriverPostgres {
+		var exists bool
+		err := c.QueryRow(`
+			SELECT EXISTS (
+				SELECT 1 FROM information_schema.columns
+				WHERE table_name = ? AND column_name = ?
+			)
+		`, table, column).Scan(&exists)
+		return exists, err
+	}
+
+	rows, err := c.DB.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			cid        int
+			name       string
+			colType    string
+			notNull    int
+			defaultVal sql.NullString
+			primaryKey int
+		)
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &defaultVal, &primaryKey); err != nil {
+			return false, err
+		}
+		if name == column {
+			return true, nil
+		}
+	}
+	return false, rows.Err()
+}
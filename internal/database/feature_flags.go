@@ -0,0 +1,112 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// FeatureFlagOverride turns a feature flag on or off at runtime, for one
+// user or, with a nil UserID, for everyone.
+type FeatureFlagOverride struct {
+	Name      string     `json:"name"`
+	UserID    *uuid.UUID `json:"user_id"`
+	Enabled   bool       `json:"enabled"`
+	UpdatedAt time.Time  `json:"updated_at"`
+}
+
+// GetFeatureFlagOverrides returns every override, by flag name with the
+// one for everyone first.
+func (c Client) GetFeatureFlagOverrides() ([]FeatureFlagOverride, error) {
+	rows, err := c.db.Query(`
+		SELECT name, user_id, enabled, updated_at
+		FROM feature_flags
+		ORDER BY name, user_id
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	overrides := []FeatureFlagOverride{}
+	for rows.Next() {
+		var o FeatureFlagOverride
+		var userID string
+		if err := rows.Scan(&o.Name, &userID, &o.Enabled, &o.UpdatedAt); err != nil {
+			return nil, err
+		}
+		if userID != "" {
+			id, err := uuid.Parse(userID)
+			if err != nil {
+				return nil, err
+			}
+			o.UserID = &id
+		}
+		overrides = append(overrides, o)
+	}
+	return overrides, rows.Err()
+}
+
+// SetFeatureFlagOverride turns a flag on or off for userID, or for
+// everyone if it's uuid.Nil.
+func (c Client) SetFeatureFlagOverride(name string, userID uuid.UUID, enabled bool) error {
+	query := `
+		INSERT INTO feature_flags (name, user_id, enabled, updated_at)
+		VALUES (?, ?, ?, CURRENT_TIMESTAMP)
+		ON CONFLICT (name, user_id) DO UPDATE SET enabled = excluded.enabled, updated_at = excluded.updated_at
+	`
+	_, err := c.db.Exec(query, name, flagUserID(userID), enabled)
+	return err
+}
+
+// DeleteFeatureFlagOverride removes an override set with
+// SetFeatureFlagOverride, reporting false if there was none.
+func (c Client) DeleteFeatureFlagOverride(name string, userID uuid.UUID) (bool, error) {
+	res, err := c.db.Exec(`DELETE FROM feature_flags WHERE name = ? AND user_id = ?`, name, flagUserID(userID))
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+func flagUserID(userID uuid.UUID) string {
+	if userID == uuid.Nil {
+		return ""
+	}
+	return userID.String()
+}
+
+// MaintenanceMode is whether uploads are paused, and what clients are told
+// while they are. UpdatedAt is nil if it was never set.
+type MaintenanceMode struct {
+	Enabled   bool       `json:"enabled"`
+	Message   string     `json:"message"`
+	UpdatedAt *time.Time `json:"updated_at"`
+}
+
+// GetMaintenanceMode returns the current maintenance mode, off if it was
+// never set.
+func (c Client) GetMaintenanceMode() (MaintenanceMode, error) {
+	var m MaintenanceMode
+	err := c.db.QueryRow(`SELECT enabled, message, updated_at FROM maintenance_mode WHERE id = 1`).Scan(&m.Enabled, &m.Message, &m.UpdatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return MaintenanceMode{}, nil
+	}
+	return m, err
+}
+
+// SetMaintenanceMode turns maintenance mode on or off.
+func (c Client) SetMaintenanceMode(enabled bool, message string) (MaintenanceMode, error) {
+	query := `
+		INSERT INTO maintenance_mode (id, enabled, message, updated_at)
+		VALUES (1, ?, ?, CURRENT_TIMESTAMP)
+		ON CONFLICT (id) DO UPDATE SET enabled = excluded.enabled, message = excluded.message, updated_at = excluded.updated_at
+	`
+	if _, err := c.db.Exec(query, enabled, message); err != nil {
+		return MaintenanceMode{}, err
+	}
+	return c.GetMaintenanceMode()
+}
@@ -0,0 +1,52 @@
+package database
+
+import (
+	"github.com/google/uuid"
+)
+
+// LikeVideo records that userID likes a video. Liking twice is a no-op.
+func (c Client) LikeVideo(videoID, userID uuid.UUID) error {
+	query := `
+		INSERT INTO video_likes (video_id, user_id, created_at)
+		VALUES (?, ?, CURRENT_TIMESTAMP)
+		ON CONFLICT DO NOTHING
+	`
+	_, err := c.db.Exec(query, videoID.String(), userID.String())
+	c.invalidateVideo(videoID, c.videoOwner(videoID))
+	return err
+}
+
+func (c Client) UnlikeVideo(videoID, userID uuid.UUID) error {
+	_, err := c.db.Exec(`DELETE FROM video_likes WHERE video_id = ? AND user_id = ?`, videoID.String(), userID.String())
+	c.invalidateVideo(videoID, c.videoOwner(videoID))
+	return err
+}
+
+// GetLikedVideos returns the videos userID has liked, most recently liked
+// first. Other users' private videos are left out.
+func (c Client) GetLikedVideos(userID uuid.UUID, page Page) ([]Video, *Cursor, error) {
+	query := `
+	SELECT` + videoColumns + `
+	FROM videos
+	JOIN video_likes vl ON vl.video_id = videos.id
+	WHERE vl.user_id = ? AND videos.deleted_at IS NULL
+		AND (videos.visibility != ? OR videos.user_id = vl.user_id)
+	`
+	query, args := page.keyset(query, []any{userID.String(), VisibilityPrivate}, "vl.created_at", "videos.id", true)
+	videos, err := c.queryVideos(query, args...)
+	if err != nil {
+		return nil, nil, err
+	}
+	videos, next := paginate(page, videos, videoCursor)
+	if next != nil {
+		// Pages follow the time of the like, not of the video
+		err = c.db.QueryRow(
+			`SELECT created_at FROM video_likes WHERE video_id = ? AND user_id = ?`,
+			next.ID, userID.String(),
+		).Scan(&next.CreatedAt)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	return videos, next, nil
+}
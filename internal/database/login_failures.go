@@ -0,0 +1,79 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// LoginFailures counts recent failed logins for a subject, an account or
+// an IP address, and how long it's locked out for.
+type LoginFailures struct {
+	Subject       string     `json:"subject"`
+	Failures      int        `json:"failures"`
+	LastFailureAt time.Time  `json:"last_failure_at"`
+	LockedUntil   *time.Time `json:"locked_until"`
+}
+
+// GetLoginFailures returns a zero LoginFailures if the subject has none.
+func (c Client) GetLoginFailures(subject string) (LoginFailures, error) {
+	query := `
+		SELECT subject, failures, last_failure_at, locked_until
+		FROM login_failures
+		WHERE subject = ?
+	`
+	var f LoginFailures
+	err := c.db.QueryRow(query, subject).Scan(&f.Subject, &f.Failures, &f.LastFailureAt, &f.LockedUntil)
+	if errors.Is(err, sql.ErrNoRows) {
+		return LoginFailures{}, nil
+	}
+	if err != nil {
+		return LoginFailures{}, err
+	}
+	return f, nil
+}
+
+// RecordLoginFailure counts a failed login for subject and returns how
+// many it has had. Failures from before since are forgotten first.
+func (c Client) RecordLoginFailure(subject string, since time.Time) (int, error) {
+	now := time.Now().UTC().Format(time.DateTime)
+	query := `
+		INSERT INTO login_failures (subject, failures, last_failure_at)
+		VALUES (?, 1, ?)
+		ON CONFLICT (subject) DO UPDATE SET
+			failures = CASE WHEN login_failures.last_failure_at < ? THEN 1 ELSE login_failures.failures + 1 END,
+			last_failure_at = excluded.last_failure_at
+	`
+	if _, err := c.db.Exec(query, subject, now, since.UTC().Format(time.DateTime)); err != nil {
+		return 0, err
+	}
+	var failures int
+	err := c.db.QueryRow(`SELECT failures FROM login_failures WHERE subject = ?`, subject).Scan(&failures)
+	return failures, err
+}
+
+// LockLogin locks subject out until the given time.
+func (c Client) LockLogin(subject string, until time.Time) error {
+	_, err := c.db.Exec(`UPDATE login_failures SET locked_until = ? WHERE subject = ?`, until.UTC().Format(time.DateTime), subject)
+	return err
+}
+
+// ClearLoginFailures forgets subject's failures and lifts its lockout.
+func (c Client) ClearLoginFailures(subject string) error {
+	_, err := c.db.Exec(`DELETE FROM login_failures WHERE subject = ?`, subject)
+	return err
+}
+
+// DeleteLoginFailuresBefore forgets subjects whose last failure was before
+// the given time and that aren't locked out anymore.
+func (c Client) DeleteLoginFailuresBefore(before time.Time) (int64, error) {
+	query := `
+		DELETE FROM login_failures
+		WHERE last_failure_at < ? AND (locked_until IS NULL OR locked_until < ?)
+	`
+	res, err := c.db.Exec(query, before.UTC().Format(time.DateTime), time.Now().UTC().Format(time.DateTime))
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
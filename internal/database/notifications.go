@@ -0,0 +1,144 @@
+package database
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Notification is something a user is told about in the app, such as one
+// of their videos finishing processing. IDs increase, so clients following
+// the stream can resume after the last one they saw.
+type Notification struct {
+	ID        int64      `json:"id"`
+	CreatedAt time.Time  `json:"created_at"`
+	UserID    uuid.UUID  `json:"user_id"`
+	Type      string     `json:"type"`
+	Message   string     `json:"message"`
+	VideoID   *uuid.UUID `json:"video_id"`
+	ReadAt    *time.Time `json:"read_at"`
+}
+
+type CreateNotificationParams struct {
+	UserID  uuid.UUID
+	Type    string
+	Message string
+	VideoID *uuid.UUID
+}
+
+const notificationColumns = `id, created_at, user_id, type, message, video_id, read_at`
+
+func scanNotification(row rowScanner) (Notification, error) {
+	var n Notification
+	err := row.Scan(&n.ID, &n.CreatedAt, &n.UserID, &n.Type, &n.Message, &n.VideoID, &n.ReadAt)
+	return n, err
+}
+
+func (c Client) queryNotifications(query string, args ...any) ([]Notification, error) {
+	rows, err := c.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	notifications := []Notification{}
+	for rows.Next() {
+		n, err := scanNotification(rows)
+		if err != nil {
+			return nil, err
+		}
+		notifications = append(notifications, n)
+	}
+	return notifications, rows.Err()
+}
+
+func (c Client) CreateNotification(params CreateNotificationParams) error {
+	query := `
+		INSERT INTO notifications
+		    (created_at, user_id, type, message, video_id)
+		VALUES
+		    (CURRENT_TIMESTAMP, ?, ?, ?, ?)
+	`
+	_, err := c.db.Exec(query, params.UserID.String(), params.Type, params.Message, params.VideoID)
+	return err
+}
+
+// GetNotifications returns a user's notifications, newest first, only the
+// unread ones if unreadOnly is set.
+func (c Client) GetNotifications(userID uuid.UUID, unreadOnly bool, page Page) ([]Notification, *Cursor, error) {
+	query := `SELECT ` + notificationColumns + ` FROM notifications WHERE user_id = ?`
+	if unreadOnly {
+		query += ` AND read_at IS NULL`
+	}
+	query, args := page.keyset(query, []any{userID.String()}, "created_at", "id", true)
+	notifications, err := c.queryNotifications(query, args...)
+	if err != nil {
+		return nil, nil, err
+	}
+	notifications, next := paginate(page, notifications, func(n Notification) Cursor {
+		return Cursor{CreatedAt: n.CreatedAt, ID: strconv.FormatInt(n.ID, 10)}
+	})
+	return notifications, next, nil
+}
+
+// GetNotificationsAfter returns a user's notifications with IDs above
+// afterID, oldest first, for following them as they're created.
+func (c Client) GetNotificationsAfter(userID uuid.UUID, afterID int64, limit int) ([]Notification, error) {
+	query := `SELECT ` + notificationColumns + ` FROM notifications WHERE user_id = ? AND id > ? ORDER BY id LIMIT ?`
+	return c.queryNotifications(query, userID.String(), afterID, limit)
+}
+
+// LatestNotificationID returns the ID of a user's newest notification, 0
+// if they have none.
+func (c Client) LatestNotificationID(userID uuid.UUID) (int64, error) {
+	var id int64
+	err := c.db.QueryRow(`SELECT COALESCE(MAX(id), 0) FROM notifications WHERE user_id = ?`, userID.String()).Scan(&id)
+	return id, err
+}
+
+// HasNotificationSince reports whether the user was sent a notification
+// of the type after since, so repeated warnings can be spaced out.
+func (c Client) HasNotificationSince(userID uuid.UUID, notificationType string, since time.Time) (bool, error) {
+	var n int
+	err := c.db.QueryRow(
+		`SELECT COUNT(*) FROM notifications WHERE user_id = ? AND type = ? AND created_at > ?`,
+		userID.String(), notificationType, since.UTC().Format(time.DateTime),
+	).Scan(&n)
+	return n > 0, err
+}
+
+func (c Client) CountUnreadNotifications(userID uuid.UUID) (int, error) {
+	var n int
+	err := c.db.QueryRow(`SELECT COUNT(*) FROM notifications WHERE user_id = ? AND read_at IS NULL`, userID.String()).Scan(&n)
+	return n, err
+}
+
+// MarkNotificationRead marks one of a user's notifications read. It
+// returns false if the user has no notification with the ID.
+func (c Client) MarkNotificationRead(userID uuid.UUID, id int64) (bool, error) {
+	res, err := c.db.Exec(
+		`UPDATE notifications SET read_at = COALESCE(read_at, CURRENT_TIMESTAMP) WHERE id = ? AND user_id = ?`,
+		id, userID.String(),
+	)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+func (c Client) MarkAllNotificationsRead(userID uuid.UUID) error {
+	_, err := c.db.Exec(`UPDATE notifications SET read_at = CURRENT_TIMESTAMP WHERE user_id = ? AND read_at IS NULL`, userID.String())
+	return err
+}
+
+// DeleteNotificationsBefore deletes notifications created before cutoff,
+// returning how many there were.
+func (c Client) DeleteNotificationsBefore(cutoff time.Time) (int64, error) {
+	res, err := c.db.Exec(`DELETE FROM notifications WHERE created_at < ?`, cutoff.UTC().Format(time.DateTime))
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
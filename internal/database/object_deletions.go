@@ -0,0 +1,66 @@
+package database
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// ObjectDeletion is an S3 object, or every object under a prefix, that
+// is deleted once DeleteAfter has passed. Replaced video files are kept
+// around for a while so players that already loaded the old URL can
+// finish.
+type ObjectDeletion struct {
+	ID          uuid.UUID `json:"id"`
+	CreatedAt   time.Time `json:"created_at"`
+	Key         string    `json:"key"`
+	Prefix      bool      `json:"prefix"`
+	DeleteAfter time.Time `json:"delete_after"`
+}
+
+const objectDeletionColumns = `id, created_at, key, prefix, delete_after`
+
+func (c Client) ScheduleObjectDeletion(key string, prefix bool, deleteAfter time.Time) error {
+	query := `
+		INSERT INTO object_deletions
+		    (id, created_at, key, prefix, delete_after)
+		VALUES
+		    (?, CURRENT_TIMESTAMP, ?, ?, ?)
+	`
+	_, err := c.db.Exec(query, uuid.New().String(), key, prefix, deleteAfter.UTC().Format(time.DateTime))
+	return err
+}
+
+// GetObjectDeletions returns every scheduled deletion, soonest first.
+func (c Client) GetObjectDeletions() ([]ObjectDeletion, error) {
+	return c.queryObjectDeletions(`SELECT ` + objectDeletionColumns + ` FROM object_deletions ORDER BY delete_after`)
+}
+
+// GetObjectDeletionsDue returns deletions whose delete_after is before now.
+func (c Client) GetObjectDeletionsDue(now time.Time) ([]ObjectDeletion, error) {
+	query := `SELECT ` + objectDeletionColumns + ` FROM object_deletions WHERE delete_after < ? ORDER BY delete_after`
+	return c.queryObjectDeletions(query, now.UTC().Format(time.DateTime))
+}
+
+func (c Client) DeleteObjectDeletion(id uuid.UUID) error {
+	_, err := c.db.Exec(`DELETE FROM object_deletions WHERE id = ?`, id.String())
+	return err
+}
+
+func (c Client) queryObjectDeletions(query string, args ...any) ([]ObjectDeletion, error) {
+	rows, err := c.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	deletions := []ObjectDeletion{}
+	for rows.Next() {
+		var d ObjectDeletion
+		if err := rows.Scan(&d.ID, &d.CreatedAt, &d.Key, &d.Prefix, &d.DeleteAfter); err != nil {
+			return nil, err
+		}
+		deletions = append(deletions, d)
+	}
+	return deletions, rows.Err()
+}
@@ -0,0 +1,269 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Roles a member can have in an organization. Viewers can see its private
+// videos, editors can also upload and change them, and owners can also
+// delete them and manage who's a member.
+const (
+	OrgRoleOwner  = "owner"
+	OrgRoleEditor = "editor"
+	OrgRoleViewer = "viewer"
+)
+
+// Organization is a team whose members share its videos. Role is the
+// role of the user it was loaded for, empty when loaded on its own.
+type Organization struct {
+	ID        uuid.UUID `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	Name      string    `json:"name"`
+	Role      string    `json:"role,omitempty"`
+}
+
+type OrganizationMember struct {
+	OrgID     uuid.UUID `json:"org_id"`
+	UserID    uuid.UUID `json:"user_id"`
+	Email     string    `json:"email"`
+	Role      string    `json:"role"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// OrganizationInvitation asks whoever owns Email to join an organization.
+// Only a hash of its token is kept, like other single-use tokens.
+type OrganizationInvitation struct {
+	ID        uuid.UUID `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+	OrgID     uuid.UUID `json:"org_id"`
+	Email     string    `json:"email"`
+	Role      string    `json:"role"`
+	InvitedBy uuid.UUID `json:"invited_by"`
+	TokenHash string    `json:"-"`
+}
+
+type CreateOrganizationInvitationParams struct {
+	OrgID     uuid.UUID
+	Email     string
+	Role      string
+	InvitedBy uuid.UUID
+	TokenHash string
+	ExpiresAt time.Time
+}
+
+// CreateOrganization creates an organization with ownerID as its first
+// owner.
+func (c Client) CreateOrganization(name string, ownerID uuid.UUID) (Organization, error) {
+	id := uuid.New()
+	query := `
+		INSERT INTO organizations (id, created_at, updated_at, name)
+		VALUES (?, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP, ?)
+	`
+	if _, err := c.db.Exec(query, id.String(), name); err != nil {
+		return Organization{}, err
+	}
+	if err := c.SetOrganizationMemberRole(id, ownerID, OrgRoleOwner); err != nil {
+		return Organization{}, err
+	}
+	return c.GetOrganization(id)
+}
+
+// GetOrganization returns a zero Organization if it doesn't exist.
+func (c Client) GetOrganization(id uuid.UUID) (Organization, error) {
+	query := `SELECT id, created_at, updated_at, name FROM organizations WHERE id = ?`
+	var o Organization
+	err := c.db.QueryRow(query, id.String()).Scan(&o.ID, &o.CreatedAt, &o.UpdatedAt, &o.Name)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Organization{}, nil
+	}
+	if err != nil {
+		return Organization{}, err
+	}
+	return o, nil
+}
+
+// GetUserOrganizations returns the organizations a user is a member of,
+// each with their role in it, oldest first.
+func (c Client) GetUserOrganizations(userID uuid.UUID) ([]Organization, error) {
+	query := `
+		SELECT organizations.id, organizations.created_at, organizations.updated_at, organizations.name, organization_members.role
+		FROM organizations
+		JOIN organization_members ON organization_members.org_id = organizations.id
+		WHERE organization_members.user_id = ?
+		ORDER BY organizations.created_at, organizations.id
+	`
+	rows, err := c.db.Query(query, userID.String())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	orgs := []Organization{}
+	for rows.Next() {
+		var o Organization
+		if err := rows.Scan(&o.ID, &o.CreatedAt, &o.UpdatedAt, &o.Name, &o.Role); err != nil {
+			return nil, err
+		}
+		orgs = append(orgs, o)
+	}
+	return orgs, rows.Err()
+}
+
+// GetOrganizationRole returns the user's role in the organization, or ""
+// if they aren't a member.
+func (c Client) GetOrganizationRole(orgID, userID uuid.UUID) (string, error) {
+	query := `SELECT role FROM organization_members WHERE org_id = ? AND user_id = ?`
+	var role string
+	err := c.db.QueryRow(query, orgID.String(), userID.String()).Scan(&role)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	}
+	return role, err
+}
+
+// GetOrganizationMembers returns an organization's members, longest
+// standing first.
+func (c Client) GetOrganizationMembers(orgID uuid.UUID) ([]OrganizationMember, error) {
+	query := `
+		SELECT organization_members.org_id, organization_members.user_id, users.email, organization_members.role, organization_members.created_at
+		FROM organization_members
+		JOIN users ON users.id = organization_members.user_id
+		WHERE organization_members.org_id = ?
+		ORDER BY organization_members.created_at, organization_members.user_id
+	`
+	rows, err := c.db.Query(query, orgID.String())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	members := []OrganizationMember{}
+	for rows.Next() {
+		var m OrganizationMember
+		if err := rows.Scan(&m.OrgID, &m.UserID, &m.Email, &m.Role, &m.CreatedAt); err != nil {
+			return nil, err
+		}
+		members = append(members, m)
+	}
+	return members, rows.Err()
+}
+
+// CountOrganizationOwners counts the members with the owner role, so the
+// last one can't leave an organization nobody can manage.
+func (c Client) CountOrganizationOwners(orgID uuid.UUID) (int, error) {
+	var n int
+	err := c.db.QueryRow(`SELECT COUNT(*) FROM organization_members WHERE org_id = ? AND role = ?`, orgID.String(), OrgRoleOwner).Scan(&n)
+	return n, err
+}
+
+// SetOrganizationMemberRole adds the user to the organization with role,
+// or changes their role if they're already a member.
+func (c Client) SetOrganizationMemberRole(orgID, userID uuid.UUID, role string) error {
+	query := `
+		INSERT INTO organization_members (org_id, user_id, role, created_at)
+		VALUES (?, ?, ?, CURRENT_TIMESTAMP)
+		ON CONFLICT (org_id, user_id) DO UPDATE SET role = excluded.role
+	`
+	_, err := c.db.Exec(query, orgID.String(), userID.String(), role)
+	return err
+}
+
+func (c Client) RemoveOrganizationMember(orgID, userID uuid.UUID) error {
+	_, err := c.db.Exec(`DELETE FROM organization_members WHERE org_id = ? AND user_id = ?`, orgID.String(), userID.String())
+	return err
+}
+
+const organizationInvitationColumns = `id, created_at, expires_at, org_id, email, role, invited_by, token_hash`
+
+func scanOrganizationInvitation(row rowScanner) (OrganizationInvitation, error) {
+	var i OrganizationInvitation
+	err := row.Scan(&i.ID, &i.CreatedAt, &i.ExpiresAt, &i.OrgID, &i.Email, &i.Role, &i.InvitedBy, &i.TokenHash)
+	return i, err
+}
+
+func (c Client) CreateOrganizationInvitation(params CreateOrganizationInvitationParams) (OrganizationInvitation, error) {
+	id := uuid.New()
+	query := `
+		INSERT INTO organization_invitations
+		    (id, created_at, expires_at, org_id, email, role, invited_by, token_hash)
+		VALUES
+		    (?, CURRENT_TIMESTAMP, ?, ?, ?, ?, ?, ?)
+	`
+	_, err := c.db.Exec(query, id.String(), params.ExpiresAt.UTC(), params.OrgID.String(), params.Email, params.Role, params.InvitedBy.String(), params.TokenHash)
+	if err != nil {
+		return OrganizationInvitation{}, err
+	}
+	return c.GetOrganizationInvitation(id)
+}
+
+// GetOrganizationInvitation returns a zero OrganizationInvitation if it
+// doesn't exist.
+func (c Client) GetOrganizationInvitation(id uuid.UUID) (OrganizationInvitation, error) {
+	query := `SELECT ` + organizationInvitationColumns + ` FROM organization_invitations WHERE id = ?`
+	return c.getOrganizationInvitation(query, id.String())
+}
+
+// GetOrganizationInvitationByToken returns the unexpired invitation with
+// the token hash, or a zero OrganizationInvitation if there's none.
+func (c Client) GetOrganizationInvitationByToken(tokenHash string) (OrganizationInvitation, error) {
+	query := `SELECT ` + organizationInvitationColumns + ` FROM organization_invitations WHERE token_hash = ? AND expires_at > ?`
+	return c.getOrganizationInvitation(query, tokenHash, time.Now().UTC())
+}
+
+func (c Client) getOrganizationInvitation(query string, args ...any) (OrganizationInvitation, error) {
+	i, err := scanOrganizationInvitation(c.db.QueryRow(query, args...))
+	if errors.Is(err, sql.ErrNoRows) {
+		return OrganizationInvitation{}, nil
+	}
+	if err != nil {
+		return OrganizationInvitation{}, err
+	}
+	return i, nil
+}
+
+// GetOrganizationInvitations returns an organization's unexpired
+// invitations, newest first.
+func (c Client) GetOrganizationInvitations(orgID uuid.UUID) ([]OrganizationInvitation, error) {
+	query := `
+		SELECT ` + organizationInvitationColumns + `
+		FROM organization_invitations
+		WHERE org_id = ? AND expires_at > ?
+		ORDER BY created_at DESC, id
+	`
+	rows, err := c.db.Query(query, orgID.String(), time.Now().UTC())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	invitations := []OrganizationInvitation{}
+	for rows.Next() {
+		i, err := scanOrganizationInvitation(rows)
+		if err != nil {
+			return nil, err
+		}
+		invitations = append(invitations, i)
+	}
+	return invitations, rows.Err()
+}
+
+func (c Client) DeleteOrganizationInvitation(id uuid.UUID) error {
+	_, err := c.db.Exec(`DELETE FROM organization_invitations WHERE id = ?`, id.String())
+	return err
+}
+
+// GetOrganizationVideos returns an organization's videos, newest first.
+func (c Client) GetOrganizationVideos(orgID uuid.UUID, page Page) ([]Video, *Cursor, error) {
+	query := `
+	SELECT` + videoColumns + `
+	FROM videos
+	WHERE org_id = ? AND deleted_at IS NULL
+	`
+	return c.queryVideoPage(page, query, orgID)
+}
@@ -0,0 +1,85 @@
+package database
+
+import (
+	"encoding/base64"
+	"errors"
+	"strings"
+	"time"
+)
+
+// ErrInvalidCursor is returned by ParseCursor for tokens it didn't issue.
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// Cursor is the sort position of the last row on a page. Lists are
+// ordered by a timestamp with the row's id breaking ties, so rows
+// inserted while a client pages through can't shift what comes next.
+type Cursor struct {
+	CreatedAt time.Time
+	ID        string
+}
+
+// String encodes the cursor as an opaque token for clients to send back.
+func (c Cursor) String() string {
+	raw := c.CreatedAt.UTC().Format(time.RFC3339Nano) + "|" + c.ID
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+func ParseCursor(token string) (Cursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return Cursor{}, ErrInvalidCursor
+	}
+	ts, id, ok := strings.Cut(string(raw), "|")
+	if !ok || id == "" {
+		return Cursor{}, ErrInvalidCursor
+	}
+	createdAt, err := time.Parse(time.RFC3339Nano, ts)
+	if err != nil {
+		return Cursor{}, ErrInvalidCursor
+	}
+	return Cursor{CreatedAt: createdAt, ID: id}, nil
+}
+
+// Page selects a slice of a list. After is the cursor returned with the
+// previous page, nil for the first one. A Limit of zero or less returns
+// every remaining row.
+type Page struct {
+	After *Cursor
+	Limit int
+}
+
+// keyset appends the cursor condition, ordering and limit to a query whose
+// WHERE clause is already written. One row more than the limit is fetched
+// so paginate can tell whether there's a next page.
+func (p Page) keyset(query string, args []any, sortCol, idCol string, desc bool) (string, []any) {
+	cmp, dir := ">", "ASC"
+	if desc {
+		cmp, dir = "<", "DESC"
+	}
+	if p.After != nil {
+		ts := p.After.CreatedAt.UTC().Format("2006-01-02 15:04:05.999999")
+		query += " AND (" + sortCol + " " + cmp + " ? OR (" + sortCol + " = ? AND " + idCol + " " + cmp + " ?))"
+		args = append(args, ts, ts, p.After.ID)
+	}
+	query += " ORDER BY " + sortCol + " " + dir + ", " + idCol + " " + dir
+	if p.Limit > 0 {
+		query += " LIMIT ?"
+		args = append(args, p.Limit+1)
+	}
+	return query, args
+}
+
+// paginate trims the extra row fetched by keyset and returns the cursor
+// for the next page, or nil on the last one.
+func paginate[T any](p Page, items []T, cursor func(T) Cursor) ([]T, *Cursor) {
+	if p.Limit <= 0 || len(items) <= p.Limit {
+		return items, nil
+	}
+	items = items[:p.Limit]
+	next := cursor(items[len(items)-1])
+	return items, &next
+}
+
+func videoCursor(v Video) Cursor {
+	return Cursor{CreatedAt: v.CreatedAt, ID: v.ID.String()}
+}
@@ -0,0 +1,92 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// ProcessedUpload is a video's processed file kept on local disk while it's
+// uploaded to the bucket, so an upload that fails can be resumed without
+// processing the original again. UploadID is the S3 multipart upload it's
+// sent in, empty until one is started or if the file fits in one request.
+type ProcessedUpload struct {
+	VideoID   uuid.UUID
+	CreatedAt time.Time
+	UpdatedAt time.Time
+	// SourceChecksum is the SHA-256 of the staged original it was made from
+	SourceChecksum string
+	Dir            string
+	ObjectKey      string
+	StorageClass   string
+	UploadID       string
+}
+
+const processedUploadColumns = `video_id, created_at, updated_at, source_checksum, dir, object_key, storage_class, upload_id`
+
+func scanProcessedUpload(row rowScanner) (ProcessedUpload, error) {
+	var u ProcessedUpload
+	err := row.Scan(&u.VideoID, &u.CreatedAt, &u.UpdatedAt, &u.SourceChecksum, &u.Dir, &u.ObjectKey, &u.StorageClass, &u.UploadID)
+	return u, err
+}
+
+// SaveProcessedUpload records a video's processed upload, replacing any it
+// had.
+func (c Client) SaveProcessedUpload(u ProcessedUpload) error {
+	query := `
+		INSERT INTO processed_uploads
+		    (video_id, created_at, updated_at, source_checksum, dir, object_key, storage_class, upload_id)
+		VALUES
+		    (?, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP, ?, ?, ?, ?, ?)
+		ON CONFLICT (video_id) DO UPDATE SET
+		    updated_at = CURRENT_TIMESTAMP,
+		    source_checksum = excluded.source_checksum,
+		    dir = excluded.dir,
+		    object_key = excluded.object_key,
+		    storage_class = excluded.storage_class,
+		    upload_id = excluded.upload_id
+	`
+	_, err := c.db.Exec(query, u.VideoID.String(), u.SourceChecksum, u.Dir, u.ObjectKey, u.StorageClass, u.UploadID)
+	return err
+}
+
+// GetProcessedUpload returns a zero ProcessedUpload if the video has none.
+func (c Client) GetProcessedUpload(videoID uuid.UUID) (ProcessedUpload, error) {
+	query := `SELECT ` + processedUploadColumns + ` FROM processed_uploads WHERE video_id = ?`
+	u, err := scanProcessedUpload(c.db.QueryRow(query, videoID.String()))
+	if errors.Is(err, sql.ErrNoRows) {
+		return ProcessedUpload{}, nil
+	}
+	if err != nil {
+		return ProcessedUpload{}, err
+	}
+	return u, nil
+}
+
+// GetProcessedUploadsBefore returns processed uploads last worked on
+// before cutoff.
+func (c Client) GetProcessedUploadsBefore(cutoff time.Time) ([]ProcessedUpload, error) {
+	query := `SELECT ` + processedUploadColumns + ` FROM processed_uploads WHERE updated_at < ? ORDER BY updated_at`
+	rows, err := c.db.Query(query, cutoff.UTC().Format(time.DateTime))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	uploads := []ProcessedUpload{}
+	for rows.Next() {
+		u, err := scanProcessedUpload(rows)
+		if err != nil {
+			return nil, err
+		}
+		uploads = append(uploads, u)
+	}
+	return uploads, rows.Err()
+}
+
+func (c Client) DeleteProcessedUpload(videoID uuid.UUID) error {
+	_, err := c.db.Exec(`DELETE FROM processed_uploads WHERE video_id = ?`, videoID.String())
+	return err
+}
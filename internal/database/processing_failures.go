@@ -0,0 +1,132 @@
+package database
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// ProcessingFailure tracks a video whose processing keeps failing. Once
+// Attempts reaches the dead-letter threshold DeadAt is set and the
+// failure stays listed until it's cleared.
+type ProcessingFailure struct {
+	VideoID   uuid.UUID  `json:"video_id"`
+	CreatedAt time.Time  `json:"created_at"`
+	UpdatedAt time.Time  `json:"updated_at"`
+	Attempts  int        `json:"attempts"`
+	Stage     string     `json:"stage"`
+	Error     string     `json:"error"`
+	Stderr    string     `json:"stderr"`
+	DeadAt    *time.Time `json:"dead_at"`
+}
+
+type RecordProcessingFailureParams struct {
+	VideoID uuid.UUID
+	Stage   string
+	Error   string
+	Stderr  string
+	// DeadAfter is the number of attempts after which the failure is
+	// dead-lettered.
+	DeadAfter int
+}
+
+// RecordProcessingFailure counts a failed processing attempt and returns
+// the updated record.
+func (c Client) RecordProcessingFailure(params RecordProcessingFailureParams) (ProcessingFailure, error) {
+	query := `
+		INSERT INTO processing_failures
+		    (video_id, created_at, updated_at, attempts, stage, error, stderr)
+		VALUES
+		    (?, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP, 1, ?, ?, ?)
+		ON CONFLICT (video_id) DO UPDATE SET
+		    updated_at = CURRENT_TIMESTAMP,
+		    attempts = processing_failures.attempts + 1,
+		    stage = excluded.stage,
+		    error = excluded.error,
+		    stderr = excluded.stderr
+	`
+	_, err := c.db.Exec(query, params.VideoID.String(), params.Stage, params.Error, params.Stderr)
+	if err != nil {
+		return ProcessingFailure{}, err
+	}
+
+	query = `
+		UPDATE processing_failures
+		SET dead_at = CURRENT_TIMESTAMP
+		WHERE video_id = ? AND dead_at IS NULL AND attempts >= ?
+	`
+	_, err = c.db.Exec(query, params.VideoID.String(), params.DeadAfter)
+	if err != nil {
+		return ProcessingFailure{}, err
+	}
+
+	failure, err := c.GetProcessingFailure(params.VideoID)
+	if err != nil || failure == nil {
+		return ProcessingFailure{}, err
+	}
+	return *failure, nil
+}
+
+// GetProcessingFailures returns failures, most recently failed first.
+// Unless all is true only dead-lettered ones are included.
+func (c Client) GetProcessingFailures(all bool, page Page) ([]ProcessingFailure, *Cursor, error) {
+	query := `
+		SELECT ` + processingFailureColumns + `
+		FROM processing_failures
+		WHERE 1 = 1
+	`
+	if !all {
+		query += " AND dead_at IS NOT NULL"
+	}
+	query, args := page.keyset(query, nil, "updated_at", "video_id", true)
+	failures, err := c.queryProcessingFailures(query, args...)
+	if err != nil {
+		return nil, nil, err
+	}
+	failures, next := paginate(page, failures, func(f ProcessingFailure) Cursor {
+		return Cursor{CreatedAt: f.UpdatedAt, ID: f.VideoID.String()}
+	})
+	return failures, next, nil
+}
+
+// GetProcessingFailure returns a video's failure record, or nil if its
+// last processing attempt didn't fail.
+func (c Client) GetProcessingFailure(videoID uuid.UUID) (*ProcessingFailure, error) {
+	failures, err := c.queryProcessingFailures(`
+		SELECT `+processingFailureColumns+`
+		FROM processing_failures
+		WHERE video_id = ?
+	`, videoID.String())
+	if err != nil || len(failures) == 0 {
+		return nil, err
+	}
+	return &failures[0], nil
+}
+
+// ClearProcessingFailure forgets a video's failures, after it finally
+// processes or an admin dismisses it.
+func (c Client) ClearProcessingFailure(videoID uuid.UUID) error {
+	_, err := c.db.Exec(`DELETE FROM processing_failures WHERE video_id = ?`, videoID.String())
+	return err
+}
+
+const processingFailureColumns = `video_id, created_at, updated_at, attempts, stage, error, stderr, dead_at`
+
+func (c Client) queryProcessingFailures(query string, args ...any) ([]ProcessingFailure, error) {
+	rows, err := c.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	failures := []ProcessingFailure{}
+	for rows.Next() {
+		var f ProcessingFailure
+		err := rows.Scan(&f.VideoID, &f.CreatedAt, &f.UpdatedAt, &f.Attempts, &f.Stage, &f.Error, &f.Stderr, &f.DeadAt)
+		if err != nil {
+			return nil, err
+		}
+		failures = append(failures, f)
+	}
+	return failures, rows.Err()
+}
@@ -0,0 +1,54 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// ProcessingProgress is how far along a video's current pipeline run is.
+// Stage names the step reporting it and Percent runs from 0 to 100.
+type ProcessingProgress struct {
+	VideoID   uuid.UUID `json:"-"`
+	Stage     string    `json:"stage"`
+	Percent   int       `json:"percent"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// SetProcessingProgress records where a video's processing has got to.
+func (c Client) SetProcessingProgress(videoID uuid.UUID, stage string, percent int) error {
+	query := `
+		INSERT INTO processing_progress
+		    (video_id, stage, percent, updated_at)
+		VALUES
+		    (?, ?, ?, CURRENT_TIMESTAMP)
+		ON CONFLICT (video_id) DO UPDATE SET
+		    stage = excluded.stage,
+		    percent = excluded.percent,
+		    updated_at = CURRENT_TIMESTAMP
+	`
+	_, err := c.db.Exec(query, videoID.String(), stage, percent)
+	return err
+}
+
+// GetProcessingProgress returns nil if the video isn't being processed.
+func (c Client) GetProcessingProgress(videoID uuid.UUID) (*ProcessingProgress, error) {
+	query := `SELECT video_id, stage, percent, updated_at FROM processing_progress WHERE video_id = ?`
+	var p ProcessingProgress
+	err := c.db.QueryRow(query, videoID.String()).Scan(&p.VideoID, &p.Stage, &p.Percent, &p.UpdatedAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &p, nil
+}
+
+// ClearProcessingProgress forgets a video's progress once its run ends.
+func (c Client) ClearProcessingProgress(videoID uuid.UUID) error {
+	_, err := c.db.Exec(`DELETE FROM processing_progress WHERE video_id = ?`, videoID.String())
+	return err
+}
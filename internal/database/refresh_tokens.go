@@ -48,6 +48,17 @@ func (c Client) RevokeRefreshToken(token string) error {
 	return err
 }
 
+// RevokeUserRefreshTokens revokes every active refresh token of a user.
+func (c Client) RevokeUserRefreshTokens(userID uuid.UUID) error {
+	query := `
+		UPDATE refresh_tokens
+		SET revoked_at = CURRENT_TIMESTAMP
+		WHERE user_id = ? AND revoked_at IS NULL
+	`
+	_, err := c.db.Exec(query, userID.String())
+	return err
+}
+
 func (c Client) GetRefreshToken(token string) (RefreshToken, error) {
 	query := `
 		SELECT token, created_at, updated_at, user_id, expires_at, revoked_at
@@ -0,0 +1,309 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	ReprocessBatchRunning   = "running"
+	ReprocessBatchCancelled = "cancelled"
+	ReprocessBatchDone      = "done"
+)
+
+const (
+	ReprocessItemPending   = "pending"
+	ReprocessItemRunning   = "running"
+	ReprocessItemSucceeded = "succeeded"
+	ReprocessItemFailed    = "failed"
+)
+
+// ReprocessBatch runs every video matching its filters through the
+// processing pipeline again, one at a time. The matching videos are fixed
+// when the batch is created, so videos uploaded later aren't picked up.
+type ReprocessBatch struct {
+	ID        uuid.UUID `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	Status    string    `json:"status"`
+
+	UserID        *uuid.UUID `json:"user_id"`
+	VideoStatus   string     `json:"video_status"`
+	CreatedAfter  *time.Time `json:"created_after"`
+	CreatedBefore *time.Time `json:"created_before"`
+	// DelayMS is how long to wait between videos.
+	DelayMS int64 `json:"delay_ms"`
+
+	Total     int `json:"total"`
+	Pending   int `json:"pending"`
+	Succeeded int `json:"succeeded"`
+	Failed    int `json:"failed"`
+}
+
+// ReprocessItem is one video in a batch.
+type ReprocessItem struct {
+	BatchID   uuid.UUID `json:"batch_id"`
+	VideoID   uuid.UUID `json:"video_id"`
+	UpdatedAt time.Time `json:"updated_at"`
+	Status    string    `json:"status"`
+	Error     string    `json:"error,omitempty"`
+}
+
+type CreateReprocessBatchParams struct {
+	UserID *uuid.UUID
+	// VideoStatus is VideoStatusReady, VideoStatusFailing or
+	// VideoStatusDeadLettered, or empty for any of them.
+	VideoStatus   string
+	CreatedAfter  *time.Time
+	CreatedBefore *time.Time
+	DelayMS       int64
+}
+
+const reprocessBatchColumns = `
+	b.id, b.created_at, b.updated_at, b.status, b.user_id, b.video_status, b.created_after, b.created_before, b.delay_ms,
+	(SELECT COUNT(*) FROM reprocess_items i WHERE i.batch_id = b.id),
+	(SELECT COUNT(*) FROM reprocess_items i WHERE i.batch_id = b.id AND i.status IN (?, ?)),
+	(SELECT COUNT(*) FROM reprocess_items i WHERE i.batch_id = b.id AND i.status = ?),
+	(SELECT COUNT(*) FROM reprocess_items i WHERE i.batch_id = b.id AND i.status = ?)
+`
+
+var reprocessBatchColumnArgs = []any{ReprocessItemPending, ReprocessItemRunning, ReprocessItemSucceeded, ReprocessItemFailed}
+
+func scanReprocessBatch(row rowScanner) (ReprocessBatch, error) {
+	var b ReprocessBatch
+	var userID *string
+	err := row.Scan(&b.ID, &b.CreatedAt, &b.UpdatedAt, &b.Status, &userID, &b.VideoStatus, &b.CreatedAfter, &b.CreatedBefore, &b.DelayMS,
+		&b.Total, &b.Pending, &b.Succeeded, &b.Failed)
+	if err != nil {
+		return ReprocessBatch{}, err
+	}
+	if userID != nil {
+		id, err := uuid.Parse(*userID)
+		if err != nil {
+			return ReprocessBatch{}, err
+		}
+		b.UserID = &id
+	}
+	return b, nil
+}
+
+// CreateReprocessBatch starts a batch over the videos matching params.
+// Only videos with a file to reprocess are included; trashed ones and
+// ones still awaiting upload never are.
+func (c Client) CreateReprocessBatch(params CreateReprocessBatchParams) (ReprocessBatch, error) {
+	id := uuid.New()
+	var userID *string
+	if params.UserID != nil {
+		s := params.UserID.String()
+		userID = &s
+	}
+	var createdAfter, createdBefore *string
+	if params.CreatedAfter != nil {
+		s := params.CreatedAfter.UTC().Format(time.DateTime)
+		createdAfter = &s
+	}
+	if params.CreatedBefore != nil {
+		s := params.CreatedBefore.UTC().Format(time.DateTime)
+		createdBefore = &s
+	}
+
+	query := `
+		INSERT INTO reprocess_batches
+		    (id, created_at, updated_at, status, user_id, video_status, created_after, created_before, delay_ms)
+		VALUES
+		    (?, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP, ?, ?, ?, ?, ?, ?)
+	`
+	_, err := c.db.Exec(query, id.String(), ReprocessBatchRunning, userID, params.VideoStatus, createdAfter, createdBefore, params.DelayMS)
+	if err != nil {
+		return ReprocessBatch{}, err
+	}
+
+	query = `
+		INSERT INTO reprocess_items (batch_id, video_id, updated_at, status, error)
+		SELECT ?, videos.id, CURRENT_TIMESTAMP, ?, ''
+		FROM videos
+		LEFT JOIN processing_failures pf ON pf.video_id = videos.id
+		WHERE videos.deleted_at IS NULL
+		  AND (videos.staging_key IS NOT NULL OR videos.video_url IS NOT NULL)
+	`
+	args := []any{id.String(), ReprocessItemPending}
+	if userID != nil {
+		query += " AND videos.user_id = ?"
+		args = append(args, *userID)
+	}
+	if createdAfter != nil {
+		query += " AND videos.created_at >= ?"
+		args = append(args, *createdAfter)
+	}
+	if createdBefore != nil {
+		query += " AND videos.created_at < ?"
+		args = append(args, *createdBefore)
+	}
+	if params.VideoStatus != "" {
+		query += " AND " + videoStatusExpr + " = ?"
+		args = append(append(args, videoStatusArgs...), params.VideoStatus)
+	}
+	if _, err := c.db.Exec(query, args...); err != nil {
+		c.db.Exec(`DELETE FROM reprocess_batches WHERE id = ?`, id.String())
+		return ReprocessBatch{}, err
+	}
+	return c.GetReprocessBatch(id)
+}
+
+// GetReprocessBatch returns a zero ReprocessBatch if it doesn't exist.
+func (c Client) GetReprocessBatch(id uuid.UUID) (ReprocessBatch, error) {
+	query := `SELECT ` + reprocessBatchColumns + ` FROM reprocess_batches b WHERE b.id = ?`
+	args := append(append([]any{}, reprocessBatchColumnArgs...), id.String())
+	b, err := scanReprocessBatch(c.db.QueryRow(query, args...))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ReprocessBatch{}, nil
+		}
+		return ReprocessBatch{}, err
+	}
+	return b, nil
+}
+
+// GetReprocessBatches returns batches, newest first.
+func (c Client) GetReprocessBatches(page Page) ([]ReprocessBatch, *Cursor, error) {
+	query := `SELECT ` + reprocessBatchColumns + ` FROM reprocess_batches b WHERE 1 = 1`
+	args := append([]any{}, reprocessBatchColumnArgs...)
+	query, args = page.keyset(query, args, "b.created_at", "b.id", true)
+	batches, err := c.queryReprocessBatches(query, args...)
+	if err != nil {
+		return nil, nil, err
+	}
+	batches, next := paginate(page, batches, func(b ReprocessBatch) Cursor {
+		return Cursor{CreatedAt: b.CreatedAt, ID: b.ID.String()}
+	})
+	return batches, next, nil
+}
+
+// GetRunningReprocessBatches returns batches with videos left to process,
+// oldest first.
+func (c Client) GetRunningReprocessBatches() ([]ReprocessBatch, error) {
+	query := `SELECT ` + reprocessBatchColumns + ` FROM reprocess_batches b WHERE b.status = ? ORDER BY b.created_at, b.id`
+	args := append(append([]any{}, reprocessBatchColumnArgs...), ReprocessBatchRunning)
+	return c.queryReprocessBatches(query, args...)
+}
+
+func (c Client) queryReprocessBatches(query string, args ...any) ([]ReprocessBatch, error) {
+	rows, err := c.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	batches := []ReprocessBatch{}
+	for rows.Next() {
+		b, err := scanReprocessBatch(rows)
+		if err != nil {
+			return nil, err
+		}
+		batches = append(batches, b)
+	}
+	return batches, rows.Err()
+}
+
+// SetReprocessBatchStatus moves a running batch to status. It reports
+// false if the batch wasn't running.
+func (c Client) SetReprocessBatchStatus(id uuid.UUID, status string) (bool, error) {
+	query := `
+		UPDATE reprocess_batches
+		SET status = ?, updated_at = CURRENT_TIMESTAMP
+		WHERE id = ? AND status = ?
+	`
+	res, err := c.db.Exec(query, status, id.String(), ReprocessBatchRunning)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// ClaimReprocessItem marks the next pending video of a batch as running
+// and returns it, or nil when none are left. Items left running since
+// before staleBefore are claimed again, since whoever was processing them
+// must have stopped.
+func (c Client) ClaimReprocessItem(batchID uuid.UUID, staleBefore time.Time) (*ReprocessItem, error) {
+	for {
+		query := `
+			SELECT video_id FROM reprocess_items
+			WHERE batch_id = ? AND (status = ? OR (status = ? AND updated_at < ?))
+			ORDER BY video_id
+			LIMIT 1
+		`
+		var videoID uuid.UUID
+		err := c.db.QueryRow(query, batchID.String(), ReprocessItemPending, ReprocessItemRunning, staleBefore.UTC().Format(time.DateTime)).Scan(&videoID)
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		// Another instance may claim the same item first, so only take it
+		// if it's unchanged
+		query = `
+			UPDATE reprocess_items
+			SET status = ?, updated_at = CURRENT_TIMESTAMP
+			WHERE batch_id = ? AND video_id = ? AND (status = ? OR (status = ? AND updated_at < ?))
+		`
+		res, err := c.db.Exec(query, ReprocessItemRunning, batchID.String(), videoID.String(), ReprocessItemPending, ReprocessItemRunning, staleBefore.UTC().Format(time.DateTime))
+		if err != nil {
+			return nil, err
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return nil, err
+		}
+		if n > 0 {
+			return &ReprocessItem{BatchID: batchID, VideoID: videoID, Status: ReprocessItemRunning}, nil
+		}
+	}
+}
+
+// FinishReprocessItem records how processing a video of a batch went.
+func (c Client) FinishReprocessItem(batchID, videoID uuid.UUID, status, errMsg string) error {
+	query := `
+		UPDATE reprocess_items
+		SET status = ?, error = ?, updated_at = CURRENT_TIMESTAMP
+		WHERE batch_id = ? AND video_id = ?
+	`
+	_, err := c.db.Exec(query, status, errMsg, batchID.String(), videoID.String())
+	return err
+}
+
+// GetReprocessItems returns a batch's videos, optionally only those with
+// status.
+func (c Client) GetReprocessItems(batchID uuid.UUID, status string) ([]ReprocessItem, error) {
+	query := `
+		SELECT batch_id, video_id, updated_at, status, error
+		FROM reprocess_items
+		WHERE batch_id = ?
+	`
+	args := []any{batchID.String()}
+	if status != "" {
+		query += " AND status = ?"
+		args = append(args, status)
+	}
+	query += " ORDER BY video_id"
+	rows, err := c.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	items := []ReprocessItem{}
+	for rows.Next() {
+		var item ReprocessItem
+		if err := rows.Scan(&item.BatchID, &item.VideoID, &item.UpdatedAt, &item.Status, &item.Error); err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	return items, rows.Err()
+}
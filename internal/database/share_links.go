@@ -0,0 +1,67 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type ShareLink struct {
+	CreatedAt time.Time `json:"created_at"`
+	ViewCount int       `json:"view_count"`
+	CreateShareLinkParams
+}
+
+type CreateShareLinkParams struct {
+	TokenHash string    `json:"-"`
+	VideoID   uuid.UUID `json:"video_id"`
+	CreatedBy uuid.UUID `json:"created_by"`
+	ExpiresAt time.Time `json:"expires_at"`
+	// MaxViews is nil for links that can be opened any number of times.
+	MaxViews *int `json:"max_views"`
+}
+
+func (c Client) CreateShareLink(params CreateShareLinkParams) error {
+	query := `
+		INSERT INTO share_links
+		    (token_hash, video_id, created_by, expires_at, max_views, view_count, created_at)
+		VALUES
+		    (?, ?, ?, ?, ?, 0, CURRENT_TIMESTAMP)
+	`
+	_, err := c.db.Exec(query, params.TokenHash, params.VideoID.String(), params.CreatedBy.String(), params.ExpiresAt.UTC(), params.MaxViews)
+	return err
+}
+
+// UseShareLink counts a view of a share link and returns the video it
+// points to. It fails with ErrTokenInvalid once the link has expired or
+// used up its views.
+func (c Client) UseShareLink(tokenHash string) (uuid.UUID, error) {
+	query := `
+		UPDATE share_links
+		SET view_count = view_count + 1
+		WHERE token_hash = ? AND expires_at > ? AND (max_views IS NULL OR view_count < max_views)
+	`
+	res, err := c.db.Exec(query, tokenHash, time.Now().UTC())
+	if err != nil {
+		return uuid.Nil, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return uuid.Nil, err
+	}
+	if n == 0 {
+		return uuid.Nil, ErrTokenInvalid
+	}
+
+	var videoID string
+	err = c.db.QueryRow(`SELECT video_id FROM share_links WHERE token_hash = ?`, tokenHash).Scan(&videoID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return uuid.Nil, ErrTokenInvalid
+		}
+		return uuid.Nil, err
+	}
+	return uuid.Parse(videoID)
+}
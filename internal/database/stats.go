@@ -0,0 +1,164 @@
+package database
+
+import (
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Video statuses reported by CountVideosByStatus.
+const (
+	VideoStatusAwaitingUpload = "awaiting_upload"
+	VideoStatusReady          = "ready"
+	VideoStatusFailing        = "failing"
+	VideoStatusDeadLettered   = "dead_lettered"
+	VideoStatusTrashed        = "trashed"
+)
+
+type RecordProcessingRunParams struct {
+	VideoID   uuid.UUID
+	Duration  time.Duration
+	Succeeded bool
+	// Stage is the pipeline stage that failed, empty on success.
+	Stage string
+}
+
+// RecordProcessingRun logs one pass of a video through the processing
+// pipeline for the stats endpoint.
+func (c Client) RecordProcessingRun(params RecordProcessingRunParams) error {
+	query := `
+		INSERT INTO processing_runs
+		    (id, created_at, video_id, duration_ms, succeeded, stage)
+		VALUES
+		    (?, CURRENT_TIMESTAMP, ?, ?, ?, ?)
+	`
+	_, err := c.db.Exec(query, uuid.New().String(), params.VideoID.String(), params.Duration.Milliseconds(), params.Succeeded, params.Stage)
+	return err
+}
+
+// videoStatusExpr works out a video's status in SQL, with
+// processing_failures joined as pf. It takes videoStatusArgs.
+const videoStatusExpr = `
+	CASE
+	    WHEN videos.deleted_at IS NOT NULL THEN ?
+	    WHEN pf.dead_at IS NOT NULL THEN ?
+	    WHEN pf.video_id IS NOT NULL THEN ?
+	    WHEN videos.video_url IS NOT NULL THEN ?
+	    ELSE ?
+	END`
+
+var videoStatusArgs = []any{VideoStatusTrashed, VideoStatusDeadLettered, VideoStatusFailing, VideoStatusReady, VideoStatusAwaitingUpload}
+
+// CountVideosByStatus counts every video, trashed ones included, by where
+// it is in its lifecycle.
+func (c Client) CountVideosByStatus() (map[string]int, error) {
+	query := `
+		SELECT ` + videoStatusExpr + ` AS status, COUNT(*)
+		FROM videos
+		LEFT JOIN processing_failures pf ON pf.video_id = videos.id
+		GROUP BY status
+	`
+	rows, err := c.db.Query(query, videoStatusArgs...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := map[string]int{
+		VideoStatusAwaitingUpload: 0,
+		VideoStatusReady:          0,
+		VideoStatusFailing:        0,
+		VideoStatusDeadLettered:   0,
+		VideoStatusTrashed:        0,
+	}
+	for rows.Next() {
+		var status string
+		var n int
+		if err := rows.Scan(&status, &n); err != nil {
+			return nil, err
+		}
+		counts[status] = n
+	}
+	return counts, rows.Err()
+}
+
+func (c Client) CountUsers() (int, error) {
+	var n int
+	err := c.db.QueryRow(`SELECT COUNT(*) FROM users`).Scan(&n)
+	return n, err
+}
+
+// DailyCount is a number of events on one UTC day, formatted YYYY-MM-DD.
+type DailyCount struct {
+	Date  string `json:"date"`
+	Count int    `json:"count"`
+}
+
+// CountAuditEventsByDay counts audit events with any of actions per day
+// since the given time. Days without events are left out.
+func (c Client) CountAuditEventsByDay(actions []string, since time.Time) ([]DailyCount, error) {
+	if len(actions) == 0 {
+		return []DailyCount{}, nil
+	}
+	day := c.db.day("created_at")
+	query := `SELECT ` + day + ` AS day, COUNT(*) FROM audit_events WHERE created_at >= ? AND action IN (?` + strings.Repeat(", ?", len(actions)-1) + `) GROUP BY day ORDER BY day`
+	args := []any{since.UTC().Format(time.DateTime)}
+	for _, a := range actions {
+		args = append(args, a)
+	}
+	rows, err := c.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := []DailyCount{}
+	for rows.Next() {
+		var d DailyCount
+		if err := rows.Scan(&d.Date, &d.Count); err != nil {
+			return nil, err
+		}
+		counts = append(counts, d)
+	}
+	return counts, rows.Err()
+}
+
+// DailyProcessingStats summarizes the processing runs of one UTC day.
+type DailyProcessingStats struct {
+	Date          string  `json:"date"`
+	Runs          int     `json:"runs"`
+	Failures      int     `json:"failures"`
+	AvgDurationMS float64 `json:"avg_duration_ms"`
+}
+
+// GetProcessingStatsByDay summarizes processing runs per day since the
+// given time. Days without runs are left out.
+func (c Client) GetProcessingStatsByDay(since time.Time) ([]DailyProcessingStats, error) {
+	day := c.db.day("created_at")
+	query := `
+		SELECT ` + day + ` AS day,
+		    COUNT(*),
+		    SUM(CASE WHEN succeeded THEN 0 ELSE 1 END),
+		    AVG(duration_ms)
+		FROM processing_runs
+		WHERE created_at >= ?
+		GROUP BY day
+		ORDER BY day
+	`
+	rows, err := c.db.Query(query, since.UTC().Format(time.DateTime))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	stats := []DailyProcessingStats{}
+	for rows.Next() {
+		var s DailyProcessingStats
+		if err := rows.Scan(&s.Date, &s.Runs, &s.Failures, &s.AvgDurationMS); err != nil {
+			return nil, err
+		}
+		stats = append(stats, s)
+	}
+	return stats, rows.Err()
+}
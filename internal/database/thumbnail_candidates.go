@@ -0,0 +1,106 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// ThumbnailCandidate is a frame extracted from a video that its owner can
+// pick as the thumbnail. Position orders candidates by where in the video
+// they were taken.
+type ThumbnailCandidate struct {
+	ID        uuid.UUID `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	VideoID   uuid.UUID `json:"video_id"`
+	Position  int       `json:"position"`
+	URL       string    `json:"url"`
+}
+
+const thumbnailCandidateColumns = `id, created_at, video_id, position, url`
+
+func scanThumbnailCandidate(row rowScanner) (ThumbnailCandidate, error) {
+	var t ThumbnailCandidate
+	err := row.Scan(&t.ID, &t.CreatedAt, &t.VideoID, &t.Position, &t.URL)
+	return t, err
+}
+
+func (c Client) queryThumbnailCandidates(query string, args ...any) ([]ThumbnailCandidate, error) {
+	rows, err := c.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	candidates := []ThumbnailCandidate{}
+	for rows.Next() {
+		t, err := scanThumbnailCandidate(rows)
+		if err != nil {
+			return nil, err
+		}
+		candidates = append(candidates, t)
+	}
+	return candidates, rows.Err()
+}
+
+// ReplaceThumbnailCandidates swaps a video's candidates for urls, in order.
+func (c Client) ReplaceThumbnailCandidates(videoID uuid.UUID, urls []string) ([]ThumbnailCandidate, error) {
+	_, err := c.db.Exec(`DELETE FROM thumbnail_candidates WHERE video_id = ?`, videoID.String())
+	if err != nil {
+		return nil, err
+	}
+	query := `
+		INSERT INTO thumbnail_candidates
+		    (id, created_at, video_id, position, url)
+		VALUES
+		    (?, CURRENT_TIMESTAMP, ?, ?, ?)
+	`
+	for i, url := range urls {
+		_, err := c.db.Exec(query, uuid.New().String(), videoID.String(), i, url)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return c.GetThumbnailCandidates(videoID)
+}
+
+func (c Client) GetThumbnailCandidates(videoID uuid.UUID) ([]ThumbnailCandidate, error) {
+	query := `SELECT ` + thumbnailCandidateColumns + ` FROM thumbnail_candidates WHERE video_id = ? ORDER BY position`
+	return c.queryThumbnailCandidates(query, videoID.String())
+}
+
+// GetThumbnailCandidate returns a zero ThumbnailCandidate if it doesn't
+// exist.
+func (c Client) GetThumbnailCandidate(id uuid.UUID) (ThumbnailCandidate, error) {
+	query := `SELECT ` + thumbnailCandidateColumns + ` FROM thumbnail_candidates WHERE id = ?`
+	t, err := scanThumbnailCandidate(c.db.QueryRow(query, id.String()))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ThumbnailCandidate{}, nil
+		}
+		return ThumbnailCandidate{}, err
+	}
+	return t, nil
+}
+
+// GetThumbnailCandidateURLs returns the URL of every candidate of every
+// video.
+func (c Client) GetThumbnailCandidateURLs() ([]string, error) {
+	rows, err := c.db.Query(`SELECT url FROM thumbnail_candidates`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	urls := []string{}
+	for rows.Next() {
+		var url string
+		if err := rows.Scan(&url); err != nil {
+			return nil, err
+		}
+		urls = append(urls, url)
+	}
+	return urls, rows.Err()
+}
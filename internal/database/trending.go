@@ -0,0 +1,138 @@
+package database
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// HourlyActivity is how many views or likes a video got in one hour.
+type HourlyActivity struct {
+	VideoID uuid.UUID
+	// Hour is the start of the hour, in UTC
+	Hour  time.Time
+	Count int
+}
+
+// RecordVideoView counts a view of a video, unless viewer was already
+// counted for it within dedupeWindow. It reports whether the view counted.
+func (c Client) RecordVideoView(videoID uuid.UUID, viewer string, dedupeWindow time.Duration) (bool, error) {
+	var n int
+	err := c.db.QueryRow(
+		`SELECT COUNT(*) FROM video_views WHERE video_id = ? AND viewer = ? AND viewed_at >= ?`,
+		videoID.String(), viewer, time.Now().Add(-dedupeWindow).UTC().Format(time.DateTime),
+	).Scan(&n)
+	if err != nil {
+		return false, err
+	}
+	if n > 0 {
+		return false, nil
+	}
+	_, err = c.db.Exec(
+		`INSERT INTO video_views (video_id, viewer, viewed_at) VALUES (?, ?, CURRENT_TIMESTAMP)`,
+		videoID.String(), viewer,
+	)
+	return err == nil, err
+}
+
+// GetHourlyViews returns views per video and hour since the given time.
+func (c Client) GetHourlyViews(since time.Time) ([]HourlyActivity, error) {
+	return c.hourlyActivity("video_views", "viewed_at", since)
+}
+
+// GetHourlyLikes returns likes per video and hour since the given time.
+func (c Client) GetHourlyLikes(since time.Time) ([]HourlyActivity, error) {
+	return c.hourlyActivity("video_likes", "created_at", since)
+}
+
+func (c Client) hourlyActivity(table, column string, since time.Time) ([]HourlyActivity, error) {
+	hour := c.db.hour(column)
+	query := `
+	SELECT video_id, ` + hour + ` AS hour, COUNT(*)
+	FROM ` + table + `
+	WHERE ` + column + ` >= ?
+	GROUP BY video_id, ` + hour
+	rows, err := c.db.Query(query, since.UTC().Format(time.DateTime))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var activity []HourlyActivity
+	for rows.Next() {
+		var a HourlyActivity
+		var hour string
+		if err := rows.Scan(&a.VideoID, &hour, &a.Count); err != nil {
+			return nil, err
+		}
+		a.Hour, err = time.Parse("2006-01-02 15", hour)
+		if err != nil {
+			return nil, err
+		}
+		activity = append(activity, a)
+	}
+	return activity, rows.Err()
+}
+
+// SaveTrendingScores stores the scores computed at computedAt and drops
+// those of videos that no longer have one.
+func (c Client) SaveTrendingScores(scores map[uuid.UUID]float64, computedAt time.Time) error {
+	at := computedAt.UTC().Format(time.DateTime)
+	query := `
+	INSERT INTO video_trending (video_id, score, computed_at)
+	VALUES (?, ?, ?)
+	ON CONFLICT (video_id) DO UPDATE SET score = excluded.score, computed_at = excluded.computed_at
+	`
+	for videoID, score := range scores {
+		if _, err := c.db.Exec(query, videoID.String(), score, at); err != nil {
+			return err
+		}
+	}
+	_, err := c.db.Exec(`DELETE FROM video_trending WHERE computed_at < ?`, at)
+	return err
+}
+
+// DeleteVideoViewsBefore deletes views older than cutoff, returning how
+// many there were.
+func (c Client) DeleteVideoViewsBefore(cutoff time.Time) (int64, error) {
+	res, err := c.db.Exec(`DELETE FROM video_views WHERE viewed_at < ?`, cutoff.UTC().Format(time.DateTime))
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// GetTrendingVideos returns published public videos by their last
+// computed trending score, highest first.
+func (c Client) GetTrendingVideos(limit int) ([]Video, error) {
+	query := `
+	SELECT` + videoColumns + `
+	FROM videos
+	JOIN video_trending vt ON vt.video_id = videos.id
+	WHERE videos.visibility = ? AND videos.published = TRUE AND videos.deleted_at IS NULL
+	ORDER BY vt.score DESC, videos.created_at DESC
+	LIMIT ?
+	`
+	return c.queryVideos(query, VisibilityPublic, limit)
+}
+
+// GetRelatedVideos returns published public videos sharing tags with a
+// video, those sharing the most first and then the trending ones.
+func (c Client) GetRelatedVideos(videoID uuid.UUID, limit int) ([]Video, error) {
+	query := `
+	SELECT` + videoColumns + `
+	FROM videos
+	JOIN (
+		SELECT other.video_id, COUNT(*) AS shared
+		FROM video_tags other
+		JOIN video_tags own ON own.tag = other.tag AND own.video_id = ?
+		WHERE other.video_id != own.video_id
+		GROUP BY other.video_id
+	) related ON related.video_id = videos.id
+	LEFT JOIN video_trending vt ON vt.video_id = videos.id
+	WHERE videos.visibility = ? AND videos.published = TRUE AND videos.deleted_at IS NULL
+	ORDER BY related.shared DESC, COALESCE(vt.score, 0) DESC, videos.created_at DESC
+	LIMIT ?
+	`
+	return c.queryVideos(query, videoID.String(), VisibilityPublic, limit)
+}
@@ -0,0 +1,108 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// UploadSession is a resumable upload of a video's file. Offset counts the
+// bytes received so far; the upload is complete once it reaches Length.
+// Metadata is the client's tus Upload-Metadata header, kept as sent.
+type UploadSession struct {
+	ID        uuid.UUID
+	CreatedAt time.Time
+	UpdatedAt time.Time
+	ExpiresAt time.Time
+	UserID    uuid.UUID
+	VideoID   uuid.UUID
+	Length    int64
+	Offset    int64
+	Metadata  string
+}
+
+type CreateUploadSessionParams struct {
+	UserID    uuid.UUID
+	VideoID   uuid.UUID
+	Length    int64
+	Metadata  string
+	ExpiresAt time.Time
+}
+
+const uploadSessionColumns = `id, created_at, updated_at, expires_at, user_id, video_id, length, upload_offset, metadata`
+
+func scanUploadSession(row rowScanner) (UploadSession, error) {
+	var s UploadSession
+	err := row.Scan(&s.ID, &s.CreatedAt, &s.UpdatedAt, &s.ExpiresAt, &s.UserID, &s.VideoID, &s.Length, &s.Offset, &s.Metadata)
+	return s, err
+}
+
+func (c Client) CreateUploadSession(params CreateUploadSessionParams) (UploadSession, error) {
+	id := uuid.New()
+	query := `
+		INSERT INTO upload_sessions
+		    (id, created_at, updated_at, expires_at, user_id, video_id, length, upload_offset, metadata)
+		VALUES
+		    (?, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP, ?, ?, ?, ?, 0, ?)
+	`
+	_, err := c.db.Exec(query, id.String(), params.ExpiresAt.UTC(), params.UserID.String(), params.VideoID.String(), params.Length, params.Metadata)
+	if err != nil {
+		return UploadSession{}, err
+	}
+	return c.GetUploadSession(id)
+}
+
+// GetUploadSession returns a zero UploadSession if it doesn't exist.
+func (c Client) GetUploadSession(id uuid.UUID) (UploadSession, error) {
+	query := `SELECT ` + uploadSessionColumns + ` FROM upload_sessions WHERE id = ?`
+	s, err := scanUploadSession(c.db.QueryRow(query, id.String()))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return UploadSession{}, nil
+		}
+		return UploadSession{}, err
+	}
+	return s, nil
+}
+
+// GetUploadSessionsExpiredBefore returns sessions that went unfinished
+// past cutoff.
+func (c Client) GetUploadSessionsExpiredBefore(cutoff time.Time) ([]UploadSession, error) {
+	query := `SELECT ` + uploadSessionColumns + ` FROM upload_sessions WHERE expires_at < ? ORDER BY expires_at`
+	rows, err := c.db.Query(query, cutoff.UTC())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := []UploadSession{}
+	for rows.Next() {
+		s, err := scanUploadSession(rows)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, s)
+	}
+	return sessions, rows.Err()
+}
+
+// UpdateUploadSessionOffset records how much of a session has been
+// received and pushes back its expiry.
+func (c Client) UpdateUploadSessionOffset(id uuid.UUID, offset int64, expiresAt time.Time) error {
+	query := `
+		UPDATE upload_sessions
+		SET upload_offset = ?,
+		    expires_at = ?,
+		    updated_at = CURRENT_TIMESTAMP
+		WHERE id = ?
+	`
+	_, err := c.db.Exec(query, offset, expiresAt.UTC(), id.String())
+	return err
+}
+
+func (c Client) DeleteUploadSession(id uuid.UUID) error {
+	_, err := c.db.Exec(`DELETE FROM upload_sessions WHERE id = ?`, id.String())
+	return err
+}
@@ -0,0 +1,126 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	UserExportPending = "pending"
+	UserExportReady   = "ready"
+	UserExportFailed  = "failed"
+	UserExportExpired = "expired"
+)
+
+// UserExport is an archive of everything a user has stored, built in the
+// background. Once ready it can be downloaded until ExpiresAt, after which
+// the archive is deleted.
+type UserExport struct {
+	ID        uuid.UUID  `json:"id"`
+	CreatedAt time.Time  `json:"created_at"`
+	UpdatedAt time.Time  `json:"updated_at"`
+	UserID    uuid.UUID  `json:"user_id"`
+	Status    string     `json:"status"`
+	Key       *string    `json:"-"`
+	SizeBytes int64      `json:"size_bytes"`
+	Error     string     `json:"error,omitempty"`
+	ExpiresAt *time.Time `json:"expires_at"`
+}
+
+const userExportColumns = `id, created_at, updated_at, user_id, status, key, size_bytes, error, expires_at`
+
+func scanUserExport(row rowScanner) (UserExport, error) {
+	var e UserExport
+	err := row.Scan(&e.ID, &e.CreatedAt, &e.UpdatedAt, &e.UserID, &e.Status, &e.Key, &e.SizeBytes, &e.Error, &e.ExpiresAt)
+	return e, err
+}
+
+func (c Client) queryUserExports(query string, args ...any) ([]UserExport, error) {
+	rows, err := c.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	exports := []UserExport{}
+	for rows.Next() {
+		e, err := scanUserExport(rows)
+		if err != nil {
+			return nil, err
+		}
+		exports = append(exports, e)
+	}
+	return exports, rows.Err()
+}
+
+func (c Client) CreateUserExport(userID uuid.UUID) (UserExport, error) {
+	id := uuid.New()
+	query := `
+		INSERT INTO user_exports
+		    (id, created_at, updated_at, user_id, status)
+		VALUES
+		    (?, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP, ?, ?)
+	`
+	_, err := c.db.Exec(query, id.String(), userID.String(), UserExportPending)
+	if err != nil {
+		return UserExport{}, err
+	}
+	return c.GetUserExport(id)
+}
+
+// GetUserExport returns a zero UserExport if it doesn't exist.
+func (c Client) GetUserExport(id uuid.UUID) (UserExport, error) {
+	query := `SELECT ` + userExportColumns + ` FROM user_exports WHERE id = ?`
+	e, err := scanUserExport(c.db.QueryRow(query, id.String()))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return UserExport{}, nil
+		}
+		return UserExport{}, err
+	}
+	return e, nil
+}
+
+// GetUserExports returns a user's exports, newest first.
+func (c Client) GetUserExports(userID uuid.UUID) ([]UserExport, error) {
+	query := `SELECT ` + userExportColumns + ` FROM user_exports WHERE user_id = ? ORDER BY created_at DESC, id`
+	return c.queryUserExports(query, userID.String())
+}
+
+// GetPendingUserExports returns up to limit exports waiting to be built,
+// oldest first.
+func (c Client) GetPendingUserExports(limit int) ([]UserExport, error) {
+	query := `SELECT ` + userExportColumns + ` FROM user_exports WHERE status = ? ORDER BY created_at LIMIT ?`
+	return c.queryUserExports(query, UserExportPending, limit)
+}
+
+// GetUserExportsExpiredBefore returns ready exports whose download window
+// closed before cutoff.
+func (c Client) GetUserExportsExpiredBefore(cutoff time.Time) ([]UserExport, error) {
+	query := `SELECT ` + userExportColumns + ` FROM user_exports WHERE status = ? AND expires_at < ? ORDER BY expires_at`
+	return c.queryUserExports(query, UserExportReady, cutoff.UTC())
+}
+
+// UpdateUserExport stores an export's status, archive and expiry.
+func (c Client) UpdateUserExport(e UserExport) error {
+	var expiresAt *time.Time
+	if e.ExpiresAt != nil {
+		t := e.ExpiresAt.UTC()
+		expiresAt = &t
+	}
+	query := `
+		UPDATE user_exports
+		SET status = ?,
+		    key = ?,
+		    size_bytes = ?,
+		    error = ?,
+		    expires_at = ?,
+		    updated_at = CURRENT_TIMESTAMP
+		WHERE id = ?
+	`
+	_, err := c.db.Exec(query, e.Status, e.Key, e.SizeBytes, e.Error, expiresAt, e.ID.String())
+	return err
+}
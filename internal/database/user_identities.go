@@ -0,0 +1,43 @@
+package database
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// UserIdentity links a user to an account at an external OAuth provider.
+type UserIdentity struct {
+	CreatedAt time.Time `json:"created_at"`
+	CreateUserIdentityParams
+}
+
+type CreateUserIdentityParams struct {
+	Provider string    `json:"provider"`
+	Subject  string    `json:"subject"`
+	UserID   uuid.UUID `json:"user_id"`
+	Email    string    `json:"email"`
+}
+
+func (c Client) CreateUserIdentity(params CreateUserIdentityParams) error {
+	query := `
+		INSERT INTO user_identities
+		    (provider, subject, user_id, email, created_at)
+		VALUES
+		    (?, ?, ?, ?, CURRENT_TIMESTAMP)
+	`
+	_, err := c.db.Exec(query, params.Provider, params.Subject, params.UserID.String(), params.Email)
+	return err
+}
+
+// GetUserByIdentity returns the user linked to a provider account, or nil
+// if the account hasn't been linked yet.
+func (c Client) GetUserByIdentity(provider, subject string) (*User, error) {
+	query := `
+		SELECT ` + userColumns + `
+		FROM users
+		JOIN user_identities ui ON users.id = ui.user_id
+		WHERE ui.provider = ? AND ui.subject = ?
+	`
+	return c.getUser(query, provider, subject)
+}
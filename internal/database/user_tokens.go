@@ -0,0 +1,73 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// TokenPurpose scopes a single-use token to one flow, so a password reset
+// token can't be replayed against another endpoint.
+type TokenPurpose string
+
+const (
+	TokenPurposePasswordReset     TokenPurpose = "password_reset"
+	TokenPurposeEmailVerification TokenPurpose = "email_verification"
+)
+
+// ErrTokenInvalid is returned when a token is unknown, expired, already
+// used, or was issued for a different purpose.
+var ErrTokenInvalid = errors.New("token is invalid or expired")
+
+type CreateUserTokenParams struct {
+	TokenHash string
+	Purpose   TokenPurpose
+	UserID    uuid.UUID
+	ExpiresAt time.Time
+}
+
+// CreateUserToken stores a single-use token. Only a hash of the token is
+// kept so a leaked database can't be used to take over accounts.
+func (c Client) CreateUserToken(params CreateUserTokenParams) error {
+	query := `
+		INSERT INTO user_tokens
+		    (token_hash, purpose, user_id, expires_at, created_at)
+		VALUES
+		    (?, ?, ?, ?, CURRENT_TIMESTAMP)
+	`
+	_, err := c.db.Exec(query, params.TokenHash, string(params.Purpose), params.UserID.String(), params.ExpiresAt.UTC())
+	return err
+}
+
+// ConsumeUserToken marks a token as used and returns the user it belongs
+// to. It fails with ErrTokenInvalid if the token can't be used.
+func (c Client) ConsumeUserToken(tokenHash string, purpose TokenPurpose) (uuid.UUID, error) {
+	query := `
+		UPDATE user_tokens
+		SET used_at = CURRENT_TIMESTAMP
+		WHERE token_hash = ? AND purpose = ? AND used_at IS NULL AND expires_at > ?
+	`
+	res, err := c.db.Exec(query, tokenHash, string(purpose), time.Now().UTC())
+	if err != nil {
+		return uuid.Nil, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return uuid.Nil, err
+	}
+	if n == 0 {
+		return uuid.Nil, ErrTokenInvalid
+	}
+
+	var userID string
+	err = c.db.QueryRow(`SELECT user_id FROM user_tokens WHERE token_hash = ?`, tokenHash).Scan(&userID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return uuid.Nil, ErrTokenInvalid
+		}
+		return uuid.Nil, err
+	}
+	return uuid.Parse(userID)
+}
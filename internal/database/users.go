@@ -12,7 +12,19 @@ type User struct {
 	ID        uuid.UUID `json:"id"`
 	CreatedAt time.Time `json:"created_at"`
 	UpdatedAt time.Time `json:"updated_at"`
+	Verified  bool      `json:"verified"`
+	// TokenVersion is embedded in access tokens; bumping it revokes them all.
+	TokenVersion int     `json:"-"`
+	AvatarURL    *string `json:"avatar_url"`
 	CreateUserParams
+	UpdateUserProfileParams
+}
+
+// UpdateUserProfileParams are the publicly visible profile fields a user
+// can edit.
+type UpdateUserProfileParams struct {
+	DisplayName string `json:"display_name"`
+	Bio         string `json:"bio"`
 }
 
 type CreateUserParams struct {
@@ -51,19 +63,13 @@ func (c Client) GetUsers() ([]User, error) {
 	return users, nil
 }
 
-func (c Client) GetUserByEmail(email string) (User, error) {
-	query := `
-		SELECT id, created_at, updated_at, email, password
-		FROM users
-		WHERE email = ?
-	`
+const userColumns = `users.id, users.created_at, users.updated_at, users.email, users.password, users.verified, users.token_version, users.display_name, users.avatar_url, users.bio`
+
+func scanUser(row rowScanner) (User, error) {
 	var user User
 	var id string
-	err := c.db.QueryRow(query, email).Scan(&id, &user.CreatedAt, &user.UpdatedAt, &user.Email, &user.Password)
+	err := row.Scan(&id, &user.CreatedAt, &user.UpdatedAt, &user.Email, &user.Password, &user.Verified, &user.TokenVersion, &user.DisplayName, &user.AvatarURL, &user.Bio)
 	if err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
-			return User{}, nil
-		}
 		return User{}, err
 	}
 	user.ID, err = uuid.Parse(id)
@@ -73,29 +79,40 @@ func (c Client) GetUserByEmail(email string) (User, error) {
 	return user, nil
 }
 
-func (c Client) GetUserByRefreshToken(token string) (*User, error) {
-	query := `
-		SELECT u.id, u.email, u.created_at, u.updated_at, u.password
-		FROM users u
-		JOIN refresh_tokens rt ON u.id = rt.user_id
-		WHERE rt.token = ?
-	`
-
-	var user User
-	var id string
-	err := c.db.QueryRow(query, token).Scan(&id, &user.Email, &user.CreatedAt, &user.UpdatedAt, &user.Password)
+// getUser runs a query selecting userColumns and returns nil if no user
+// matched.
+func (c Client) getUser(query string, args ...any) (*User, error) {
+	user, err := scanUser(c.db.QueryRow(query, args...))
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return nil, nil
 		}
 		return nil, err
 	}
-	user.ID, err = uuid.Parse(id)
-	if err != nil {
-		return nil, err
+	return &user, nil
+}
+
+func (c Client) GetUserByEmail(email string) (User, error) {
+	query := `
+		SELECT ` + userColumns + `
+		FROM users
+		WHERE email = ?
+	`
+	user, err := c.getUser(query, email)
+	if err != nil || user == nil {
+		return User{}, err
 	}
+	return *user, nil
+}
 
-	return &user, nil
+func (c Client) GetUserByRefreshToken(token string) (*User, error) {
+	query := `
+		SELECT ` + userColumns + `
+		FROM users
+		JOIN refresh_tokens rt ON users.id = rt.user_id
+		WHERE rt.token = ? AND rt.revoked_at IS NULL AND rt.expires_at > ?
+	`
+	return c.getUser(query, token, time.Now().UTC())
 }
 
 func (c Client) CreateUser(params CreateUserParams) (*User, error) {
@@ -117,24 +134,82 @@ func (c Client) CreateUser(params CreateUserParams) (*User, error) {
 
 func (c Client) GetUser(id uuid.UUID) (*User, error) {
 	query := `
-		SELECT id, created_at, updated_at, email, password
+		SELECT ` + userColumns + `
 		FROM users
 		WHERE id = ?
 	`
-	var user User
-	var idStr string
-	err := c.db.QueryRow(query, id.String()).Scan(&idStr, &user.CreatedAt, &user.UpdatedAt, &user.Email, &user.Password)
+	return c.getUser(query, id.String())
+}
+
+func (c Client) SetUserVerified(id uuid.UUID) error {
+	query := `
+		UPDATE users
+		SET verified = TRUE, updated_at = CURRENT_TIMESTAMP
+		WHERE id = ?
+	`
+	_, err := c.db.Exec(query, id.String())
+	return err
+}
+
+// IncrementUserTokenVersion invalidates every access token issued to the
+// user so far.
+func (c Client) IncrementUserTokenVersion(id uuid.UUID) error {
+	query := `
+		UPDATE users
+		SET token_version = token_version + 1, updated_at = CURRENT_TIMESTAMP
+		WHERE id = ?
+	`
+	_, err := c.db.Exec(query, id.String())
+	return err
+}
+
+func (c Client) UpdateUserPassword(id uuid.UUID, hashedPassword string) error {
+	query := `
+		UPDATE users
+		SET password = ?, updated_at = CURRENT_TIMESTAMP
+		WHERE id = ?
+	`
+	_, err := c.db.Exec(query, hashedPassword, id.String())
+	return err
+}
+
+func (c Client) UpdateUserProfile(id uuid.UUID, params UpdateUserProfileParams) error {
+	query := `
+		UPDATE users
+		SET display_name = ?, bio = ?, updated_at = CURRENT_TIMESTAMP
+		WHERE id = ?
+	`
+	_, err := c.db.Exec(query, params.DisplayName, params.Bio, id.String())
+	return err
+}
+
+func (c Client) SetUserAvatar(id uuid.UUID, avatarURL string) error {
+	query := `
+		UPDATE users
+		SET avatar_url = ?, updated_at = CURRENT_TIMESTAMP
+		WHERE id = ?
+	`
+	_, err := c.db.Exec(query, avatarURL, id.String())
+	return err
+}
+
+// GetUserAvatarURLs returns the avatar URL of every user that has one.
+func (c Client) GetUserAvatarURLs() ([]string, error) {
+	rows, err := c.db.Query(`SELECT avatar_url FROM users WHERE avatar_url IS NOT NULL`)
 	if err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
-			return nil, nil
-		}
 		return nil, err
 	}
-	user.ID, err = uuid.Parse(idStr)
-	if err != nil {
-		return nil, err
+	defer rows.Close()
+
+	urls := []string{}
+	for rows.Next() {
+		var url string
+		if err := rows.Scan(&url); err != nil {
+			return nil, err
+		}
+		urls = append(urls, url)
 	}
-	return &user, nil
+	return urls, rows.Err()
 }
 
 func (c Client) DeleteUser(id uuid.UUID) error {
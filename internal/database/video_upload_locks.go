@@ -0,0 +1,68 @@
+package database
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// AcquireVideoUploadLock marks a video as having an upload in progress, held
+// by token until ttl passes without a refresh. It reports false if
+// another upload holds the lock, unless force is set, which takes it
+// from them.
+func (c Client) AcquireVideoUploadLock(videoID, token uuid.UUID, ttl time.Duration, force bool) (bool, error) {
+	now := time.Now().UTC()
+	query := `DELETE FROM video_upload_locks WHERE video_id = ? AND expires_at < ?`
+	args := []any{videoID.String(), now.Format(time.DateTime)}
+	if force {
+		query = `DELETE FROM video_upload_locks WHERE video_id = ?`
+		args = args[:1]
+	}
+	if _, err := c.db.Exec(query, args...); err != nil {
+		return false, err
+	}
+
+	query = `
+		INSERT INTO video_upload_locks
+		    (video_id, token, created_at, expires_at)
+		VALUES
+		    (?, ?, CURRENT_TIMESTAMP, ?)
+		ON CONFLICT (video_id) DO NOTHING
+	`
+	res, err := c.db.Exec(query, videoID.String(), token.String(), now.Add(ttl).Format(time.DateTime))
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// RefreshVideoUploadLock pushes a lock's expiry ttl into the future. It
+// reports false if token no longer holds the lock.
+func (c Client) RefreshVideoUploadLock(videoID, token uuid.UUID, ttl time.Duration) (bool, error) {
+	query := `UPDATE video_upload_locks SET expires_at = ? WHERE video_id = ? AND token = ?`
+	res, err := c.db.Exec(query, time.Now().UTC().Add(ttl).Format(time.DateTime), videoID.String(), token.String())
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// ReleaseVideoUploadLock gives up the lock if token still holds it.
+func (c Client) ReleaseVideoUploadLock(videoID, token uuid.UUID) error {
+	_, err := c.db.Exec(`DELETE FROM video_upload_locks WHERE video_id = ? AND token = ?`, videoID.String(), token.String())
+	return err
+}
+
+// BreakVideoUploadLock frees a video's lock whoever holds it, reporting false
+// if there was no live one.
+func (c Client) BreakVideoUploadLock(videoID uuid.UUID) (bool, error) {
+	query := `DELETE FROM video_upload_locks WHERE video_id = ? AND expires_at >= ?`
+	res, err := c.db.Exec(query, videoID.String(), time.Now().UTC().Format(time.DateTime))
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
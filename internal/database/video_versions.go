@@ -0,0 +1,84 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// VideoVersion is an earlier source file of a video, kept when the video
+// was replaced so it can be rolled back to. CreatedAt is when it was
+// replaced.
+type VideoVersion struct {
+	ID               uuid.UUID `json:"id"`
+	CreatedAt        time.Time `json:"created_at"`
+	VideoID          uuid.UUID `json:"video_id"`
+	Key              string    `json:"-"`
+	ChecksumSHA256   *string   `json:"checksum_sha256"`
+	OriginalFilename *string   `json:"original_filename"`
+}
+
+type CreateVideoVersionParams struct {
+	VideoID          uuid.UUID
+	Key              string
+	ChecksumSHA256   *string
+	OriginalFilename *string
+}
+
+const videoVersionColumns = `id, created_at, video_id, key, checksum_sha256, original_filename`
+
+func scanVideoVersion(row rowScanner) (VideoVersion, error) {
+	var v VideoVersion
+	err := row.Scan(&v.ID, &v.CreatedAt, &v.VideoID, &v.Key, &v.ChecksumSHA256, &v.OriginalFilename)
+	return v, err
+}
+
+func (c Client) CreateVideoVersion(params CreateVideoVersionParams) (VideoVersion, error) {
+	id := uuid.New()
+	query := `
+		INSERT INTO video_versions
+		    (id, created_at, video_id, key, checksum_sha256, original_filename)
+		VALUES
+		    (?, CURRENT_TIMESTAMP, ?, ?, ?, ?)
+	`
+	_, err := c.db.Exec(query, id.String(), params.VideoID.String(), params.Key, params.ChecksumSHA256, params.OriginalFilename)
+	if err != nil {
+		return VideoVersion{}, err
+	}
+	return c.GetVideoVersion(id)
+}
+
+// GetVideoVersions returns a video's earlier versions, newest first.
+func (c Client) GetVideoVersions(videoID uuid.UUID) ([]VideoVersion, error) {
+	query := `SELECT ` + videoVersionColumns + ` FROM video_versions WHERE video_id = ? ORDER BY created_at DESC, id`
+	rows, err := c.db.Query(query, videoID.String())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	versions := []VideoVersion{}
+	for rows.Next() {
+		v, err := scanVideoVersion(rows)
+		if err != nil {
+			return nil, err
+		}
+		versions = append(versions, v)
+	}
+	return versions, rows.Err()
+}
+
+// GetVideoVersion returns a zero VideoVersion if it doesn't exist.
+func (c Client) GetVideoVersion(id uuid.UUID) (VideoVersion, error) {
+	query := `SELECT ` + videoVersionColumns + ` FROM video_versions WHERE id = ?`
+	v, err := scanVideoVersion(c.db.QueryRow(query, id.String()))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return VideoVersion{}, nil
+		}
+		return VideoVersion{}, err
+	}
+	return v, nil
+}
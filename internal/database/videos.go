@@ -2,44 +2,221 @@ package database
 
 import (
 	"database/sql"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"strings"
 	"time"
 
 	"github.com/google/uuid"
 )
 
 type Video struct {
-	ID           uuid.UUID `json:"id"`
-	CreatedAt    time.Time `json:"created_at"`
-	UpdatedAt    time.Time `json:"updated_at"`
-	ThumbnailURL *string   `json:"thumbnail_url"`
-	VideoURL     *string   `json:"video_url"`
+	ID        uuid.UUID `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	// Version goes up by one with every update, so UpdateVideo can tell
+	// when the video changed after it was read.
+	Version      int64   `json:"version"`
+	ThumbnailURL *string `json:"thumbnail_url"`
+	VideoURL     *string `json:"video_url"`
+	VideoKey     *string `json:"-"`
+	// StagingKey is the S3 key of the original upload, kept so the video
+	// can be processed again without the client sending it a second time.
+	StagingKey *string `json:"-"`
+	// ChecksumSHA256 is the hex SHA-256 of the object at VideoKey, so
+	// clients can verify what they download.
+	ChecksumSHA256        *string `json:"checksum_sha256"`
+	StagingChecksumSHA256 *string `json:"-"`
+	// OriginalFilename is the name of the uploaded file, used when the
+	// original is downloaded again.
+	OriginalFilename *string    `json:"original_filename"`
+	DashURL          *string    `json:"dash_url"`
+	DashKey          *string    `json:"-"`
+	StorageClass     string     `json:"storage_class"`
+	Published        bool       `json:"published"`
+	DeletedAt        *time.Time `json:"deleted_at,omitempty"`
+	CommentCount     int        `json:"comment_count"`
+	LikeCount        int        `json:"like_count"`
+
+	// ThumbnailSourceURL is the image the thumbnail variants were cut
+	// from: ThumbnailURL for 16:9 cards and ThumbnailSquareURL for 1:1
+	// spots.
+	ThumbnailSourceURL *string        `json:"thumbnail_source_url"`
+	ThumbnailSquareURL *string        `json:"thumbnail_square_url"`
+	ThumbnailCrop      *ThumbnailCrop `json:"thumbnail_crop"`
+
+	// GeoRestriction limits which countries the video plays in, nil if
+	// it plays everywhere.
+	GeoRestriction *GeoRestriction `json:"geo_restriction"`
+
+	// HDRFormat is HDRFormatPQ or HDRFormatHLG for HDR uploads, which
+	// play as a tone-mapped SDR rendition where HDR isn't available. Nil
+	// for SDR.
+	HDRFormat *string `json:"hdr_format"`
 	CreateVideoParams
 }
 
+// ThumbnailCrop is the part of the source image thumbnails are cut from,
+// in pixels, and the point within it that variants keep in frame, as
+// fractions of its width and height. A zero Width or Height means the
+// whole image.
+type ThumbnailCrop struct {
+	X      int     `json:"x"`
+	Y      int     `json:"y"`
+	Width  int     `json:"width"`
+	Height int     `json:"height"`
+	FocalX float64 `json:"focal_x"`
+	FocalY float64 `json:"focal_y"`
+}
+
+// GeoRestriction lists countries as ISO 3166-1 alpha-2 codes. A
+// non-empty Allow list lets only its countries play the video; countries
+// on the Deny list are blocked either way.
+type GeoRestriction struct {
+	Allow []string `json:"allow"`
+	Deny  []string `json:"deny"`
+}
+
+// Video visibility levels. Public videos are served straight from the
+// CDN; unlisted and private ones only through short-lived signed URLs.
+const (
+	VisibilityPublic   = "public"
+	VisibilityUnlisted = "unlisted"
+	VisibilityPrivate  = "private"
+)
+
+// HDR transfer functions a video can be mastered in.
+const (
+	HDRFormatPQ  = "pq"
+	HDRFormatHLG = "hlg"
+)
+
 type CreateVideoParams struct {
 	Title       string    `json:"title"`
 	Description string    `json:"description"`
+	Visibility  string    `json:"visibility"`
 	UserID      uuid.UUID `json:"user_id"`
+	// Encrypted videos have their objects encrypted under a data key of
+	// their own, stored in WrappedKey wrapped by the server's master key.
+	// It's chosen when the video is created and never changes.
+	Encrypted  bool    `json:"encrypted"`
+	WrappedKey *string `json:"-"`
+	// OrgID is the organization the video belongs to, if any, whose
+	// members can manage it by their role. It's set when the video is
+	// created and never changes.
+	OrgID *uuid.UUID `json:"org_id"`
+	// Tags are lowercase labels shared between related videos, sorted
+	Tags []string `json:"tags"`
+	// KeyPrefix goes before the S3 key of every object of the video. It's
+	// chosen when the video is created and never changes, so the keys of
+	// its objects can always be found again.
+	KeyPrefix string `json:"-"`
+	// VideoID, if set, is the ID the video is created with, for callers
+	// that need it before the video exists
+	VideoID uuid.UUID `json:"-"`
 }
 
-func (c Client) GetVideos(userID uuid.UUID) ([]Video, error) {
-	query := `
-	SELECT
-		id,
-		created_at,
-		updated_at,
-		title,
-		description,
-		thumbnail_url,
-		video_url,
-		user_id
-	FROM videos
-	WHERE user_id = ?
-	ORDER BY created_at DESC
-	`
+const videoColumns = `
+		videos.id,
+		videos.created_at,
+		videos.updated_at,
+		videos.version,
+		videos.title,
+		videos.description,
+		videos.thumbnail_url,
+		videos.video_url,
+		videos.video_key,
+		videos.staging_key,
+		videos.checksum_sha256,
+		videos.staging_checksum_sha256,
+		videos.original_filename,
+		videos.dash_url,
+		videos.dash_key,
+		videos.thumbnail_source_url,
+		videos.thumbnail_square_url,
+		videos.thumbnail_crop,
+		videos.geo_restriction,
+		videos.hdr_format,
+		videos.wrapped_key,
+		videos.storage_class,
+		videos.published,
+		videos.deleted_at,
+		videos.visibility,
+		videos.user_id,
+		videos.org_id,
+		videos.key_prefix,
+		(SELECT COUNT(*) FROM comments WHERE comments.video_id = videos.id) AS comment_count,
+		(SELECT COUNT(*) FROM video_likes WHERE video_likes.video_id = videos.id) AS like_count,
+		(SELECT string_agg(tag, ',' ORDER BY tag) FROM video_tags WHERE video_tags.video_id = videos.id) AS tags
+`
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanVideo(row rowScanner) (Video, error) {
+	var video Video
+	var crop, geo, tags sql.NullString
+	err := row.Scan(
+		&video.ID,
+		&video.CreatedAt,
+		&video.UpdatedAt,
+		&video.Version,
+		&video.Title,
+		&video.Description,
+		&video.ThumbnailURL,
+		&video.VideoURL,
+		&video.VideoKey,
+		&video.StagingKey,
+		&video.ChecksumSHA256,
+		&video.StagingChecksumSHA256,
+		&video.OriginalFilename,
+		&video.DashURL,
+		&video.DashKey,
+		&video.ThumbnailSourceURL,
+		&video.ThumbnailSquareURL,
+		&crop,
+		&geo,
+		&video.HDRFormat,
+		&video.WrappedKey,
+		&video.StorageClass,
+		&video.Published,
+		&video.DeletedAt,
+		&video.Visibility,
+		&video.UserID,
+		&video.OrgID,
+		&video.KeyPrefix,
+		&video.CommentCount,
+		&video.LikeCount,
+		&tags,
+	)
+	if err != nil {
+		return video, err
+	}
+	video.Encrypted = video.WrappedKey != nil
+	// Tags can't contain commas, so they're joined with them
+	video.Tags = []string{}
+	if tags.Valid && tags.String != "" {
+		video.Tags = strings.Split(tags.String, ",")
+	}
+	if crop.Valid {
+		video.ThumbnailCrop = &ThumbnailCrop{}
+		if err := json.Unmarshal([]byte(crop.String), video.ThumbnailCrop); err != nil {
+			return video, fmt.Errorf("invalid thumbnail crop for video %s: %w", video.ID, err)
+		}
+	}
+	if geo.Valid {
+		video.GeoRestriction = &GeoRestriction{}
+		if err := json.Unmarshal([]byte(geo.String), video.GeoRestriction); err != nil {
+			return video, fmt.Errorf("invalid geo restriction for video %s: %w", video.ID, err)
+		}
+	}
+	return video, nil
+}
 
-	rows, err := c.db.Query(query, userID)
+func (c Client) queryVideos(query string, args ...any) ([]Video, error) {
+	rows, err := c.db.Query(query, args...)
 	if err != nil {
 		return nil, err
 	}
@@ -47,27 +224,103 @@ func (c Client) GetVideos(userID uuid.UUID) ([]Video, error) {
 
 	videos := []Video{}
 	for rows.Next() {
-		var video Video
-		if err := rows.Scan(
-			&video.ID,
-			&video.CreatedAt,
-			&video.UpdatedAt,
-			&video.Title,
-			&video.Description,
-			&video.ThumbnailURL,
-			&video.VideoURL,
-			&video.UserID,
-		); err != nil {
+		video, err := scanVideo(rows)
+		if err != nil {
 			return nil, err
 		}
 		videos = append(videos, video)
 	}
 
-	return videos, nil
+	return videos, rows.Err()
+}
+
+// GetVideos returns a user's videos, newest first.
+func (c Client) GetVideos(userID uuid.UUID, page Page) ([]Video, *Cursor, error) {
+	query := `
+	SELECT` + videoColumns + `
+	FROM videos
+	WHERE user_id = ? AND deleted_at IS NULL
+	`
+	return c.cachedVideoPage("own", userID, page, func() ([]Video, *Cursor, error) {
+		return c.queryVideoPage(page, query, userID)
+	})
+}
+
+// GetPublicVideos returns a user's published public videos, as shown on
+// their channel.
+func (c Client) GetPublicVideos(userID uuid.UUID, page Page) ([]Video, *Cursor, error) {
+	query := `
+	SELECT` + videoColumns + `
+	FROM videos
+	WHERE user_id = ? AND visibility = ? AND published = TRUE AND deleted_at IS NULL
+	`
+	return c.cachedVideoPage("public", userID, page, func() ([]Video, *Cursor, error) {
+		return c.queryVideoPage(page, query, userID, VisibilityPublic)
+	})
+}
+
+// GetAllVideos returns every video regardless of owner, for admin use.
+func (c Client) GetAllVideos(page Page) ([]Video, *Cursor, error) {
+	query := `
+	SELECT` + videoColumns + `
+	FROM videos
+	WHERE 1 = 1
+	`
+	return c.queryVideoPage(page, query)
+}
+
+// queryVideoPage runs a query selecting videoColumns a page at a time,
+// newest first.
+func (c Client) queryVideoPage(page Page, query string, args ...any) ([]Video, *Cursor, error) {
+	query, args = page.keyset(query, args, "videos.created_at", "videos.id", true)
+	videos, err := c.queryVideos(query, args...)
+	if err != nil {
+		return nil, nil, err
+	}
+	videos, next := paginate(page, videos, videoCursor)
+	return videos, next, nil
+}
+
+// GetUserVideos returns every video a user owns, trashed ones included,
+// oldest first.
+func (c Client) GetUserVideos(userID uuid.UUID) ([]Video, error) {
+	query := `
+	SELECT` + videoColumns + `
+	FROM videos
+	WHERE user_id = ?
+	ORDER BY created_at, id
+	`
+	return c.queryVideos(query, userID)
+}
+
+// GetDraftVideosCreatedBefore returns unpublished videos created before cutoff.
+func (c Client) GetDraftVideosCreatedBefore(cutoff time.Time) ([]Video, error) {
+	query := `
+	SELECT` + videoColumns + `
+	FROM videos
+	WHERE published = FALSE AND created_at < ?
+	ORDER BY created_at
+	`
+	return c.queryVideos(query, cutoff.UTC().Format(time.DateTime))
+}
+
+// GetVideosDeletedBefore returns trashed videos whose deletion is older
+// than cutoff.
+func (c Client) GetVideosDeletedBefore(cutoff time.Time) ([]Video, error) {
+	query := `
+	SELECT` + videoColumns + `
+	FROM videos
+	WHERE deleted_at IS NOT NULL AND deleted_at < ?
+	ORDER BY deleted_at
+	`
+	return c.queryVideos(query, cutoff.UTC().Format(time.DateTime))
 }
 
 func (c Client) CreateVideo(params CreateVideoParams) (Video, error) {
-	id := uuid.New()
+	id := params.VideoID
+	if id == uuid.Nil {
+		id = uuid.New()
+	}
 	query := `
 	INSERT INTO videos (
 		id,
@@ -75,42 +328,64 @@ func (c Client) CreateVideo(params CreateVideoParams) (Video, error) {
 		updated_at,
 		title,
 		description,
-		user_id
-	) VALUES (?, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP, ?, ?, ?)
+		visibility,
+		user_id,
+		wrapped_key,
+		org_id,
+		key_prefix
+	) VALUES (?, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP, ?, ?, ?, ?, ?, ?, ?)
 	`
-	_, err := c.db.Exec(query, id, params.Title, params.Description, params.UserID)
+	if params.Visibility == "" {
+		params.Visibility = VisibilityPublic
+	}
+	if params.Encrypted != (params.WrappedKey != nil) {
+		return Video{}, errors.New("encrypted videos need a wrapped key, and only they can have one")
+	}
+	_, err := c.db.Exec(query, id, params.Title, params.Description, params.Visibility, params.UserID, params.WrappedKey, params.OrgID, params.KeyPrefix)
 	if err != nil {
 		return Video{}, err
 	}
+	if err := c.setVideoTags(id, params.Tags); err != nil {
+		return Video{}, err
+	}
+	c.invalidateVideo(id, params.UserID)
 
 	return c.GetVideo(id)
 }
 
+// GetVideo returns a video that isn't in the trash.
 func (c Client) GetVideo(id uuid.UUID) (Video, error) {
+	var key string
+	if c.cache != nil {
+		key = c.videoCacheKey(id)
+		if video, ok := cacheGet[Video](c, key); ok {
+			return video, nil
+		}
+	}
 	query := `
-	SELECT
-		id,
-		created_at,
-		updated_at,
-		title,
-		description,
-		thumbnail_url,
-		video_url,
-		user_id
+	SELECT` + videoColumns + `
 	FROM videos
-	WHERE id = ?
+	WHERE id = ? AND deleted_at IS NULL
 	`
+	video, err := c.getVideo(query, id)
+	if err == nil && key != "" && video.ID != uuid.Nil {
+		cacheSet(c, key, video)
+	}
+	return video, err
+}
 
-	var video Video
-	err := c.db.QueryRow(query, id).Scan(
-		&video.ID,
-		&video.CreatedAt,
-		&video.UpdatedAt,
-		&video.Title,
-		&video.Description,
-		&video.ThumbnailURL,
-		&video.VideoURL,
-		&video.UserID)
+// GetTrashedVideo returns a video only if it is in the trash.
+func (c Client) GetTrashedVideo(id uuid.UUID) (Video, error) {
+	query := `
+	SELECT` + videoColumns + `
+	FROM videos
+	WHERE id = ? AND deleted_at IS NOT NULL
+	`
+	return c.getVideo(query, id)
+}
+
+func (c Client) getVideo(query string, id uuid.UUID) (Video, error) {
+	video, err := scanVideo(c.db.QueryRow(query, id))
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return Video{}, nil
@@ -121,35 +396,221 @@ func (c Client) GetVideo(id uuid.UUID) (Video, error) {
 	return video, nil
 }
 
-func (c Client) UpdateVideo(video Video) error {
+// jsonColumn encodes v for a nullable JSON text column, nil if v is.
+func jsonColumn[T any](v *T) (*string, error) {
+	if v == nil {
+		return nil, nil
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	s := string(b)
+	return &s, nil
+}
+
+// ErrVideoConflict means the video was updated by someone else since it
+// was read.
+var ErrVideoConflict = errors.New("video was changed since it was read")
+
+// UpdateVideo saves video if it's still at video.Version, returning it
+// with its new version. Otherwise it returns ErrVideoConflict and the
+// caller should read the video again before retrying.
+func (c Client) UpdateVideo(video Video) (Video, error) {
+	owner := c.videoOwner(video.ID)
+	updatedAt := time.Now().UTC().Truncate(time.Second)
 	query := `
 	UPDATE videos
 	SET
+		version = version + 1,
+		updated_at = ?,
 		title = ?,
 		description = ?,
 		thumbnail_url = ?,
 		video_url = ?,
+		video_key = ?,
+		staging_key = ?,
+		checksum_sha256 = ?,
+		staging_checksum_sha256 = ?,
+		original_filename = ?,
+		dash_url = ?,
+		dash_key = ?,
+		thumbnail_source_url = ?,
+		thumbnail_square_url = ?,
+		thumbnail_crop = ?,
+		geo_restriction = ?,
+		hdr_format = ?,
+		storage_class = ?,
+		published = ?,
+		visibility = ?,
 		user_id = ?
-	WHERE id = ?
+	WHERE id = ? AND version = ?
 	`
 
-	_, err := c.db.Exec(
+	crop, err := jsonColumn(video.ThumbnailCrop)
+	if err != nil {
+		return Video{}, err
+	}
+	geo, err := jsonColumn(video.GeoRestriction)
+	if err != nil {
+		return Video{}, err
+	}
+
+	// Invalidated after the tags are saved too, so no one caches old ones
+	defer c.invalidateVideo(video.ID, owner, video.UserID)
+	res, err := c.db.Exec(
 		query,
+		updatedAt.Format(time.DateTime),
 		video.Title,
 		video.Description,
 		&video.ThumbnailURL,
 		&video.VideoURL,
+		&video.VideoKey,
+		&video.StagingKey,
+		&video.ChecksumSHA256,
+		&video.StagingChecksumSHA256,
+		&video.OriginalFilename,
+		&video.DashURL,
+		&video.DashKey,
+		&video.ThumbnailSourceURL,
+		&video.ThumbnailSquareURL,
+		crop,
+		geo,
+		&video.HDRFormat,
+		video.StorageClass,
+		video.Published,
+		video.Visibility,
 		video.UserID,
 		video.ID,
+		video.Version,
 	)
+	if err != nil {
+		return Video{}, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return Video{}, err
+	}
+	if n == 0 {
+		return Video{}, ErrVideoConflict
+	}
+	if err := c.setVideoTags(video.ID, video.Tags); err != nil {
+		return Video{}, err
+	}
+	video.Version++
+	video.UpdatedAt = updatedAt
+	return video, nil
+}
+
+// setVideoTags replaces a video's tags.
+func (c Client) setVideoTags(videoID uuid.UUID, tags []string) error {
+	_, err := c.db.Exec(`DELETE FROM video_tags WHERE video_id = ?`, videoID.String())
+	if err != nil {
+		return err
+	}
+	for _, tag := range tags {
+		_, err := c.db.Exec(`INSERT INTO video_tags (video_id, tag) VALUES (?, ?) ON CONFLICT DO NOTHING`, videoID.String(), tag)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// TrashVideo soft deletes a video. It can be restored until it is purged.
+func (c Client) TrashVideo(id uuid.UUID) error {
+	query := `
+	UPDATE videos
+	SET deleted_at = CURRENT_TIMESTAMP
+	WHERE id = ?
+	`
+	_, err := c.db.Exec(query, id)
+	c.invalidateVideo(id, c.videoOwner(id))
+	return err
+}
+
+func (c Client) RestoreVideo(id uuid.UUID) error {
+	query := `
+	UPDATE videos
+	SET deleted_at = NULL
+	WHERE id = ?
+	`
+	_, err := c.db.Exec(query, id)
+	c.invalidateVideo(id, c.videoOwner(id))
 	return err
 }
 
+// DeleteVideo permanently removes a video record.
 func (c Client) DeleteVideo(id uuid.UUID) error {
+	defer c.invalidateVideo(id, c.videoOwner(id))
+	_, err := c.db.Exec(`DELETE FROM share_links WHERE video_id = ?`, id)
+	if err != nil {
+		return err
+	}
+	_, err = c.db.Exec(`DELETE FROM comments WHERE video_id = ?`, id)
+	if err != nil {
+		return err
+	}
+	_, err = c.db.Exec(`DELETE FROM video_likes WHERE video_id = ?`, id)
+	if err != nil {
+		return err
+	}
+	_, err = c.db.Exec(`DELETE FROM notifications WHERE video_id = ?`, id)
+	if err != nil {
+		return err
+	}
+	_, err = c.db.Exec(`DELETE FROM processing_failures WHERE video_id = ?`, id)
+	if err != nil {
+		return err
+	}
+	_, err = c.db.Exec(`DELETE FROM thumbnail_candidates WHERE video_id = ?`, id)
+	if err != nil {
+		return err
+	}
+	_, err = c.db.Exec(`DELETE FROM captions WHERE video_id = ?`, id)
+	if err != nil {
+		return err
+	}
+	_, err = c.db.Exec(`DELETE FROM video_tags WHERE video_id = ?`, id)
+	if err != nil {
+		return err
+	}
+	_, err = c.db.Exec(`DELETE FROM video_views WHERE video_id = ?`, id)
+	if err != nil {
+		return err
+	}
+	_, err = c.db.Exec(`DELETE FROM video_trending WHERE video_id = ?`, id)
+	if err != nil {
+		return err
+	}
+	_, err = c.db.Exec(`DELETE FROM video_versions WHERE video_id = ?`, id)
+	if err != nil {
+		return err
+	}
+	_, err = c.db.Exec(`DELETE FROM upload_sessions WHERE video_id = ?`, id)
+	if err != nil {
+		return err
+	}
+	_, err = c.db.Exec(`DELETE FROM processing_progress WHERE video_id = ?`, id)
+	if err != nil {
+		return err
+	}
+	_, err = c.db.Exec(`DELETE FROM reprocess_items WHERE video_id = ?`, id)
+	if err != nil {
+		return err
+	}
+	_, err = c.db.Exec(`DELETE FROM video_upload_locks WHERE video_id = ?`, id)
+	if err != nil {
+		return err
+	}
+	_, err = c.db.Exec(`DELETE FROM processed_uploads WHERE video_id = ?`, id)
+	if err != nil {
+		return err
+	}
 	query := `
 	DELETE FROM videos
 	WHERE id = ?
 	`
-	_, err := c.db.Exec(query, id)
+	_, err = c.db.Exec(query, id)
 	return err
 }
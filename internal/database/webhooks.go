@@ -0,0 +1,285 @@
+package database
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	WebhookDeliveryPending   = "pending"
+	WebhookDeliverySucceeded = "succeeded"
+	WebhookDeliveryFailed    = "failed"
+)
+
+// WebhookEndpoint is a URL a user has asked to be notified at. Secret
+// signs every delivery and is only shown when the endpoint is created.
+type WebhookEndpoint struct {
+	ID        uuid.UUID `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	UserID    uuid.UUID `json:"user_id"`
+	URL       string    `json:"url"`
+	Secret    string    `json:"-"`
+	// Events is empty for endpoints subscribed to everything.
+	Events []string `json:"events"`
+}
+
+// Subscribed reports whether the endpoint wants event.
+func (e WebhookEndpoint) Subscribed(event string) bool {
+	if len(e.Events) == 0 {
+		return true
+	}
+	for _, ev := range e.Events {
+		if ev == event {
+			return true
+		}
+	}
+	return false
+}
+
+type CreateWebhookEndpointParams struct {
+	UserID uuid.UUID
+	URL    string
+	Secret string
+	Events []string
+}
+
+// WebhookDelivery is one event sent, or still to be sent, to an endpoint.
+// Pending deliveries are retried at NextAttemptAt until they succeed or
+// run out of attempts.
+type WebhookDelivery struct {
+	ID             uuid.UUID       `json:"id"`
+	CreatedAt      time.Time       `json:"created_at"`
+	UpdatedAt      time.Time       `json:"updated_at"`
+	EndpointID     uuid.UUID       `json:"endpoint_id"`
+	Event          string          `json:"event"`
+	Payload        json.RawMessage `json:"payload"`
+	Status         string          `json:"status"`
+	Attempts       int             `json:"attempts"`
+	NextAttemptAt  *time.Time      `json:"next_attempt_at"`
+	ResponseStatus *int            `json:"response_status"`
+	Error          string          `json:"error"`
+}
+
+// RecordWebhookAttemptParams describes the outcome of one delivery
+// attempt. NextAttemptAt is only used while the delivery stays pending.
+type RecordWebhookAttemptParams struct {
+	ID             uuid.UUID
+	Status         string
+	ResponseStatus *int
+	Error          string
+	NextAttemptAt  time.Time
+}
+
+const webhookEndpointColumns = `id, created_at, user_id, url, secret, events`
+
+func scanWebhookEndpoint(row rowScanner) (WebhookEndpoint, error) {
+	var e WebhookEndpoint
+	var events string
+	err := row.Scan(&e.ID, &e.CreatedAt, &e.UserID, &e.URL, &e.Secret, &events)
+	if err != nil {
+		return WebhookEndpoint{}, err
+	}
+	e.Events = []string{}
+	if events != "" {
+		e.Events = strings.Split(events, ",")
+	}
+	return e, nil
+}
+
+func (c Client) CreateWebhookEndpoint(params CreateWebhookEndpointParams) (WebhookEndpoint, error) {
+	id := uuid.New()
+	query := `
+		INSERT INTO webhook_endpoints
+		    (id, created_at, user_id, url, secret, events)
+		VALUES
+		    (?, CURRENT_TIMESTAMP, ?, ?, ?, ?)
+	`
+	_, err := c.db.Exec(query, id.String(), params.UserID.String(), params.URL, params.Secret, strings.Join(params.Events, ","))
+	if err != nil {
+		return WebhookEndpoint{}, err
+	}
+	return c.GetWebhookEndpoint(id)
+}
+
+// GetWebhookEndpoint returns a zero WebhookEndpoint if it doesn't exist.
+func (c Client) GetWebhookEndpoint(id uuid.UUID) (WebhookEndpoint, error) {
+	query := `SELECT ` + webhookEndpointColumns + ` FROM webhook_endpoints WHERE id = ?`
+	e, err := scanWebhookEndpoint(c.db.QueryRow(query, id.String()))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return WebhookEndpoint{}, nil
+		}
+		return WebhookEndpoint{}, err
+	}
+	return e, nil
+}
+
+func (c Client) GetWebhookEndpoints(userID uuid.UUID) ([]WebhookEndpoint, error) {
+	query := `SELECT ` + webhookEndpointColumns + ` FROM webhook_endpoints WHERE user_id = ? ORDER BY created_at, id`
+	rows, err := c.db.Query(query, userID.String())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	endpoints := []WebhookEndpoint{}
+	for rows.Next() {
+		e, err := scanWebhookEndpoint(rows)
+		if err != nil {
+			return nil, err
+		}
+		endpoints = append(endpoints, e)
+	}
+	return endpoints, rows.Err()
+}
+
+// DeleteWebhookEndpoint removes an endpoint along with its delivery log.
+func (c Client) DeleteWebhookEndpoint(id uuid.UUID) error {
+	_, err := c.db.Exec(`DELETE FROM webhook_deliveries WHERE endpoint_id = ?`, id.String())
+	if err != nil {
+		return err
+	}
+	_, err = c.db.Exec(`DELETE FROM webhook_endpoints WHERE id = ?`, id.String())
+	return err
+}
+
+const webhookDeliveryColumns = `id, created_at, updated_at, endpoint_id, event, payload, status, attempts, next_attempt_at, response_status, error`
+
+func scanWebhookDelivery(row rowScanner) (WebhookDelivery, error) {
+	var d WebhookDelivery
+	var payload string
+	err := row.Scan(
+		&d.ID,
+		&d.CreatedAt,
+		&d.UpdatedAt,
+		&d.EndpointID,
+		&d.Event,
+		&payload,
+		&d.Status,
+		&d.Attempts,
+		&d.NextAttemptAt,
+		&d.ResponseStatus,
+		&d.Error,
+	)
+	if err != nil {
+		return WebhookDelivery{}, err
+	}
+	d.Payload = json.RawMessage(payload)
+	return d, nil
+}
+
+func (c Client) queryWebhookDeliveries(query string, args ...any) ([]WebhookDelivery, error) {
+	rows, err := c.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	deliveries := []WebhookDelivery{}
+	for rows.Next() {
+		d, err := scanWebhookDelivery(rows)
+		if err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, d)
+	}
+	return deliveries, rows.Err()
+}
+
+// CreateWebhookDelivery queues payload for delivery to an endpoint right
+// away.
+func (c Client) CreateWebhookDelivery(endpointID uuid.UUID, event string, payload []byte) (WebhookDelivery, error) {
+	id := uuid.New()
+	query := `
+		INSERT INTO webhook_deliveries
+		    (id, created_at, updated_at, endpoint_id, event, payload, status, attempts, next_attempt_at, error)
+		VALUES
+		    (?, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP, ?, ?, ?, ?, 0, ?, '')
+	`
+	_, err := c.db.Exec(query, id.String(), endpointID.String(), event, string(payload), WebhookDeliveryPending, time.Now().UTC())
+	if err != nil {
+		return WebhookDelivery{}, err
+	}
+	return c.GetWebhookDelivery(id)
+}
+
+// GetWebhookDelivery returns a zero WebhookDelivery if it doesn't exist.
+func (c Client) GetWebhookDelivery(id uuid.UUID) (WebhookDelivery, error) {
+	query := `SELECT ` + webhookDeliveryColumns + ` FROM webhook_deliveries WHERE id = ?`
+	d, err := scanWebhookDelivery(c.db.QueryRow(query, id.String()))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return WebhookDelivery{}, nil
+		}
+		return WebhookDelivery{}, err
+	}
+	return d, nil
+}
+
+// GetWebhookDeliveries returns an endpoint's delivery log, newest first.
+func (c Client) GetWebhookDeliveries(endpointID uuid.UUID, page Page) ([]WebhookDelivery, *Cursor, error) {
+	query := `SELECT ` + webhookDeliveryColumns + ` FROM webhook_deliveries WHERE endpoint_id = ?`
+	query, args := page.keyset(query, []any{endpointID.String()}, "created_at", "id", true)
+	deliveries, err := c.queryWebhookDeliveries(query, args...)
+	if err != nil {
+		return nil, nil, err
+	}
+	deliveries, next := paginate(page, deliveries, func(d WebhookDelivery) Cursor {
+		return Cursor{CreatedAt: d.CreatedAt, ID: d.ID.String()}
+	})
+	return deliveries, next, nil
+}
+
+// GetDueWebhookDeliveries returns up to limit pending deliveries whose
+// next attempt is due, oldest first.
+func (c Client) GetDueWebhookDeliveries(limit int) ([]WebhookDelivery, error) {
+	query := `
+		SELECT ` + webhookDeliveryColumns + `
+		FROM webhook_deliveries
+		WHERE status = ? AND next_attempt_at <= ?
+		ORDER BY next_attempt_at
+		LIMIT ?
+	`
+	return c.queryWebhookDeliveries(query, WebhookDeliveryPending, time.Now().UTC(), limit)
+}
+
+// RecordWebhookAttempt counts a delivery attempt and stores its outcome.
+func (c Client) RecordWebhookAttempt(params RecordWebhookAttemptParams) error {
+	var nextAttemptAt *time.Time
+	if params.Status == WebhookDeliveryPending {
+		t := params.NextAttemptAt.UTC()
+		nextAttemptAt = &t
+	}
+	query := `
+		UPDATE webhook_deliveries
+		SET attempts = attempts + 1,
+		    status = ?,
+		    response_status = ?,
+		    error = ?,
+		    next_attempt_at = ?,
+		    updated_at = CURRENT_TIMESTAMP
+		WHERE id = ?
+	`
+	_, err := c.db.Exec(query, params.Status, params.ResponseStatus, params.Error, nextAttemptAt, params.ID.String())
+	return err
+}
+
+// RedeliverWebhook queues a delivery to be sent again right away, with a
+// fresh set of attempts.
+func (c Client) RedeliverWebhook(id uuid.UUID) error {
+	query := `
+		UPDATE webhook_deliveries
+		SET status = ?,
+		    attempts = 0,
+		    next_attempt_at = ?,
+		    updated_at = CURRENT_TIMESTAMP
+		WHERE id = ?
+	`
+	_, err := c.db.Exec(query, WebhookDeliveryPending, time.Now().UTC(), id.String())
+	return err
+}
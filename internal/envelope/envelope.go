@@ -0,0 +1,280 @@
+// Package envelope encrypts objects under per-video data keys, which are
+// stored wrapped by a master key. Objects are sealed in fixed-size chunks
+// so any byte range can be decrypted without reading what comes before
+// it, which keeps Range requests working for encrypted videos.
+package envelope
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// KeySize is the length of data and master keys, for AES-256.
+const KeySize = 32
+
+// ChunkSize is how much plaintext is sealed at a time.
+const ChunkSize = 64 << 10
+
+const (
+	saltSize        = 16
+	tagSize         = 16
+	sealedChunkSize = ChunkSize + tagSize
+)
+
+// magic starts every encrypted object, naming the format's version.
+var magic = []byte("TBE1")
+
+const headerSize = 4 + saltSize
+
+// ErrInvalid means an object failed authentication: it was changed,
+// truncated or encrypted under another key.
+var ErrInvalid = errors.New("envelope: object is corrupt or was encrypted with another key")
+
+// objectAEAD derives the key an object's chunks are sealed with from the
+// data key and the object's salt, so objects sharing a data key never
+// share a nonce space.
+func objectAEAD(dataKey, salt []byte) (cipher.AEAD, error) {
+	if len(dataKey) != KeySize {
+		return nil, fmt.Errorf("envelope: data key is %d bytes, want %d", len(dataKey), KeySize)
+	}
+	mac := hmac.New(sha256.New, dataKey)
+	mac.Write(salt)
+	block, err := aes.NewCipher(mac.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// chunkNonce numbers chunk i and marks the last one, so chunks can't be
+// reordered and an object can't be cut short at a chunk boundary.
+func chunkNonce(i int64, final bool) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce[3:11], uint64(i))
+	if final {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+// chunkCount is how many chunks a plaintext of size bytes is sealed in.
+// Even an empty plaintext has one.
+func chunkCount(size int64) int64 {
+	if size == 0 {
+		return 1
+	}
+	return (size + ChunkSize - 1) / ChunkSize
+}
+
+// EncryptedSize is the size of the object a plaintext of size bytes
+// encrypts to.
+func EncryptedSize(size int64) int64 {
+	return headerSize + size + chunkCount(size)*tagSize
+}
+
+// PlaintextSize is the size of the plaintext in an object of size bytes.
+func PlaintextSize(size int64) (int64, error) {
+	body := size - headerSize
+	if body < tagSize {
+		return 0, ErrInvalid
+	}
+	full, rem := body/sealedChunkSize, body%sealedChunkSize
+	if rem == 0 {
+		return full * ChunkSize, nil
+	}
+	if rem < tagSize {
+		return 0, ErrInvalid
+	}
+	return full*ChunkSize + rem - tagSize, nil
+}
+
+// Encrypt writes src to dst encrypted under dataKey.
+func Encrypt(dst io.Writer, src io.Reader, dataKey []byte) error {
+	salt := make([]byte, saltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return err
+	}
+	aead, err := objectAEAD(dataKey, salt)
+	if err != nil {
+		return err
+	}
+	if _, err := dst.Write(append(bytes.Clone(magic), salt...)); err != nil {
+		return err
+	}
+
+	br := bufio.NewReader(src)
+	buf := make([]byte, ChunkSize)
+	sealed := make([]byte, 0, sealedChunkSize)
+	for i := int64(0); ; i++ {
+		n, err := io.ReadFull(br, buf)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return err
+		}
+		// A full chunk is only the last one if nothing follows it
+		final := n < ChunkSize
+		if !final {
+			if _, err := br.Peek(1); err == io.EOF {
+				final = true
+			} else if err != nil {
+				return err
+			}
+		}
+		sealed = aead.Seal(sealed[:0], chunkNonce(i, final), buf[:n], nil)
+		if _, err := dst.Write(sealed); err != nil {
+			return err
+		}
+		if final {
+			return nil
+		}
+	}
+}
+
+// Source opens an encrypted object at byte offset off, reading to its
+// end, and reports the size of the whole object.
+type Source func(off int64) (body io.ReadCloser, size int64, err error)
+
+// Reader decrypts an object as an io.ReadSeeker. Seeking is free until
+// the next Read, which reopens the source at the chunk holding the new
+// position unless it's already there. Every chunk is authenticated
+// before any of it is returned.
+type Reader struct {
+	src    Source
+	aead   cipher.AEAD
+	size   int64
+	chunks int64
+	pos    int64
+
+	// body is the open source, positioned at the start of chunk next
+	body io.ReadCloser
+	next int64
+
+	// chunk is the plaintext of chunk cur, -1 if none is loaded
+	chunk  []byte
+	cur    int64
+	sealed []byte
+}
+
+// NewReader opens the object behind src and reads its header. The caller
+// closes the Reader.
+func NewReader(src Source, dataKey []byte) (*Reader, error) {
+	body, size, err := src(0)
+	if err != nil {
+		return nil, err
+	}
+	header := make([]byte, headerSize)
+	if _, err := io.ReadFull(body, header); err != nil {
+		body.Close()
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, ErrInvalid
+		}
+		return nil, err
+	}
+	plainSize, err := PlaintextSize(size)
+	if err != nil || !bytes.Equal(header[:len(magic)], magic) {
+		body.Close()
+		return nil, ErrInvalid
+	}
+	aead, err := objectAEAD(dataKey, header[len(magic):])
+	if err != nil {
+		body.Close()
+		return nil, err
+	}
+	return &Reader{
+		src:    src,
+		aead:   aead,
+		size:   plainSize,
+		chunks: chunkCount(plainSize),
+		body:   body,
+		chunk:  make([]byte, 0, ChunkSize),
+		cur:    -1,
+		sealed: make([]byte, sealedChunkSize),
+	}, nil
+}
+
+// Size is the length of the plaintext.
+func (r *Reader) Size() int64 {
+	return r.size
+}
+
+func (r *Reader) Read(p []byte) (int, error) {
+	if r.pos >= r.size {
+		return 0, io.EOF
+	}
+	i := r.pos / ChunkSize
+	if i != r.cur {
+		if err := r.load(i); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.chunk[r.pos-i*ChunkSize:])
+	r.pos += int64(n)
+	return n, nil
+}
+
+// load decrypts chunk i into r.chunk.
+func (r *Reader) load(i int64) error {
+	if r.body == nil || r.next != i {
+		r.Close()
+		body, _, err := r.src(headerSize + i*sealedChunkSize)
+		if err != nil {
+			return err
+		}
+		r.body, r.next = body, i
+	}
+
+	final := i == r.chunks-1
+	sealed := r.sealed
+	if final {
+		sealed = sealed[:r.size-i*ChunkSize+tagSize]
+	}
+	if _, err := io.ReadFull(r.body, sealed); err != nil {
+		r.Close()
+		return err
+	}
+	r.next++
+
+	r.cur = -1
+	chunk, err := r.aead.Open(r.chunk[:0], chunkNonce(i, final), sealed, nil)
+	if err != nil {
+		return ErrInvalid
+	}
+	r.chunk, r.cur = chunk, i
+	return nil
+}
+
+func (r *Reader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.pos
+	case io.SeekEnd:
+		offset += r.size
+	default:
+		return 0, errors.New("envelope: invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("envelope: negative position")
+	}
+	r.pos = offset
+	return offset, nil
+}
+
+// Close closes the source. The Reader can still be used; the next Read
+// opens it again.
+func (r *Reader) Close() error {
+	if r.body == nil {
+		return nil
+	}
+	err := r.body.Close()
+	r.body = nil
+	return err
+}
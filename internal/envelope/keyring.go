@@ -0,0 +1,69 @@
+package envelope
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+)
+
+// DataKey is a fresh key for encrypting a video's objects along with the
+// same key wrapped for storage.
+type DataKey struct {
+	Plaintext []byte
+	Wrapped   []byte
+}
+
+// Keyring makes data keys and unwraps them again. Only the keyring's
+// master key can unwrap what it wrapped.
+type Keyring interface {
+	GenerateDataKey(ctx context.Context) (DataKey, error)
+	Unwrap(ctx context.Context, wrapped []byte) ([]byte, error)
+}
+
+// LocalKeyring wraps data keys under a master key the app holds itself,
+// for deployments without a KMS.
+type LocalKeyring struct {
+	aead cipher.AEAD
+}
+
+func NewLocalKeyring(masterKey []byte) (*LocalKeyring, error) {
+	if len(masterKey) != KeySize {
+		return nil, fmt.Errorf("master key is %d bytes, want %d", len(masterKey), KeySize)
+	}
+	block, err := aes.NewCipher(masterKey)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &LocalKeyring{aead: aead}, nil
+}
+
+func (k *LocalKeyring) GenerateDataKey(ctx context.Context) (DataKey, error) {
+	key := make([]byte, KeySize)
+	if _, err := rand.Read(key); err != nil {
+		return DataKey{}, err
+	}
+	nonce := make([]byte, k.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return DataKey{}, err
+	}
+	return DataKey{Plaintext: key, Wrapped: k.aead.Seal(nonce, nonce, key, nil)}, nil
+}
+
+func (k *LocalKeyring) Unwrap(ctx context.Context, wrapped []byte) ([]byte, error) {
+	n := k.aead.NonceSize()
+	if len(wrapped) < n {
+		return nil, errors.New("wrapped data key is too short")
+	}
+	key, err := k.aead.Open(nil, wrapped[:n], wrapped[n:], nil)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't unwrap data key: %w", err)
+	}
+	return key, nil
+}
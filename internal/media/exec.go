@@ -0,0 +1,249 @@
+package media
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// waitDelay bounds how long Wait blocks on a killed ffmpeg or ffprobe
+// whose output pipes are still held open by a child process.
+const waitDelay = 5 * time.Second
+
+// maxStderrBytes caps how much of a subprocess's stderr is kept for
+// failure reports. The end of the output is kept since that's where
+// ffmpeg explains what went wrong.
+const maxStderrBytes = 8 << 10
+
+// ExecError is a failed ffmpeg or ffprobe run with the tail of its stderr.
+type ExecError struct {
+	Err    error
+	Stderr string
+}
+
+func (e *ExecError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *ExecError) Unwrap() error {
+	return e.Err
+}
+
+// Exec probes and transcodes by running ffprobe and ffmpeg. Processes are
+// killed when their context ends.
+type Exec struct {
+	// FFmpegPath and FFprobePath are the binaries to run, looked up on
+	// PATH when they have no slash. Empty means "ffmpeg" and "ffprobe".
+	FFmpegPath  string
+	FFprobePath string
+	// FFmpegArgs and FFprobeArgs go before every command's own arguments,
+	// for global and input options such as "-hwaccel auto".
+	FFmpegArgs  []string
+	FFprobeArgs []string
+}
+
+func (e Exec) Probe(ctx context.Context, path string) (Info, error) {
+	return e.probe(ctx, nil, path)
+}
+
+func (e Exec) ProbeStream(ctx context.Context, in io.Reader) (Info, error) {
+	return e.probe(ctx, in, "pipe:0")
+}
+
+func (e Exec) probe(ctx context.Context, stdin io.Reader, input string) (Info, error) {
+	var out bytes.Buffer
+	err := e.run(ctx, e.ffprobe(), e.FFprobeArgs, stdin, &out,
+		"-v", "error", "-select_streams", "v:0",
+		"-show_entries", "stream=width,height,color_transfer:format=duration",
+		"-print_format", "json", input)
+	if err != nil {
+		return Info{}, err
+	}
+
+	var probe struct {
+		Streams []struct {
+			Width         int    `json:"width"`
+			Height        int    `json:"height"`
+			ColorTransfer string `json:"color_transfer"`
+		} `json:"streams"`
+		Format struct {
+			Duration string `json:"duration"`
+		} `json:"format"`
+	}
+	if err := json.Unmarshal(out.Bytes(), &probe); err != nil {
+		return Info{}, err
+	}
+	if len(probe.Streams) == 0 {
+		return Info{}, errors.New("no video streams found")
+	}
+	info := Info{
+		Width:         probe.Streams[0].Width,
+		Height:        probe.Streams[0].Height,
+		ColorTransfer: probe.Streams[0].ColorTransfer,
+	}
+	if probe.Format.Duration != "" {
+		info.Duration, err = strconv.ParseFloat(probe.Format.Duration, 64)
+		if err != nil {
+			return Info{}, fmt.Errorf("unexpected duration %q", probe.Format.Duration)
+		}
+	}
+	return info, nil
+}
+
+func (e Exec) FastStart(ctx context.Context, in, out string, progress Progress) error {
+	return e.ffmpegTo(ctx, out, progress,
+		"-i", in, "-c", "copy", "-movflags", "faststart", "-f", "mp4", "-y", out)
+}
+
+func (e Exec) ToneMapSDR(ctx context.Context, in, out string, progress Progress) error {
+	return e.ffmpegTo(ctx, out, progress,
+		"-i", in, "-map", "0",
+		"-vf", "zscale=t=linear:npl=100,format=gbrpf32le,zscale=p=bt709,tonemap=tonemap=hable:desat=0,zscale=t=bt709:m=bt709:r=tv,format=yuv420p",
+		"-c", "copy", "-c:v", "libx264", "-preset", "medium", "-crf", "20",
+		"-color_primaries", "bt709", "-color_trc", "bt709", "-colorspace", "bt709",
+		"-movflags", "faststart", "-f", "mp4", "-y", out)
+}
+
+func (e Exec) PackageDASH(ctx context.Context, in, sdr, out string, progress Progress) error {
+	args := []string{"-i", in, "-map", "0"}
+	if sdr != "" {
+		args = []string{"-i", in, "-i", sdr, "-map", "0", "-map", "1:v"}
+	}
+	args = append(args, "-c", "copy",
+		"-f", "dash", "-single_file", "1", "-single_file_name", "stream$RepresentationID$.mp4",
+		"-seg_duration", "4", "-use_template", "1", "-use_timeline", "1",
+		"-y", out)
+	return e.ffmpegTo(ctx, out, progress, args...)
+}
+
+func (e Exec) ExtractFrame(ctx context.Context, in string, at float64, out string) error {
+	return e.ffmpegTo(ctx, out, Progress{},
+		"-ss", strconv.FormatFloat(at, 'f', 3, 64), "-i", in, "-frames:v", "1", "-q:v", "3", "-y", out)
+}
+
+func (e Exec) ConvertImage(ctx context.Context, in, out string) error {
+	return e.ffmpegTo(ctx, out, Progress{},
+		"-i", in, "-frames:v", "1", "-c:v", "png", "-f", "image2", "-y", out)
+}
+
+func (e Exec) ExtractAudio(ctx context.Context, in, out string) error {
+	return e.ffmpegTo(ctx, out, Progress{},
+		"-i", in, "-map", "0:a:0", "-vn", "-ac", "1", "-ar", "16000", "-c:a", "pcm_s16le", "-f", "wav", "-y", out)
+}
+
+func (e Exec) FastStartStream(ctx context.Context, in io.Reader, out io.Writer) error {
+	return e.run(ctx, e.ffmpeg(), e.FFmpegArgs, in, out,
+		"-i", "pipe:0", "-c", "copy", "-f", "mp4", "-movflags", "frag_keyframe+empty_moov", "pipe:1")
+}
+
+func (e Exec) ExtractFrameStream(ctx context.Context, in io.Reader, at float64, out io.Writer) error {
+	return e.run(ctx, e.ffmpeg(), e.FFmpegArgs, in, out,
+		"-ss", strconv.FormatFloat(at, 'f', 3, 64), "-i", "pipe:0", "-frames:v", "1", "-q:v", "3",
+		"-c:v", "mjpeg", "-f", "image2pipe", "pipe:1")
+}
+
+func (e Exec) ExtractAudioStream(ctx context.Context, in io.Reader, out string) error {
+	return e.ffmpegFrom(ctx, in, out, Progress{},
+		"-i", "pipe:0", "-map", "0:a:0", "-vn", "-ac", "1", "-ar", "16000", "-c:a", "pcm_s16le", "-f", "wav", "-y", out)
+}
+
+// ffmpegTo runs ffmpeg with args, removing out if it fails.
+func (e Exec) ffmpegTo(ctx context.Context, out string, progress Progress, args ...string) error {
+	return e.ffmpegFrom(ctx, nil, out, progress, args...)
+}
+
+// ffmpegFrom is ffmpegTo with stdin piped to ffmpeg.
+func (e Exec) ffmpegFrom(ctx context.Context, stdin io.Reader, out string, progress Progress, args ...string) error {
+	var stdout io.Writer
+	if progress.Report != nil {
+		args = append([]string{"-progress", "pipe:1", "-nostats"}, args...)
+		stdout = &ffmpegProgress{duration: progress.Duration, report: progress.Report}
+	}
+	if err := e.run(ctx, e.ffmpeg(), e.FFmpegArgs, stdin, stdout, args...); err != nil {
+		os.Remove(out)
+		return err
+	}
+	return nil
+}
+
+func (e Exec) ffmpeg() string {
+	if e.FFmpegPath == "" {
+		return "ffmpeg"
+	}
+	return e.FFmpegPath
+}
+
+func (e Exec) ffprobe() string {
+	if e.FFprobePath == "" {
+		return "ffprobe"
+	}
+	return e.FFprobePath
+}
+
+// run runs name with the configured extra args and then args, failing with
+// an *ExecError. stdin, if not nil, is piped to it.
+func (e Exec) run(ctx context.Context, name string, extra []string, stdin io.Reader, stdout io.Writer, args ...string) error {
+	cmd := exec.CommandContext(ctx, name, append(append([]string{}, extra...), args...)...)
+	cmd.WaitDelay = waitDelay
+	cmd.Stdin = stdin
+	cmd.Stdout = stdout
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	if err == nil {
+		return nil
+	}
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		err = fmt.Errorf("%s stopped: %w", name, ctxErr)
+	}
+	out := stderr.Bytes()
+	if len(out) > maxStderrBytes {
+		out = out[len(out)-maxStderrBytes:]
+	}
+	return &ExecError{Err: err, Stderr: string(out)}
+}
+
+// ffmpegProgress parses the key=value lines ffmpeg writes with -progress.
+type ffmpegProgress struct {
+	duration float64
+	report   func(percent int)
+	buf      []byte
+}
+
+func (p *ffmpegProgress) Write(b []byte) (int, error) {
+	p.buf = append(p.buf, b...)
+	for {
+		i := bytes.IndexByte(p.buf, '\n')
+		if i < 0 {
+			break
+		}
+		p.line(string(p.buf[:i]))
+		p.buf = p.buf[i+1:]
+	}
+	return len(b), nil
+}
+
+func (p *ffmpegProgress) line(line string) {
+	key, value, _ := strings.Cut(strings.TrimSpace(line), "=")
+	switch key {
+	case "out_time_us":
+		us, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || p.duration <= 0 {
+			return
+		}
+		// 100 waits for ffmpeg to say it's done
+		p.report(max(min(int(float64(us)/1e6/p.duration*100), 99), 0))
+	case "progress":
+		if value == "end" {
+			p.report(100)
+		}
+	}
+}
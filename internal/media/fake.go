@@ -0,0 +1,113 @@
+package media
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// Fake is a Prober and Transcoder for tests that runs nothing. Every probe
+// returns Info, every output file gets Output written to it, and each call
+// is recorded.
+type Fake struct {
+	Info Info
+	// Output is the contents of each file written. A DASH package is just
+	// its manifest.
+	Output []byte
+	// Err fails every call if it isn't nil.
+	Err error
+
+	mu    sync.Mutex
+	calls []string
+}
+
+// Calls lists the calls made so far, as the method name followed by its
+// input path.
+func (f *Fake) Calls() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string{}, f.calls...)
+}
+
+func (f *Fake) Probe(ctx context.Context, path string) (Info, error) {
+	if err := f.record(ctx, "Probe", path); err != nil {
+		return Info{}, err
+	}
+	return f.Info, nil
+}
+
+func (f *Fake) ProbeStream(ctx context.Context, in io.Reader) (Info, error) {
+	if err := f.record(ctx, "ProbeStream", "pipe:0"); err != nil {
+		return Info{}, err
+	}
+	return f.Info, nil
+}
+
+func (f *Fake) FastStart(ctx context.Context, in, out string, progress Progress) error {
+	return f.write(ctx, "FastStart", in, out, progress)
+}
+
+func (f *Fake) ToneMapSDR(ctx context.Context, in, out string, progress Progress) error {
+	return f.write(ctx, "ToneMapSDR", in, out, progress)
+}
+
+func (f *Fake) PackageDASH(ctx context.Context, in, sdr, out string, progress Progress) error {
+	return f.write(ctx, "PackageDASH", in, out, progress)
+}
+
+func (f *Fake) ExtractFrame(ctx context.Context, in string, at float64, out string) error {
+	return f.write(ctx, "ExtractFrame", in, out, Progress{})
+}
+
+func (f *Fake) ConvertImage(ctx context.Context, in, out string) error {
+	return f.write(ctx, "ConvertImage", in, out, Progress{})
+}
+
+func (f *Fake) ExtractAudio(ctx context.Context, in, out string) error {
+	return f.write(ctx, "ExtractAudio", in, out, Progress{})
+}
+
+func (f *Fake) FastStartStream(ctx context.Context, in io.Reader, out io.Writer) error {
+	if err := f.record(ctx, "FastStartStream", "pipe:0"); err != nil {
+		return err
+	}
+	_, err := out.Write(f.Output)
+	return err
+}
+
+func (f *Fake) ExtractFrameStream(ctx context.Context, in io.Reader, at float64, out io.Writer) error {
+	if err := f.record(ctx, "ExtractFrameStream", "pipe:0"); err != nil {
+		return err
+	}
+	_, err := out.Write(f.Output)
+	return err
+}
+
+func (f *Fake) ExtractAudioStream(ctx context.Context, in io.Reader, out string) error {
+	return f.write(ctx, "ExtractAudioStream", "pipe:0", out, Progress{})
+}
+
+func (f *Fake) write(ctx context.Context, method, in, out string, progress Progress) error {
+	if err := f.record(ctx, method, in); err != nil {
+		return err
+	}
+	if err := os.WriteFile(out, f.Output, 0o600); err != nil {
+		return err
+	}
+	if progress.Report != nil {
+		progress.Report(100)
+	}
+	return nil
+}
+
+func (f *Fake) record(ctx context.Context, method, path string) error {
+	f.mu.Lock()
+	f.calls = append(f.calls, method+" "+path)
+	f.mu.Unlock()
+	if f.Err != nil {
+		return fmt.Errorf("%s: %w", method, f.Err)
+	}
+	return ctx.Err()
+}
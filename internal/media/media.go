@@ -0,0 +1,66 @@
+// Package media probes and transcodes video files. Exec runs the ffmpeg
+// and ffprobe binaries; Fake stands in for them in tests.
+package media
+
+import (
+	"context"
+	"io"
+)
+
+// Info is what a probe learns about a file's first video stream.
+type Info struct {
+	Width  int
+	Height int
+	// ColorTransfer is the transfer characteristics as ffprobe names
+	// them, such as "bt709" or "smpte2084". Empty if the file doesn't say.
+	ColorTransfer string
+	// Duration is the file's length in seconds, 0 if unknown.
+	Duration float64
+}
+
+// Prober reads a video file's properties.
+type Prober interface {
+	Probe(ctx context.Context, path string) (Info, error)
+	// ProbeStream is Probe for a video piped to ffprobe, whose index must
+	// come before its media data.
+	ProbeStream(ctx context.Context, in io.Reader) (Info, error)
+}
+
+// Progress is told how far a transcode has got through its input.
+type Progress struct {
+	// Duration is the input's length in seconds. Without it only
+	// completion is reported.
+	Duration float64
+	// Report is called with percentages as the transcode moves along, if
+	// it isn't nil.
+	Report func(percent int)
+}
+
+// Transcoder writes new files from a video. Each method writes its output
+// to out, replacing any file there.
+type Transcoder interface {
+	// FastStart remuxes in as an MP4 with its index at the front, without
+	// re-encoding.
+	FastStart(ctx context.Context, in, out string, progress Progress) error
+	// ToneMapSDR re-encodes the HDR video in as BT.709 SDR H.264.
+	ToneMapSDR(ctx context.Context, in, out string, progress Progress) error
+	// PackageDASH writes a DASH manifest to out with a single-file CMAF
+	// representation per stream of in beside it. If sdr isn't empty its
+	// video is added as another representation.
+	PackageDASH(ctx context.Context, in, sdr, out string, progress Progress) error
+	// ExtractFrame writes the frame at the given second of in as a JPEG.
+	ExtractFrame(ctx context.Context, in string, at float64, out string) error
+	// ConvertImage writes the image in, such as an AVIF, as a PNG.
+	ConvertImage(ctx context.Context, in, out string) error
+	// ExtractAudio writes the first audio stream of in as 16 kHz mono
+	// WAV, the input speech recognizers expect.
+	ExtractAudio(ctx context.Context, in, out string) error
+
+	// The Stream methods are the ones above for a video piped to ffmpeg,
+	// whose index must come before its media data. FastStartStream can't
+	// seek back to put the index first, so it writes a fragmented MP4
+	// whose index is at the front anyway.
+	FastStartStream(ctx context.Context, in io.Reader, out io.Writer) error
+	ExtractFrameStream(ctx context.Context, in io.Reader, at float64, out io.Writer) error
+	ExtractAudioStream(ctx context.Context, in io.Reader, out string) error
+}
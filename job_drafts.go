@@ -0,0 +1,34 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// expireDrafts deletes videos that were never published within the
+// configured draft TTL, along with their uploaded files.
+func (cfg *apiConfig) expireDrafts(ctx context.Context) error {
+	cutoff := time.Now().Add(-cfg.draftTTL)
+	videos, err := cfg.db.GetDraftVideosCreatedBefore(cutoff)
+	if err != nil {
+		return err
+	}
+
+	for _, video := range videos {
+		if err := cfg.deleteVideoFiles(ctx, video); err != nil {
+			log.Printf("Couldn't delete files for expired draft %s: %v", video.ID, err)
+			continue
+		}
+		if err := cfg.db.DeleteVideo(video.ID); err != nil {
+			log.Printf("Couldn't delete expired draft %s: %v", video.ID, err)
+			continue
+		}
+		log.Printf("Deleted expired draft video %s", video.ID)
+		cfg.audit(nil, uuid.Nil, "video.expire_draft", "video", video.ID.String(), fmt.Sprintf("deleted unpublished %q", video.Title))
+	}
+	return nil
+}
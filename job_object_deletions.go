@@ -0,0 +1,40 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// deleteReplacedObjects removes S3 objects whose scheduled deletion time
+// has passed.
+func (cfg *apiConfig) deleteReplacedObjects(ctx context.Context) error {
+	deletions, err := cfg.db.GetObjectDeletionsDue(time.Now())
+	if err != nil {
+		return err
+	}
+
+	for _, d := range deletions {
+		if d.Prefix {
+			err = cfg.deleteObjectsWithPrefix(ctx, d.Key)
+		} else {
+			_, err = cfg.s3Client.DeleteObject(ctx, &s3.DeleteObjectInput{
+				Bucket: &cfg.s3Bucket,
+				Key:    &d.Key,
+			})
+		}
+		if err != nil {
+			log.Printf("Couldn't delete replaced object %s: %v", d.Key, err)
+			continue
+		}
+		if err := cfg.db.DeleteObjectDeletion(d.ID); err != nil {
+			log.Printf("Couldn't clear scheduled deletion of %s: %v", d.Key, err)
+		}
+	}
+	if len(deletions) > 0 {
+		log.Printf("Deleted %d replaced objects", len(deletions))
+	}
+	return nil
+}
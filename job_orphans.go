@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+// orphanGracePeriod keeps objects that were just written from being
+// collected while the upload that created them is still updating the
+// database.
+const orphanGracePeriod = time.Hour
+
+type orphanReport struct {
+	S3Objects   []string `json:"s3_objects"`
+	LocalAssets []string `json:"local_assets"`
+	Deleted     bool     `json:"deleted"`
+}
+
+// findOrphans compares the bucket and the local assets directory against
+// the videos table and returns files no video refers to. When remove is
+// true the orphans are deleted as well.
+func (cfg *apiConfig) findOrphans(ctx context.Context, remove bool) (orphanReport, error) {
+	report := orphanReport{
+		S3Objects:   []string{},
+		LocalAssets: []string{},
+		Deleted:     remove,
+	}
+
+	// Trashed videos still own their files, so include every record
+	videos, _, err := cfg.db.GetAllVideos(database.Page{})
+	if err != nil {
+		return report, err
+	}
+	keys := make(map[string]bool, len(videos))
+	thumbnails := make(map[string]bool, len(videos))
+	var keptPrefixes []string
+	for _, video := range videos {
+		if key, ok := videoObjectKey(video); ok {
+			keys[key] = true
+		}
+		if video.StagingKey != nil {
+			keys[*video.StagingKey] = true
+		}
+		if prefix, ok := videoDashPrefix(video); ok {
+			keptPrefixes = append(keptPrefixes, prefix)
+		}
+		keptPrefixes = append(keptPrefixes, cfg.videoVersionsPrefix(video), cfg.videoCaptionsPrefix(video))
+		for _, thumbnailURL := range []*string{video.ThumbnailURL, video.ThumbnailSourceURL, video.ThumbnailSquareURL} {
+			if thumbnailURL == nil {
+				continue
+			}
+			if u, err := url.Parse(*thumbnailURL); err == nil && strings.HasPrefix(u.Path, "/assets/") {
+				thumbnails[filepath.Base(u.Path)] = true
+			}
+		}
+	}
+
+	candidateURLs, err := cfg.db.GetThumbnailCandidateURLs()
+	if err != nil {
+		return report, err
+	}
+	// Avatars are saved to the assets directory too
+	avatarURLs, err := cfg.db.GetUserAvatarURLs()
+	if err != nil {
+		return report, err
+	}
+	for _, candidateURL := range append(candidateURLs, avatarURLs...) {
+		if u, err := url.Parse(candidateURL); err == nil && strings.HasPrefix(u.Path, "/assets/") {
+			thumbnails[filepath.Base(u.Path)] = true
+		}
+	}
+
+	// Exports are deleted by the expire-exports job
+	keptPrefixes = append(keptPrefixes, cfg.s3ExportsPrefix)
+
+	// Replaced files are kept until their scheduled deletion
+	deletions, err := cfg.db.GetObjectDeletions()
+	if err != nil {
+		return report, err
+	}
+	for _, d := range deletions {
+		if d.Prefix {
+			keptPrefixes = append(keptPrefixes, d.Key)
+		} else {
+			keys[d.Key] = true
+		}
+	}
+
+	cutoff := time.Now().Add(-orphanGracePeriod)
+
+	paginator := s3.NewListObjectsV2Paginator(cfg.s3Client, &s3.ListObjectsV2Input{
+		Bucket: &cfg.s3Bucket,
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return report, err
+		}
+		for _, obj := range page.Contents {
+			if obj.Key == nil || keys[*obj.Key] {
+				continue
+			}
+			if slices.ContainsFunc(keptPrefixes, func(prefix string) bool {
+				return strings.HasPrefix(*obj.Key, prefix)
+			}) {
+				continue
+			}
+			if obj.LastModified != nil && obj.LastModified.After(cutoff) {
+				continue
+			}
+			report.S3Objects = append(report.S3Objects, *obj.Key)
+		}
+	}
+
+	entries, err := os.ReadDir(cfg.assetsRoot)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return report, err
+	}
+	for _, entry := range entries {
+		if entry.IsDir() || thumbnails[entry.Name()] {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil || info.ModTime().After(cutoff) {
+			continue
+		}
+		report.LocalAssets = append(report.LocalAssets, entry.Name())
+	}
+
+	if !remove {
+		return report, nil
+	}
+
+	for _, key := range report.S3Objects {
+		_, err := cfg.s3Client.DeleteObject(ctx, &s3.DeleteObjectInput{
+			Bucket: &cfg.s3Bucket,
+			Key:    &key,
+		})
+		if err != nil {
+			return report, err
+		}
+	}
+	for _, name := range report.LocalAssets {
+		err := os.Remove(filepath.Join(cfg.assetsRoot, name))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return report, err
+		}
+	}
+	return report, nil
+}
+
+func (cfg *apiConfig) collectOrphans(ctx context.Context) error {
+	report, err := cfg.findOrphans(ctx, true)
+	if err != nil {
+		return err
+	}
+	if n := len(report.S3Objects) + len(report.LocalAssets); n > 0 {
+		log.Printf("Deleted %d orphaned files", n)
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// reprocessStaleAfter is how long a video can be marked as reprocessing
+// before it's assumed whoever started it stopped, and it's picked up
+// again.
+const reprocessStaleAfter = time.Hour
+
+// runReprocessBatches works through running reprocess batches, oldest
+// first, one video at a time.
+func (cfg *apiConfig) runReprocessBatches(ctx context.Context) error {
+	batches, err := cfg.db.GetRunningReprocessBatches()
+	if err != nil {
+		return err
+	}
+	for _, batch := range batches {
+		if err := cfg.runReprocessBatch(ctx, batch.ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (cfg *apiConfig) runReprocessBatch(ctx context.Context, batchID uuid.UUID) error {
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		// Look again before each video so a cancellation takes effect
+		// between them
+		batch, err := cfg.db.GetReprocessBatch(batchID)
+		if err != nil {
+			return err
+		}
+		if batch.Status != database.ReprocessBatchRunning {
+			return nil
+		}
+
+		item, err := cfg.db.ClaimReprocessItem(batchID, time.Now().Add(-reprocessStaleAfter))
+		if err != nil {
+			return err
+		}
+		if item == nil {
+			// Videos claimed by another instance may still be running
+			if batch.Pending == 0 {
+				if _, err := cfg.db.SetReprocessBatchStatus(batchID, database.ReprocessBatchDone); err != nil {
+					return err
+				}
+				log.Printf("Reprocess batch %s done: %d succeeded, %d failed", batchID, batch.Succeeded, batch.Failed)
+			}
+			return nil
+		}
+
+		err = cfg.reprocessBatchItem(ctx, batchID, item.VideoID)
+		// Shutting down isn't the video's fault; it's picked up again once
+		// it goes stale
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		status, errMsg := database.ReprocessItemSucceeded, ""
+		if err != nil {
+			log.Printf("Couldn't reprocess video %s in batch %s: %v", item.VideoID, batchID, err)
+			status, errMsg = database.ReprocessItemFailed, err.Error()
+		}
+		if err := cfg.db.FinishReprocessItem(batchID, item.VideoID, status, errMsg); err != nil {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Duration(batch.DelayMS) * time.Millisecond):
+		}
+	}
+}
+
+func (cfg *apiConfig) reprocessBatchItem(ctx context.Context, batchID, videoID uuid.UUID) error {
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		return err
+	}
+	if video.ID == uuid.Nil || video.DeletedAt != nil {
+		return fmt.Errorf("video %s was deleted", videoID)
+	}
+
+	// Leave videos being uploaded to alone rather than race the upload
+	ctx, release, err := cfg.lockVideoUpload(ctx, videoID, false)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	oldVideoKey := stringOrEmpty(video.VideoKey)
+	video, err = cfg.reprocessVideo(ctx, video)
+	if err != nil {
+		return uploadFailure(ctx, err)
+	}
+	cfg.audit(nil, uuid.Nil, "video.reprocess", "video", videoID.String(), fmt.Sprintf("batch %s, video_key: %q -> %q", batchID, oldVideoKey, stringOrEmpty(video.VideoKey)))
+	return nil
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// tempFilePrefix starts the name of every temp file and directory the
+// server creates, including the dirs processed videos wait in until
+// they're uploaded.
+const tempFilePrefix = "tubely-"
+
+// sweepTempFiles removes temp artifacts older than cfg.tempMaxAge, which
+// are left behind when the server crashes or is killed mid-processing.
+// Files in use are written to or were created recently, so they're newer
+// than the cutoff as long as it's longer than any processing timeout.
+func (cfg *apiConfig) sweepTempFiles(ctx context.Context) error {
+	dir := cfg.scratchDir
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	cutoff := time.Now().Add(-cfg.tempMaxAge)
+	var removed, reclaimed int64
+	for _, entry := range entries {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if !strings.HasPrefix(entry.Name(), tempFilePrefix) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil || info.ModTime().After(cutoff) {
+			continue
+		}
+		path := filepath.Join(dir, entry.Name())
+		size := diskUsage(path)
+		if err := os.RemoveAll(path); err != nil {
+			log.Printf("Couldn't remove stale temp file %s: %v", path, err)
+			continue
+		}
+		removed++
+		reclaimed += size
+	}
+
+	metricTempFilesRemoved.Add(removed)
+	metricTempBytesReclaimed.Add(reclaimed)
+	if removed > 0 {
+		log.Printf("Removed %d stale temp files, reclaiming %d bytes", removed, reclaimed)
+	}
+	return nil
+}
+
+// diskUsage returns the total size of the file or directory tree at path.
+func diskUsage(path string) int64 {
+	var size int64
+	filepath.WalkDir(path, func(_ string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if info, err := d.Info(); err == nil && !d.IsDir() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// purgeTrash permanently deletes videos that have been in the trash for
+// longer than the retention period, including their uploaded files.
+func (cfg *apiConfig) purgeTrash(ctx context.Context) error {
+	cutoff := time.Now().Add(-cfg.trashRetention)
+	videos, err := cfg.db.GetVideosDeletedBefore(cutoff)
+	if err != nil {
+		return err
+	}
+
+	for _, video := range videos {
+		if err := cfg.deleteVideoFiles(ctx, video); err != nil {
+			log.Printf("Couldn't delete files for trashed video %s: %v", video.ID, err)
+			continue
+		}
+		if err := cfg.db.DeleteVideo(video.ID); err != nil {
+			log.Printf("Couldn't purge trashed video %s: %v", video.ID, err)
+			continue
+		}
+		log.Printf("Purged trashed video %s", video.ID)
+		cfg.audit(nil, uuid.Nil, "video.purge", "video", video.ID.String(), fmt.Sprintf("permanently deleted %q", video.Title))
+	}
+	return nil
+}
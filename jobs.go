@@ -0,0 +1,26 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// startJob runs fn every interval in its own goroutine until ctx is done.
+// A failed run is logged and retried on the next tick.
+func startJob(ctx context.Context, name string, interval time.Duration, fn func(context.Context) error) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := fn(ctx); err != nil {
+					log.Printf("job %s failed: %v", name, err)
+				}
+			}
+		}
+	}()
+}
@@ -2,22 +2,115 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"log"
 	"net/http"
 )
 
-func respondWithError(w http.ResponseWriter, code int, msg string, err error) {
-	if err != nil {
-		log.Println(err)
+// errorCode tells API clients what went wrong without parsing the
+// message.
+type errorCode string
+
+const (
+	codeBadRequest           errorCode = "bad_request"
+	codeUnauthorized         errorCode = "unauthorized"
+	codeForbidden            errorCode = "forbidden"
+	codeNotFound             errorCode = "not_found"
+	codeMethodNotAllowed     errorCode = "method_not_allowed"
+	codeNotAcceptable        errorCode = "not_acceptable"
+	codeConflict             errorCode = "conflict"
+	codeGone                 errorCode = "gone"
+	codeLengthRequired       errorCode = "length_required"
+	codePreconditionFailed   errorCode = "precondition_failed"
+	codePayloadTooLarge      errorCode = "payload_too_large"
+	codeUnsupportedMediaType errorCode = "unsupported_media_type"
+	codeRangeNotSatisfiable  errorCode = "range_not_satisfiable"
+	codeLocked               errorCode = "locked"
+	codeRateLimited          errorCode = "rate_limited"
+	codeInternal             errorCode = "internal_error"
+	codeNotImplemented       errorCode = "not_implemented"
+	codeBadGateway           errorCode = "bad_gateway"
+	codeUnavailable          errorCode = "unavailable"
+	codeGatewayTimeout       errorCode = "gateway_timeout"
+	codeInsufficientStorage  errorCode = "insufficient_storage"
+
+	// More specific codes handlers pick with respondWithErrorCode
+	codeNotOwner         errorCode = "not_owner"
+	codeEmailUnverified  errorCode = "email_unverified"
+	codeTooManyUploads   errorCode = "too_many_uploads"
+	codeUserUploadLimit  errorCode = "user_upload_limit"
+	codeVideoNotUploaded errorCode = "video_not_uploaded"
+	codeGeoBlocked       errorCode = "geo_blocked"
+	codeGeoUnknown       errorCode = "geo_unknown"
+	codeOffsetMismatch   errorCode = "offset_mismatch"
+	codeChecksumMismatch errorCode = "checksum_mismatch"
+	codeUploadInProgress errorCode = "upload_in_progress"
+	codeLoginLocked      errorCode = "login_locked"
+	codeCaptchaRequired  errorCode = "captcha_required"
+	codeRequestTimeout   errorCode = "request_timeout"
+	codeMaintenance      errorCode = "maintenance"
+)
+
+var statusErrorCodes = map[int]errorCode{
+	http.StatusBadRequest:                   codeBadRequest,
+	http.StatusUnauthorized:                 codeUnauthorized,
+	http.StatusForbidden:                    codeForbidden,
+	http.StatusNotFound:                     codeNotFound,
+	http.StatusMethodNotAllowed:             codeMethodNotAllowed,
+	http.StatusNotAcceptable:                codeNotAcceptable,
+	http.StatusConflict:                     codeConflict,
+	http.StatusGone:                         codeGone,
+	http.StatusLengthRequired:               codeLengthRequired,
+	http.StatusPreconditionFailed:           codePreconditionFailed,
+	http.StatusRequestEntityTooLarge:        codePayloadTooLarge,
+	http.StatusUnsupportedMediaType:         codeUnsupportedMediaType,
+	http.StatusRequestedRangeNotSatisfiable: codeRangeNotSatisfiable,
+	http.StatusLocked:                       codeLocked,
+	http.StatusTooManyRequests:              codeRateLimited,
+	http.StatusInternalServerError:          codeInternal,
+	http.StatusNotImplemented:               codeNotImplemented,
+	http.StatusBadGateway:                   codeBadGateway,
+	http.StatusServiceUnavailable:           codeUnavailable,
+	http.StatusGatewayTimeout:               codeGatewayTimeout,
+	http.StatusInsufficientStorage:          codeInsufficientStorage,
+}
+
+// statusErrorCode is the code for errors the handler didn't pick a more
+// specific one for.
+func statusErrorCode(status int) errorCode {
+	if code, ok := statusErrorCodes[status]; ok {
+		return code
 	}
-	if code > 499 {
-		log.Printf("Responding with 5XX error: %s", msg)
+	if status >= 500 {
+		return codeInternal
 	}
-	type errorResponse struct {
-		Error string `json:"error"`
+	return codeBadRequest
+}
+
+// errorResponse is the body of every API error. RequestID matches the
+// X-Request-ID response header, for matching reports up with logs.
+type errorResponse struct {
+	Error     string    `json:"error"`
+	Code      errorCode `json:"code"`
+	RequestID string    `json:"request_id,omitempty"`
+}
+
+func respondWithError(w http.ResponseWriter, status int, msg string, err error) {
+	respondWithErrorCode(w, status, statusErrorCode(status), msg, err)
+}
+
+func respondWithErrorCode(w http.ResponseWriter, status int, code errorCode, msg string, err error) {
+	requestID := w.Header().Get(requestIDHeader)
+	if err != nil {
+		log.Printf("[%s] %v", requestID, err)
+	}
+	if status > 499 {
+		log.Printf("[%s] Responding with 5XX error: %s", requestID, msg)
 	}
-	respondWithJSON(w, code, errorResponse{
-		Error: msg,
+	respondWithJSON(w, status, errorResponse{
+		Error:     msg,
+		Code:      code,
+		RequestID: requestID,
 	})
 }
 
@@ -32,3 +125,10 @@ func respondWithJSON(w http.ResponseWriter, code int, payload interface{}) {
 	w.WriteHeader(code)
 	w.Write(dat)
 }
+
+// isBodyTooLarge reports whether err came from reading past an
+// http.MaxBytesReader limit.
+func isBodyTooLarge(err error) bool {
+	var maxBytesErr *http.MaxBytesError
+	return errors.As(err, &maxBytesErr)
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"path"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// Variables of key templates. {env} is S3_KEY_ENV, {date} the day the
+// video was created as YYYY-MM-DD, {aspect} landscape, portrait or other,
+// {rendition} which of the video's processed files the key is for, and
+// {random} a value that's new every time a video is processed.
+const (
+	keyVarEnv       = "env"
+	keyVarUser      = "user"
+	keyVarVideo     = "video"
+	keyVarDate      = "date"
+	keyVarAspect    = "aspect"
+	keyVarRendition = "rendition"
+	keyVarRandom    = "random"
+)
+
+// Renditions a processed video's keys are rendered for.
+const (
+	renditionVideo = "video"
+	renditionDASH  = "dash"
+)
+
+var keyVarPattern = regexp.MustCompile(`\{([a-z]+)\}`)
+
+// keyTemplate is an S3 key, or the start of one, with {name} variables.
+// It also matches keys it rendered, so objects can be told apart by them.
+type keyTemplate struct {
+	raw  string
+	vars []string
+	re   *regexp.Regexp
+}
+
+// parseKeyTemplate checks that raw only uses the allowed variables.
+func parseKeyTemplate(raw string, allowed ...string) (keyTemplate, error) {
+	t := keyTemplate{raw: raw}
+	var expr strings.Builder
+	expr.WriteString("^")
+	last := 0
+	for _, m := range keyVarPattern.FindAllStringSubmatchIndex(raw, -1) {
+		name := raw[m[2]:m[3]]
+		if !slices.Contains(allowed, name) {
+			return keyTemplate{}, fmt.Errorf("unknown variable {%s} in key template %q, want one of %s", name, raw, strings.Join(allowed, ", "))
+		}
+		expr.WriteString(regexp.QuoteMeta(raw[last:m[0]]))
+		expr.WriteString(`(?P<` + name + `>[^/]+)`)
+		t.vars = append(t.vars, name)
+		last = m[1]
+	}
+	expr.WriteString(regexp.QuoteMeta(raw[last:]))
+	if strings.Contains(keyVarPattern.ReplaceAllString(raw, ""), "{") {
+		return keyTemplate{}, fmt.Errorf("malformed variable in key template %q", raw)
+	}
+	var err error
+	t.re, err = regexp.Compile(expr.String())
+	if err != nil {
+		return keyTemplate{}, err
+	}
+	return t, nil
+}
+
+func (t keyTemplate) uses(name string) bool {
+	return slices.Contains(t.vars, name)
+}
+
+func (t keyTemplate) render(vars map[string]string) string {
+	return keyVarPattern.ReplaceAllStringFunc(t.raw, func(v string) string {
+		return vars[v[1:len(v)-1]]
+	})
+}
+
+// match returns the variables of key if the whole key fits the template.
+func (t keyTemplate) match(key string) (map[string]string, bool) {
+	m := t.re.FindStringSubmatch(key)
+	if m == nil || len(m[0]) != len(key) {
+		return nil, false
+	}
+	vars := map[string]string{}
+	for i, name := range t.re.SubexpNames() {
+		if name != "" {
+			vars[name] = m[i]
+		}
+	}
+	return vars, true
+}
+
+// trimPrefix removes the start of key that fits the template.
+func (t keyTemplate) trimPrefix(key string) (string, bool) {
+	loc := t.re.FindStringIndex(key)
+	if loc == nil {
+		return key, false
+	}
+	return key[loc[1]:], true
+}
+
+// keyVars are the variables every key of a video can use.
+func (cfg *apiConfig) keyVars(videoID, userID uuid.UUID, createdAt time.Time) map[string]string {
+	return map[string]string{
+		keyVarEnv:   cfg.s3KeyEnv,
+		keyVarUser:  userID.String(),
+		keyVarVideo: videoID.String(),
+		keyVarDate:  createdAt.UTC().Format(time.DateOnly),
+	}
+}
+
+// createVideo creates a video with its key prefix rendered from
+// S3_KEY_PREFIX_TEMPLATE.
+func (cfg *apiConfig) createVideo(params database.CreateVideoParams) (database.Video, error) {
+	params.VideoID = uuid.New()
+	params.KeyPrefix = cfg.keyPrefixTemplate.render(cfg.keyVars(params.VideoID, params.UserID, time.Now()))
+	return cfg.db.CreateVideo(params)
+}
+
+// aspectName is how an aspect ratio from probeVideo appears in keys.
+func aspectName(ratio string) string {
+	switch ratio {
+	case "16:9":
+		return "landscape"
+	case "9:16":
+		return "portrait"
+	}
+	return "other"
+}
+
+// processedVideoKey is a fresh key for the processed MP4 of a video with
+// the given aspect ratio.
+func (cfg *apiConfig) processedVideoKey(video database.Video, ratio string) string {
+	random := make([]byte, 32)
+	rand.Read(random)
+	vars := cfg.keyVars(video.ID, video.UserID, video.CreatedAt)
+	vars[keyVarAspect] = aspectName(ratio)
+	vars[keyVarRendition] = renditionVideo
+	vars[keyVarRandom] = base64.RawURLEncoding.EncodeToString(random)
+	return video.KeyPrefix + cfg.videoKeyTemplate.render(vars)
+}
+
+// processedDashPrefix is where the DASH packaging of the MP4 at key goes.
+// A template that names renditions decides it by rendering the key as
+// the dash rendition; otherwise it goes in a dash directory next to the
+// MP4.
+func (cfg *apiConfig) processedDashPrefix(video database.Video, key string) string {
+	if cfg.videoKeyTemplate.uses(keyVarRendition) {
+		vars, ok := cfg.videoKeyTemplate.match(strings.TrimPrefix(key, video.KeyPrefix))
+		if ok && vars[keyVarRendition] == renditionVideo {
+			vars[keyVarRendition] = renditionDASH
+			dashKey := video.KeyPrefix + cfg.videoKeyTemplate.render(vars)
+			return strings.TrimSuffix(dashKey, path.Ext(dashKey)) + "/"
+		}
+	}
+	return strings.TrimSuffix(key, path.Ext(key)) + "/dash/"
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// loginLockoutPolicy locks out accounts and IP addresses that keep failing
+// to log in. Once a subject reaches its threshold each further failure
+// doubles its lockout, from base up to max. Failures older than window
+// are forgotten.
+type loginLockoutPolicy struct {
+	accountThreshold int
+	ipThreshold      int
+	base             time.Duration
+	max              time.Duration
+	window           time.Duration
+}
+
+// lockout is how long a subject with the given number of failures is
+// locked out for, 0 if it's below threshold. A threshold of 0 disables
+// lockouts.
+func (p loginLockoutPolicy) lockout(failures, threshold int) time.Duration {
+	if threshold <= 0 || failures < threshold {
+		return 0
+	}
+	// Cap the shift so large failure counts can't overflow
+	return min(p.base<<min(failures-threshold, 30), p.max)
+}
+
+// Accounts are tracked by email rather than user ID, so lockouts look the
+// same whether or not the account exists.
+func accountLoginSubject(email string) string {
+	return "account:" + strings.ToLower(strings.TrimSpace(email))
+}
+
+func ipLoginSubject(r *http.Request) string {
+	return "ip:" + clientIP(r)
+}
+
+// checkLoginLockout reports how long until the account and IP of a login
+// attempt are both free to try again, and the most failures either has.
+func (cfg *apiConfig) checkLoginLockout(r *http.Request, email string) (retryAfter time.Duration, failures int, err error) {
+	now := time.Now()
+	for _, subject := range []string{accountLoginSubject(email), ipLoginSubject(r)} {
+		f, err := cfg.db.GetLoginFailures(subject)
+		if err != nil {
+			return 0, 0, err
+		}
+		if f.LastFailureAt.Before(now.Add(-cfg.loginLockout.window)) {
+			f.Failures = 0
+		}
+		failures = max(failures, f.Failures)
+		if f.LockedUntil != nil && f.LockedUntil.After(now) {
+			retryAfter = max(retryAfter, f.LockedUntil.Sub(now))
+		}
+	}
+	return retryAfter, failures, nil
+}
+
+// recordLoginFailure counts a failed login against its account and IP,
+// locking out whichever reached its threshold. userID is uuid.Nil if no
+// account has the email.
+func (cfg *apiConfig) recordLoginFailure(r *http.Request, email string, userID uuid.UUID) {
+	resourceID := ""
+	if userID != uuid.Nil {
+		resourceID = userID.String()
+	}
+	cfg.audit(r, userID, "user.login_failed", "user", resourceID, fmt.Sprintf("email: %q", email))
+
+	now := time.Now()
+	subjects := []struct {
+		name      string
+		threshold int
+	}{
+		{accountLoginSubject(email), cfg.loginLockout.accountThreshold},
+		{ipLoginSubject(r), cfg.loginLockout.ipThreshold},
+	}
+	for _, s := range subjects {
+		failures, err := cfg.db.RecordLoginFailure(s.name, now.Add(-cfg.loginLockout.window))
+		if err != nil {
+			log.Printf("Couldn't record failed login for %s: %v", s.name, err)
+			continue
+		}
+		lockout := cfg.loginLockout.lockout(failures, s.threshold)
+		if lockout == 0 {
+			continue
+		}
+		if err := cfg.db.LockLogin(s.name, now.Add(lockout)); err != nil {
+			log.Printf("Couldn't lock out %s: %v", s.name, err)
+			continue
+		}
+		cfg.audit(r, userID, "user.login_locked", "user", resourceID, fmt.Sprintf("%s locked out for %s after %d failed logins", s.name, lockout, failures))
+	}
+}
+
+// clearLoginFailures lifts an account's lockout once its owner has proven
+// who they are. The IP's count stands, so an attacker can't reset it by
+// logging in to an account of their own.
+func (cfg *apiConfig) clearLoginFailures(email string) {
+	if err := cfg.db.ClearLoginFailures(accountLoginSubject(email)); err != nil {
+		log.Printf("Couldn't clear failed logins of %s: %v", email, err)
+	}
+}
+
+func respondWithLoginLocked(w http.ResponseWriter, retryAfter time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	respondWithErrorCode(w, http.StatusTooManyRequests, codeLoginLocked, "Too many failed logins, try again later", nil)
+}
+
+// expireLoginFailures forgets failed logins past the window, once any
+// lockout they caused is over.
+func (cfg *apiConfig) expireLoginFailures(ctx context.Context) error {
+	n, err := cfg.db.DeleteLoginFailuresBefore(time.Now().Add(-cfg.loginLockout.window))
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		log.Printf("Forgot failed logins of %d accounts and IPs", n)
+	}
+	return nil
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/smtp"
+	"strings"
+)
+
+// Mailer sends transactional emails such as password resets.
+type Mailer interface {
+	Send(ctx context.Context, to, subject, body string) error
+}
+
+// logMailer writes emails to the server log instead of sending them. It is
+// used when no SMTP server is configured, which is handy in development.
+type logMailer struct{}
+
+func (logMailer) Send(ctx context.Context, to, subject, body string) error {
+	log.Printf("email to %s: %s\n%s", to, subject, body)
+	return nil
+}
+
+type smtpMailer struct {
+	addr string
+	auth smtp.Auth
+	from string
+}
+
+func newSMTPMailer(host, port, username, password, from string) *smtpMailer {
+	var a smtp.Auth
+	if username != "" {
+		a = smtp.PlainAuth("", username, password, host)
+	}
+	return &smtpMailer{
+		addr: net.JoinHostPort(host, port),
+		auth: a,
+		from: from,
+	}
+}
+
+func (m *smtpMailer) Send(ctx context.Context, to, subject, body string) error {
+	if strings.ContainsAny(to+subject, "\r\n") {
+		return fmt.Errorf("invalid email header value")
+	}
+	msg := fmt.Sprintf(
+		"From: %s\r\nTo: %s\r\nSubject: %s\r\nContent-Type: text/plain; charset=UTF-8\r\n\r\n%s",
+		m.from, to, subject, body,
+	)
+	return smtp.SendMail(m.addr, m.auth, m.from, []string{to}, []byte(msg))
+}
@@ -5,13 +5,20 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"runtime"
+	"strings"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/aws-sdk-go-v2/service/sns"
 	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/envelope"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/media"
 
 	"github.com/joho/godotenv"
-	_ "github.com/lib/pq"
 )
 
 type apiConfig struct {
@@ -25,21 +32,193 @@ type apiConfig struct {
 	s3Region         string
 	s3CfDistribution string
 	s3Client         *s3.Client
+	s3PresignClient  *s3.PresignClient
+	signedURLTTL     time.Duration
+	s3StorageClass   types.StorageClass
+	s3StagingPrefix  string
+	s3VersionsPrefix string
+	s3ExportsPrefix  string
+	adminAPIKey      string
+
+	// every object of a video goes under its key prefix, rendered from
+	// keyPrefixTemplate when it's created, and its processed files are
+	// named by videoKeyTemplate. s3KeyEnv is their {env} variable.
+	s3KeyEnv          string
+	keyPrefixTemplate keyTemplate
+	videoKeyTemplate  keyTemplate
+
+	draftTTL         time.Duration
+	trashRetention   time.Duration
+	orphanGCInterval time.Duration
+	retry            retryPolicy
+	ffprobeTimeout   time.Duration
+	ffmpegTimeout    time.Duration
+	transcodes       *transcodePool
+	transcoder       transcoder
+	speechRecognizer speechRecognizer
+	prober           media.Prober
+	mediaTranscoder  media.Transcoder
+	ingest           *ingestLimiter
+
+	// package a DASH manifest alongside each MP4
+	dashEnabled bool
+
+	// feature flags and maintenance mode, as of the last refresh
+	flags *featureFlags
+
+	// automatic captions: the language spoken in videos, empty to detect
+	// it, and how long transcribing one may take
+	captionLanguage  string
+	captionTimeout   time.Duration
+	s3CaptionsPrefix string
+
+	// how long a replaced video's old files are kept before deletion
+	replacedObjectGrace time.Duration
+
+	// how long a finished data export can be downloaded
+	exportTTL time.Duration
+
+	// temp files older than this are assumed abandoned by a crash
+	tempMaxAge time.Duration
+
+	// processed videos bigger than this are uploaded in parts of this
+	// size, so a failed upload resumes from the last part S3 has
+	s3PartSize int64
+
+	// where uploads and processing outputs are written, and how much
+	// space must be left free there after an upload
+	scratchDir     string
+	scratchMinFree int64
+
+	// how long a resumable upload can sit idle before it's discarded
+	uploadSessionTTL time.Duration
+	uploadLocks      *uploadLocks
+
+	// one upload per video at a time; a lock not refreshed within
+	// uploadLockTTL is taken to be abandoned
+	uploadLockTTL time.Duration
+	videoUploads  *videoUploads
+
+	playbackMode     string
+	playbackTokenTTL time.Duration
+	playbackBindIP   bool
+	cloudFrontSigner *cloudFrontSigner
+
+	// finds viewers' countries for geo-restricted videos
+	geoLocator geoLocator
+
+	// wraps the data keys of encrypted videos, nil if they're disabled
+	keyring     envelope.Keyring
+	keyProvider string
+
+	// where the server is reached from outside, for links in embeds
+	publicBaseURL string
+
+	// checksum S3 verifies uploads with, empty to skip verification
+	s3ChecksumAlgorithm types.ChecksumAlgorithm
+
+	// where files uploaded straight to the bucket wait to be processed
+	s3DirectUploadPrefix string
+
+	// what a GB-month costs by storage class, and the last usage report
+	storagePrices     storagePrices
+	storageUsageCache *storageUsageCache
+	// users storing more than this are sent a warning, 0 to never warn
+	storageWarningBytes int64
+
+	notificationMaxAge time.Duration
+	accessLogMaxAge    time.Duration
+
+	// views and likes older than trendingWindow don't count towards
+	// trending scores, and newer ones count half as much per
+	// trendingHalfLife of age
+	trendingWindow   time.Duration
+	trendingHalfLife time.Duration
+
+	// default pause between videos of a reprocess batch
+	reprocessDelay time.Duration
+
+	// where clients fetch public objects from: the CloudFront distribution,
+	// or the S3 endpoint itself in local-s3 mode
+	objectBaseURL string
+
+	deadLetterAfter      int
+	deadLetterWebhookURL string
+
+	webhookClient *http.Client
+	webhookRetry  retryPolicy
+
+	// targets video lifecycle events are published to, besides webhooks
+	eventPublishers []eventPublisher
+
+	maxVideoUploadSize int64
+	// smallUploads holds uploads small enough to process in memory, nil if
+	// all uploads go to disk
+	smallUploads           *smallUploadPool
+	maxThumbnailUploadSize int64
+	maxImagePixels         int64
+	imageConvertType       string
+	thumbnailCandidates    int
+	importClient           *http.Client
+
+	defaultPageSize int
+	maxPageSize     int
+
+	oauthProviders map[string]oauthProvider
+
+	mailer               Mailer
+	passwordResetLimiter *rateLimiter
+	verificationLimiter  *rateLimiter
+	requireVerifiedEmail bool
+
+	// brute-force protection for signup and login. captcha is nil unless
+	// a provider is configured; logins only need one once the account or
+	// IP has captchaAfterFailures recent failures.
+	loginLockout         loginLockoutPolicy
+	signupLimiter        *rateLimiter
+	captcha              captchaVerifier
+	captchaAfterFailures int
 }
 
 func main() {
 	godotenv.Load(".env")
 
-	pathToDB := os.Getenv("DB_PATH")
-	if pathToDB == "" {
-		log.Fatal("DB_URL must be set")
+	dbDriver := os.Getenv("DB_DRIVER")
+	if dbDriver == "" {
+		dbDriver = database.DriverSQLite
+	}
+
+	var dataSource string
+	switch dbDriver {
+	case database.DriverPostgres:
+		dataSource = os.Getenv("DATABASE_URL")
+		if dataSource == "" {
+			log.Fatal("DATABASE_URL must be set when DB_DRIVER is postgres")
+		}
+	default:
+		dataSource = os.Getenv("DB_PATH")
+		if dataSource == "" {
+			log.Fatal("DB_PATH must be set")
+		}
 	}
 
-	db, err := database.NewClient(pathToDB)
+	db, err := database.NewClient(dbDriver, dataSource, database.PoolConfig{
+		MaxOpenConns:    envInt("DB_MAX_OPEN_CONNS", 0),
+		MaxIdleConns:    envInt("DB_MAX_IDLE_CONNS", 0),
+		ConnMaxLifetime: envDuration("DB_CONN_MAX_LIFETIME", 0),
+	})
 	if err != nil {
 		log.Fatalf("Couldn't connect to database: %v", err)
 	}
 
+	if redisURL := os.Getenv("REDIS_URL"); redisURL != "" {
+		cache, err := newRedisCache(redisURL, envDuration("REDIS_CACHE_TTL", 5*time.Minute))
+		if err != nil {
+			log.Fatalf("Couldn't configure Redis cache: %v", err)
+		}
+		db = db.WithCache(cache)
+	}
+
 	jwtSecret := os.Getenv("JWT_SECRET")
 	if jwtSecret == "" {
 		log.Fatal("JWT_SECRET environment variable is not set")
@@ -77,16 +256,120 @@ func main() {
 		log.Fatal("S3_REGION environment variable is not set")
 	}
 
+	storageMode := envString("STORAGE_MODE", storageModeAWS)
+	if storageMode != storageModeAWS && storageMode != storageModeLocalS3 {
+		log.Fatalf("Unknown STORAGE_MODE %q, want aws or local-s3", storageMode)
+	}
+
+	// Local S3 servers have no CDN in front of them
 	s3CfDistribution := os.Getenv("S3_CF_DISTRO")
-	if s3CfDistribution == "" {
+	if s3CfDistribution == "" && storageMode == storageModeAWS {
 		log.Fatal("S3_CF_DISTRO environment variable is not set")
 	}
 
-	s3Config, err := config.LoadDefaultConfig(context.Background(), config.WithRegion(s3Region))
+	s3StorageClass := types.StorageClassStandard
+	if v := os.Getenv("S3_STORAGE_CLASS"); v != "" {
+		s3StorageClass, err = parseStorageClass(v)
+		if err != nil {
+			log.Fatalf("Invalid S3_STORAGE_CLASS: %v", err)
+		}
+	}
+
+	awsOptions := []func(*config.LoadOptions) error{config.WithRegion(s3Region)}
+	if storageMode == storageModeLocalS3 {
+		awsOptions = append(awsOptions, config.WithCredentialsProvider(credentials.NewStaticCredentialsProvider(
+			envString("S3_ACCESS_KEY_ID", "test"),
+			envString("S3_SECRET_ACCESS_KEY", "test"),
+			"",
+		)))
+	}
+	s3Config, err := config.LoadDefaultConfig(context.Background(), awsOptions...)
 	if err != nil {
 		log.Fatalf("unable to load SDK config, %v", err)
 	}
-	s3Client := s3.NewFromConfig(s3Config)
+
+	s3ChecksumAlgorithm, err := parseChecksumAlgorithm(envString("S3_CHECKSUM_ALGORITHM", string(types.ChecksumAlgorithmSha256)))
+	if err != nil {
+		log.Fatalf("Invalid S3_CHECKSUM_ALGORITHM: %v", err)
+	}
+
+	storagePrices, err := parseStoragePrices(envList("STORAGE_PRICES", nil))
+	if err != nil {
+		log.Fatalf("Invalid STORAGE_PRICES: %v", err)
+	}
+
+	s3Endpoint := s3EndpointConfig{
+		baseURL:       os.Getenv("S3_ENDPOINT"),
+		usePathStyle:  envBool("S3_USE_PATH_STYLE", false),
+		useAccelerate: envBool("S3_USE_ACCELERATE", false),
+		region:        os.Getenv("S3_CLIENT_REGION"),
+	}
+	objectBaseURL := "https://" + s3CfDistribution + "/"
+	if storageMode == storageModeLocalS3 {
+		if s3Endpoint.baseURL == "" {
+			s3Endpoint.baseURL = defaultLocalS3Endpoint
+		}
+		s3Endpoint.usePathStyle = true
+		objectBaseURL = strings.TrimSuffix(s3Endpoint.baseURL, "/") + "/" + s3Bucket + "/"
+	}
+	if err := s3Endpoint.validate(); err != nil {
+		log.Fatalf("Invalid S3 endpoint configuration: %v", err)
+	}
+	s3Client := s3.NewFromConfig(s3Config, s3Endpoint.apply)
+
+	var eventPublishers []eventPublisher
+	if topicARN := os.Getenv("EVENTS_SNS_TOPIC_ARN"); topicARN != "" {
+		eventPublishers = append(eventPublishers, snsPublisher{
+			client:   sns.NewFromConfig(s3Config),
+			topicARN: topicARN,
+		})
+	}
+	if bus := os.Getenv("EVENTS_EVENTBRIDGE_BUS"); bus != "" {
+		eventPublishers = append(eventPublishers, eventBridgePublisher{
+			api:    newAWSJSONClient(s3Config, "events", s3Region, ""),
+			bus:    bus,
+			source: envString("EVENTS_SOURCE", "tubely"),
+		})
+	}
+
+	// Admin endpoints are disabled unless a key is configured
+	adminAPIKey := os.Getenv("ADMIN_API_KEY")
+
+	// Unpublished videos are kept forever unless a TTL is configured
+	draftTTL := envDuration("DRAFT_TTL", 0)
+	trashRetention := envDuration("TRASH_RETENTION", 30*24*time.Hour)
+	orphanGCInterval := envDuration("ORPHAN_GC_INTERVAL", 0)
+
+	retry := retryPolicy{
+		maxAttempts: envInt("RETRY_MAX_ATTEMPTS", 4),
+		baseDelay:   envDuration("RETRY_BASE_DELAY", 200*time.Millisecond),
+		maxDelay:    envDuration("RETRY_MAX_DELAY", 10*time.Second),
+	}
+
+	scratchDir := envString("SCRATCH_DIR", os.TempDir())
+	if err := os.MkdirAll(scratchDir, 0o700); err != nil {
+		log.Fatalf("Couldn't create SCRATCH_DIR: %v", err)
+	}
+	// Multipart form files spool to os.TempDir, so send them there too
+	os.Setenv("TMPDIR", scratchDir)
+
+	ffmpeg := media.Exec{
+		FFmpegPath:  envString("FFMPEG_PATH", "ffmpeg"),
+		FFprobePath: envString("FFPROBE_PATH", "ffprobe"),
+		FFmpegArgs:  strings.Fields(os.Getenv("FFMPEG_ARGS")),
+		FFprobeArgs: strings.Fields(os.Getenv("FFPROBE_ARGS")),
+	}
+
+	var mailer Mailer = logMailer{}
+	if smtpHost := os.Getenv("SMTP_HOST"); smtpHost != "" {
+		mailer = newSMTPMailer(
+			smtpHost,
+			envString("SMTP_PORT", "587"),
+			os.Getenv("SMTP_USERNAME"),
+			os.Getenv("SMTP_PASSWORD"),
+			envString("MAIL_FROM", "no-reply@tubely.local"),
+		)
+	}
 
 	cfg := apiConfig{
 		db:               db,
@@ -99,6 +382,228 @@ func main() {
 		s3Region:         s3Region,
 		s3CfDistribution: s3CfDistribution,
 		s3Client:         s3Client,
+		s3PresignClient:  s3.NewPresignClient(s3Client),
+		signedURLTTL:     envDuration("SIGNED_URL_TTL", 15*time.Minute),
+		s3StorageClass:   s3StorageClass,
+		s3StagingPrefix:  envString("S3_STAGING_PREFIX", "staging/"),
+		s3VersionsPrefix: envString("S3_VERSIONS_PREFIX", "versions/"),
+		s3ExportsPrefix:  envString("S3_EXPORTS_PREFIX", "exports/"),
+		adminAPIKey:      adminAPIKey,
+		draftTTL:         draftTTL,
+		trashRetention:   trashRetention,
+		orphanGCInterval: orphanGCInterval,
+		retry:            retry,
+		ffprobeTimeout:   envDuration("FFPROBE_TIMEOUT", 30*time.Second),
+		ffmpegTimeout:    envDuration("FFMPEG_TIMEOUT", 10*time.Minute),
+		transcodes:       newTranscodePool(envInt("MAX_CONCURRENT_TRANSCODES", runtime.NumCPU())),
+		prober:           ffmpeg,
+		mediaTranscoder:  ffmpeg,
+		dashEnabled:      envBool("DASH_ENABLED", true),
+		captionLanguage:  os.Getenv("CAPTIONS_LANGUAGE"),
+		captionTimeout:   envDuration("CAPTIONS_TIMEOUT", time.Hour),
+		s3CaptionsPrefix: envString("S3_CAPTIONS_PREFIX", "captions/"),
+		playbackMode:     envString("PLAYBACK_MODE", playbackProxy),
+		playbackTokenTTL: envDuration("PLAYBACK_TOKEN_TTL", 4*time.Hour),
+		playbackBindIP:   envBool("PLAYBACK_BIND_IP", true),
+		ingest: newIngestLimiter(ingestConfig{
+			userRate:    envInt("INGEST_RATE_PER_USER", 0),
+			userBurst:   envInt("INGEST_BURST_PER_USER", 4<<20),
+			globalRate:  envInt("INGEST_RATE_GLOBAL", 0),
+			globalBurst: envInt("INGEST_BURST_GLOBAL", 16<<20),
+			maxActive:   envInt("MAX_CONCURRENT_INGESTS", 0),
+
+			maxActivePerUser: envInt("MAX_CONCURRENT_UPLOADS_PER_USER", 3),
+		}),
+
+		s3ChecksumAlgorithm: s3ChecksumAlgorithm,
+
+		s3DirectUploadPrefix: envString("S3_DIRECT_UPLOAD_PREFIX", "direct-uploads/"),
+
+		storagePrices:       storagePrices,
+		storageUsageCache:   &storageUsageCache{},
+		storageWarningBytes: int64(envInt("STORAGE_WARNING_BYTES", 0)),
+		notificationMaxAge:  envDuration("NOTIFICATION_MAX_AGE", 90*24*time.Hour),
+		accessLogMaxAge:     envDuration("ACCESS_LOG_MAX_AGE", 365*24*time.Hour),
+
+		trendingWindow:   envDuration("TRENDING_WINDOW", 7*24*time.Hour),
+		trendingHalfLife: envDuration("TRENDING_HALF_LIFE", 24*time.Hour),
+
+		objectBaseURL: objectBaseURL,
+
+		reprocessDelay: envDuration("REPROCESS_BATCH_DELAY", 5*time.Second),
+
+		replacedObjectGrace: envDuration("REPLACED_OBJECT_GRACE", 24*time.Hour),
+
+		exportTTL: envDuration("EXPORT_TTL", 7*24*time.Hour),
+
+		tempMaxAge: envDuration("TEMP_MAX_AGE", 24*time.Hour),
+
+		s3PartSize: max(int64(envInt("S3_PART_SIZE_BYTES", 16<<20)), minS3PartSize),
+
+		scratchDir:     scratchDir,
+		scratchMinFree: int64(envInt("SCRATCH_MIN_FREE_BYTES", 512<<20)),
+
+		uploadSessionTTL: envDuration("UPLOAD_SESSION_TTL", 24*time.Hour),
+		uploadLocks:      newUploadLocks(),
+
+		uploadLockTTL: max(envDuration("UPLOAD_LOCK_TTL", time.Minute), 3*time.Second),
+		videoUploads:  newVideoUploads(),
+
+		publicBaseURL: strings.TrimSuffix(envString("PUBLIC_BASE_URL", "http://localhost:"+port), "/"),
+
+		deadLetterAfter:      max(envInt("DEAD_LETTER_AFTER_ATTEMPTS", 3), 1),
+		deadLetterWebhookURL: os.Getenv("DEAD_LETTER_WEBHOOK_URL"),
+
+		webhookClient: newPublicClient(envDuration("WEBHOOK_TIMEOUT", 10*time.Second)),
+		webhookRetry: retryPolicy{
+			maxAttempts: max(envInt("WEBHOOK_MAX_ATTEMPTS", 8), 1),
+			baseDelay:   envDuration("WEBHOOK_RETRY_BASE_DELAY", 30*time.Second),
+			maxDelay:    envDuration("WEBHOOK_RETRY_MAX_DELAY", 6*time.Hour),
+		},
+
+		eventPublishers: eventPublishers,
+
+		maxVideoUploadSize:     int64(envInt("MAX_VIDEO_UPLOAD_BYTES", 1<<30)),
+		smallUploads:           newSmallUploadPool(int64(envInt("SMALL_UPLOAD_MAX_BYTES", 8<<20)), int64(envInt("SMALL_UPLOAD_MEMORY", 128<<20))),
+		maxThumbnailUploadSize: int64(envInt("MAX_THUMBNAIL_UPLOAD_BYTES", 10<<20)),
+		maxImagePixels:         int64(envInt("MAX_IMAGE_PIXELS", 40_000_000)),
+		imageConvertType:       "image/" + envString("IMAGE_CONVERT_FORMAT", "jpeg"),
+		thumbnailCandidates:    envInt("THUMBNAIL_CANDIDATES", 5),
+		importClient:           newPublicClient(envDuration("VIDEO_IMPORT_TIMEOUT", 10*time.Minute)),
+
+		defaultPageSize: max(envInt("PAGE_SIZE_DEFAULT", 20), 1),
+		maxPageSize:     max(envInt("PAGE_SIZE_MAX", 100), 1),
+
+		oauthProviders: newOAuthProviders(
+			envString("OAUTH_REDIRECT_BASE_URL", "http://localhost:"+port),
+			map[string][2]string{
+				"google": {os.Getenv("OAUTH_GOOGLE_CLIENT_ID"), os.Getenv("OAUTH_GOOGLE_CLIENT_SECRET")},
+				"github": {os.Getenv("OAUTH_GITHUB_CLIENT_ID"), os.Getenv("OAUTH_GITHUB_CLIENT_SECRET")},
+			},
+		),
+
+		mailer:               mailer,
+		passwordResetLimiter: newRateLimiter(5, time.Hour),
+		verificationLimiter:  newRateLimiter(5, time.Hour),
+		requireVerifiedEmail: envBool("REQUIRE_VERIFIED_EMAIL", false),
+
+		loginLockout: loginLockoutPolicy{
+			accountThreshold: envInt("LOGIN_LOCKOUT_THRESHOLD", 5),
+			ipThreshold:      envInt("LOGIN_IP_LOCKOUT_THRESHOLD", 20),
+			base:             envDuration("LOGIN_LOCKOUT_BASE", time.Minute),
+			max:              envDuration("LOGIN_LOCKOUT_MAX", time.Hour),
+			window:           envDuration("LOGIN_FAILURE_WINDOW", 24*time.Hour),
+		},
+		signupLimiter:        newRateLimiter(max(envInt("SIGNUP_LIMIT_PER_HOUR", 10), 1), time.Hour),
+		captchaAfterFailures: envInt("CAPTCHA_AFTER_FAILURES", 3),
+	}
+	if verifyURL := os.Getenv("CAPTCHA_VERIFY_URL"); verifyURL != "" {
+		secret := os.Getenv("CAPTCHA_SECRET")
+		if secret == "" {
+			log.Fatal("CAPTCHA_SECRET must be set when CAPTCHA_VERIFY_URL is")
+		}
+		cfg.captcha = siteverifyCaptcha{
+			verifyURL: verifyURL,
+			secret:    secret,
+			client:    &http.Client{Timeout: envDuration("CAPTCHA_TIMEOUT", 10*time.Second)},
+		}
+	}
+
+	cfg.transcoder, err = newTranscoder(&cfg, envString("TRANSCODER", "ffmpeg"), mediaConvertConfig{
+		awsConfig:    s3Config,
+		region:       s3Region,
+		endpoint:     os.Getenv("MEDIACONVERT_ENDPOINT"),
+		roleARN:      os.Getenv("MEDIACONVERT_ROLE_ARN"),
+		queue:        os.Getenv("MEDIACONVERT_QUEUE"),
+		pollInterval: envDuration("MEDIACONVERT_POLL_INTERVAL", 15*time.Second),
+		timeout:      envDuration("MEDIACONVERT_TIMEOUT", time.Hour),
+		eventsToken:  os.Getenv("MEDIACONVERT_EVENTS_TOKEN"),
+	})
+	if err != nil {
+		log.Fatalf("Couldn't configure transcoder: %v", err)
+	}
+	cfg.speechRecognizer, err = newSpeechRecognizer(&cfg, os.Getenv("CAPTIONS_BACKEND"), speechRecognizerConfig{
+		awsConfig:    s3Config,
+		region:       s3Region,
+		endpoint:     os.Getenv("TRANSCRIBE_ENDPOINT"),
+		pollInterval: envDuration("TRANSCRIBE_POLL_INTERVAL", 15*time.Second),
+		whisperPath:  envString("WHISPER_PATH", "whisper"),
+		whisperArgs:  strings.Fields(os.Getenv("WHISPER_ARGS")),
+	})
+	if err != nil {
+		log.Fatalf("Couldn't configure captions: %v", err)
+	}
+
+	switch cfg.playbackMode {
+	case playbackProxy:
+	case playbackCloudFront:
+		if storageMode == storageModeLocalS3 {
+			log.Fatal("PLAYBACK_MODE cloudfront can't be used with STORAGE_MODE local-s3")
+		}
+		cfg.cloudFrontSigner, err = newCloudFrontSigner(
+			os.Getenv("CLOUDFRONT_KEY_PAIR_ID"),
+			os.Getenv("CLOUDFRONT_PRIVATE_KEY_PATH"),
+			os.Getenv("CLOUDFRONT_COOKIE_DOMAIN"),
+		)
+		if err != nil {
+			log.Fatalf("Couldn't configure CloudFront signed cookies: %v", err)
+		}
+	default:
+		log.Fatalf("Unknown PLAYBACK_MODE %q, want proxy or cloudfront", cfg.playbackMode)
+	}
+	if cfg.imageConvertType != "image/jpeg" && cfg.imageConvertType != "image/png" {
+		log.Fatalf("Unknown IMAGE_CONVERT_FORMAT %q, want jpeg or png", strings.TrimPrefix(cfg.imageConvertType, "image/"))
+	}
+
+	cfg.s3KeyEnv = os.Getenv("S3_KEY_ENV")
+	cfg.keyPrefixTemplate, err = parseKeyTemplate(os.Getenv("S3_KEY_PREFIX_TEMPLATE"), keyVarEnv, keyVarUser, keyVarVideo, keyVarDate)
+	if err != nil {
+		log.Fatalf("Invalid S3_KEY_PREFIX_TEMPLATE: %v", err)
+	}
+	cfg.videoKeyTemplate, err = parseKeyTemplate(
+		envString("S3_VIDEO_KEY_TEMPLATE", "{aspect}/{random}.mp4"),
+		keyVarEnv, keyVarUser, keyVarVideo, keyVarDate, keyVarAspect, keyVarRendition, keyVarRandom,
+	)
+	if err != nil {
+		log.Fatalf("Invalid S3_VIDEO_KEY_TEMPLATE: %v", err)
+	}
+	// Replacements are uploaded while the old file is still playing and
+	// then have the old file deleted, so they need keys of their own
+	if !cfg.videoKeyTemplate.uses(keyVarRandom) {
+		log.Fatalf("S3_VIDEO_KEY_TEMPLATE %q needs {random} so reprocessed files don't overwrite the ones being played", cfg.videoKeyTemplate.raw)
+	}
+
+	cfg.flags, err = newFeatureFlags(envList("FEATURE_FLAGS", nil))
+	if err != nil {
+		log.Fatalf("Invalid FEATURE_FLAGS: %v", err)
+	}
+	if err := cfg.refreshFeatureFlags(context.Background()); err != nil {
+		log.Fatalf("Couldn't load feature flags: %v", err)
+	}
+
+	cfg.geoLocator = noGeoLocator{}
+	if path := os.Getenv("GEOIP_DB_PATH"); path != "" {
+		cfg.geoLocator, err = newMaxMindLocator(path)
+		if err != nil {
+			log.Fatalf("Couldn't open GeoIP database: %v", err)
+		}
+	}
+
+	cfg.keyProvider = os.Getenv("ENCRYPTION_KEY_PROVIDER")
+	cfg.keyring, err = newKeyring(
+		cfg.keyProvider,
+		os.Getenv("ENCRYPTION_MASTER_KEY"),
+		os.Getenv("ENCRYPTION_KMS_KEY_ID"),
+		newAWSJSONClient(s3Config, "kms", s3Region, os.Getenv("KMS_ENDPOINT")),
+	)
+	if err != nil {
+		log.Fatalf("Couldn't configure encryption: %v", err)
+	}
+
+	if storageMode == storageModeLocalS3 {
+		if err := cfg.ensureBucket(context.Background()); err != nil {
+			log.Fatalf("Couldn't create bucket %s: %v", cfg.s3Bucket, err)
+		}
 	}
 
 	err = cfg.ensureAssetsDir()
@@ -106,33 +611,214 @@ func main() {
 		log.Fatalf("Couldn't create assets directory: %v", err)
 	}
 
+	if cfg.draftTTL > 0 {
+		startJob(context.Background(), "expire-drafts", time.Hour, cfg.expireDrafts)
+	}
+	startJob(context.Background(), "purge-trash", time.Hour, cfg.purgeTrash)
+	startJob(context.Background(), "expire-login-failures", time.Hour, cfg.expireLoginFailures)
+	startJob(context.Background(), "delete-replaced-objects", 10*time.Minute, cfg.deleteReplacedObjects)
+	startJob(context.Background(), "build-exports", envDuration("EXPORT_POLL_INTERVAL", 30*time.Second), cfg.buildPendingExports)
+	startJob(context.Background(), "expire-exports", time.Hour, cfg.expireExports)
+	startJob(context.Background(), "expire-upload-sessions", time.Hour, cfg.expireUploadSessions)
+	// Sweep once at startup since a crash is the usual source of leftovers
+	go func() {
+		if err := cfg.sweepTempFiles(context.Background()); err != nil {
+			log.Printf("job sweep-temp-files failed: %v", err)
+		}
+	}()
+	startJob(context.Background(), "sweep-temp-files", envDuration("TEMP_JANITOR_INTERVAL", time.Hour), cfg.sweepTempFiles)
+	startJob(context.Background(), "expire-processed-uploads", time.Hour, cfg.expireProcessedUploads)
+	startJob(context.Background(), "expire-notifications", time.Hour, cfg.expireNotifications)
+	startJob(context.Background(), "expire-access-log", time.Hour, cfg.expireAccessLog)
+	startJob(context.Background(), "refresh-feature-flags", envDuration("FEATURE_FLAG_REFRESH_INTERVAL", 15*time.Second), cfg.refreshFeatureFlags)
+	startJob(context.Background(), "refresh-trending", envDuration("TRENDING_REFRESH_INTERVAL", 10*time.Minute), cfg.refreshTrending)
+	if cfg.orphanGCInterval > 0 {
+		startJob(context.Background(), "collect-orphans", cfg.orphanGCInterval, cfg.collectOrphans)
+	}
+	if interval := envDuration("STORAGE_USAGE_INTERVAL", 6*time.Hour); interval > 0 {
+		startJob(context.Background(), "report-storage-usage", interval, cfg.refreshStorageUsage)
+	}
+	startJob(context.Background(), "run-reprocess-batches", envDuration("REPROCESS_POLL_INTERVAL", 30*time.Second), cfg.runReprocessBatches)
+	startJob(context.Background(), "deliver-webhooks", envDuration("WEBHOOK_POLL_INTERVAL", 5*time.Second), cfg.deliverDueWebhooks)
+
 	mux := http.NewServeMux()
 	appHandler := http.StripPrefix("/app", http.FileServer(http.Dir(filepathRoot)))
 	mux.Handle("/app/", appHandler)
 
 	assetsHandler := http.StripPrefix("/assets", http.FileServer(http.Dir(assetsRoot)))
-	mux.Handle("/assets/", cacheMiddleware(assetsHandler))
+	mux.Handle("/assets/", assetCacheMiddleware(assetsHandler))
+
+	mux.HandleFunc("GET /embed/{videoID}", cfg.handlerEmbed)
+
+	mux.Handle("GET /api/docs/", http.StripPrefix("/api/docs/", swaggerUIHandler()))
+	mux.Handle("POST /graphql", cfg.graphQLHandler())
 
-	mux.HandleFunc("POST /api/login", cfg.handlerLogin)
-	mux.HandleFunc("POST /api/refresh", cfg.handlerRefresh)
-	mux.HandleFunc("POST /api/revoke", cfg.handlerRevoke)
+	v1 := http.NewServeMux()
+	v1.HandleFunc("GET /api/v1/openapi.json", handlerOpenAPISpec)
 
-	mux.HandleFunc("POST /api/users", cfg.handlerUsersCreate)
+	v1.HandleFunc("POST /api/v1/login", cfg.handlerLogin)
+	v1.HandleFunc("POST /api/v1/refresh", cfg.handlerRefresh)
+	v1.HandleFunc("POST /api/v1/revoke", cfg.handlerRevoke)
+	v1.HandleFunc("GET /api/v1/oauth/{provider}/login", cfg.handlerOAuthLogin)
+	v1.HandleFunc("GET /api/v1/oauth/{provider}/callback", cfg.handlerOAuthCallback)
 
-	mux.HandleFunc("POST /api/videos", cfg.handlerVideoMetaCreate)
-	mux.HandleFunc("POST /api/thumbnail_upload/{videoID}", cfg.handlerUploadThumbnail)
-	mux.HandleFunc("POST /api/video_upload/{videoID}", cfg.handlerUploadVideo)
-	mux.HandleFunc("GET /api/videos", cfg.handlerVideosRetrieve)
-	mux.HandleFunc("GET /api/videos/{videoID}", cfg.handlerVideoGet)
-	mux.HandleFunc("DELETE /api/videos/{videoID}", cfg.handlerVideoMetaDelete)
+	v1.HandleFunc("POST /api/v1/users", cfg.handlerUsersCreate)
+	v1.HandleFunc("POST /api/v1/users/verify", cfg.handlerVerifyEmail)
+	v1.HandleFunc("POST /api/v1/users/verify/resend", cfg.handlerVerifyEmailResend)
+	v1.HandleFunc("POST /api/v1/users/me/logout-all", cfg.handlerLogoutAll)
+	v1.HandleFunc("POST /api/v1/users/me/export", cfg.handlerUserExportCreate)
+	v1.HandleFunc("GET /api/v1/users/me/exports", cfg.handlerUserExportsList)
+	v1.HandleFunc("GET /api/v1/users/me/exports/{exportID}", cfg.handlerUserExportGet)
+	v1.HandleFunc("GET /api/v1/users/me/usage", cfg.handlerUserStorageUsage)
+	v1.HandleFunc("POST /api/v1/password-reset/request", cfg.handlerPasswordResetRequest)
+	v1.HandleFunc("POST /api/v1/password-reset/confirm", cfg.handlerPasswordResetConfirm)
+
+	v1.HandleFunc("POST /api/v1/videos", cfg.handlerVideoMetaCreate)
+	v1.HandleFunc("POST /api/v1/thumbnail_upload/{videoID}", cfg.pausedForMaintenance(cfg.handlerUploadThumbnail))
+	v1.HandleFunc("GET /api/v1/videos/{videoID}/thumbnail/candidates", cfg.handlerThumbnailCandidatesList)
+	v1.HandleFunc("PUT /api/v1/videos/{videoID}/thumbnail/select", cfg.handlerThumbnailSelect)
+	v1.HandleFunc("PUT /api/v1/videos/{videoID}/thumbnail/crop", cfg.handlerThumbnailCrop)
+	v1.HandleFunc("POST /api/v1/video_upload/{videoID}", cfg.pausedForMaintenance(cfg.handlerUploadVideo))
+	v1.HandleFunc("PUT /api/v1/videos/{videoID}/content", cfg.pausedForMaintenance(cfg.handlerUploadVideoContent))
+	v1.HandleFunc("DELETE /api/v1/videos/{videoID}/upload", cfg.handlerVideoUploadCancel)
+	v1.HandleFunc("OPTIONS /api/v1/uploads", cfg.handlerUploadSessionOptions)
+	v1.HandleFunc("POST /api/v1/uploads", cfg.pausedForMaintenance(cfg.handlerUploadSessionCreate))
+	v1.HandleFunc("HEAD /api/v1/uploads/{uploadID}", cfg.handlerUploadSessionHead)
+	v1.HandleFunc("PATCH /api/v1/uploads/{uploadID}", cfg.pausedForMaintenance(cfg.handlerUploadSessionPatch))
+	v1.HandleFunc("DELETE /api/v1/uploads/{uploadID}", cfg.handlerUploadSessionDelete)
+	v1.HandleFunc("POST /api/v1/videos/{videoID}/direct-uploads", cfg.pausedForMaintenance(cfg.handlerDirectUploadCreate))
+	v1.HandleFunc("POST /api/v1/videos/{videoID}/direct-uploads/complete", cfg.pausedForMaintenance(cfg.handlerDirectUploadComplete))
+	v1.HandleFunc("POST /api/v1/videos/{videoID}/import", cfg.pausedForMaintenance(cfg.handlerImportVideo))
+	v1.HandleFunc("POST /api/v1/videos/{videoID}/reprocess", cfg.pausedForMaintenance(cfg.handlerReprocessVideo))
+	v1.HandleFunc("POST /api/v1/videos/{videoID}/replace", cfg.pausedForMaintenance(cfg.handlerVideoReplace))
+	v1.HandleFunc("GET /api/v1/videos/{videoID}/download", cfg.handlerVideoDownload)
+	v1.HandleFunc("GET /api/v1/videos/{videoID}/access-log", cfg.handlerVideoAccessLog)
+	v1.HandleFunc("GET /api/v1/videos/{videoID}/captions", cfg.handlerCaptionsList)
+	v1.HandleFunc("GET /api/v1/videos/{videoID}/captions/{captionID}", cfg.handlerCaptionGet)
+	v1.HandleFunc("GET /api/v1/videos/{videoID}/versions", cfg.handlerVideoVersionsList)
+	v1.HandleFunc("POST /api/v1/videos/{videoID}/versions/{versionID}/rollback", cfg.handlerVideoRollback)
+	v1.HandleFunc("GET /api/v1/videos", cfg.handlerVideosRetrieve)
+	v1.HandleFunc("GET /api/v1/videos/trending", cfg.handlerVideosTrending)
+	v1.HandleFunc("GET /api/v1/videos/{videoID}", cfg.handlerVideoGet)
+	v1.HandleFunc("GET /api/v1/videos/{videoID}/playback", cfg.handlerVideoPlayback)
+	v1.HandleFunc("POST /api/v1/videos/{videoID}/views", cfg.handlerVideoViewRecord)
+	v1.HandleFunc("GET /api/v1/videos/{videoID}/related", cfg.handlerVideoRelated)
+	v1.HandleFunc("GET /api/v1/videos/{videoID}/stream", cfg.handlerVideoStream)
+	v1.HandleFunc("GET /api/v1/videos/{videoID}/status", cfg.handlerVideoStatus)
+	v1.HandleFunc("GET /api/v1/playback/{token}/{file...}", cfg.handlerPlaybackStream)
+	v1.HandleFunc("GET /api/v1/oembed", cfg.handlerOEmbed)
+	v1.HandleFunc("POST /api/v1/videos/{videoID}/publish", cfg.handlerVideoPublish)
+	v1.HandleFunc("PUT /api/v1/videos/{videoID}/visibility", cfg.handlerVideoVisibilityUpdate)
+	v1.HandleFunc("PUT /api/v1/videos/{videoID}/tags", cfg.handlerVideoTagsUpdate)
+	v1.HandleFunc("PUT /api/v1/videos/{videoID}/geo_restriction", cfg.handlerVideoGeoRestrictionUpdate)
+	v1.HandleFunc("POST /api/v1/videos/{videoID}/share", cfg.handlerShareLinkCreate)
+	v1.HandleFunc("GET /api/v1/share/{token}", cfg.handlerShareLinkResolve)
+	v1.HandleFunc("POST /api/v1/videos/{videoID}/comments", cfg.handlerCommentCreate)
+	v1.HandleFunc("GET /api/v1/videos/{videoID}/comments", cfg.handlerCommentsList)
+	v1.HandleFunc("DELETE /api/v1/comments/{commentID}", cfg.handlerCommentDelete)
+	v1.HandleFunc("POST /api/v1/videos/{videoID}/like", cfg.handlerVideoLike)
+	v1.HandleFunc("DELETE /api/v1/videos/{videoID}/like", cfg.handlerVideoUnlike)
+	v1.HandleFunc("GET /api/v1/users/me/liked", cfg.handlerLikedVideosRetrieve)
+	v1.HandleFunc("PUT /api/v1/users/me/profile", cfg.handlerProfileUpdate)
+	v1.HandleFunc("POST /api/v1/users/me/avatar", cfg.pausedForMaintenance(cfg.handlerAvatarUpload))
+	v1.HandleFunc("GET /api/v1/users/{userID}", cfg.handlerProfileGet)
+	v1.HandleFunc("GET /api/v1/users/{userID}/videos", cfg.handlerChannelVideosRetrieve)
+	v1.HandleFunc("DELETE /api/v1/videos/{videoID}", cfg.handlerVideoMetaDelete)
+	v1.HandleFunc("POST /api/v1/videos/{videoID}/restore", cfg.handlerVideoRestore)
+	v1.HandleFunc("GET /api/v1/notifications", cfg.handlerNotificationsList)
+	v1.HandleFunc("GET /api/v1/notifications/unread-count", cfg.handlerNotificationsUnreadCount)
+	v1.HandleFunc("GET /api/v1/notifications/stream", cfg.handlerNotificationsStream)
+	v1.HandleFunc("POST /api/v1/notifications/read-all", cfg.handlerNotificationsReadAll)
+	v1.HandleFunc("POST /api/v1/notifications/{notificationID}/read", cfg.handlerNotificationRead)
+	v1.HandleFunc("POST /api/v1/orgs", cfg.handlerOrganizationCreate)
+	v1.HandleFunc("GET /api/v1/orgs", cfg.handlerOrganizationsList)
+	v1.HandleFunc("GET /api/v1/orgs/{orgID}", cfg.handlerOrganizationGet)
+	v1.HandleFunc("GET /api/v1/orgs/{orgID}/videos", cfg.handlerOrganizationVideosList)
+	v1.HandleFunc("POST /api/v1/orgs/{orgID}/invitations", cfg.handlerOrganizationInvitationCreate)
+	v1.HandleFunc("GET /api/v1/orgs/{orgID}/invitations", cfg.handlerOrganizationInvitationsList)
+	v1.HandleFunc("DELETE /api/v1/orgs/{orgID}/invitations/{invitationID}", cfg.handlerOrganizationInvitationDelete)
+	v1.HandleFunc("POST /api/v1/invitations/accept", cfg.handlerOrganizationInvitationAccept)
+	v1.HandleFunc("PUT /api/v1/orgs/{orgID}/members/{userID}", cfg.handlerOrganizationMemberUpdate)
+	v1.HandleFunc("DELETE /api/v1/orgs/{orgID}/members/{userID}", cfg.handlerOrganizationMemberRemove)
+	v1.HandleFunc("POST /api/v1/mediaconvert/events", cfg.handlerMediaConvertEvent)
+	v1.HandleFunc("POST /api/v1/webhooks", cfg.handlerWebhookCreate)
+	v1.HandleFunc("GET /api/v1/webhooks", cfg.handlerWebhooksList)
+	v1.HandleFunc("DELETE /api/v1/webhooks/{webhookID}", cfg.handlerWebhookDelete)
+	v1.HandleFunc("GET /api/v1/webhooks/{webhookID}/deliveries", cfg.handlerWebhookDeliveriesList)
+	v1.HandleFunc("POST /api/v1/webhooks/{webhookID}/deliveries/{deliveryID}/redeliver", cfg.handlerWebhookRedeliver)
+
+	mux.Handle("/api/", apiVersionRouter(map[string]http.Handler{
+		"1": v1,
+	}))
 
 	mux.HandleFunc("POST /admin/reset", cfg.handlerReset)
+	mux.HandleFunc("GET /admin/videos", cfg.handlerAdminVideosList)
+	mux.HandleFunc("POST /admin/videos/{videoID}/versions/{versionID}/rollback", cfg.handlerAdminVideoRollback)
+	mux.HandleFunc("POST /admin/gc", cfg.handlerAdminGC)
+	mux.HandleFunc("GET /admin/metrics", cfg.handlerAdminMetrics)
+	mux.HandleFunc("GET /admin/stats", cfg.handlerAdminStats)
+	mux.HandleFunc("GET /admin/storage/usage", cfg.handlerAdminStorageUsage)
+	mux.HandleFunc("GET /admin/audit", cfg.handlerAdminAuditList)
+	mux.HandleFunc("GET /admin/audit/stream", cfg.handlerAdminAuditStream)
+	mux.HandleFunc("GET /admin/access-log", cfg.handlerAdminAccessLog)
+	mux.HandleFunc("POST /admin/reprocess-batches", cfg.handlerAdminReprocessBatchCreate)
+	mux.HandleFunc("GET /admin/reprocess-batches", cfg.handlerAdminReprocessBatchesList)
+	mux.HandleFunc("GET /admin/reprocess-batches/{batchID}", cfg.handlerAdminReprocessBatchGet)
+	mux.HandleFunc("POST /admin/reprocess-batches/{batchID}/cancel", cfg.handlerAdminReprocessBatchCancel)
+	mux.HandleFunc("GET /admin/dead-letters", cfg.handlerAdminDeadLetters)
+	mux.HandleFunc("DELETE /admin/dead-letters/{videoID}", cfg.handlerAdminDeadLetterDismiss)
+	mux.HandleFunc("GET /admin/maintenance", cfg.handlerAdminMaintenanceGet)
+	mux.HandleFunc("PUT /admin/maintenance", cfg.handlerAdminMaintenanceUpdate)
+	mux.HandleFunc("GET /admin/flags", cfg.handlerAdminFeatureFlagsList)
+	mux.HandleFunc("PUT /admin/flags/{name}", cfg.handlerAdminFeatureFlagUpdate)
+	mux.HandleFunc("DELETE /admin/flags/{name}", cfg.handlerAdminFeatureFlagReset)
+
+	cors := corsConfig{
+		allowedOrigins: envList("CORS_ALLOWED_ORIGINS", nil),
+		allowedMethods: envList("CORS_ALLOWED_METHODS", []string{"GET", "POST", "PUT", "PATCH", "DELETE"}),
+		allowedHeaders: envList("CORS_ALLOWED_HEADERS", []string{"Authorization", "Content-Type", "Tus-Resumable", "Upload-Length", "Upload-Metadata", "Upload-Offset", "Upload-Checksum", "If-Match", "X-Captcha-Token"}),
+		exposedHeaders: envList("CORS_EXPOSED_HEADERS", []string{"X-Request-ID", "API-Version", "Deprecation", "Link", "Location", "Tus-Resumable", "Tus-Version", "Upload-Offset", "Upload-Length", "Upload-Expires", "ETag"}),
+		maxAge:         envDuration("CORS_MAX_AGE", 10*time.Minute),
+	}
+
+	compress := compressConfig{
+		encodings: envList("COMPRESSION_ENCODINGS", []string{"zstd", "gzip"}),
+		minSize:   envInt("COMPRESSION_MIN_BYTES", 1024),
+	}
+
+	timeouts := newRequestTimeouts(
+		envDuration("REQUEST_TIMEOUT", 30*time.Second),
+		envDuration("LONG_REQUEST_TIMEOUT", time.Hour),
+	)
 
 	srv := &http.Server{
-		Addr:    ":" + port,
-		Handler: mux,
+		Addr:              ":" + port,
+		Handler:           requestIDMiddleware(corsMiddleware(cors, compressMiddleware(compress, timeoutMiddleware(timeouts, mux)))),
+		ReadHeaderTimeout: envDuration("READ_HEADER_TIMEOUT", 10*time.Second),
+		ReadTimeout:       envDuration("READ_TIMEOUT", time.Minute),
+		WriteTimeout:      envDuration("WRITE_TIMEOUT", 2*time.Minute),
+		IdleTimeout:       envDuration("IDLE_TIMEOUT", 2*time.Minute),
+	}
+
+	tlsCfg := tlsConfig{
+		certFile:         os.Getenv("TLS_CERT_FILE"),
+		keyFile:          os.Getenv("TLS_KEY_FILE"),
+		autocertDomains:  envList("AUTOCERT_DOMAINS", nil),
+		autocertCacheDir: envString("AUTOCERT_CACHE_DIR", "./certs"),
+		autocertEmail:    os.Getenv("AUTOCERT_EMAIL"),
+		autocertHTTPAddr: envString("AUTOCERT_HTTP_ADDR", ":80"),
+	}
+
+	if grpcPort := os.Getenv("GRPC_PORT"); grpcPort != "" {
+		go func() {
+			log.Fatal(cfg.serveGRPC(":"+grpcPort, tlsCfg))
+		}()
 	}
 
-	log.Printf("Serving on: http://localhost:%s/app/\n", port)
-	log.Fatal(srv.ListenAndServe())
+	scheme := "http"
+	if tlsCfg.enabled() {
+		scheme = "https"
+	}
+	log.Printf("Serving on: %s://localhost:%s/app/\n", scheme, port)
+	log.Fatal(listenAndServe(srv, tlsCfg))
 }
@@ -0,0 +1,348 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+)
+
+// mediaConvertStorageClasses are the storage classes MediaConvert can
+// write outputs with. Others fall back to the bucket default.
+var mediaConvertStorageClasses = []string{
+	"STANDARD", "REDUCED_REDUNDANCY", "STANDARD_IA", "ONEZONE_IA",
+	"INTELLIGENT_TIERING", "GLACIER", "DEEP_ARCHIVE",
+}
+
+type mediaConvertConfig struct {
+	awsConfig aws.Config
+	region    string
+	// endpoint overrides the regional endpoint, for accounts that still
+	// use a dedicated one
+	endpoint string
+	roleARN  string
+	// queue is empty for the account's default queue
+	queue        string
+	pollInterval time.Duration
+	timeout      time.Duration
+	// eventsToken authenticates job state changes forwarded by
+	// EventBridge; empty disables the endpoint
+	eventsToken string
+}
+
+// mediaConvertTranscoder runs a MediaConvert job on the staged original
+// and waits for it to finish. Jobs are polled, and an EventBridge rule
+// forwarding "MediaConvert Job State Change" events can wake the wait
+// early.
+type mediaConvertTranscoder struct {
+	cfg *apiConfig
+	api awsJSONClient
+	mediaConvertConfig
+
+	mu      sync.Mutex
+	waiters map[string]chan struct{}
+}
+
+func newMediaConvertTranscoder(cfg *apiConfig, mc mediaConvertConfig) (*mediaConvertTranscoder, error) {
+	if mc.roleARN == "" {
+		return nil, errors.New("MEDIACONVERT_ROLE_ARN must be set to use MediaConvert")
+	}
+	return &mediaConvertTranscoder{
+		cfg:                cfg,
+		api:                newAWSJSONClient(mc.awsConfig, "mediaconvert", mc.region, mc.endpoint),
+		mediaConvertConfig: mc,
+		waiters:            map[string]chan struct{}{},
+	}, nil
+}
+
+type mediaConvertJob struct {
+	ID                 string `json:"id"`
+	Status             string `json:"status"`
+	JobPercentComplete int    `json:"jobPercentComplete"`
+	ErrorCode          int    `json:"errorCode"`
+	ErrorMessage       string `json:"errorMessage"`
+}
+
+func (t *mediaConvertTranscoder) transcode(ctx context.Context, job transcodeJob) (transcodeResult, error) {
+	if job.stagingKey == "" {
+		return transcodeResult{}, &pipelineError{"transcode", http.StatusInternalServerError, "Couldn't start MediaConvert job", errors.New("video has no staged original")}
+	}
+	ctx, cancel := context.WithTimeout(ctx, t.timeout)
+	defer cancel()
+
+	var created struct {
+		Job mediaConvertJob `json:"job"`
+	}
+	err := t.cfg.retry.do(ctx, "mediaconvert_create_job", func() error {
+		return t.api.do(ctx, http.MethodPost, "/2017-08-29/jobs", nil, t.jobSettings(job), &created)
+	})
+	if err != nil {
+		return transcodeResult{}, &pipelineError{"transcode", http.StatusBadGateway, "Couldn't start MediaConvert job", err}
+	}
+	log.Printf("Started MediaConvert job %s for video %s", created.Job.ID, job.videoID)
+
+	if err := t.wait(ctx, created.Job.ID, job.progress.reporter(progressTranscoding)); err != nil {
+		return transcodeResult{}, &pipelineError{"transcode", http.StatusInternalServerError, "MediaConvert job failed", err}
+	}
+
+	// Make sure the output landed where the video will point
+	_, err = t.cfg.s3Client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: &t.cfg.s3Bucket,
+		Key:    &job.key,
+	})
+	if err != nil {
+		return transcodeResult{}, &pipelineError{"transcode", http.StatusInternalServerError, "Couldn't find MediaConvert output", err}
+	}
+	var result transcodeResult
+	if job.dashPrefix != "" {
+		result.dashKey = job.dashPrefix + dashManifestName
+	}
+	return result, nil
+}
+
+// jobSettings describes a single fast-start H.264/AAC MP4 written to the
+// job's key, plus a DASH manifest over single-file CMAF tracks when the job
+// has a DASH prefix. HDR originals are tone-mapped to SDR for every output.
+// MediaConvert appends extensions to destinations itself.
+func (t *mediaConvertTranscoder) jobSettings(job transcodeJob) map[string]any {
+	video := mediaConvertVideo
+	if job.hdrFormat != "" {
+		video = maps.Clone(mediaConvertVideo)
+		video["videoPreprocessors"] = map[string]any{
+			"colorCorrector": map[string]any{
+				"colorSpaceConversion": "FORCE_709",
+				"hdrToSdrToneMapper":   "PRESERVE_DETAILS",
+			},
+		}
+	}
+	outputGroups := []any{map[string]any{
+		"name": "File Group",
+		"outputGroupSettings": map[string]any{
+			"type":              "FILE_GROUP_SETTINGS",
+			"fileGroupSettings": t.destination(strings.TrimSuffix(job.key, ".mp4"), job),
+		},
+		"outputs": []any{map[string]any{
+			"containerSettings": map[string]any{
+				"container":   "MP4",
+				"mp4Settings": map[string]any{"moovPlacement": "PROGRESSIVE_DOWNLOAD"},
+			},
+			"videoDescription":  video,
+			"audioDescriptions": []any{mediaConvertAudio},
+		}},
+	}}
+	if job.dashPrefix != "" {
+		cmaf := t.destination(job.dashPrefix+strings.TrimSuffix(dashManifestName, ".mpd"), job)
+		cmaf["writeDashManifest"] = "ENABLED"
+		cmaf["writeHlsManifest"] = "DISABLED"
+		cmaf["segmentControl"] = "SINGLE_FILE"
+		cmaf["segmentLength"] = 4
+		cmaf["fragmentLength"] = 2
+		outputGroups = append(outputGroups, map[string]any{
+			"name": "DASH",
+			"outputGroupSettings": map[string]any{
+				"type":              "CMAF_GROUP_SETTINGS",
+				"cmafGroupSettings": cmaf,
+			},
+			"outputs": []any{
+				map[string]any{
+					"nameModifier":      "_video",
+					"containerSettings": map[string]any{"container": "CMFC"},
+					"videoDescription":  video,
+				},
+				map[string]any{
+					"nameModifier":      "_audio",
+					"containerSettings": map[string]any{"container": "CMFC"},
+					"audioDescriptions": []any{mediaConvertAudio},
+				},
+			},
+		})
+	}
+	settings := map[string]any{
+		"role": t.roleARN,
+		"userMetadata": map[string]string{
+			"video_id": job.videoID.String(),
+		},
+		"settings": map[string]any{
+			"inputs": []any{map[string]any{
+				"fileInput":      fmt.Sprintf("s3://%s/%s", t.cfg.s3Bucket, job.stagingKey),
+				"timecodeSource": "ZEROBASED",
+				"videoSelector":  map[string]any{},
+				"audioSelectors": map[string]any{
+					"Audio Selector 1": map[string]any{"defaultSelection": "DEFAULT"},
+				},
+			}},
+			"outputGroups": outputGroups,
+		},
+	}
+	if t.queue != "" {
+		settings["queue"] = t.queue
+	}
+	return settings
+}
+
+// destination is an output group's destination at key in the bucket,
+// written with the job's storage class when MediaConvert supports it.
+func (t *mediaConvertTranscoder) destination(key string, job transcodeJob) map[string]any {
+	destination := map[string]any{
+		"destination": fmt.Sprintf("s3://%s/%s", t.cfg.s3Bucket, key),
+	}
+	if slices.Contains(mediaConvertStorageClasses, string(job.storageClass)) {
+		destination["destinationSettings"] = map[string]any{
+			"s3Settings": map[string]any{"storageClass": string(job.storageClass)},
+		}
+	}
+	return destination
+}
+
+// mediaConvertVideo and mediaConvertAudio are the encodes shared by the MP4
+// and the DASH tracks.
+var (
+	mediaConvertVideo = map[string]any{
+		"codecSettings": map[string]any{
+			"codec": "H_264",
+			"h264Settings": map[string]any{
+				"rateControlMode":   "QVBR",
+				"maxBitrate":        8000000,
+				"sceneChangeDetect": "TRANSITION_DETECTION",
+			},
+		},
+	}
+	mediaConvertAudio = map[string]any{
+		"audioSourceName": "Audio Selector 1",
+		"codecSettings": map[string]any{
+			"codec": "AAC",
+			"aacSettings": map[string]any{
+				"bitrate":    128000,
+				"codingMode": "CODING_MODE_2_0",
+				"sampleRate": 48000,
+			},
+		},
+	}
+)
+
+// wait polls the job until it completes, fails or ctx ends, passing its
+// progress to report if that isn't nil. A job that's still running when
+// ctx ends is cancelled.
+func (t *mediaConvertTranscoder) wait(ctx context.Context, jobID string, report func(percent int)) error {
+	wake := t.waiter(jobID)
+	defer t.forget(jobID)
+
+	for {
+		var got struct {
+			Job mediaConvertJob `json:"job"`
+		}
+		err := t.cfg.retry.do(ctx, "mediaconvert_get_job", func() error {
+			return t.api.do(ctx, http.MethodGet, "/2017-08-29/jobs/"+jobID, nil, nil, &got)
+		})
+		if err != nil && ctx.Err() == nil {
+			return err
+		}
+		switch got.Job.Status {
+		case "COMPLETE":
+			return nil
+		case "PROGRESSING":
+			if report != nil {
+				report(got.Job.JobPercentComplete)
+			}
+		case "ERROR":
+			return fmt.Errorf("job %s failed with code %d: %s", jobID, got.Job.ErrorCode, got.Job.ErrorMessage)
+		case "CANCELED":
+			return fmt.Errorf("job %s was cancelled", jobID)
+		}
+
+		select {
+		case <-ctx.Done():
+			t.cancelJob(jobID)
+			return fmt.Errorf("job %s didn't finish in time: %w", jobID, ctx.Err())
+		case <-wake:
+		case <-time.After(t.pollInterval):
+		}
+	}
+}
+
+func (t *mediaConvertTranscoder) cancelJob(jobID string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := t.api.do(ctx, http.MethodDelete, "/2017-08-29/jobs/"+jobID, nil, nil, nil); err != nil {
+		log.Printf("Couldn't cancel MediaConvert job %s: %v", jobID, err)
+	}
+}
+
+func (t *mediaConvertTranscoder) waiter(jobID string) <-chan struct{} {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	ch := make(chan struct{}, 1)
+	t.waiters[jobID] = ch
+	return ch
+}
+
+func (t *mediaConvertTranscoder) forget(jobID string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.waiters, jobID)
+}
+
+// notify wakes whoever is waiting on jobID so it checks the job now. It
+// reports whether anyone on this instance was waiting.
+func (t *mediaConvertTranscoder) notify(jobID string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	ch, ok := t.waiters[jobID]
+	if ok {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+	return ok
+}
+
+// handlerMediaConvertEvent receives "MediaConvert Job State Change" events
+// from an EventBridge API destination authenticated with a bearer token.
+func (cfg *apiConfig) handlerMediaConvertEvent(w http.ResponseWriter, r *http.Request) {
+	t, ok := cfg.transcoder.(*mediaConvertTranscoder)
+	if !ok || t.eventsToken == "" {
+		respondWithError(w, http.StatusNotFound, "MediaConvert events aren't enabled", nil)
+		return
+	}
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find token", err)
+		return
+	}
+	if subtle.ConstantTimeCompare([]byte(token), []byte(t.eventsToken)) != 1 {
+		respondWithError(w, http.StatusUnauthorized, "Invalid token", nil)
+		return
+	}
+
+	var event struct {
+		DetailType string `json:"detail-type"`
+		Detail     struct {
+			JobID  string `json:"jobId"`
+			Status string `json:"status"`
+		} `json:"detail"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&event); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode event", err)
+		return
+	}
+	if event.Detail.JobID == "" {
+		respondWithError(w, http.StatusBadRequest, "Event has no job ID", nil)
+		return
+	}
+	// Jobs started on other instances are picked up by their own polling
+	t.notify(event.Detail.JobID)
+	w.WriteHeader(http.StatusNoContent)
+}
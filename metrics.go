@@ -0,0 +1,25 @@
+package main
+
+import (
+	"expvar"
+	"net/http"
+)
+
+// Process-wide counters, published as JSON on /admin/metrics.
+var (
+	metricRetries              = expvar.NewMap("retries")
+	metricTranscodeQueueDepth  = expvar.NewInt("transcode_queue_depth")
+	metricTranscodesActive     = expvar.NewInt("transcodes_active")
+	metricDeadLetters          = expvar.NewInt("dead_letters")
+	metricEventPublishFailures = expvar.NewMap("event_publish_failures")
+	metricTempFilesRemoved     = expvar.NewInt("temp_files_removed")
+	metricTempBytesReclaimed   = expvar.NewInt("temp_bytes_reclaimed")
+)
+
+func (cfg *apiConfig) handlerAdminMetrics(w http.ResponseWriter, r *http.Request) {
+	if err := cfg.authorizeAdmin(r); err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't authorize admin", err)
+		return
+	}
+	expvar.Handler().ServeHTTP(w, r)
+}
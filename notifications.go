@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+const (
+	notificationVideoReady   = "video.ready"
+	notificationVideoFailed  = "video.failed"
+	notificationComment      = "comment.created"
+	notificationQuotaWarning = "storage.quota_warning"
+)
+
+// quotaWarningInterval is how long a user over the storage warning
+// threshold goes between reminders.
+const quotaWarningInterval = 7 * 24 * time.Hour
+
+// notify tells a user about something in the notification center. It's
+// best effort: failures are logged, not returned.
+func (cfg *apiConfig) notify(userID uuid.UUID, notificationType, message string, videoID *uuid.UUID) {
+	err := cfg.db.CreateNotification(database.CreateNotificationParams{
+		UserID:  userID,
+		Type:    notificationType,
+		Message: message,
+		VideoID: videoID,
+	})
+	if err != nil {
+		log.Printf("Couldn't notify user %s of %s: %v", userID, notificationType, err)
+	}
+}
+
+// notifyComment tells the video's owner, and the author of the comment
+// replied to, about a new comment, unless they wrote it themselves.
+func (cfg *apiConfig) notifyComment(video database.Video, comment database.Comment) {
+	if video.UserID != comment.UserID {
+		cfg.notify(video.UserID, notificationComment, fmt.Sprintf("New comment on %q", video.Title), &video.ID)
+	}
+	if comment.ParentID == nil {
+		return
+	}
+	parent, err := cfg.db.GetComment(*comment.ParentID)
+	if err != nil {
+		log.Printf("Couldn't get comment %s to notify its author: %v", *comment.ParentID, err)
+		return
+	}
+	if parent.ID != uuid.Nil && parent.UserID != comment.UserID && parent.UserID != video.UserID {
+		cfg.notify(parent.UserID, notificationComment, fmt.Sprintf("New reply to your comment on %q", video.Title), &video.ID)
+	}
+}
+
+// warnStorageQuotas notifies users storing more than the warning
+// threshold, at most once per quotaWarningInterval.
+func (cfg *apiConfig) warnStorageQuotas(report *usageReport) {
+	if cfg.storageWarningBytes <= 0 {
+		return
+	}
+	since := time.Now().Add(-quotaWarningInterval)
+	for _, u := range report.Users {
+		if u.Bytes < cfg.storageWarningBytes {
+			continue
+		}
+		warned, err := cfg.db.HasNotificationSince(u.UserID, notificationQuotaWarning, since)
+		if err != nil {
+			log.Printf("Couldn't check quota warnings of user %s: %v", u.UserID, err)
+			continue
+		}
+		if warned {
+			continue
+		}
+		cfg.notify(u.UserID, notificationQuotaWarning, fmt.Sprintf(
+			"You're storing %s, over the %s warning level. Delete videos you no longer need to free up space.",
+			formatBytes(u.Bytes), formatBytes(cfg.storageWarningBytes),
+		), nil)
+	}
+}
+
+// formatBytes renders a size in binary units, like "1.5 GiB".
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// expireNotifications deletes notifications older than
+// cfg.notificationMaxAge, read or not.
+func (cfg *apiConfig) expireNotifications(ctx context.Context) error {
+	n, err := cfg.db.DeleteNotificationsBefore(time.Now().Add(-cfg.notificationMaxAge))
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		log.Printf("Deleted %d expired notifications", n)
+	}
+	return nil
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/endpoints"
+)
+
+// oauthIdentity is the account information a provider returns after login.
+type oauthIdentity struct {
+	Subject       string
+	Email         string
+	EmailVerified bool
+}
+
+type oauthProvider struct {
+	config        *oauth2.Config
+	fetchIdentity func(ctx context.Context, client *http.Client) (oauthIdentity, error)
+}
+
+// newOAuthProviders builds the providers that have client credentials
+// configured. Callbacks are served from redirectBase + /api/v1/oauth/{name}/callback.
+func newOAuthProviders(redirectBase string, creds map[string][2]string) map[string]oauthProvider {
+	providers := map[string]oauthProvider{}
+	for name, cred := range creds {
+		clientID, clientSecret := cred[0], cred[1]
+		if clientID == "" || clientSecret == "" {
+			continue
+		}
+		conf := &oauth2.Config{
+			ClientID:     clientID,
+			ClientSecret: clientSecret,
+			RedirectURL:  fmt.Sprintf("%s/api/v1/oauth/%s/callback", redirectBase, name),
+		}
+		switch name {
+		case "google":
+			conf.Endpoint = endpoints.Google
+			conf.Scopes = []string{"openid", "email"}
+			providers[name] = oauthProvider{config: conf, fetchIdentity: fetchGoogleIdentity}
+		case "github":
+			conf.Endpoint = endpoints.GitHub
+			conf.Scopes = []string{"read:user", "user:email"}
+			providers[name] = oauthProvider{config: conf, fetchIdentity: fetchGitHubIdentity}
+		}
+	}
+	return providers
+}
+
+func fetchGoogleIdentity(ctx context.Context, client *http.Client) (oauthIdentity, error) {
+	var info struct {
+		Sub           string `json:"sub"`
+		Email         string `json:"email"`
+		EmailVerified bool   `json:"email_verified"`
+	}
+	if err := getJSON(ctx, client, "https://openidconnect.googleapis.com/v1/userinfo", &info); err != nil {
+		return oauthIdentity{}, err
+	}
+	if info.Sub == "" {
+		return oauthIdentity{}, errors.New("google userinfo has no subject")
+	}
+	return oauthIdentity{Subject: info.Sub, Email: info.Email, EmailVerified: info.EmailVerified}, nil
+}
+
+func fetchGitHubIdentity(ctx context.Context, client *http.Client) (oauthIdentity, error) {
+	var user struct {
+		ID int64 `json:"id"`
+	}
+	if err := getJSON(ctx, client, "https://api.github.com/user", &user); err != nil {
+		return oauthIdentity{}, err
+	}
+	if user.ID == 0 {
+		return oauthIdentity{}, errors.New("github user has no id")
+	}
+
+	// The profile email may be hidden, so look up the primary address
+	var emails []struct {
+		Email    string `json:"email"`
+		Primary  bool   `json:"primary"`
+		Verified bool   `json:"verified"`
+	}
+	if err := getJSON(ctx, client, "https://api.github.com/user/emails", &emails); err != nil {
+		return oauthIdentity{}, err
+	}
+	identity := oauthIdentity{Subject: strconv.FormatInt(user.ID, 10)}
+	for _, e := range emails {
+		if e.Primary {
+			identity.Email = e.Email
+			identity.EmailVerified = e.Verified
+		}
+	}
+	return identity, nil
+}
+
+func getJSON(ctx context.Context, client *http.Client, url string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: unexpected status %s", url, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
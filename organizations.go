@@ -0,0 +1,146 @@
+package main
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// orgRoleRank orders organization roles, each allowed whatever the ones
+// below it are.
+var orgRoleRank = map[string]int{
+	database.OrgRoleViewer: 1,
+	database.OrgRoleEditor: 2,
+	database.OrgRoleOwner:  3,
+}
+
+func validOrgRole(role string) bool {
+	_, ok := orgRoleRank[role]
+	return ok
+}
+
+// roleAtLeast reports whether role allows what need does. No role allows
+// nothing.
+func roleAtLeast(role, need string) bool {
+	return role != "" && orgRoleRank[role] >= orgRoleRank[need]
+}
+
+// videoRole is the user's role on a video: their role in its organization
+// if it has one, or owner of their own personal videos. It's "" if they
+// have no access beyond what its visibility gives everyone.
+func (cfg *apiConfig) videoRole(video database.Video, userID uuid.UUID) (string, error) {
+	if userID == uuid.Nil {
+		return "", nil
+	}
+	if video.OrgID == nil {
+		if video.UserID == userID {
+			return database.OrgRoleOwner, nil
+		}
+		return "", nil
+	}
+	return cfg.db.GetOrganizationRole(*video.OrgID, userID)
+}
+
+// canViewVideo reports whether the user can see a private video. Errors
+// deny access.
+func (cfg *apiConfig) canViewVideo(video database.Video, userID uuid.UUID) bool {
+	role, err := cfg.videoRole(video, userID)
+	if err != nil {
+		log.Printf("Couldn't get role of user %s on video %s: %v", userID, video.ID, err)
+		return false
+	}
+	return roleAtLeast(role, database.OrgRoleViewer)
+}
+
+// authorizeVideo checks the user has at least the need role on a video.
+// If not it writes a 403 with msg and returns false.
+func (cfg *apiConfig) authorizeVideo(w http.ResponseWriter, video database.Video, userID uuid.UUID, need, msg string) bool {
+	role, err := cfg.videoRole(video, userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't check access to video", err)
+		return false
+	}
+	if !roleAtLeast(role, need) {
+		respondWithErrorCode(w, http.StatusForbidden, codeNotOwner, msg, nil)
+		return false
+	}
+	return true
+}
+
+// ownVideo loads the video in the path for an authenticated user who can
+// change it: its owner, or an editor of its organization, along with the
+// caller's ID. On failure it writes the error response itself and returns
+// ok == false.
+func (cfg *apiConfig) ownVideo(w http.ResponseWriter, r *http.Request) (database.Video, uuid.UUID, bool) {
+	return cfg.videoWithRole(w, r, database.OrgRoleEditor)
+}
+
+// videoWithRole is ownVideo for a user with at least the need role on
+// the video.
+func (cfg *apiConfig) videoWithRole(w http.ResponseWriter, r *http.Request, need string) (database.Video, uuid.UUID, bool) {
+	videoID, err := uuid.Parse(r.PathValue("videoID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid ID", err)
+		return database.Video{}, uuid.Nil, false
+	}
+
+	userID, ok := cfg.authenticate(w, r)
+	if !ok {
+		return database.Video{}, uuid.Nil, false
+	}
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return database.Video{}, uuid.Nil, false
+	}
+	if video.ID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, "Couldn't get video", nil)
+		return database.Video{}, uuid.Nil, false
+	}
+	if !cfg.authorizeVideo(w, video, userID, need, "Video not owned by user") {
+		return database.Video{}, uuid.Nil, false
+	}
+	return video, userID, true
+}
+
+// orgMember loads the organization in the path for an authenticated
+// member with at least the need role, returning it with their role. On
+// failure it writes the error response itself and returns ok == false.
+// Non-members get a 404, so they can't tell which organizations exist.
+func (cfg *apiConfig) orgMember(w http.ResponseWriter, r *http.Request, need string) (org database.Organization, userID uuid.UUID, ok bool) {
+	orgID, err := uuid.Parse(r.PathValue("orgID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid ID", err)
+		return database.Organization{}, uuid.Nil, false
+	}
+
+	userID, ok = cfg.authenticate(w, r)
+	if !ok {
+		return database.Organization{}, uuid.Nil, false
+	}
+
+	role, err := cfg.db.GetOrganizationRole(orgID, userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get organization", err)
+		return database.Organization{}, uuid.Nil, false
+	}
+	if role == "" {
+		respondWithError(w, http.StatusNotFound, "Couldn't get organization", nil)
+		return database.Organization{}, uuid.Nil, false
+	}
+	if !roleAtLeast(role, need) {
+		respondWithErrorCode(w, http.StatusForbidden, codeNotOwner, "Your role in the organization doesn't allow this", nil)
+		return database.Organization{}, uuid.Nil, false
+	}
+
+	org, err = cfg.db.GetOrganization(orgID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get organization", err)
+		return database.Organization{}, uuid.Nil, false
+	}
+	org.Role = role
+	return org, userID, true
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+// page is the body of every list endpoint. NextCursor is passed back as
+// ?cursor= to get the following page and is null on the last one.
+type page[T any] struct {
+	Items      []T     `json:"items"`
+	NextCursor *string `json:"next_cursor"`
+}
+
+func respondWithPage[T any](w http.ResponseWriter, items []T, next *database.Cursor) {
+	body := page[T]{Items: items}
+	if next != nil {
+		token := next.String()
+		body.NextCursor = &token
+	}
+	respondWithJSON(w, http.StatusOK, body)
+}
+
+// pageLimit clamps a requested page size, with zero meaning the default.
+func (cfg *apiConfig) pageLimit(limit int) int {
+	if limit <= 0 {
+		return cfg.defaultPageSize
+	}
+	return min(limit, cfg.maxPageSize)
+}
+
+// parsePage reads the limit and cursor query parameters of a list request.
+func (cfg *apiConfig) parsePage(q url.Values) (database.Page, error) {
+	var p database.Page
+	if v := q.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit < 1 {
+			return p, fmt.Errorf("invalid limit %q", v)
+		}
+		p.Limit = limit
+	}
+	p.Limit = cfg.pageLimit(p.Limit)
+	if v := q.Get("cursor"); v != "" {
+		cursor, err := database.ParseCursor(v)
+		if err != nil {
+			return p, err
+		}
+		p.After = &cursor
+	}
+	return p, nil
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// The files ffmpeg processing leaves in a video's processed upload dir.
+// Only the one sent to the bucket is needed to resume; the others are
+// kept for DASH packaging.
+const (
+	processedFileName       = "processed.mp4"
+	processedSDRFileName    = "processed.sdr.mp4"
+	processedSealedFileName = "processed.sealed"
+)
+
+// minS3PartSize is the smallest part S3 takes in a multipart upload, save
+// the last.
+const minS3PartSize = 5 << 20
+
+// processedUploadDir is where a video's processed files wait until
+// they're in the bucket. It's named after the video so a retry finds them.
+func (cfg *apiConfig) processedUploadDir(videoID uuid.UUID) string {
+	return filepath.Join(cfg.scratchDir, tempFilePrefix+"processed-"+videoID.String())
+}
+
+// processedFilePaths names the files processing writes to dir: the
+// fast-start remux, its SDR tone-map for HDR videos and the file that's
+// uploaded, which is one of those or its encrypted copy.
+func processedFilePaths(dir string, hdr, encrypted bool) (processed, sdr, upload string) {
+	processed = filepath.Join(dir, processedFileName)
+	upload = processed
+	if hdr {
+		sdr = filepath.Join(dir, processedSDRFileName)
+		upload = sdr
+	}
+	if encrypted {
+		upload = filepath.Join(dir, processedSealedFileName)
+	}
+	return processed, sdr, upload
+}
+
+// resumableUpload returns what a previous run left when it processed the
+// video's current original but failed to upload it, or nil if there's
+// nothing to resume. Leftovers from another original, storage class or
+// whose files are gone are discarded, as are any from an original without
+// a checksum, since there's no telling whether it's the same one.
+func (cfg *apiConfig) resumableUpload(ctx context.Context, video database.Video, storageClass types.StorageClass, hdr, encrypted bool) *database.ProcessedUpload {
+	pending, err := cfg.db.GetProcessedUpload(video.ID)
+	if err != nil {
+		log.Printf("Couldn't get processed upload of video %s: %v", video.ID, err)
+		return nil
+	}
+	if pending.VideoID == uuid.Nil {
+		return nil
+	}
+	_, _, uploadPath := processedFilePaths(pending.Dir, hdr, encrypted)
+	_, statErr := os.Stat(uploadPath)
+	if statErr == nil && video.StagingChecksumSHA256 != nil && pending.SourceChecksum == *video.StagingChecksumSHA256 && pending.StorageClass == string(storageClass) {
+		return &pending
+	}
+	if err := cfg.discardProcessedUpload(ctx, video.ID); err != nil {
+		log.Printf("Couldn't discard processed upload of video %s: %v", video.ID, err)
+	}
+	return nil
+}
+
+// discardProcessedUpload aborts a video's unfinished processed upload, if
+// it has one, and removes its files.
+func (cfg *apiConfig) discardProcessedUpload(ctx context.Context, videoID uuid.UUID) error {
+	pending, err := cfg.db.GetProcessedUpload(videoID)
+	if err != nil {
+		return err
+	}
+	if pending.VideoID == uuid.Nil {
+		return nil
+	}
+	if pending.UploadID != "" {
+		_, err := cfg.s3Client.AbortMultipartUpload(ctx, &s3.AbortMultipartUploadInput{
+			Bucket:   &cfg.s3Bucket,
+			Key:      &pending.ObjectKey,
+			UploadId: &pending.UploadID,
+		})
+		if err != nil && !isUploadGone(err) {
+			return err
+		}
+	}
+	return cfg.removeProcessedUpload(pending)
+}
+
+// removeProcessedUpload deletes a processed upload's files and record,
+// once it's in the bucket or aborted.
+func (cfg *apiConfig) removeProcessedUpload(pending database.ProcessedUpload) error {
+	if err := os.RemoveAll(pending.Dir); err != nil {
+		return err
+	}
+	return cfg.db.DeleteProcessedUpload(pending.VideoID)
+}
+
+// uploadProcessed puts the processed file at path in the bucket at the
+// pending upload's key. Files bigger than one part go up in a multipart
+// upload, which picks up from the last part S3 has if pending was already
+// part way through one.
+func (cfg *apiConfig) uploadProcessed(ctx context.Context, pending *database.ProcessedUpload, path, contentType string, sum fileChecksum) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	size := info.Size()
+	storageClass := types.StorageClass(pending.StorageClass)
+
+	if size <= cfg.s3PartSize && pending.UploadID == "" {
+		return cfg.retry.do(ctx, "s3_put_object", func() error {
+			_, err := cfg.s3Client.PutObject(ctx, cfg.withChecksum(&s3.PutObjectInput{
+				Bucket:       &cfg.s3Bucket,
+				Key:          &pending.ObjectKey,
+				ContentType:  &contentType,
+				Body:         io.NewSectionReader(f, 0, size),
+				StorageClass: storageClass,
+			}, sum))
+			return err
+		})
+	}
+
+	var uploaded map[int32]types.Part
+	if pending.UploadID != "" {
+		uploaded, err = cfg.uploadedParts(ctx, pending)
+		if isUploadGone(err) {
+			// Aborted, or completed by a run that failed after it
+			pending.UploadID = ""
+		} else if err != nil {
+			return err
+		}
+	}
+	if pending.UploadID == "" {
+		var out *s3.CreateMultipartUploadOutput
+		err := cfg.retry.do(ctx, "s3_create_multipart_upload", func() error {
+			var err error
+			out, err = cfg.s3Client.CreateMultipartUpload(ctx, &s3.CreateMultipartUploadInput{
+				Bucket:            &cfg.s3Bucket,
+				Key:               &pending.ObjectKey,
+				ContentType:       &contentType,
+				StorageClass:      storageClass,
+				ChecksumAlgorithm: cfg.s3ChecksumAlgorithm,
+			})
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		pending.UploadID = aws.ToString(out.UploadId)
+		if err := cfg.db.SaveProcessedUpload(*pending); err != nil {
+			return err
+		}
+	} else if len(uploaded) > 0 {
+		log.Printf("Resuming upload of %s with %d parts already in S3", pending.ObjectKey, len(uploaded))
+	}
+
+	var parts []types.CompletedPart
+	for offset, number := int64(0), int32(1); offset < size; offset, number = offset+cfg.s3PartSize, number+1 {
+		length := min(cfg.s3PartSize, size-offset)
+		if part, ok := uploaded[number]; ok && aws.ToInt64(part.Size) == length {
+			parts = append(parts, types.CompletedPart{
+				PartNumber:     part.PartNumber,
+				ETag:           part.ETag,
+				ChecksumSHA256: part.ChecksumSHA256,
+				ChecksumCRC32:  part.ChecksumCRC32,
+			})
+			continue
+		}
+		var out *s3.UploadPartOutput
+		err := cfg.retry.do(ctx, "s3_upload_part", func() error {
+			var err error
+			out, err = cfg.s3Client.UploadPart(ctx, &s3.UploadPartInput{
+				Bucket:            &cfg.s3Bucket,
+				Key:               &pending.ObjectKey,
+				UploadId:          &pending.UploadID,
+				PartNumber:        aws.Int32(number),
+				Body:              io.NewSectionReader(f, offset, length),
+				ContentLength:     aws.Int64(length),
+				ChecksumAlgorithm: cfg.s3ChecksumAlgorithm,
+			})
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("part %d: %w", number, err)
+		}
+		parts = append(parts, types.CompletedPart{
+			PartNumber:     aws.Int32(number),
+			ETag:           out.ETag,
+			ChecksumSHA256: out.ChecksumSHA256,
+			ChecksumCRC32:  out.ChecksumCRC32,
+		})
+	}
+
+	return cfg.retry.do(ctx, "s3_complete_multipart_upload", func() error {
+		_, err := cfg.s3Client.CompleteMultipartUpload(ctx, &s3.CompleteMultipartUploadInput{
+			Bucket:          &cfg.s3Bucket,
+			Key:             &pending.ObjectKey,
+			UploadId:        &pending.UploadID,
+			MultipartUpload: &types.CompletedMultipartUpload{Parts: parts},
+		})
+		return err
+	})
+}
+
+// uploadedParts returns the parts S3 has of a multipart upload, by number.
+func (cfg *apiConfig) uploadedParts(ctx context.Context, pending *database.ProcessedUpload) (map[int32]types.Part, error) {
+	parts := map[int32]types.Part{}
+	paginator := s3.NewListPartsPaginator(cfg.s3Client, &s3.ListPartsInput{
+		Bucket:   &cfg.s3Bucket,
+		Key:      &pending.ObjectKey,
+		UploadId: &pending.UploadID,
+	})
+	for paginator.HasMorePages() {
+		var page *s3.ListPartsOutput
+		err := cfg.retry.do(ctx, "s3_list_parts", func() error {
+			var err error
+			page, err = paginator.NextPage(ctx)
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		for _, part := range page.Parts {
+			parts[aws.ToInt32(part.PartNumber)] = part
+		}
+	}
+	return parts, nil
+}
+
+// isUploadGone reports whether err is S3 saying a multipart upload no
+// longer exists.
+func isUploadGone(err error) bool {
+	var respErr interface{ HTTPStatusCode() int }
+	return errors.As(err, &respErr) && respErr.HTTPStatusCode() == http.StatusNotFound
+}
+
+// expireProcessedUploads discards processed uploads no retry has resumed
+// within cfg.tempMaxAge, aborting their multipart uploads so S3 doesn't
+// keep charging for the parts.
+func (cfg *apiConfig) expireProcessedUploads(ctx context.Context) error {
+	pending, err := cfg.db.GetProcessedUploadsBefore(time.Now().Add(-cfg.tempMaxAge))
+	if err != nil {
+		return err
+	}
+	for _, p := range pending {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		// A video being uploaded may be resuming this one right now
+		_, release, err := cfg.lockVideoUpload(ctx, p.VideoID, false)
+		if errors.Is(err, errUploadInProgress) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if err := cfg.discardProcessedUpload(ctx, p.VideoID); err != nil {
+			log.Printf("Couldn't expire processed upload of video %s: %v", p.VideoID, err)
+		}
+		release()
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Stages a pipeline run reports progress for.
+const (
+	progressQueued      = "queued"
+	progressTranscoding = "transcoding"
+	progressTonemapping = "tonemapping"
+	progressPackaging   = "packaging"
+)
+
+// progressHeartbeat is how often a run's progress is written again while
+// it isn't moving, so a stalled percentage doesn't look like a dead run.
+const progressHeartbeat = 30 * time.Second
+
+// progressStaleAfter is how old progress can get before the run that
+// reported it is assumed to have died with its server.
+const progressStaleAfter = 3 * progressHeartbeat
+
+// progressTracker saves how far along a video's pipeline run is for the
+// status endpoint. A nil tracker drops reports.
+type progressTracker struct {
+	cfg     *apiConfig
+	videoID uuid.UUID
+	stop    chan struct{}
+
+	mu      sync.Mutex
+	stage   string
+	percent int
+}
+
+// trackProgress starts tracking a run of videoID's pipeline, which the
+// caller ends with done.
+func (cfg *apiConfig) trackProgress(videoID uuid.UUID) *progressTracker {
+	t := &progressTracker{cfg: cfg, videoID: videoID, stop: make(chan struct{}), percent: -1}
+	t.report(progressQueued, 0)
+	go func() {
+		ticker := time.NewTicker(progressHeartbeat)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-t.stop:
+				return
+			case <-ticker.C:
+				t.mu.Lock()
+				t.save()
+				t.mu.Unlock()
+			}
+		}
+	}()
+	return t
+}
+
+// report records that the run is percent of the way through stage. Only
+// changes are written.
+func (t *progressTracker) report(stage string, percent int) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if stage == t.stage && percent == t.percent {
+		return
+	}
+	t.stage, t.percent = stage, percent
+	t.save()
+}
+
+// reporter returns report for one stage, or nil for a nil tracker.
+func (t *progressTracker) reporter(stage string) func(percent int) {
+	if t == nil {
+		return nil
+	}
+	return func(percent int) { t.report(stage, percent) }
+}
+
+// save writes the current progress. t.mu must be held.
+func (t *progressTracker) save() {
+	if err := t.cfg.db.SetProcessingProgress(t.videoID, t.stage, t.percent); err != nil {
+		log.Printf("Couldn't save processing progress of video %s: %v", t.videoID, err)
+	}
+}
+
+func (t *progressTracker) done() {
+	close(t.stop)
+	// Wait out a heartbeat that's mid-write so it can't bring the row back
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if err := t.cfg.db.ClearProcessingProgress(t.videoID); err != nil {
+		log.Printf("Couldn't clear processing progress of video %s: %v", t.videoID, err)
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// rateLimiter allows at most limit events per key within a sliding window.
+// State is kept in memory, so limits apply per app instance.
+type rateLimiter struct {
+	mu     sync.Mutex
+	limit  int
+	window time.Duration
+	events map[string][]time.Time
+}
+
+func newRateLimiter(limit int, window time.Duration) *rateLimiter {
+	return &rateLimiter{
+		limit:  limit,
+		window: window,
+		events: map[string][]time.Time{},
+	}
+}
+
+// allow records an event for key and reports whether it is within the limit.
+func (l *rateLimiter) allow(key string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	cutoff := now.Add(-l.window)
+	recent := l.events[key][:0]
+	for _, t := range l.events[key] {
+		if t.After(cutoff) {
+			recent = append(recent, t)
+		}
+	}
+	if len(recent) >= l.limit {
+		l.events[key] = recent
+		return false
+	}
+	l.events[key] = append(recent, now)
+
+	// Drop keys that have gone quiet so the map doesn't grow forever
+	if len(l.events) > 10000 {
+		for k, times := range l.events {
+			if len(times) == 0 || times[len(times)-1].Before(cutoff) {
+				delete(l.events, k)
+			}
+		}
+	}
+	return true
+}
+
+// clientIP returns the remote address of the request without the port.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
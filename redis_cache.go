@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// redisCacheTimeout bounds each cache call, so a slow Redis degrades to
+// cache misses instead of slowing requests down.
+const redisCacheTimeout = 250 * time.Millisecond
+
+const redisKeyPrefix = "tubely:"
+
+// redisCache implements database.Cache.
+type redisCache struct {
+	client *redis.Client
+	ttl    time.Duration
+}
+
+func newRedisCache(url string, ttl time.Duration) (*redisCache, error) {
+	opts, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, err
+	}
+	c := &redisCache{client: redis.NewClient(opts), ttl: ttl}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := c.client.Ping(ctx).Err(); err != nil {
+		// Keep going: requests fall back to the database until Redis is up
+		log.Printf("Redis cache isn't reachable yet: %v", err)
+	}
+	return c, nil
+}
+
+func (c *redisCache) Get(key string) ([]byte, bool) {
+	ctx, cancel := context.WithTimeout(context.Background(), redisCacheTimeout)
+	defer cancel()
+	data, err := c.client.Get(ctx, redisKeyPrefix+key).Bytes()
+	if err != nil {
+		if !errors.Is(err, redis.Nil) {
+			log.Printf("Couldn't read cache key %s: %v", key, err)
+		}
+		return nil, false
+	}
+	return data, true
+}
+
+func (c *redisCache) Set(key string, value []byte) {
+	ctx, cancel := context.WithTimeout(context.Background(), redisCacheTimeout)
+	defer cancel()
+	if err := c.client.Set(ctx, redisKeyPrefix+key, value, c.ttl).Err(); err != nil {
+		log.Printf("Couldn't write cache key %s: %v", key, err)
+	}
+}
+
+func (c *redisCache) Delete(keys ...string) {
+	if len(keys) == 0 {
+		return
+	}
+	prefixed := make([]string, len(keys))
+	for i, key := range keys {
+		prefixed[i] = redisKeyPrefix + key
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), redisCacheTimeout)
+	defer cancel()
+	if err := c.client.Del(ctx, prefixed...).Err(); err != nil {
+		log.Printf("Couldn't delete cache keys: %v", err)
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+type retryPolicy struct {
+	maxAttempts int
+	baseDelay   time.Duration
+	maxDelay    time.Duration
+}
+
+// do calls fn until it succeeds, returns a permanent error, or the policy
+// runs out of attempts. Delays grow exponentially from baseDelay with full
+// jitter and are capped at maxDelay.
+func (p retryPolicy) do(ctx context.Context, op string, fn func() error) error {
+	attempts := max(p.maxAttempts, 1)
+	var err error
+	for attempt := 1; ; attempt++ {
+		err = fn()
+		if err == nil || attempt >= attempts || !isRetryable(err) {
+			return err
+		}
+
+		delay := time.Duration(rand.Int64N(int64(p.backoff(attempt)) + 1))
+		log.Printf("%s failed (attempt %d/%d), retrying in %s: %v", op, attempt, attempts, delay, err)
+		metricRetries.Add(op, 1)
+
+		select {
+		case <-ctx.Done():
+			return errors.Join(err, ctx.Err())
+		case <-time.After(delay):
+		}
+	}
+}
+
+// backoff is the longest wait after the given failed attempt.
+func (p retryPolicy) backoff(attempt int) time.Duration {
+	// Cap the shift so large attempt counts can't overflow
+	return min(p.baseDelay<<min(attempt-1, 30), p.maxDelay)
+}
+
+// isRetryable treats cancellations and client errors as permanent. Other
+// errors, including throttling and 5XX responses, are retried.
+func isRetryable(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	// Saving the same stale copy again can't succeed
+	if errors.Is(err, database.ErrVideoConflict) {
+		return false
+	}
+	var respErr interface{ HTTPStatusCode() int }
+	if errors.As(err, &respErr) {
+		code := respErr.HTTPStatusCode()
+		return code >= 500 || code == http.StatusTooManyRequests || code == http.StatusRequestTimeout
+	}
+	return true
+}
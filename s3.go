@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+// Storage modes. local-s3 is for development against LocalStack or MinIO:
+// requests go path-style to a local endpoint with static credentials, the
+// bucket is created on startup, and video URLs point at the endpoint
+// rather than CloudFront.
+const (
+	storageModeAWS     = "aws"
+	storageModeLocalS3 = "local-s3"
+)
+
+// defaultLocalS3Endpoint is LocalStack's edge port.
+const defaultLocalS3Endpoint = "http://localhost:4566"
+
+// s3EndpointConfig picks where S3 requests go: the bucket's regional
+// endpoint by default, the Transfer Acceleration endpoint, or an
+// S3-compatible server such as LocalStack or MinIO. Presigned URLs follow
+// the same settings.
+type s3EndpointConfig struct {
+	baseURL       string
+	usePathStyle  bool
+	useAccelerate bool
+	// region overrides the region requests are signed for, for endpoints
+	// that expect a different one than the bucket's (MinIO wants us-east-1)
+	region string
+}
+
+func (c s3EndpointConfig) validate() error {
+	if c.useAccelerate && c.baseURL != "" {
+		return errors.New("transfer acceleration can't be used with a custom endpoint")
+	}
+	// Accelerated endpoints only exist for virtual-hosted style addressing
+	if c.useAccelerate && c.usePathStyle {
+		return errors.New("transfer acceleration can't be used with path-style addressing")
+	}
+	if c.baseURL != "" {
+		u, err := url.Parse(c.baseURL)
+		if err != nil || u.Scheme == "" || u.Host == "" {
+			return fmt.Errorf("endpoint %q isn't an absolute URL", c.baseURL)
+		}
+	}
+	return nil
+}
+
+func (c s3EndpointConfig) apply(o *s3.Options) {
+	if c.baseURL != "" {
+		o.BaseEndpoint = &c.baseURL
+	}
+	if c.region != "" {
+		o.Region = c.region
+	}
+	o.UsePathStyle = c.usePathStyle
+	o.UseAccelerate = c.useAccelerate
+}
+
+// objectURL is where clients fetch a public object in the bucket from.
+func (cfg *apiConfig) objectURL(key string) string {
+	return cfg.objectBaseURL + key
+}
+
+// ensureBucket creates the bucket if it doesn't exist yet, for local
+// S3 servers that start out empty.
+func (cfg *apiConfig) ensureBucket(ctx context.Context) error {
+	_, err := cfg.s3Client.HeadBucket(ctx, &s3.HeadBucketInput{Bucket: &cfg.s3Bucket})
+	var notFound *types.NotFound
+	if !errors.As(err, &notFound) {
+		return err
+	}
+	input := &s3.CreateBucketInput{Bucket: &cfg.s3Bucket}
+	// us-east-1 is the one region that mustn't be given as a constraint
+	if region := cfg.s3Client.Options().Region; region != "us-east-1" {
+		input.CreateBucketConfiguration = &types.CreateBucketConfiguration{
+			LocationConstraint: types.BucketLocationConstraint(region),
+		}
+	}
+	_, err = cfg.s3Client.CreateBucket(ctx, input)
+	return err
+}
+
+// videoObjectKey returns the S3 key of a video's file. Videos uploaded
+// before the key was stored fall back to the path of their CloudFront URL.
+func videoObjectKey(video database.Video) (string, bool) {
+	if video.VideoKey != nil && *video.VideoKey != "" {
+		return *video.VideoKey, true
+	}
+	if video.VideoURL == nil {
+		return "", false
+	}
+	u, err := url.Parse(*video.VideoURL)
+	if err != nil || u.Path == "" {
+		return "", false
+	}
+	return strings.TrimPrefix(u.Path, "/"), true
+}
+
+// videoDashPrefix returns the prefix a video's DASH manifest and segments
+// were uploaded under.
+func videoDashPrefix(video database.Video) (string, bool) {
+	if video.DashKey == nil || *video.DashKey == "" {
+		return "", false
+	}
+	return path.Dir(*video.DashKey) + "/", true
+}
+
+// deleteObjectsWithPrefix removes every object under prefix.
+func (cfg *apiConfig) deleteObjectsWithPrefix(ctx context.Context, prefix string) error {
+	paginator := s3.NewListObjectsV2Paginator(cfg.s3Client, &s3.ListObjectsV2Input{
+		Bucket: &cfg.s3Bucket,
+		Prefix: &prefix,
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return err
+		}
+		for _, obj := range page.Contents {
+			_, err := cfg.s3Client.DeleteObject(ctx, &s3.DeleteObjectInput{
+				Bucket: &cfg.s3Bucket,
+				Key:    obj.Key,
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// deleteVideoFiles removes the S3 objects and local thumbnails belonging to
+// a video. Missing files are not an error.
+func (cfg *apiConfig) deleteVideoFiles(ctx context.Context, video database.Video) error {
+	if key, ok := videoObjectKey(video); ok {
+		_, err := cfg.s3Client.DeleteObject(ctx, &s3.DeleteObjectInput{
+			Bucket: &cfg.s3Bucket,
+			Key:    &key,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if video.StagingKey != nil {
+		_, err := cfg.s3Client.DeleteObject(ctx, &s3.DeleteObjectInput{
+			Bucket: &cfg.s3Bucket,
+			Key:    video.StagingKey,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if prefix, ok := videoDashPrefix(video); ok {
+		if err := cfg.deleteObjectsWithPrefix(ctx, prefix); err != nil {
+			return err
+		}
+	}
+	if err := cfg.deleteObjectsWithPrefix(ctx, cfg.videoVersionsPrefix(video)); err != nil {
+		return err
+	}
+	if err := cfg.deleteObjectsWithPrefix(ctx, cfg.videoCaptionsPrefix(video)); err != nil {
+		return err
+	}
+	if err := cfg.discardProcessedUpload(ctx, video.ID); err != nil {
+		return err
+	}
+
+	for _, thumbnailURL := range []*string{video.ThumbnailURL, video.ThumbnailSourceURL, video.ThumbnailSquareURL} {
+		if thumbnailURL == nil {
+			continue
+		}
+		if err := cfg.removeLocalAsset(*thumbnailURL); err != nil {
+			return err
+		}
+	}
+	candidates, err := cfg.db.GetThumbnailCandidates(video.ID)
+	if err != nil {
+		return err
+	}
+	for _, c := range candidates {
+		if err := cfg.removeLocalAsset(c.URL); err != nil {
+			return err
+		}
+	}
+	return nil
+}
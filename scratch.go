@@ -0,0 +1,42 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"syscall"
+)
+
+// scratchSpaceFactor is how many times an upload's size it needs in the
+// scratch dir: the upload itself plus the fast-start copy made of it.
+const scratchSpaceFactor = 2
+
+var errScratchFull = errors.New("scratch dir is too full")
+
+// checkScratchSpace fails with errScratchFull if the scratch dir can't fit
+// an upload of size bytes through processing and still keep
+// cfg.scratchMinFree free. A negative size checks only the headroom. If
+// free space can't be read, the upload is let through.
+func (cfg *apiConfig) checkScratchSpace(size int64) error {
+	free, err := freeSpace(cfg.scratchDir)
+	if err != nil {
+		log.Printf("Couldn't check free space in %s: %v", cfg.scratchDir, err)
+		return nil
+	}
+	need := cfg.scratchMinFree + max(size, 0)*scratchSpaceFactor
+	if free < need {
+		return fmt.Errorf("%w: need %d bytes, %d free", errScratchFull, need, free)
+	}
+	return nil
+}
+
+// isScratchFull reports whether err is a failed space check or a write
+// that ran out of disk.
+func isScratchFull(err error) bool {
+	return errors.Is(err, errScratchFull) || errors.Is(err, syscall.ENOSPC)
+}
+
+func respondWithScratchFull(w http.ResponseWriter, err error) {
+	respondWithError(w, http.StatusInsufficientStorage, "Not enough disk space to take this upload right now", err)
+}
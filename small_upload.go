@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/media"
+)
+
+// smallUploadPool lends the buffers small uploads are held in instead of
+// a scratch file. Buffers are reused, and no more are lent at once than
+// fit in the configured memory; uploads that find none free go to disk.
+type smallUploadPool struct {
+	size  int64
+	slots chan struct{}
+	bufs  sync.Pool
+}
+
+// newSmallUploadPool returns a pool of size byte buffers using at most
+// memory bytes, or nil if small uploads go to disk like any other.
+func newSmallUploadPool(size, memory int64) *smallUploadPool {
+	if size <= 0 || memory < size {
+		return nil
+	}
+	p := &smallUploadPool{size: size, slots: make(chan struct{}, memory/size)}
+	p.bufs.New = func() any {
+		buf := make([]byte, size)
+		return &buf
+	}
+	return p
+}
+
+// get lends a buffer for an upload of n bytes, if it's small enough and
+// one is free. The caller gives it back with put.
+func (p *smallUploadPool) get(n int64) ([]byte, bool) {
+	if p == nil || n < 0 || n > p.size {
+		return nil, false
+	}
+	select {
+	case p.slots <- struct{}{}:
+	default:
+		return nil, false
+	}
+	return *p.bufs.Get().(*[]byte), true
+}
+
+func (p *smallUploadPool) put(buf []byte) {
+	buf = buf[:cap(buf)]
+	p.bufs.Put(&buf)
+	<-p.slots
+}
+
+// mediaInput is a video being processed, in the file at path or, for
+// small uploads, held in data.
+type mediaInput struct {
+	path string
+	data []byte
+}
+
+// probe runs ffprobe on the video, over a pipe if it's in memory.
+func (cfg *apiConfig) probe(ctx context.Context, in mediaInput) (media.Info, error) {
+	if in.data != nil {
+		return cfg.prober.ProbeStream(ctx, bytes.NewReader(in.data))
+	}
+	return cfg.prober.Probe(ctx, in.path)
+}
+
+// spillToScratch writes data to a scratch file and returns its path, for
+// when a video held in memory needs to be on disk after all. The caller
+// removes it.
+func (cfg *apiConfig) spillToScratch(data []byte) (string, error) {
+	if err := cfg.checkScratchSpace(int64(len(data))); err != nil {
+		return "", err
+	}
+	f, err := os.CreateTemp(cfg.scratchDir, "tubely-video-upload.mp4")
+	if err != nil {
+		return "", err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return "", err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+// putObjectBytes uploads data as the object in describes, retrying as op.
+func (cfg *apiConfig) putObjectBytes(ctx context.Context, op string, in *s3.PutObjectInput, data []byte, sum fileChecksum) error {
+	cfg.withChecksum(in, sum)
+	return cfg.retry.do(ctx, op, func() error {
+		in.Body = bytes.NewReader(data)
+		_, err := cfg.s3Client.PutObject(ctx, in)
+		return err
+	})
+}
+
+// runSmallVideoPipeline is runVideoPipeline for a video held in memory.
+// It's remuxed by piping it through ffmpeg, which can't go back to put
+// the index at the front of a plain MP4, so it writes a fragmented one
+// instead. Videos ffmpeg can't read from a pipe, such as ones with their
+// index at the end, and ones that need more than a remux, such as HDR
+// ones that are tone-mapped, are written to disk and take the full
+// pipeline. Small videos aren't packaged for DASH, since the MP4 starts
+// quickly enough.
+func (cfg *apiConfig) runSmallVideoPipeline(ctx context.Context, dbVideo database.Video, in mediaInput, mediaType string, storageClass types.StorageClass, progress *progressTracker) (database.Video, error) {
+	// MediaConvert works from the staged original, so it only needs the
+	// copy in memory for thumbnails and captions
+	if _, ok := cfg.transcoder.(ffmpegTranscoder); !ok {
+		return cfg.runVideoPipeline(ctx, dbVideo, in, mediaType, storageClass, progress)
+	}
+	spill := func() (database.Video, error) {
+		path, err := cfg.spillToScratch(in.data)
+		if err != nil {
+			return database.Video{}, &pipelineError{"spill", http.StatusInternalServerError, "Couldn't write video to disk", err}
+		}
+		defer os.Remove(path)
+		return cfg.runVideoPipeline(ctx, dbVideo, mediaInput{path: path}, mediaType, storageClass, progress)
+	}
+	if dbVideo.Encrypted {
+		return spill()
+	}
+
+	probe, err := cfg.probeVideo(ctx, in)
+	if err != nil && ctx.Err() != nil {
+		return database.Video{}, err
+	}
+	if err != nil {
+		log.Printf("Couldn't probe video %s from memory, processing it on disk: %v", dbVideo.ID, err)
+		return spill()
+	}
+	if probe.hdrFormat != "" {
+		return spill()
+	}
+
+	progress.report(progressTranscoding, 0)
+	processed, err := cfg.fastStartStream(ctx, in.data)
+	if err != nil && ctx.Err() != nil {
+		return database.Video{}, &pipelineError{"transcode", http.StatusInternalServerError, "Couldn't process video for fast start", err}
+	}
+	if err != nil {
+		log.Printf("Couldn't remux video %s in memory, processing it on disk: %v", dbVideo.ID, err)
+		return spill()
+	}
+
+	objName := cfg.processedVideoKey(dbVideo, probe.aspectRatio)
+	checksum := newChecksummer()
+	checksum.Write(processed)
+	sum := checksum.sum()
+	err = cfg.putObjectBytes(ctx, "s3_put_object", &s3.PutObjectInput{
+		Bucket:       &cfg.s3Bucket,
+		Key:          &objName,
+		ContentType:  &mediaType,
+		StorageClass: storageClass,
+	}, processed, sum)
+	if err != nil {
+		return database.Video{}, &pipelineError{"s3_upload", http.StatusInternalServerError, "Couldn't upload to S3", err}
+	}
+	return cfg.finishVideoPipeline(ctx, dbVideo, mediaInput{data: processed}, storageClass, objName, probe, transcodeResult{checksum: &sum})
+}
+
+// fastStartStream remuxes data with ffmpeg once a transcode slot is free,
+// returning the fragmented MP4 it writes.
+func (cfg *apiConfig) fastStartStream(ctx context.Context, data []byte) ([]byte, error) {
+	releaseSlot, err := cfg.transcodes.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer releaseSlot()
+
+	ffmpegCtx, cancelFFmpeg := context.WithTimeout(ctx, cfg.ffmpegTimeout)
+	defer cancelFFmpeg()
+	var out bytes.Buffer
+	out.Grow(len(data))
+	if err := cfg.mediaTranscoder.FastStartStream(ffmpegCtx, bytes.NewReader(data), &out); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
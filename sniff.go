@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+)
+
+// sniffLen is how many leading bytes are needed to identify a file.
+const sniffLen = 512
+
+// sniffVideoType identifies a video container from its leading bytes.
+// It returns "" when the data isn't a recognised video format.
+func sniffVideoType(head []byte) string {
+	switch {
+	// ISO base media files (MP4, MOV) start with a box whose type is "ftyp"
+	case len(head) >= 12 && bytes.Equal(head[4:8], []byte("ftyp")):
+		if bytes.Equal(head[8:12], []byte("qt  ")) {
+			return "video/quicktime"
+		}
+		return "video/mp4"
+	// Matroska and WebM share the EBML header
+	case bytes.HasPrefix(head, []byte{0x1A, 0x45, 0xDF, 0xA3}):
+		return "video/webm"
+	case len(head) >= 12 && bytes.HasPrefix(head, []byte("RIFF")) && bytes.Equal(head[8:12], []byte("AVI ")):
+		return "video/x-msvideo"
+	default:
+		return ""
+	}
+}
+
+// sniffImageType identifies an image format from its leading bytes using
+// the standard library's content sniffer, returning "" for non-images.
+// AVIF, which the sniffer doesn't know, is an ISO BMFF file like MP4 with
+// its own brand.
+func sniffImageType(head []byte) string {
+	if len(head) >= 12 && bytes.Equal(head[4:8], []byte("ftyp")) {
+		switch string(head[8:12]) {
+		case "avif", "avis":
+			return "image/avif"
+		}
+	}
+	contentType := http.DetectContentType(head)
+	switch contentType {
+	case "image/jpeg", "image/png", "image/gif", "image/webp":
+		return contentType
+	default:
+		return ""
+	}
+}
+
+// readHead reads up to sniffLen bytes from the start of r.
+func readHead(r io.ReaderAt) ([]byte, error) {
+	head := make([]byte, sniffLen)
+	n, err := r.ReadAt(head, 0)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	return head[:n], nil
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/google/uuid"
+)
+
+// recognizeJob is the audio of one video for a speech recognizer to
+// transcribe.
+type recognizeJob struct {
+	videoID uuid.UUID
+	// workPrefix is where in the bucket the recognizer may keep files
+	// while it works
+	workPrefix string
+	// audioPath is a local 16 kHz mono WAV file
+	audioPath string
+	// language is the spoken language's tag, empty to detect it
+	language string
+}
+
+// speechRecognizer is a speech-to-text backend for automatic captions.
+type speechRecognizer interface {
+	recognize(ctx context.Context, job recognizeJob) (transcript, error)
+}
+
+type speechRecognizerConfig struct {
+	awsConfig aws.Config
+	region    string
+	// endpoint overrides Transcribe's regional endpoint
+	endpoint     string
+	pollInterval time.Duration
+	// whisperPath is the whisper command, and whisperArgs go before the
+	// arguments the server adds, for options such as "--model small"
+	whisperPath string
+	whisperArgs []string
+}
+
+// newSpeechRecognizer returns the named backend, or nil if backend is
+// empty and automatic captions are off.
+func newSpeechRecognizer(cfg *apiConfig, backend string, sc speechRecognizerConfig) (speechRecognizer, error) {
+	switch backend {
+	case "":
+		return nil, nil
+	case "transcribe":
+		return &awsTranscribeRecognizer{
+			cfg:          cfg,
+			api:          newAWSJSONClient(sc.awsConfig, "transcribe", sc.region, sc.endpoint),
+			pollInterval: sc.pollInterval,
+		}, nil
+	case "whisper":
+		return whisperRecognizer{cfg: cfg, path: sc.whisperPath, args: sc.whisperArgs}, nil
+	default:
+		return nil, fmt.Errorf("unknown captions backend %q, want transcribe or whisper", backend)
+	}
+}
+
+// awsTranscribeRecognizer uploads the audio next to the video's captions
+// and runs an Amazon Transcribe job on it, which writes its results back
+// to the bucket. The audio and results are deleted once read.
+type awsTranscribeRecognizer struct {
+	cfg          *apiConfig
+	api          awsJSONClient
+	pollInterval time.Duration
+}
+
+type transcribeJob struct {
+	TranscriptionJobName   string `json:"TranscriptionJobName"`
+	TranscriptionJobStatus string `json:"TranscriptionJobStatus"`
+	LanguageCode           string `json:"LanguageCode"`
+	FailureReason          string `json:"FailureReason"`
+}
+
+// transcribeResults is the part of Transcribe's output captions are
+// made from.
+type transcribeResults struct {
+	Results struct {
+		Items []struct {
+			Type         string `json:"type"`
+			StartTime    string `json:"start_time"`
+			EndTime      string `json:"end_time"`
+			Alternatives []struct {
+				Content string `json:"content"`
+			} `json:"alternatives"`
+		} `json:"items"`
+	} `json:"results"`
+}
+
+func (t *awsTranscribeRecognizer) call(ctx context.Context, op string, in, out any) error {
+	return t.cfg.retry.do(ctx, "transcribe_"+op, func() error {
+		return t.api.do(ctx, http.MethodPost, "/", map[string]string{
+			"Content-Type": "application/x-amz-json-1.1",
+			"X-Amz-Target": "Transcribe." + op,
+		}, in, out)
+	})
+}
+
+func (t *awsTranscribeRecognizer) recognize(ctx context.Context, job recognizeJob) (transcript, error) {
+	cfg := t.cfg
+	name := fmt.Sprintf("tubely-%s-%d", job.videoID, time.Now().Unix())
+	audioKey := job.workPrefix + name + ".wav"
+	resultsKey := job.workPrefix + name + ".json"
+	defer func() {
+		for _, key := range []string{audioKey, resultsKey} {
+			_, err := cfg.s3Client.DeleteObject(context.Background(), &s3.DeleteObjectInput{
+				Bucket: &cfg.s3Bucket,
+				Key:    &key,
+			})
+			if err != nil {
+				log.Printf("Couldn't delete transcription file %s: %v", key, err)
+			}
+		}
+	}()
+
+	contentType := "audio/wav"
+	err := cfg.retry.do(ctx, "s3_put_object", func() error {
+		f, err := os.Open(job.audioPath)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = cfg.s3Client.PutObject(ctx, &s3.PutObjectInput{
+			Bucket:      &cfg.s3Bucket,
+			Key:         &audioKey,
+			ContentType: &contentType,
+			Body:        f,
+		})
+		return err
+	})
+	if err != nil {
+		return transcript{}, fmt.Errorf("couldn't upload audio: %w", err)
+	}
+
+	start := map[string]any{
+		"TranscriptionJobName": name,
+		"Media":                map[string]any{"MediaFileUri": "s3://" + cfg.s3Bucket + "/" + audioKey},
+		"MediaFormat":          "wav",
+		"OutputBucketName":     cfg.s3Bucket,
+		"OutputKey":            resultsKey,
+	}
+	if job.language != "" {
+		start["LanguageCode"] = job.language
+	} else {
+		start["IdentifyLanguage"] = true
+	}
+	if err := t.call(ctx, "StartTranscriptionJob", start, nil); err != nil {
+		return transcript{}, fmt.Errorf("couldn't start transcription job: %w", err)
+	}
+	log.Printf("Started transcription job %s for video %s", name, job.videoID)
+	defer func() {
+		err := t.call(context.Background(), "DeleteTranscriptionJob", map[string]string{"TranscriptionJobName": name}, nil)
+		if err != nil {
+			log.Printf("Couldn't delete transcription job %s: %v", name, err)
+		}
+	}()
+
+	done, err := t.wait(ctx, name)
+	if err != nil {
+		return transcript{}, err
+	}
+
+	obj, err := cfg.s3Client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: &cfg.s3Bucket,
+		Key:    &resultsKey,
+	})
+	if err != nil {
+		return transcript{}, fmt.Errorf("couldn't get transcription results: %w", err)
+	}
+	defer obj.Body.Close()
+	var results transcribeResults
+	if err := json.NewDecoder(obj.Body).Decode(&results); err != nil {
+		return transcript{}, fmt.Errorf("couldn't decode transcription results: %w", err)
+	}
+
+	var words []captionWord
+	for _, item := range results.Results.Items {
+		if len(item.Alternatives) == 0 {
+			continue
+		}
+		content := item.Alternatives[0].Content
+		if item.Type == "punctuation" {
+			if len(words) > 0 {
+				words[len(words)-1].text += content
+			}
+			continue
+		}
+		start, err1 := strconv.ParseFloat(item.StartTime, 64)
+		end, err2 := strconv.ParseFloat(item.EndTime, 64)
+		if err1 != nil || err2 != nil {
+			continue
+		}
+		words = append(words, captionWord{start: start, end: end, text: content})
+	}
+	return transcript{language: done.LanguageCode, cues: wordsToCues(words)}, nil
+}
+
+// wait polls the job until it's finished.
+func (t *awsTranscribeRecognizer) wait(ctx context.Context, name string) (transcribeJob, error) {
+	ticker := time.NewTicker(t.pollInterval)
+	defer ticker.Stop()
+	for {
+		var out struct {
+			TranscriptionJob transcribeJob `json:"TranscriptionJob"`
+		}
+		err := t.call(ctx, "GetTranscriptionJob", map[string]string{"TranscriptionJobName": name}, &out)
+		if err != nil {
+			return transcribeJob{}, fmt.Errorf("couldn't get transcription job: %w", err)
+		}
+		switch job := out.TranscriptionJob; job.TranscriptionJobStatus {
+		case "COMPLETED":
+			return job, nil
+		case "FAILED":
+			return transcribeJob{}, fmt.Errorf("transcription job %s failed: %s", name, job.FailureReason)
+		}
+
+		select {
+		case <-ctx.Done():
+			return transcribeJob{}, ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// whisperRecognizer runs OpenAI's whisper command on the server, in a
+// transcode slot since it's as heavy as any transcode.
+type whisperRecognizer struct {
+	cfg  *apiConfig
+	path string
+	args []string
+}
+
+// whisperResults is the JSON whisper writes with --output_format json.
+type whisperResults struct {
+	Language string `json:"language"`
+	Segments []struct {
+		Start float64 `json:"start"`
+		End   float64 `json:"end"`
+		Text  string  `json:"text"`
+	} `json:"segments"`
+}
+
+func (w whisperRecognizer) recognize(ctx context.Context, job recognizeJob) (transcript, error) {
+	releaseSlot, err := w.cfg.transcodes.acquire(ctx)
+	if err != nil {
+		return transcript{}, err
+	}
+	defer releaseSlot()
+
+	dir, err := os.MkdirTemp(w.cfg.scratchDir, tempFilePrefix+"whisper")
+	if err != nil {
+		return transcript{}, err
+	}
+	defer os.RemoveAll(dir)
+
+	args := append([]string{}, w.args...)
+	args = append(args, "--output_format", "json", "--output_dir", dir)
+	if job.language != "" {
+		args = append(args, "--language", job.language)
+	}
+	args = append(args, job.audioPath)
+	cmd := exec.CommandContext(ctx, w.path, args...)
+	cmd.WaitDelay = 5 * time.Second
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			err = ctxErr
+		}
+		out := stderr.Bytes()
+		if len(out) > 2048 {
+			out = out[len(out)-2048:]
+		}
+		return transcript{}, fmt.Errorf("whisper failed: %w: %s", err, bytes.TrimSpace(out))
+	}
+
+	// whisper names its output after the input file
+	name := strings.TrimSuffix(filepath.Base(job.audioPath), filepath.Ext(job.audioPath)) + ".json"
+	f, err := os.Open(filepath.Join(dir, name))
+	if err != nil {
+		return transcript{}, fmt.Errorf("couldn't find whisper output: %w", err)
+	}
+	defer f.Close()
+	var results whisperResults
+	if err := json.NewDecoder(io.LimitReader(f, 64<<20)).Decode(&results); err != nil {
+		return transcript{}, fmt.Errorf("couldn't decode whisper output: %w", err)
+	}
+
+	t := transcript{language: job.language}
+	if t.language == "" {
+		t.language = results.Language
+	}
+	for _, s := range results.Segments {
+		if strings.TrimSpace(s.Text) == "" {
+			continue
+		}
+		t.cues = append(t.cues, captionCue{start: s.Start, end: s.End, text: strings.TrimSpace(s.Text)})
+	}
+	return t, nil
+}
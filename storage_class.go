@@ -0,0 +1,28 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// allowedStorageClasses are the S3 storage classes uploads may opt into.
+// Archive tiers that need a restore before reads (GLACIER, DEEP_ARCHIVE)
+// are excluded because CloudFront can't serve them directly.
+var allowedStorageClasses = []types.StorageClass{
+	types.StorageClassStandard,
+	types.StorageClassStandardIa,
+	types.StorageClassIntelligentTiering,
+	types.StorageClassGlacierIr,
+}
+
+func parseStorageClass(s string) (types.StorageClass, error) {
+	s = strings.ToUpper(strings.TrimSpace(s))
+	for _, class := range allowedStorageClasses {
+		if string(class) == s {
+			return class, nil
+		}
+	}
+	return "", fmt.Errorf("unsupported storage class %q", s)
+}
@@ -0,0 +1,452 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// storageClassLocal is the class reported for thumbnails, which are kept
+// on the app's disk rather than in the bucket.
+const storageClassLocal = "LOCAL"
+
+// Categories usage is broken down by. Video files are filed under the
+// orientation prefix they were uploaded to.
+const (
+	usageLandscape  = "landscape"
+	usagePortrait   = "portrait"
+	usageOther      = "other"
+	usageRenditions = "renditions"
+	usageThumbnails = "thumbnails"
+	usageOriginals  = "originals"
+	usageVersions   = "versions"
+	usageExports    = "exports"
+	usageUploads    = "uploads"
+)
+
+// usageTopUsers is how many users the admin report lists by default.
+const usageTopUsers = 50
+
+// bytesPerGB is the gigabyte S3 bills storage by.
+const bytesPerGB = 1 << 30
+
+// storagePrices is what a GB-month costs in each storage class, in USD.
+type storagePrices map[string]float64
+
+// defaultStoragePrices are S3's us-east-1 list prices.
+var defaultStoragePrices = storagePrices{
+	string(types.StorageClassStandard):           0.023,
+	string(types.StorageClassStandardIa):         0.0125,
+	string(types.StorageClassOnezoneIa):          0.01,
+	string(types.StorageClassIntelligentTiering): 0.023,
+	string(types.StorageClassGlacierIr):          0.004,
+	string(types.StorageClassGlacier):            0.0036,
+	string(types.StorageClassDeepArchive):        0.00099,
+	storageClassLocal:                            0,
+}
+
+// parseStoragePrices reads a price table like "STANDARD=0.023,GLACIER_IR=0.004"
+// over the defaults, so only the prices that differ need setting.
+func parseStoragePrices(entries []string) (storagePrices, error) {
+	prices := storagePrices{}
+	for class, price := range defaultStoragePrices {
+		prices[class] = price
+	}
+	for _, entry := range entries {
+		class, v, ok := strings.Cut(entry, "=")
+		if !ok {
+			return nil, fmt.Errorf("price %q isn't CLASS=USD", entry)
+		}
+		price, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+		if err != nil || price < 0 {
+			return nil, fmt.Errorf("invalid price for %s: %q", class, v)
+		}
+		prices[strings.ToUpper(strings.TrimSpace(class))] = price
+	}
+	return prices, nil
+}
+
+// monthlyCost estimates what storing bytes in class costs a month, and
+// whether the class has a price at all.
+func (p storagePrices) monthlyCost(class string, bytes int64) (float64, bool) {
+	price, ok := p[class]
+	return float64(bytes) / bytesPerGB * price, ok
+}
+
+type usageTotal struct {
+	Objects     int     `json:"objects"`
+	Bytes       int64   `json:"bytes"`
+	MonthlyCost float64 `json:"monthly_cost"`
+}
+
+func (t *usageTotal) add(bytes int64, cost float64) {
+	t.Objects++
+	t.Bytes += bytes
+	t.MonthlyCost += cost
+}
+
+type usageBreakdown struct {
+	usageTotal
+	ByCategory     map[string]usageTotal `json:"by_category"`
+	ByStorageClass map[string]usageTotal `json:"by_storage_class"`
+}
+
+func newUsageBreakdown() *usageBreakdown {
+	return &usageBreakdown{ByCategory: map[string]usageTotal{}, ByStorageClass: map[string]usageTotal{}}
+}
+
+func (b *usageBreakdown) add(category, class string, bytes int64, cost float64) {
+	b.usageTotal.add(bytes, cost)
+	t := b.ByCategory[category]
+	t.add(bytes, cost)
+	b.ByCategory[category] = t
+	t = b.ByStorageClass[class]
+	t.add(bytes, cost)
+	b.ByStorageClass[class] = t
+}
+
+type userUsage struct {
+	UserID uuid.UUID `json:"user_id"`
+	*usageBreakdown
+}
+
+// usageReport is everything the app stores, with an estimate of what it
+// costs a month at the configured prices.
+type usageReport struct {
+	GeneratedAt time.Time `json:"generated_at"`
+	Currency    string    `json:"currency"`
+	*usageBreakdown
+	// Unattributed is in objects no user owns, such as replaced files
+	// waiting for deletion and orphans.
+	Unattributed *usageBreakdown `json:"unattributed"`
+	// UnpricedClasses are storage classes found without a price, which
+	// count as free in the estimate.
+	UnpricedClasses []string    `json:"unpriced_classes"`
+	Users           []userUsage `json:"users"`
+
+	byUser map[uuid.UUID]*usageBreakdown
+}
+
+// forUser returns a user's share of the report, empty if they store nothing.
+func (r *usageReport) forUser(userID uuid.UUID) userUsage {
+	if b, ok := r.byUser[userID]; ok {
+		return userUsage{userID, b}
+	}
+	return userUsage{userID, newUsageBreakdown()}
+}
+
+// storageUsageCache holds the last report so users can check their usage
+// without the bucket being listed each time.
+type storageUsageCache struct {
+	// building is held while a report is built, so concurrent requests
+	// wait for the same listing instead of starting their own
+	building sync.Mutex
+
+	mu     sync.Mutex
+	report *usageReport
+}
+
+// storageUsage returns the last report, building one first if there
+// isn't one yet or refresh is set.
+func (cfg *apiConfig) storageUsage(ctx context.Context, refresh bool) (*usageReport, error) {
+	c := cfg.storageUsageCache
+	c.mu.Lock()
+	last := c.report
+	c.mu.Unlock()
+	if last != nil && !refresh {
+		return last, nil
+	}
+
+	c.building.Lock()
+	defer c.building.Unlock()
+	// Another request may have built one while this one waited
+	c.mu.Lock()
+	report := c.report
+	c.mu.Unlock()
+	if report != last {
+		return report, nil
+	}
+	report, err := cfg.buildUsageReport(ctx)
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	c.report = report
+	c.mu.Unlock()
+	return report, nil
+}
+
+// refreshStorageUsage rebuilds the cached report in the background, and
+// warns users who are storing too much.
+func (cfg *apiConfig) refreshStorageUsage(ctx context.Context) error {
+	report, err := cfg.storageUsage(ctx, true)
+	if err != nil {
+		return err
+	}
+	cfg.warnStorageQuotas(report)
+	return nil
+}
+
+// buildUsageReport lists the bucket and the thumbnails on disk and adds
+// them up by owner, category and storage class.
+func (cfg *apiConfig) buildUsageReport(ctx context.Context) (*usageReport, error) {
+	owners, videos, err := cfg.loadObjectOwners()
+	if err != nil {
+		return nil, err
+	}
+
+	report := &usageReport{
+		GeneratedAt:     time.Now().UTC(),
+		Currency:        "USD",
+		usageBreakdown:  newUsageBreakdown(),
+		Unattributed:    newUsageBreakdown(),
+		Users:           []userUsage{},
+		UnpricedClasses: []string{},
+		byUser:          map[uuid.UUID]*usageBreakdown{},
+	}
+	unpriced := map[string]bool{}
+	add := func(owner uuid.UUID, owned bool, category, class string, bytes int64) {
+		cost, ok := cfg.storagePrices.monthlyCost(class, bytes)
+		if !ok {
+			unpriced[class] = true
+		}
+		report.add(category, class, bytes, cost)
+		if !owned {
+			report.Unattributed.add(category, class, bytes, cost)
+			return
+		}
+		b, ok := report.byUser[owner]
+		if !ok {
+			b = newUsageBreakdown()
+			report.byUser[owner] = b
+		}
+		b.add(category, class, bytes, cost)
+	}
+
+	paginator := s3.NewListObjectsV2Paginator(cfg.s3Client, &s3.ListObjectsV2Input{
+		Bucket: &cfg.s3Bucket,
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, obj := range page.Contents {
+			if obj.Key == nil {
+				continue
+			}
+			var size int64
+			if obj.Size != nil {
+				size = *obj.Size
+			}
+			// Listings leave the class out for STANDARD on some
+			// S3-compatible stores
+			class := string(obj.StorageClass)
+			if class == "" {
+				class = string(types.StorageClassStandard)
+			}
+			owner, owned := owners.owner(*obj.Key)
+			add(owner, owned, cfg.usageCategory(*obj.Key), class, size)
+		}
+	}
+
+	for _, video := range videos {
+		for _, assetURL := range []*string{video.ThumbnailURL, video.ThumbnailSourceURL, video.ThumbnailSquareURL} {
+			if assetURL == nil {
+				continue
+			}
+			size, err := cfg.localAssetSize(*assetURL)
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			add(video.UserID, true, usageThumbnails, storageClassLocal, size)
+		}
+	}
+
+	for userID, b := range report.byUser {
+		report.Users = append(report.Users, userUsage{userID, b})
+	}
+	slices.SortFunc(report.Users, func(a, b userUsage) int {
+		switch {
+		case a.Bytes > b.Bytes:
+			return -1
+		case a.Bytes < b.Bytes:
+			return 1
+		}
+		return strings.Compare(a.UserID.String(), b.UserID.String())
+	})
+	for class := range unpriced {
+		report.UnpricedClasses = append(report.UnpricedClasses, class)
+	}
+	slices.Sort(report.UnpricedClasses)
+	return report, nil
+}
+
+// usageCategory files an object by what it's for, from its key alone.
+// Keys are read past the video's key prefix, and processed files by the
+// aspect in their key if the template has one.
+func (cfg *apiConfig) usageCategory(key string) string {
+	if strings.HasPrefix(key, cfg.s3ExportsPrefix) {
+		return usageExports
+	}
+	key, _ = cfg.keyPrefixTemplate.trimPrefix(key)
+	switch {
+	case strings.HasPrefix(key, cfg.s3StagingPrefix):
+		return usageOriginals
+	case strings.HasPrefix(key, cfg.s3VersionsPrefix):
+		return usageVersions
+	case strings.HasPrefix(key, cfg.s3DirectUploadPrefix):
+		return usageUploads
+	// DASH packages sit next to the MP4 they were cut from
+	case strings.Contains(key, "/dash/"):
+		return usageRenditions
+	}
+	if vars, ok := cfg.videoKeyTemplate.match(key); ok {
+		switch vars[keyVarAspect] {
+		case usageLandscape:
+			return usageLandscape
+		case usagePortrait:
+			return usagePortrait
+		}
+	}
+	return usageOther
+}
+
+// localAssetSize is the size of the file behind an /assets/ URL.
+func (cfg *apiConfig) localAssetSize(assetURL string) (int64, error) {
+	f, err := cfg.openLocalAsset(assetURL)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+// objectOwners finds the user an object in the bucket belongs to.
+// Objects are owned by exact key, or by the directory they're in for
+// DASH segments, versions and direct uploads.
+type objectOwners struct {
+	cfg  *apiConfig
+	keys map[string]uuid.UUID
+	dirs map[string]uuid.UUID
+}
+
+// loadObjectOwners maps every video's objects to its owner, and returns
+// the videos too.
+func (cfg *apiConfig) loadObjectOwners() (objectOwners, []database.Video, error) {
+	owners := objectOwners{cfg: cfg, keys: map[string]uuid.UUID{}, dirs: map[string]uuid.UUID{}}
+	videos, _, err := cfg.db.GetAllVideos(database.Page{})
+	if err != nil {
+		return owners, nil, err
+	}
+	for _, video := range videos {
+		if key, ok := videoObjectKey(video); ok {
+			owners.keys[key] = video.UserID
+		}
+		if video.StagingKey != nil {
+			owners.keys[*video.StagingKey] = video.UserID
+		}
+		if prefix, ok := videoDashPrefix(video); ok {
+			owners.dirs[prefix] = video.UserID
+		}
+		owners.dirs[cfg.videoVersionsPrefix(video)] = video.UserID
+		owners.dirs[cfg.directUploadPrefix(video)] = video.UserID
+	}
+	return owners, videos, nil
+}
+
+func (o objectOwners) owner(key string) (uuid.UUID, bool) {
+	if owner, ok := o.keys[key]; ok {
+		return owner, true
+	}
+	if owner, ok := o.dirs[path.Dir(key)+"/"]; ok {
+		return owner, true
+	}
+	return o.cfg.exportOwner(key)
+}
+
+// handlerAdminStorageUsage reports what the app stores and what it costs
+// by category, storage class and user. The report is rebuilt
+// periodically; ?refresh=true rebuilds it now, which lists the whole
+// bucket. ?limit caps how many of the biggest users are listed.
+func (cfg *apiConfig) handlerAdminStorageUsage(w http.ResponseWriter, r *http.Request) {
+	if err := cfg.authorizeAdmin(r); err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't authorize admin", err)
+		return
+	}
+
+	refresh := false
+	if v := r.URL.Query().Get("refresh"); v != "" {
+		var err error
+		refresh, err = strconv.ParseBool(v)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid refresh value", err)
+			return
+		}
+	}
+	limit := usageTopUsers
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			respondWithError(w, http.StatusBadRequest, "Invalid limit", err)
+			return
+		}
+		limit = n
+	}
+
+	report, err := cfg.storageUsage(r.Context(), refresh)
+	if err != nil {
+		respondWithError(w, http.StatusBadGateway, "Couldn't build storage usage report", err)
+		return
+	}
+	resp := *report
+	if len(resp.Users) > limit {
+		resp.Users = resp.Users[:limit]
+	}
+	respondWithJSON(w, http.StatusOK, resp)
+}
+
+// handlerUserStorageUsage reports the caller's share of the last storage
+// usage report.
+func (cfg *apiConfig) handlerUserStorageUsage(w http.ResponseWriter, r *http.Request) {
+	type response struct {
+		GeneratedAt time.Time `json:"generated_at"`
+		Currency    string    `json:"currency"`
+		*usageBreakdown
+	}
+
+	userID, ok := cfg.authenticate(w, r)
+	if !ok {
+		return
+	}
+	report, err := cfg.storageUsage(r.Context(), false)
+	if err != nil {
+		respondWithError(w, http.StatusBadGateway, "Couldn't build storage usage report", err)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, response{
+		GeneratedAt:    report.GeneratedAt,
+		Currency:       report.Currency,
+		usageBreakdown: report.forUser(userID).usageBreakdown,
+	})
+}
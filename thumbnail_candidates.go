@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+// generateThumbnailCandidates extracts cfg.thumbnailCandidates frames
+// spread evenly through the video and saves them as the video's
+// candidates, replacing any earlier ones.
+func (cfg *apiConfig) generateThumbnailCandidates(ctx context.Context, video database.Video, in mediaInput) ([]database.ThumbnailCandidate, error) {
+	if cfg.thumbnailCandidates <= 0 {
+		return nil, nil
+	}
+
+	releaseSlot, err := cfg.transcodes.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer releaseSlot()
+	ctx, cancel := context.WithTimeout(ctx, cfg.ffmpegTimeout)
+	defer cancel()
+
+	info, err := cfg.probe(ctx, in)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't probe video: %w", err)
+	}
+	if info.Duration <= 0 {
+		return nil, errors.New("video duration unknown")
+	}
+
+	// Frames of a video held in memory come back over a pipe instead
+	var dir string
+	if in.data == nil {
+		dir, err = os.MkdirTemp(cfg.scratchDir, "tubely-frames")
+		if err != nil {
+			return nil, err
+		}
+		defer os.RemoveAll(dir)
+	}
+
+	urls := make([]string, 0, cfg.thumbnailCandidates)
+	for i := 1; i <= cfg.thumbnailCandidates; i++ {
+		// Skip the very start and end, which are often black
+		at := info.Duration * float64(i) / float64(cfg.thumbnailCandidates+1)
+		frame, err := cfg.extractFrame(ctx, in, dir, i, at)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't extract frame at %.2fs: %w", at, err)
+		}
+		url, err := cfg.saveImageAsset(frame, "image/jpeg")
+		frame.Close()
+		if err != nil {
+			return nil, err
+		}
+		urls = append(urls, url)
+	}
+
+	old, err := cfg.db.GetThumbnailCandidates(video.ID)
+	if err != nil {
+		return nil, err
+	}
+	candidates, err := cfg.db.ReplaceThumbnailCandidates(video.ID, urls)
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range old {
+		// A picked candidate stays on as the thumbnail source
+		if video.ThumbnailSourceURL != nil && *video.ThumbnailSourceURL == c.URL {
+			continue
+		}
+		if err := cfg.removeLocalAsset(c.URL); err != nil {
+			log.Printf("Couldn't remove old thumbnail candidate %s: %v", c.URL, err)
+		}
+	}
+	return candidates, nil
+}
+
+// extractFrame returns the JPEG of the frame at the given time, written
+// to dir as the ith frame if the video is on disk.
+func (cfg *apiConfig) extractFrame(ctx context.Context, in mediaInput, dir string, i int, at float64) (io.ReadCloser, error) {
+	if in.data != nil {
+		var frame bytes.Buffer
+		if err := cfg.mediaTranscoder.ExtractFrameStream(ctx, bytes.NewReader(in.data), at, &frame); err != nil {
+			return nil, err
+		}
+		return io.NopCloser(&frame), nil
+	}
+	framePath := filepath.Join(dir, fmt.Sprintf("%d.jpg", i))
+	if err := cfg.mediaTranscoder.ExtractFrame(ctx, in.path, at, framePath); err != nil {
+		return nil, err
+	}
+	return os.Open(framePath)
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/gif"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"golang.org/x/image/draw"
+)
+
+// thumbnailVariant is a framing of the thumbnail source generated on
+// upload. Images smaller than the variant aren't scaled up.
+type thumbnailVariant struct {
+	width, height int
+}
+
+var (
+	thumbnailCard   = thumbnailVariant{1280, 720}
+	thumbnailSquare = thumbnailVariant{512, 512}
+)
+
+// defaultThumbnailCrop uses the whole image, framed around its center.
+var defaultThumbnailCrop = database.ThumbnailCrop{FocalX: 0.5, FocalY: 0.5}
+
+// thumbnailCropParams are the optional crop and focal point fields of a
+// thumbnail upload or re-crop. Left out, the whole image is used with the
+// focal point in the middle.
+type thumbnailCropParams struct {
+	X      *int     `json:"x"`
+	Y      *int     `json:"y"`
+	Width  *int     `json:"width"`
+	Height *int     `json:"height"`
+	FocalX *float64 `json:"focal_x"`
+	FocalY *float64 `json:"focal_y"`
+}
+
+// thumbnailCropForm reads crop parameters from crop_x, crop_y,
+// crop_width, crop_height, focal_x and focal_y form fields.
+func thumbnailCropForm(r *http.Request) (thumbnailCropParams, error) {
+	var params thumbnailCropParams
+	ints := []struct {
+		field string
+		dst   **int
+	}{
+		{"crop_x", &params.X},
+		{"crop_y", &params.Y},
+		{"crop_width", &params.Width},
+		{"crop_height", &params.Height},
+	}
+	for _, f := range ints {
+		v := r.FormValue(f.field)
+		if v == "" {
+			continue
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return params, fmt.Errorf("%s must be an integer", f.field)
+		}
+		*f.dst = &n
+	}
+	floats := []struct {
+		field string
+		dst   **float64
+	}{
+		{"focal_x", &params.FocalX},
+		{"focal_y", &params.FocalY},
+	}
+	for _, f := range floats {
+		v := r.FormValue(f.field)
+		if v == "" {
+			continue
+		}
+		n, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return params, fmt.Errorf("%s must be a number", f.field)
+		}
+		*f.dst = &n
+	}
+	return params, nil
+}
+
+// crop fills in defaults and checks the parameters against an image of
+// the given size.
+func (p thumbnailCropParams) crop(width, height int) (database.ThumbnailCrop, error) {
+	crop := defaultThumbnailCrop
+	set := func(dst *int, v *int) {
+		if v != nil {
+			*dst = *v
+		}
+	}
+	set(&crop.X, p.X)
+	set(&crop.Y, p.Y)
+	set(&crop.Width, p.Width)
+	set(&crop.Height, p.Height)
+	if p.FocalX != nil {
+		crop.FocalX = *p.FocalX
+	}
+	if p.FocalY != nil {
+		crop.FocalY = *p.FocalY
+	}
+
+	if crop.Width == 0 && crop.Height == 0 {
+		if crop.X != 0 || crop.Y != 0 {
+			return crop, errors.New("crop x and y need a width and height")
+		}
+	} else if crop.Width <= 0 || crop.Height <= 0 {
+		return crop, errors.New("crop width and height must both be positive")
+	}
+	if crop.X < 0 || crop.Y < 0 || crop.X+crop.Width > width || crop.Y+crop.Height > height {
+		return crop, fmt.Errorf("crop must lie within the %dx%d image", width, height)
+	}
+	if crop.FocalX < 0 || crop.FocalX > 1 || crop.FocalY < 0 || crop.FocalY > 1 {
+		return crop, errors.New("focal point must be between 0 and 1")
+	}
+	return crop, nil
+}
+
+// frame returns the largest part of the crop with the variant's aspect
+// ratio, centered on the focal point as far as the crop allows.
+func (v thumbnailVariant) frame(bounds image.Rectangle, crop database.ThumbnailCrop) image.Rectangle {
+	region := bounds
+	if crop.Width > 0 && crop.Height > 0 {
+		region = image.Rect(crop.X, crop.Y, crop.X+crop.Width, crop.Y+crop.Height).Add(bounds.Min)
+	}
+	w := region.Dx()
+	h := w * v.height / v.width
+	if h > region.Dy() {
+		h = region.Dy()
+		w = h * v.width / v.height
+	}
+	focusX := region.Min.X + int(crop.FocalX*float64(region.Dx()))
+	focusY := region.Min.Y + int(crop.FocalY*float64(region.Dy()))
+	x := min(max(focusX-w/2, region.Min.X), region.Max.X-w)
+	y := min(max(focusY-h/2, region.Min.Y), region.Max.Y-h)
+	return image.Rect(x, y, x+w, y+h)
+}
+
+func (v thumbnailVariant) render(src image.Image, crop database.ThumbnailCrop) image.Image {
+	frame := v.frame(src.Bounds(), crop)
+	w := min(v.width, frame.Dx())
+	h := max(w*v.height/v.width, 1)
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), src, frame, draw.Src, nil)
+	return dst
+}
+
+// applyThumbnail makes the image at sourceURL, whose contents r holds,
+// the video's thumbnail source and points the video at freshly generated
+// variants. The caller saves the video.
+func (cfg *apiConfig) applyThumbnail(video *database.Video, sourceURL string, r io.ReadSeeker, mediaType string, crop database.ThumbnailCrop) error {
+	src, _, err := image.Decode(r)
+	if err != nil {
+		return err
+	}
+
+	urls := make([]string, 0, 2)
+	for _, v := range []thumbnailVariant{thumbnailCard, thumbnailSquare} {
+		var buf bytes.Buffer
+		variantType := mediaType
+		if mediaType != "image/jpeg" {
+			variantType = "image/png"
+		}
+		if err := encodeImage(&buf, v.render(src, crop), variantType); err != nil {
+			return err
+		}
+		url, err := cfg.saveImageAsset(&buf, variantType)
+		if err != nil {
+			return err
+		}
+		urls = append(urls, url)
+	}
+
+	video.ThumbnailSourceURL = &sourceURL
+	video.ThumbnailURL = &urls[0]
+	video.ThumbnailSquareURL = &urls[1]
+	video.ThumbnailCrop = &crop
+	// Cropping would drop the animation, so animated GIFs stay whole on
+	// cards
+	if mediaType == "image/gif" {
+		if _, err := r.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		if g, err := gif.DecodeAll(r); err == nil && len(g.Image) > 1 {
+			video.ThumbnailURL = &sourceURL
+		}
+	}
+	return nil
+}
+
+// applyThumbnailAsset is applyThumbnail for an image already saved in the
+// assets directory.
+func (cfg *apiConfig) applyThumbnailAsset(video *database.Video, sourceURL string, crop database.ThumbnailCrop) error {
+	source, err := cfg.openLocalAsset(sourceURL)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+	head, err := readHead(source)
+	if err != nil {
+		return err
+	}
+	if _, err := checkImageSize(source, cfg.maxImagePixels); err != nil {
+		return err
+	}
+	return cfg.applyThumbnail(video, sourceURL, source, sniffImageType(head), crop)
+}
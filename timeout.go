@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// longRequestRoutes are the routes that move whole video files, or
+// process them before answering, so they get timeouts.long instead of the
+// standard deadline. Unversioned API paths match their /api/v1 route.
+var longRequestRoutes = []string{
+	"POST /api/v1/video_upload/{videoID}",
+	"PUT /api/v1/videos/{videoID}/content",
+	"PATCH /api/v1/uploads/{uploadID}",
+	"POST /api/v1/videos/{videoID}/direct-uploads/complete",
+	"POST /api/v1/videos/{videoID}/import",
+	"POST /api/v1/videos/{videoID}/reprocess",
+	"POST /api/v1/videos/{videoID}/replace",
+	"POST /api/v1/videos/{videoID}/versions/{versionID}/rollback",
+	"POST /api/v1/thumbnail_upload/{videoID}",
+	"POST /api/v1/users/me/avatar",
+	"GET /api/v1/videos/{videoID}/download",
+	"GET /api/v1/videos/{videoID}/stream",
+	"GET /api/v1/playback/{token}/{file...}",
+	"POST /admin/videos/{videoID}/versions/{versionID}/rollback",
+	"POST /admin/gc",
+	"GET /api/v1/notifications/stream",
+	"GET /admin/audit/stream",
+}
+
+// requestTimeouts bounds how long a request can take, from its first body
+// byte to its last response byte. Zero leaves it to the server's read and
+// write timeouts.
+type requestTimeouts struct {
+	standard time.Duration
+	long     time.Duration
+	// longRoutes matches longRequestRoutes
+	longRoutes *http.ServeMux
+}
+
+func newRequestTimeouts(standard, long time.Duration) requestTimeouts {
+	longRoutes := http.NewServeMux()
+	for _, pattern := range longRequestRoutes {
+		longRoutes.Handle(pattern, http.NotFoundHandler())
+	}
+	return requestTimeouts{standard: standard, long: long, longRoutes: longRoutes}
+}
+
+// forRequest picks the deadline for r by the route it's for.
+func (t requestTimeouts) forRequest(r *http.Request) time.Duration {
+	path := r.URL.Path
+	if rest, ok := strings.CutPrefix(path, "/api/"); ok {
+		if first, _, _ := strings.Cut(rest, "/"); !isVersionSegment(first) {
+			path = "/api/v" + latestAPIVersion + "/" + rest
+		}
+	}
+	if _, pattern := t.longRoutes.Handler(&http.Request{Method: r.Method, Host: r.Host, URL: &url.URL{Path: path}}); pattern != "" {
+		return t.long
+	}
+	return t.standard
+}
+
+// timeoutGrace is how long past its deadline a request can still write
+// the timeout error.
+const timeoutGrace = 5 * time.Second
+
+// timeoutMiddleware gives each request a deadline by its route. Reading
+// the body and writing the response stop at the deadline, so stalled
+// clients can't hold a connection, and the handler's context ends with
+// it. A handler that hasn't answered by then gets a 503 instead of
+// whatever error the cancellation caused.
+func timeoutMiddleware(t requestTimeouts, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		timeout := t.forRequest(r)
+		if timeout <= 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		// These replace the server's read and write timeouts, so long routes
+		// aren't cut off by them
+		rc := http.NewResponseController(w)
+		deadline := time.Now().Add(timeout)
+		if err := rc.SetReadDeadline(deadline); err != nil && !errors.Is(err, http.ErrNotSupported) {
+			log.Printf("Couldn't set read deadline: %v", err)
+		}
+		if err := rc.SetWriteDeadline(deadline.Add(timeoutGrace)); err != nil && !errors.Is(err, http.ErrNotSupported) {
+			log.Printf("Couldn't set write deadline: %v", err)
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+		tw := &timeoutWriter{ResponseWriter: w, ctx: ctx}
+		next.ServeHTTP(tw, r.WithContext(ctx))
+		if !tw.wroteHeader && ctx.Err() == context.DeadlineExceeded {
+			tw.WriteHeader(http.StatusOK)
+		}
+	})
+}
+
+// timeoutWriter swaps the response for a timeout error if the handler
+// starts it after the deadline.
+type timeoutWriter struct {
+	http.ResponseWriter
+	ctx         context.Context
+	wroteHeader bool
+	timedOut    bool
+}
+
+func (tw *timeoutWriter) WriteHeader(status int) {
+	if tw.wroteHeader || status < 200 {
+		tw.ResponseWriter.WriteHeader(status)
+		return
+	}
+	tw.wroteHeader = true
+	if tw.ctx.Err() != context.DeadlineExceeded {
+		tw.ResponseWriter.WriteHeader(status)
+		return
+	}
+	tw.timedOut = true
+	// Drop what the handler set for the body it won't send
+	for _, h := range []string{"Content-Length", "Content-Range", "Content-Disposition", "ETag", "Last-Modified"} {
+		tw.Header().Del(h)
+	}
+	respondWithErrorCode(tw.ResponseWriter, http.StatusServiceUnavailable, codeRequestTimeout, "Request took too long, try again", tw.ctx.Err())
+}
+
+func (tw *timeoutWriter) Write(p []byte) (int, error) {
+	if !tw.wroteHeader {
+		tw.WriteHeader(http.StatusOK)
+	}
+	if tw.timedOut {
+		return 0, tw.ctx.Err()
+	}
+	return tw.ResponseWriter.Write(p)
+}
+
+// Flush keeps event streams working through the wrapper.
+func (tw *timeoutWriter) Flush() {
+	if !tw.wroteHeader {
+		tw.WriteHeader(http.StatusOK)
+	}
+	if tw.timedOut {
+		return
+	}
+	http.NewResponseController(tw.ResponseWriter).Flush()
+}
+
+func (tw *timeoutWriter) Unwrap() http.ResponseWriter {
+	return tw.ResponseWriter
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"crypto/tls"
+	"log"
+	"net/http"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+type tlsConfig struct {
+	certFile string
+	keyFile  string
+
+	// Autocert obtains certificates from Let's Encrypt for these domains
+	// instead of reading certFile/keyFile.
+	autocertDomains  []string
+	autocertCacheDir string
+	autocertEmail    string
+	autocertHTTPAddr string
+}
+
+func (c tlsConfig) enabled() bool {
+	return len(c.autocertDomains) > 0 || (c.certFile != "" && c.keyFile != "")
+}
+
+// autocertManager gets certificates for the autocert domains, sharing
+// them with any other manager through the cache directory.
+func (c tlsConfig) autocertManager() *autocert.Manager {
+	return &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(c.autocertDomains...),
+		Cache:      autocert.DirCache(c.autocertCacheDir),
+		Email:      c.autocertEmail,
+	}
+}
+
+// listenAndServe starts srv over HTTPS when TLS is configured and plain
+// HTTP otherwise. In autocert mode a second listener on autocertHTTPAddr
+// answers HTTP-01 challenges and redirects everything else to HTTPS.
+func listenAndServe(srv *http.Server, c tlsConfig) error {
+	if len(c.autocertDomains) > 0 {
+		m := c.autocertManager()
+		go func() {
+			err := http.ListenAndServe(c.autocertHTTPAddr, m.HTTPHandler(nil))
+			if err != nil {
+				log.Printf("ACME challenge listener stopped: %v", err)
+			}
+		}()
+		srv.TLSConfig = m.TLSConfig()
+		srv.TLSConfig.MinVersion = tls.VersionTLS12
+		return srv.ListenAndServeTLS("", "")
+	}
+	if c.certFile != "" && c.keyFile != "" {
+		srv.TLSConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+		return srv.ListenAndServeTLS(c.certFile, c.keyFile)
+	}
+	return srv.ListenAndServe()
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"context"
+)
+
+// transcodePool caps how many uploads may run ffprobe/ffmpeg at once.
+// Callers beyond the limit wait in acquire until a slot frees up or their
+// context is cancelled.
+type transcodePool struct {
+	slots chan struct{}
+}
+
+func newTranscodePool(size int) *transcodePool {
+	return &transcodePool{slots: make(chan struct{}, max(size, 1))}
+}
+
+// acquire blocks until a slot is available. The returned release func must
+// be called once the subprocess work is done.
+func (p *transcodePool) acquire(ctx context.Context) (release func(), err error) {
+	metricTranscodeQueueDepth.Add(1)
+	defer metricTranscodeQueueDepth.Add(-1)
+
+	select {
+	case p.slots <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	metricTranscodesActive.Add(1)
+	return func() {
+		metricTranscodesActive.Add(-1)
+		<-p.slots
+	}, nil
+}
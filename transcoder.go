@@ -0,0 +1,280 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/media"
+	"github.com/google/uuid"
+)
+
+// transcodeJob is one video for a transcoder to turn into a fast-start
+// MP4 at key in the bucket.
+type transcodeJob struct {
+	videoID uuid.UUID
+	// path is a local copy of the original
+	path string
+	// stagingKey is where the same original is staged in the bucket
+	stagingKey   string
+	key          string
+	mediaType    string
+	storageClass types.StorageClass
+	// dashPrefix is where a DASH manifest and its segments go, empty to
+	// skip DASH packaging
+	dashPrefix string
+	// hdrFormat is set for HDR originals, which get an SDR tone-mapped
+	// rendition
+	hdrFormat string
+	// duration is the original's length in seconds, 0 if unknown
+	duration float64
+	// dataKey encrypts everything uploaded for an encrypted video, nil to
+	// upload in the clear
+	dataKey []byte
+	// progress is told how far along the job is, if not nil
+	progress *progressTracker
+	// sourceChecksum is the SHA-256 of the staged original, which a
+	// processed upload is only resumed for
+	sourceChecksum string
+	// resume is a processed upload of the original to pick up instead of
+	// transcoding it again, nil to start from scratch
+	resume *database.ProcessedUpload
+}
+
+type transcodeResult struct {
+	// checksum is the digest of the MP4, nil when the backend can't
+	// compute one
+	checksum *fileChecksum
+	// dashKey is the manifest's key, empty if none was packaged
+	dashKey string
+}
+
+// dashManifestName is the manifest's file name under the DASH prefix.
+const dashManifestName = "manifest.mpd"
+
+// transcoder is a backend that processes uploads. Errors are
+// *pipelineError so failures are attributed to a stage.
+type transcoder interface {
+	transcode(ctx context.Context, job transcodeJob) (transcodeResult, error)
+}
+
+func newTranscoder(cfg *apiConfig, backend string, mc mediaConvertConfig) (transcoder, error) {
+	switch backend {
+	case "ffmpeg":
+		return ffmpegTranscoder{cfg: cfg, timeout: cfg.ffmpegTimeout}, nil
+	case "mediaconvert":
+		return newMediaConvertTranscoder(cfg, mc)
+	default:
+		return nil, fmt.Errorf("unknown transcoder %q, want ffmpeg or mediaconvert", backend)
+	}
+}
+
+// ffmpegTranscoder remuxes the local copy with ffmpeg and uploads the
+// result. HDR originals are tone-mapped to SDR for the MP4, and the HDR
+// remux is kept alongside it in the DASH packaging.
+type ffmpegTranscoder struct {
+	cfg     *apiConfig
+	timeout time.Duration
+}
+
+func (t ffmpegTranscoder) transcode(ctx context.Context, job transcodeJob) (transcodeResult, error) {
+	cfg := t.cfg
+
+	pending := job.resume
+	dir := cfg.processedUploadDir(job.videoID)
+	if pending != nil {
+		dir = pending.Dir
+		log.Printf("Resuming upload of processed video %s instead of transcoding it again", job.videoID)
+	}
+	processedFilePath, sdrFilePath, uploadFilePath := processedFilePaths(dir, job.hdrFormat != "", job.dataKey != nil)
+
+	if pending == nil {
+		var err error
+		pending, err = t.process(ctx, job, dir)
+		if err != nil {
+			os.RemoveAll(dir)
+			return transcodeResult{}, err
+		}
+	}
+
+	// The video keeps the checksum of the MP4 viewers get back, while S3
+	// verifies the encrypted bytes it's sent
+	plainFilePath := processedFilePath
+	if sdrFilePath != "" {
+		plainFilePath = sdrFilePath
+	}
+	checksum, err := checksumFile(plainFilePath)
+	if err != nil {
+		return transcodeResult{}, &pipelineError{"transcode", http.StatusInternalServerError, "Couldn't checksum processed video file", err}
+	}
+	uploadChecksum := checksum
+	if uploadFilePath != plainFilePath {
+		uploadChecksum, err = checksumFile(uploadFilePath)
+		if err != nil {
+			return transcodeResult{}, &pipelineError{"encrypt", http.StatusInternalServerError, "Couldn't checksum encrypted video file", err}
+		}
+	}
+
+	// Use the S3 client to upload the file. If this fails the processed
+	// files are kept, so a retry picks up where it left off.
+	fmt.Printf("Uploading video to S3 bucket %s with key %s\n", cfg.s3Bucket, job.key)
+	err = cfg.uploadProcessed(ctx, pending, uploadFilePath, job.mediaType, uploadChecksum)
+	if err != nil {
+		return transcodeResult{}, &pipelineError{"s3_upload", http.StatusInternalServerError, "Couldn't upload to S3", err}
+	}
+	result := transcodeResult{checksum: &checksum}
+
+	if job.dashPrefix != "" {
+		result.dashKey, err = t.packageDASH(ctx, processedFilePath, sdrFilePath, job)
+		if err != nil {
+			return transcodeResult{}, err
+		}
+	}
+	if err := cfg.removeProcessedUpload(*pending); err != nil {
+		log.Printf("Couldn't remove processed files of video %s: %v", job.videoID, err)
+	}
+	return result, nil
+}
+
+// process remuxes the job's original into dir for fast start, tone-maps
+// and encrypts it as needed, and records the result as a processed upload
+// to the job's key.
+func (t ffmpegTranscoder) process(ctx context.Context, job transcodeJob, dir string) (*database.ProcessedUpload, error) {
+	cfg := t.cfg
+
+	// Wait for a free transcode slot so concurrent uploads can't start an
+	// unbounded number of ffmpeg processes
+	releaseSlot, err := cfg.transcodes.acquire(ctx)
+	if err != nil {
+		return nil, &pipelineError{"queue", http.StatusServiceUnavailable, "Upload cancelled while waiting to process", err}
+	}
+	defer releaseSlot()
+
+	// Anything left from a run that failed before uploading is stale
+	if err := cfg.discardProcessedUpload(ctx, job.videoID); err != nil {
+		return nil, &pipelineError{"transcode", http.StatusInternalServerError, "Couldn't discard earlier processed files", err}
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		return nil, &pipelineError{"transcode", http.StatusInternalServerError, "Couldn't clear processing directory", err}
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, &pipelineError{"transcode", http.StatusInternalServerError, "Couldn't create processing directory", err}
+	}
+	processedFilePath, sdrFilePath, uploadFilePath := processedFilePaths(dir, job.hdrFormat != "", job.dataKey != nil)
+
+	job.progress.report(progressTranscoding, 0)
+
+	// Process the video for fast start using ffmpeg
+	ffmpegCtx, cancelFFmpeg := context.WithTimeout(ctx, t.timeout)
+	defer cancelFFmpeg()
+	err = cfg.mediaTranscoder.FastStart(ffmpegCtx, job.path, processedFilePath, job.mediaProgress(progressTranscoding))
+	if err != nil {
+		return nil, &pipelineError{"transcode", http.StatusInternalServerError, "Couldn't process video for fast start", err}
+	}
+
+	// Most players show HDR washed out, so the MP4 everyone can play is
+	// tone-mapped to SDR
+	plainFilePath := processedFilePath
+	if sdrFilePath != "" {
+		job.progress.report(progressTonemapping, 0)
+		err = cfg.mediaTranscoder.ToneMapSDR(ffmpegCtx, processedFilePath, sdrFilePath, job.mediaProgress(progressTonemapping))
+		if err != nil {
+			return nil, &pipelineError{"tonemap", http.StatusInternalServerError, "Couldn't tone-map HDR video", err}
+		}
+		plainFilePath = sdrFilePath
+	}
+
+	if job.dataKey != nil {
+		sealedPath, _, err := cfg.sealFile(plainFilePath, job.dataKey)
+		if err != nil {
+			return nil, &pipelineError{"encrypt", http.StatusInternalServerError, "Couldn't encrypt processed video file", err}
+		}
+		if err := os.Rename(sealedPath, uploadFilePath); err != nil {
+			os.Remove(sealedPath)
+			return nil, &pipelineError{"encrypt", http.StatusInternalServerError, "Couldn't encrypt processed video file", err}
+		}
+	}
+
+	pending := &database.ProcessedUpload{
+		VideoID:        job.videoID,
+		SourceChecksum: job.sourceChecksum,
+		Dir:            dir,
+		ObjectKey:      job.key,
+		StorageClass:   string(job.storageClass),
+	}
+	if err := cfg.db.SaveProcessedUpload(*pending); err != nil {
+		return nil, &pipelineError{"transcode", http.StatusInternalServerError, "Couldn't record processed video file", err}
+	}
+	return pending, nil
+}
+
+// packageDASH splits the fast-start MP4 at path into a DASH manifest with
+// one single-file CMAF representation per stream, and uploads them under
+// the job's DASH prefix. If sdrPath isn't empty its video is packaged too,
+// as an SDR representation of an HDR original.
+func (t ffmpegTranscoder) packageDASH(ctx context.Context, path, sdrPath string, job transcodeJob) (string, error) {
+	cfg := t.cfg
+	dir, err := os.MkdirTemp(cfg.scratchDir, "tubely-dash")
+	if err != nil {
+		return "", &pipelineError{"package", http.StatusInternalServerError, "Couldn't create DASH directory", err}
+	}
+	defer os.RemoveAll(dir)
+
+	ffmpegCtx, cancelFFmpeg := context.WithTimeout(ctx, t.timeout)
+	defer cancelFFmpeg()
+	err = cfg.mediaTranscoder.PackageDASH(ffmpegCtx, path, sdrPath, filepath.Join(dir, dashManifestName), job.mediaProgress(progressPackaging))
+	if err != nil {
+		return "", &pipelineError{"package", http.StatusInternalServerError, "Couldn't package DASH", err}
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return "", &pipelineError{"package", http.StatusInternalServerError, "Couldn't read DASH output", err}
+	}
+	for _, entry := range entries {
+		key := job.dashPrefix + entry.Name()
+		contentType := "video/mp4"
+		if filepath.Ext(entry.Name()) == ".mpd" {
+			contentType = "application/dash+xml"
+		}
+		path := filepath.Join(dir, entry.Name())
+		if job.dataKey != nil {
+			path, _, err = cfg.sealFile(path, job.dataKey)
+			if err != nil {
+				return "", &pipelineError{"encrypt", http.StatusInternalServerError, "Couldn't encrypt DASH files", err}
+			}
+			defer os.Remove(path)
+		}
+		err := cfg.retry.do(ctx, "s3_put_object", func() error {
+			f, err := os.Open(path)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			_, err = cfg.s3Client.PutObject(ctx, &s3.PutObjectInput{
+				Bucket:       &cfg.s3Bucket,
+				Key:          &key,
+				ContentType:  &contentType,
+				Body:         f,
+				StorageClass: job.storageClass,
+			})
+			return err
+		})
+		if err != nil {
+			return "", &pipelineError{"s3_upload", http.StatusInternalServerError, "Couldn't upload DASH files to S3", err}
+		}
+	}
+	return job.dashPrefix + dashManifestName, nil
+}
+
+// mediaProgress reports how far through stage of the job a transcode is.
+func (job transcodeJob) mediaProgress(stage string) media.Progress {
+	return media.Progress{Duration: job.duration, Report: job.progress.reporter(stage)}
+}
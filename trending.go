@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/google/uuid"
+)
+
+// viewDedupeWindow is how long repeat views of a video by the same viewer
+// count as one, so reloading the page doesn't push it up the trending list.
+const viewDedupeWindow = 30 * time.Minute
+
+// likeWeight is how many views a like is worth in a trending score.
+const likeWeight = 5.0
+
+// Tags are short lowercase labels, at most maxVideoTags per video.
+const (
+	maxVideoTags   = 10
+	maxVideoTagLen = 32
+)
+
+// normalizeTags lowercases tags and turns spaces into dashes, then checks
+// they're only letters, digits and dashes. The result is sorted without
+// duplicates.
+func normalizeTags(tags []string) ([]string, error) {
+	normalized := []string{}
+	for _, tag := range tags {
+		tag = strings.Join(strings.Fields(strings.ToLower(tag)), "-")
+		if tag == "" {
+			continue
+		}
+		if len([]rune(tag)) > maxVideoTagLen {
+			return nil, fmt.Errorf("tag %q is longer than %d characters", tag, maxVideoTagLen)
+		}
+		for _, c := range tag {
+			if c != '-' && !unicode.IsLetter(c) && !unicode.IsDigit(c) {
+				return nil, fmt.Errorf("tag %q can only have letters, digits and dashes", tag)
+			}
+		}
+		normalized = append(normalized, tag)
+	}
+	slices.Sort(normalized)
+	normalized = slices.Compact(normalized)
+	if len(normalized) > maxVideoTags {
+		return nil, fmt.Errorf("videos can have at most %d tags", maxVideoTags)
+	}
+	return normalized, nil
+}
+
+// recordView counts a view of a video for the trending list. Signed in
+// viewers are told apart by user ID and anonymous ones by a hash of their
+// address. Like audit, failures are logged rather than returned.
+func (cfg *apiConfig) recordView(r *http.Request, userID, videoID uuid.UUID) {
+	viewer := "user:" + userID.String()
+	if userID == uuid.Nil {
+		viewer = "ip:" + auth.HashToken(clientIP(r))
+	}
+	if _, err := cfg.db.RecordVideoView(videoID, viewer, viewDedupeWindow); err != nil {
+		log.Printf("Couldn't record view of video %s: %v", videoID, err)
+	}
+}
+
+// refreshTrending scores videos by their views and likes over the last
+// cfg.trendingWindow, each counting half as much per cfg.trendingHalfLife
+// of age, and saves the scores for the trending list. Views older than
+// the window are no longer needed and are deleted.
+func (cfg *apiConfig) refreshTrending(ctx context.Context) error {
+	now := time.Now()
+	since := now.Add(-cfg.trendingWindow)
+	views, err := cfg.db.GetHourlyViews(since)
+	if err != nil {
+		return fmt.Errorf("couldn't get views: %w", err)
+	}
+	likes, err := cfg.db.GetHourlyLikes(since)
+	if err != nil {
+		return fmt.Errorf("couldn't get likes: %w", err)
+	}
+
+	scores := map[uuid.UUID]float64{}
+	for _, a := range views {
+		scores[a.VideoID] += float64(a.Count) * cfg.trendingDecay(now, a.Hour)
+	}
+	for _, a := range likes {
+		scores[a.VideoID] += likeWeight * float64(a.Count) * cfg.trendingDecay(now, a.Hour)
+	}
+	if err := cfg.db.SaveTrendingScores(scores, now); err != nil {
+		return fmt.Errorf("couldn't save trending scores: %w", err)
+	}
+
+	n, err := cfg.db.DeleteVideoViewsBefore(since)
+	if err != nil {
+		return fmt.Errorf("couldn't delete old views: %w", err)
+	}
+	if n > 0 {
+		log.Printf("Deleted %d views older than the trending window", n)
+	}
+	return nil
+}
+
+// trendingDecay is what activity in the hour starting at hour is worth
+// now, taking it to have happened mid-hour.
+func (cfg *apiConfig) trendingDecay(now, hour time.Time) float64 {
+	age := max(now.Sub(hour.Add(30*time.Minute)), 0)
+	return math.Pow(0.5, age.Hours()/cfg.trendingHalfLife.Hours())
+}
+
+// handlerVideosTrending lists the published public videos with the
+// highest trending scores, as of the last refresh.
+func (cfg *apiConfig) handlerVideosTrending(w http.ResponseWriter, r *http.Request) {
+	page, err := cfg.parsePage(r.URL.Query())
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid page", err)
+		return
+	}
+	videos, err := cfg.db.GetTrendingVideos(page.Limit)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get trending videos", err)
+		return
+	}
+	videos, err = cfg.signVideos(accessContext(r, cfg.optionalUserID(r)), videos)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't sign video URLs", err)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, videos)
+}
+
+// handlerVideoRelated lists published public videos sharing tags with a
+// video the caller can see.
+func (cfg *apiConfig) handlerVideoRelated(w http.ResponseWriter, r *http.Request) {
+	video, ok := cfg.viewableVideo(w, r)
+	if !ok {
+		return
+	}
+	page, err := cfg.parsePage(r.URL.Query())
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid page", err)
+		return
+	}
+	videos, err := cfg.db.GetRelatedVideos(video.ID, page.Limit)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get related videos", err)
+		return
+	}
+	videos, err = cfg.signVideos(accessContext(r, cfg.optionalUserID(r)), videos)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't sign video URLs", err)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, videos)
+}
+
+// handlerVideoViewRecord counts a view by a player that got the video
+// some other way than a playback token or share link, such as a
+// presigned or CDN URL.
+func (cfg *apiConfig) handlerVideoViewRecord(w http.ResponseWriter, r *http.Request) {
+	video, ok := cfg.viewableVideo(w, r)
+	if !ok {
+		return
+	}
+	if !video.Published {
+		respondWithError(w, http.StatusConflict, "Video isn't published", nil)
+		return
+	}
+	cfg.recordView(r, cfg.optionalUserID(r), video.ID)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,363 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.5.1
+// - protoc             (unknown)
+// source: tubely.proto
+
+package tubelyrpc
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.64.0 or later.
+const _ = grpc.SupportPackageIsVersion9
+
+const (
+	Videos_CreateVideo_FullMethodName         = "/tubely.v1.Videos/CreateVideo"
+	Videos_GetVideo_FullMethodName            = "/tubely.v1.Videos/GetVideo"
+	Videos_ListVideos_FullMethodName          = "/tubely.v1.Videos/ListVideos"
+	Videos_UpdateVideo_FullMethodName         = "/tubely.v1.Videos/UpdateVideo"
+	Videos_DeleteVideo_FullMethodName         = "/tubely.v1.Videos/DeleteVideo"
+	Videos_CreateUploadSession_FullMethodName = "/tubely.v1.Videos/CreateUploadSession"
+	Videos_WatchVideo_FullMethodName          = "/tubely.v1.Videos/WatchVideo"
+)
+
+// VideosClient is the client API for Videos service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+//
+// Videos is implemented by the Tubely server. Every call must carry an
+// "authorization: Bearer <access token>" metadata entry.
+type VideosClient interface {
+	CreateVideo(ctx context.Context, in *CreateVideoRequest, opts ...grpc.CallOption) (*Video, error)
+	GetVideo(ctx context.Context, in *GetVideoRequest, opts ...grpc.CallOption) (*Video, error)
+	ListVideos(ctx context.Context, in *ListVideosRequest, opts ...grpc.CallOption) (*ListVideosResponse, error)
+	UpdateVideo(ctx context.Context, in *UpdateVideoRequest, opts ...grpc.CallOption) (*Video, error)
+	DeleteVideo(ctx context.Context, in *DeleteVideoRequest, opts ...grpc.CallOption) (*DeleteVideoResponse, error)
+	CreateUploadSession(ctx context.Context, in *CreateUploadSessionRequest, opts ...grpc.CallOption) (*UploadSession, error)
+	// WatchVideo sends the video's status right away and again whenever it
+	// changes, until the client disconnects.
+	WatchVideo(ctx context.Context, in *WatchVideoRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[VideoStatus], error)
+}
+
+type videosClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewVideosClient(cc grpc.ClientConnInterface) VideosClient {
+	return &videosClient{cc}
+}
+
+func (c *videosClient) CreateVideo(ctx context.Context, in *CreateVideoRequest, opts ...grpc.CallOption) (*Video, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(Video)
+	err := c.cc.Invoke(ctx, Videos_CreateVideo_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *videosClient) GetVideo(ctx context.Context, in *GetVideoRequest, opts ...grpc.CallOption) (*Video, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(Video)
+	err := c.cc.Invoke(ctx, Videos_GetVideo_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *videosClient) ListVideos(ctx context.Context, in *ListVideosRequest, opts ...grpc.CallOption) (*ListVideosResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(ListVideosResponse)
+	err := c.cc.Invoke(ctx, Videos_ListVideos_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *videosClient) UpdateVideo(ctx context.Context, in *UpdateVideoRequest, opts ...grpc.CallOption) (*Video, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(Video)
+	err := c.cc.Invoke(ctx, Videos_UpdateVideo_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *videosClient) DeleteVideo(ctx context.Context, in *DeleteVideoRequest, opts ...grpc.CallOption) (*DeleteVideoResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(DeleteVideoResponse)
+	err := c.cc.Invoke(ctx, Videos_DeleteVideo_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *videosClient) CreateUploadSession(ctx context.Context, in *CreateUploadSessionRequest, opts ...grpc.CallOption) (*UploadSession, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(UploadSession)
+	err := c.cc.Invoke(ctx, Videos_CreateUploadSession_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *videosClient) WatchVideo(ctx context.Context, in *WatchVideoRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[VideoStatus], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &Videos_ServiceDesc.Streams[0], Videos_WatchVideo_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[WatchVideoRequest, VideoStatus]{ClientStream: stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Videos_WatchVideoClient = grpc.ServerStreamingClient[VideoStatus]
+
+// VideosServer is the server API for Videos service.
+// All implementations must embed UnimplementedVideosServer
+// for forward compatibility.
+//
+// Videos is implemented by the Tubely server. Every call must carry an
+// "authorization: Bearer <access token>" metadata entry.
+type VideosServer interface {
+	CreateVideo(context.Context, *CreateVideoRequest) (*Video, error)
+	GetVideo(context.Context, *GetVideoRequest) (*Video, error)
+	ListVideos(context.Context, *ListVideosRequest) (*ListVideosResponse, error)
+	UpdateVideo(context.Context, *UpdateVideoRequest) (*Video, error)
+	DeleteVideo(context.Context, *DeleteVideoRequest) (*DeleteVideoResponse, error)
+	CreateUploadSession(context.Context, *CreateUploadSessionRequest) (*UploadSession, error)
+	// WatchVideo sends the video's status right away and again whenever it
+	// changes, until the client disconnects.
+	WatchVideo(*WatchVideoRequest, grpc.ServerStreamingServer[VideoStatus]) error
+	mustEmbedUnimplementedVideosServer()
+}
+
+// UnimplementedVideosServer must be embedded to have
+// forward compatible implementations.
+//
+// NOTE: this should be embedded by value instead of pointer to avoid a nil
+// pointer dereference when methods are called.
+type UnimplementedVideosServer struct{}
+
+func (UnimplementedVideosServer) CreateVideo(context.Context, *CreateVideoRequest) (*Video, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method CreateVideo not implemented")
+}
+func (UnimplementedVideosServer) GetVideo(context.Context, *GetVideoRequest) (*Video, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetVideo not implemented")
+}
+func (UnimplementedVideosServer) ListVideos(context.Context, *ListVideosRequest) (*ListVideosResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListVideos not implemented")
+}
+func (UnimplementedVideosServer) UpdateVideo(context.Context, *UpdateVideoRequest) (*Video, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method UpdateVideo not implemented")
+}
+func (UnimplementedVideosServer) DeleteVideo(context.Context, *DeleteVideoRequest) (*DeleteVideoResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method DeleteVideo not implemented")
+}
+func (UnimplementedVideosServer) CreateUploadSession(context.Context, *CreateUploadSessionRequest) (*UploadSession, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method CreateUploadSession not implemented")
+}
+func (UnimplementedVideosServer) WatchVideo(*WatchVideoRequest, grpc.ServerStreamingServer[VideoStatus]) error {
+	return status.Errorf(codes.Unimplemented, "method WatchVideo not implemented")
+}
+func (UnimplementedVideosServer) mustEmbedUnimplementedVideosServer() {}
+func (UnimplementedVideosServer) testEmbeddedByValue()                {}
+
+// UnsafeVideosServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to VideosServer will
+// result in compilation errors.
+type UnsafeVideosServer interface {
+	mustEmbedUnimplementedVideosServer()
+}
+
+func RegisterVideosServer(s grpc.ServiceRegistrar, srv VideosServer) {
+	// If the following call pancis, it indicates UnimplementedVideosServer was
+	// embedded by pointer and is nil.  This will cause panics if an
+	// unimplemented method is ever invoked, so we test this at initialization
+	// time to prevent it from happening at runtime later due to I/O.
+	if t, ok := srv.(interface{ testEmbeddedByValue() }); ok {
+		t.testEmbeddedByValue()
+	}
+	s.RegisterService(&Videos_ServiceDesc, srv)
+}
+
+func _Videos_CreateVideo_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(CreateVideoRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(VideosServer).CreateVideo(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Videos_CreateVideo_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(VideosServer).CreateVideo(ctx, req.(*CreateVideoRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Videos_GetVideo_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetVideoRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(VideosServer).GetVideo(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Videos_GetVideo_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(VideosServer).GetVideo(ctx, req.(*GetVideoRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Videos_ListVideos_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListVideosRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(VideosServer).ListVideos(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Videos_ListVideos_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(VideosServer).ListVideos(ctx, req.(*ListVideosRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Videos_UpdateVideo_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(UpdateVideoRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(VideosServer).UpdateVideo(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Videos_UpdateVideo_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(VideosServer).UpdateVideo(ctx, req.(*UpdateVideoRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Videos_DeleteVideo_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(DeleteVideoRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(VideosServer).DeleteVideo(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Videos_DeleteVideo_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(VideosServer).DeleteVideo(ctx, req.(*DeleteVideoRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Videos_CreateUploadSession_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(CreateUploadSessionRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(VideosServer).CreateUploadSession(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Videos_CreateUploadSession_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(VideosServer).CreateUploadSession(ctx, req.(*CreateUploadSessionRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Videos_WatchVideo_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(WatchVideoRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(VideosServer).WatchVideo(m, &grpc.GenericServerStream[WatchVideoRequest, VideoStatus]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Videos_WatchVideoServer = grpc.ServerStreamingServer[VideoStatus]
+
+// Videos_ServiceDesc is the grpc.ServiceDesc for Videos service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Videos_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "tubely.v1.Videos",
+	HandlerType: (*VideosServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "CreateVideo",
+			Handler:    _Videos_CreateVideo_Handler,
+		},
+		{
+			MethodName: "GetVideo",
+			Handler:    _Videos_GetVideo_Handler,
+		},
+		{
+			MethodName: "ListVideos",
+			Handler:    _Videos_ListVideos_Handler,
+		},
+		{
+			MethodName: "UpdateVideo",
+			Handler:    _Videos_UpdateVideo_Handler,
+		},
+		{
+			MethodName: "DeleteVideo",
+			Handler:    _Videos_DeleteVideo_Handler,
+		},
+		{
+			MethodName: "CreateUploadSession",
+			Handler:    _Videos_CreateUploadSession_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "WatchVideo",
+			Handler:       _Videos_WatchVideo_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "tubely.proto",
+}
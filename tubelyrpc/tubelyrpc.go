@@ -0,0 +1,12 @@
+// Package tubelyrpc holds Tubely's gRPC service and its messages,
+// generated from tubely.proto.
+package tubelyrpc
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative tubely.proto
+
+// Video processing states reported by WatchVideo.
+const (
+	StatusAwaitingUpload = "awaiting_upload"
+	StatusReady          = "ready"
+	StatusFailed         = "failed"
+)
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/google/uuid"
+)
+
+// Resumable uploads follow the tus protocol, https://tus.io/protocols/resumable-upload
+const (
+	tusVersion    = "1.0.0"
+	tusExtensions = "creation,expiration,checksum,termination"
+	// tusContentType is the only body type PATCH requests may send
+	tusContentType = "application/offset+octet-stream"
+)
+
+// statusChecksumMismatch is the status tus uses for a chunk whose
+// Upload-Checksum doesn't match its contents.
+const statusChecksumMismatch = 460
+
+// checkTusResumable sets the Tus-Resumable header every tus response
+// carries and rejects requests speaking another protocol version. On
+// failure it writes the error response itself.
+func checkTusResumable(w http.ResponseWriter, r *http.Request) bool {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	if v := r.Header.Get("Tus-Resumable"); v != tusVersion {
+		w.Header().Set("Tus-Version", tusVersion)
+		respondWithError(w, http.StatusPreconditionFailed, "Unsupported Tus-Resumable version", fmt.Errorf("client sent %q", v))
+		return false
+	}
+	return true
+}
+
+// tusMetadata is what a client says about an upload in its
+// Upload-Metadata header.
+type tusMetadata struct {
+	videoID      uuid.UUID
+	mediaType    string
+	storageClass types.StorageClass
+	// filename is the name the client gave the file, nil if it gave none
+	filename *string
+	// title, description and visibility like on a form upload
+	fields uploadMetadata
+}
+
+// parseTusMetadata reads an Upload-Metadata header: comma separated pairs
+// of a key and its base64 encoded value. video_id is required; filename,
+// filetype, storage_class, title, description and visibility are optional.
+func (cfg *apiConfig) parseTusMetadata(header string) (tusMetadata, error) {
+	pairs := map[string]string{}
+	for _, pair := range strings.Split(header, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		key, encoded, _ := strings.Cut(pair, " ")
+		if _, ok := pairs[key]; ok {
+			return tusMetadata{}, fmt.Errorf("duplicate key %q", key)
+		}
+		value, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return tusMetadata{}, fmt.Errorf("value of %q isn't base64", key)
+		}
+		pairs[key] = string(value)
+	}
+	optional := func(key string) *string {
+		if v, ok := pairs[key]; ok {
+			return &v
+		}
+		return nil
+	}
+
+	videoID, err := uuid.Parse(pairs["video_id"])
+	if err != nil {
+		return tusMetadata{}, errors.New("video_id must be a video ID")
+	}
+	meta := tusMetadata{
+		videoID:      videoID,
+		mediaType:    "video/mp4",
+		storageClass: cfg.s3StorageClass,
+		filename:     originalFilename(pairs["filename"]),
+		fields: uploadMetadata{
+			title:       optional("title"),
+			description: optional("description"),
+			visibility:  optional("visibility"),
+		},
+	}
+	if v := pairs["filetype"]; v != "" && v != meta.mediaType {
+		return tusMetadata{}, fmt.Errorf("unsupported filetype %q", v)
+	}
+	if v := pairs["storage_class"]; v != "" {
+		meta.storageClass, err = parseStorageClass(v)
+		if err != nil {
+			return tusMetadata{}, err
+		}
+	}
+	if v := meta.fields.visibility; v != nil && !validVisibility(*v) {
+		return tusMetadata{}, errors.New("invalid visibility")
+	}
+	return meta, nil
+}
+
+var tusChecksumAlgorithms = map[string]func() hash.Hash{
+	"md5":    md5.New,
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+}
+
+// tusChecksumAlgorithmList is the Tus-Checksum-Algorithm header value.
+const tusChecksumAlgorithmList = "md5,sha1,sha256"
+
+// uploadChecksum checks a PATCH body against its Upload-Checksum header.
+type uploadChecksum struct {
+	hash.Hash
+	want []byte
+}
+
+// parseUploadChecksum reads an Upload-Checksum header of an algorithm and
+// base64 digest. It returns nil if the header is empty.
+func parseUploadChecksum(header string) (*uploadChecksum, error) {
+	if header == "" {
+		return nil, nil
+	}
+	algorithm, encoded, _ := strings.Cut(header, " ")
+	newHash, ok := tusChecksumAlgorithms[algorithm]
+	if !ok {
+		return nil, fmt.Errorf("unsupported checksum algorithm %q", algorithm)
+	}
+	want, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, errors.New("checksum isn't base64")
+	}
+	return &uploadChecksum{Hash: newHash(), want: want}, nil
+}
+
+func (c *uploadChecksum) matches() bool {
+	return bytes.Equal(c.Sum(nil), c.want)
+}
+
+// uploadSessionPath is where an upload session's bytes are kept. The name
+// has the temp file prefix, so a file the expiry job misses is swept once
+// it has sat idle for cfg.tempMaxAge.
+func (cfg *apiConfig) uploadSessionPath(id uuid.UUID) string {
+	return filepath.Join(cfg.scratchDir, tempFilePrefix+"upload-"+id.String())
+}
+
+// uploadLocks keeps two requests from writing to one upload session at
+// once.
+type uploadLocks struct {
+	mu     sync.Mutex
+	locked map[uuid.UUID]bool
+}
+
+func newUploadLocks() *uploadLocks {
+	return &uploadLocks{locked: map[uuid.UUID]bool{}}
+}
+
+// tryLock claims the session without waiting, returning ok == false if
+// another request holds it.
+func (l *uploadLocks) tryLock(id uuid.UUID) (unlock func(), ok bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.locked[id] {
+		return nil, false
+	}
+	l.locked[id] = true
+	return func() {
+		l.mu.Lock()
+		delete(l.locked, id)
+		l.mu.Unlock()
+	}, true
+}
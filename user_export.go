@@ -0,0 +1,278 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"path"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// exportBatchSize bounds how many pending exports one run of the
+// build-exports job works through.
+const exportBatchSize = 5
+
+// buildPendingExports assembles the archives of exports users have
+// requested, one at a time.
+func (cfg *apiConfig) buildPendingExports(ctx context.Context) error {
+	exports, err := cfg.db.GetPendingUserExports(exportBatchSize)
+	if err != nil {
+		return err
+	}
+	for _, export := range exports {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		cfg.buildUserExport(ctx, export)
+	}
+	return nil
+}
+
+func (cfg *apiConfig) buildUserExport(ctx context.Context, export database.UserExport) {
+	key, size, err := cfg.writeUserExport(ctx, export)
+	if err != nil {
+		log.Printf("Couldn't build export %s for user %s: %v", export.ID, export.UserID, err)
+		export.Status = database.UserExportFailed
+		export.Error = err.Error()
+		if err := cfg.db.UpdateUserExport(export); err != nil {
+			log.Printf("Couldn't record failed export %s: %v", export.ID, err)
+		}
+		return
+	}
+
+	expiresAt := time.Now().Add(cfg.exportTTL)
+	export.Status = database.UserExportReady
+	export.Key = &key
+	export.SizeBytes = size
+	export.ExpiresAt = &expiresAt
+	if err := cfg.db.UpdateUserExport(export); err != nil {
+		log.Printf("Couldn't record finished export %s: %v", export.ID, err)
+		return
+	}
+	cfg.audit(nil, export.UserID, "user.export", "user", export.UserID.String(), fmt.Sprintf("export %s ready, %d bytes", export.ID, size))
+
+	user, err := cfg.db.GetUser(export.UserID)
+	if err != nil || user == nil {
+		log.Printf("Couldn't get user %s to notify about export %s: %v", export.UserID, export.ID, err)
+		return
+	}
+	body := fmt.Sprintf(
+		"Your Tubely data export is ready. Download it before %s from /api/v1/users/me/exports/%s.",
+		expiresAt.UTC().Format(time.RFC1123), export.ID,
+	)
+	if err := cfg.mailer.Send(ctx, user.Email, "Your Tubely data export is ready", body); err != nil {
+		log.Printf("Couldn't email user %s about export %s: %v", export.UserID, export.ID, err)
+	}
+}
+
+// writeUserExport zips up the user's profile, videos, thumbnails, comments
+// and likes and uploads the archive, returning its key and size.
+func (cfg *apiConfig) writeUserExport(ctx context.Context, export database.UserExport) (string, int64, error) {
+	tmpFile, err := os.CreateTemp(cfg.scratchDir, "tubely-export.zip")
+	if err != nil {
+		return "", 0, err
+	}
+	defer os.Remove(tmpFile.Name())
+	defer tmpFile.Close()
+
+	zw := zip.NewWriter(tmpFile)
+	if err := cfg.writeUserExportEntries(ctx, zw, export.UserID); err != nil {
+		return "", 0, err
+	}
+	if err := zw.Close(); err != nil {
+		return "", 0, err
+	}
+	size, err := tmpFile.Seek(0, io.SeekEnd)
+	if err != nil {
+		return "", 0, err
+	}
+
+	key := fmt.Sprintf("%s%s/%s.zip", cfg.s3ExportsPrefix, export.UserID, export.ID)
+	contentType := "application/zip"
+	err = cfg.retry.do(ctx, "s3_put_export", func() error {
+		if _, err := tmpFile.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		_, err := cfg.s3Client.PutObject(ctx, &s3.PutObjectInput{
+			Bucket:      &cfg.s3Bucket,
+			Key:         &key,
+			ContentType: &contentType,
+			Body:        tmpFile,
+		})
+		return err
+	})
+	if err != nil {
+		return "", 0, err
+	}
+	return key, size, nil
+}
+
+func (cfg *apiConfig) writeUserExportEntries(ctx context.Context, zw *zip.Writer, userID uuid.UUID) error {
+	user, err := cfg.db.GetUser(userID)
+	if err != nil {
+		return err
+	}
+	if user == nil {
+		return fmt.Errorf("user %s doesn't exist", userID)
+	}
+	profile := struct {
+		ID          uuid.UUID `json:"id"`
+		CreatedAt   time.Time `json:"created_at"`
+		Email       string    `json:"email"`
+		Verified    bool      `json:"verified"`
+		DisplayName string    `json:"display_name"`
+		Bio         string    `json:"bio"`
+		AvatarURL   *string   `json:"avatar_url"`
+	}{user.ID, user.CreatedAt, user.Email, user.Verified, user.DisplayName, user.Bio, user.AvatarURL}
+	if err := writeZipJSON(zw, "profile.json", profile); err != nil {
+		return err
+	}
+	if user.AvatarURL != nil {
+		if err := cfg.writeZipAsset(zw, "avatar", *user.AvatarURL); err != nil {
+			return err
+		}
+	}
+
+	videos, err := cfg.db.GetUserVideos(userID)
+	if err != nil {
+		return err
+	}
+	if err := writeZipJSON(zw, "videos.json", videos); err != nil {
+		return err
+	}
+	for _, video := range videos {
+		dir := "videos/" + video.ID.String() + "/"
+		if err := cfg.writeZipVideo(ctx, zw, dir, video); err != nil {
+			return fmt.Errorf("couldn't add video %s: %w", video.ID, err)
+		}
+		if video.ThumbnailSourceURL != nil {
+			if err := cfg.writeZipAsset(zw, dir+"thumbnail", *video.ThumbnailSourceURL); err != nil {
+				return err
+			}
+		}
+	}
+
+	comments, err := cfg.db.GetUserComments(userID)
+	if err != nil {
+		return err
+	}
+	if err := writeZipJSON(zw, "comments.json", comments); err != nil {
+		return err
+	}
+
+	liked, _, err := cfg.db.GetLikedVideos(userID, database.Page{})
+	if err != nil {
+		return err
+	}
+	type like struct {
+		VideoID uuid.UUID `json:"video_id"`
+		Title   string    `json:"title"`
+	}
+	likes := make([]like, 0, len(liked))
+	for _, v := range liked {
+		likes = append(likes, like{v.ID, v.Title})
+	}
+	return writeZipJSON(zw, "likes.json", likes)
+}
+
+// writeZipVideo adds the video's original upload under dir, or the
+// processed file if the original isn't kept.
+func (cfg *apiConfig) writeZipVideo(ctx context.Context, zw *zip.Writer, dir string, video database.Video) error {
+	key, ok := "", false
+	name := "video.mp4"
+	if video.StagingKey != nil {
+		key, ok = *video.StagingKey, true
+		if video.OriginalFilename != nil {
+			name = *video.OriginalFilename
+		}
+	} else {
+		key, ok = videoObjectKey(video)
+	}
+	if !ok {
+		return nil
+	}
+
+	dataKey, err := cfg.videoDataKey(ctx, video)
+	if err != nil {
+		return err
+	}
+	body, _, err := cfg.openObject(ctx, key, dataKey)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	// Video is already compressed, so store it as is
+	w, err := zw.CreateHeader(&zip.FileHeader{Name: dir + name, Method: zip.Store, Modified: video.UpdatedAt})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, body)
+	return err
+}
+
+// writeZipAsset adds the local asset behind assetURL as name plus the
+// asset's extension. Images that aren't local assets or can't be read are
+// left out rather than failing the whole export.
+func (cfg *apiConfig) writeZipAsset(zw *zip.Writer, name, assetURL string) error {
+	f, err := cfg.openLocalAsset(assetURL)
+	if err != nil {
+		log.Printf("Leaving %s out of export: %v", assetURL, err)
+		return nil
+	}
+	u, err := url.Parse(assetURL)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	w, err := zw.Create(name + path.Ext(u.Path))
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, f)
+	return err
+}
+
+func writeZipJSON(zw *zip.Writer, name string, v any) error {
+	w, err := zw.Create(name)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+// expireExports deletes archives whose download window has closed.
+func (cfg *apiConfig) expireExports(ctx context.Context) error {
+	exports, err := cfg.db.GetUserExportsExpiredBefore(time.Now())
+	if err != nil {
+		return err
+	}
+	for _, export := range exports {
+		if export.Key != nil {
+			_, err := cfg.s3Client.DeleteObject(ctx, &s3.DeleteObjectInput{
+				Bucket: &cfg.s3Bucket,
+				Key:    export.Key,
+			})
+			if err != nil {
+				log.Printf("Couldn't delete archive of export %s: %v", export.ID, err)
+				continue
+			}
+		}
+		export.Status = database.UserExportExpired
+		export.Key = nil
+		if err := cfg.db.UpdateUserExport(export); err != nil {
+			log.Printf("Couldn't expire export %s: %v", export.ID, err)
+		}
+	}
+	return nil
+}
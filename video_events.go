@@ -0,0 +1,57 @@
+package main
+
+import (
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+const (
+	eventVideoCreated = "video.created"
+	eventVideoReady   = "video.ready"
+	eventVideoFailed  = "video.failed"
+	eventVideoDeleted = "video.deleted"
+)
+
+var videoEventTypes = []string{eventVideoCreated, eventVideoReady, eventVideoFailed, eventVideoDeleted}
+
+// videoEvent is what subscribers are told when a video changes state. It
+// carries just enough to identify the video; consumers fetch the rest
+// through the API, so the event never leaks URLs of non-public videos.
+type videoEvent struct {
+	ID        uuid.UUID      `json:"id"`
+	Type      string         `json:"type"`
+	CreatedAt time.Time      `json:"created_at"`
+	Data      videoEventData `json:"data"`
+}
+
+type videoEventData struct {
+	VideoID    uuid.UUID `json:"video_id"`
+	UserID     uuid.UUID `json:"user_id"`
+	Title      string    `json:"title"`
+	Visibility string    `json:"visibility"`
+	// Error is set on video.failed
+	Error string `json:"error,omitempty"`
+}
+
+// publishVideoEvent notifies subscribers that a video changed state.
+// cause is the error behind a video.failed event and nil otherwise.
+func (cfg *apiConfig) publishVideoEvent(eventType string, video database.Video, cause error) {
+	event := videoEvent{
+		ID:        uuid.New(),
+		Type:      eventType,
+		CreatedAt: time.Now().UTC(),
+		Data: videoEventData{
+			VideoID:    video.ID,
+			UserID:     video.UserID,
+			Title:      video.Title,
+			Visibility: video.Visibility,
+		},
+	}
+	if cause != nil {
+		event.Data.Error = cause.Error()
+	}
+	cfg.queueWebhooks(video.UserID, event)
+	cfg.publishEvent(event)
+}
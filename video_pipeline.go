@@ -0,0 +1,272 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// pipelineError is a processVideo failure along with the stage that
+// failed and the response it should produce.
+type pipelineError struct {
+	stage   string
+	status  int
+	message string
+	err     error
+}
+
+func (e *pipelineError) Error() string {
+	return fmt.Sprintf("%s: %v", e.message, e.err)
+}
+
+func (e *pipelineError) Unwrap() error {
+	return e.err
+}
+
+func respondWithPipelineError(w http.ResponseWriter, err error) {
+	var pErr *pipelineError
+	if errors.As(err, &pErr) {
+		respondWithError(w, pErr.status, pErr.message, pErr.err)
+		return
+	}
+	respondWithError(w, http.StatusInternalServerError, "Couldn't process video", err)
+}
+
+// processVideo probes and remuxes the MP4 at path for fast start, uploads
+// it to S3 and points the video at the new object. The caller still owns
+// path and removes it afterwards. Failures are recorded so repeatedly
+// failing videos end up dead-lettered.
+func (cfg *apiConfig) processVideo(ctx context.Context, dbVideo database.Video, path, mediaType string, storageClass types.StorageClass) (database.Video, error) {
+	return cfg.processInput(ctx, dbVideo, mediaInput{path: path}, mediaType, storageClass)
+}
+
+// processInput is processVideo for a video that may be held in memory.
+func (cfg *apiConfig) processInput(ctx context.Context, dbVideo database.Video, in mediaInput, mediaType string, storageClass types.StorageClass) (database.Video, error) {
+	start := time.Now()
+	progress := cfg.trackProgress(dbVideo.ID)
+	defer progress.done()
+	run := cfg.runVideoPipeline
+	if in.data != nil {
+		run = cfg.runSmallVideoPipeline
+	}
+	video, err := run(ctx, dbVideo, in, mediaType, storageClass, progress)
+	if err != nil {
+		// A client that went away isn't a processing failure
+		if ctx.Err() == nil {
+			cfg.recordProcessingRun(dbVideo.ID, start, err)
+			cfg.recordProcessingFailure(dbVideo.ID, err)
+			cfg.publishVideoEvent(eventVideoFailed, dbVideo, err)
+			cfg.notify(dbVideo.UserID, notificationVideoFailed, fmt.Sprintf("%q couldn't be processed", dbVideo.Title), &dbVideo.ID)
+		}
+		return database.Video{}, err
+	}
+	cfg.recordProcessingRun(dbVideo.ID, start, nil)
+	if err := cfg.db.ClearProcessingFailure(dbVideo.ID); err != nil {
+		log.Printf("Couldn't clear processing failures for video %s: %v", dbVideo.ID, err)
+	}
+	cfg.startCaptioning(ctx, video, in)
+	cfg.publishVideoEvent(eventVideoReady, video, nil)
+	cfg.notify(video.UserID, notificationVideoReady, fmt.Sprintf("%q is ready to watch", video.Title), &video.ID)
+	return video, nil
+}
+
+// recordProcessingRun logs how a pipeline run that began at start went,
+// for the admin stats.
+func (cfg *apiConfig) recordProcessingRun(videoID uuid.UUID, start time.Time, err error) {
+	params := database.RecordProcessingRunParams{
+		VideoID:   videoID,
+		Duration:  time.Since(start),
+		Succeeded: err == nil,
+	}
+	if err != nil {
+		params.Stage = "unknown"
+		var pErr *pipelineError
+		if errors.As(err, &pErr) {
+			params.Stage = pErr.stage
+		}
+	}
+	if err := cfg.db.RecordProcessingRun(params); err != nil {
+		log.Printf("Couldn't record processing run for video %s: %v", videoID, err)
+	}
+}
+
+func (cfg *apiConfig) runVideoPipeline(ctx context.Context, dbVideo database.Video, in mediaInput, mediaType string, storageClass types.StorageClass, progress *progressTracker) (database.Video, error) {
+	dataKey, err := cfg.videoDataKey(ctx, dbVideo)
+	if err != nil {
+		return database.Video{}, &pipelineError{"encrypt", http.StatusInternalServerError, "Couldn't get video key", err}
+	}
+	// MediaConvert reads the staged original straight from the bucket and
+	// can't decrypt it, so encrypted videos are always transcoded here
+	backend := cfg.transcoder
+	if dataKey != nil {
+		backend = ffmpegTranscoder{cfg: cfg, timeout: cfg.ffmpegTimeout}
+	}
+
+	// Determine video aspect ratio and dynamic range using ffprobe
+	probe, err := cfg.probeVideo(ctx, in)
+	if err != nil {
+		return database.Video{}, err
+	}
+
+	// A run that processed this original but failed to upload it left its
+	// files behind, so they're uploaded to the same key instead of
+	// transcoding again
+	var resume *database.ProcessedUpload
+	if _, ok := backend.(ffmpegTranscoder); ok {
+		resume = cfg.resumableUpload(ctx, dbVideo, storageClass, probe.hdrFormat != "", dataKey != nil)
+	}
+
+	var objName string
+	if resume != nil {
+		objName = resume.ObjectKey
+	} else {
+		objName = cfg.processedVideoKey(dbVideo, probe.aspectRatio)
+	}
+
+	// Have the configured backend write the fast-start MP4 to objName, and
+	// the DASH packaging next to it
+	var dashPrefix string
+	if cfg.dashEnabled && cfg.flags.enabled(flagDASHPackaging, dbVideo.UserID) {
+		dashPrefix = cfg.processedDashPrefix(dbVideo, objName)
+	}
+	result, err := backend.transcode(ctx, transcodeJob{
+		videoID:        dbVideo.ID,
+		path:           in.path,
+		stagingKey:     stringOrEmpty(dbVideo.StagingKey),
+		key:            objName,
+		mediaType:      mediaType,
+		storageClass:   storageClass,
+		dashPrefix:     dashPrefix,
+		hdrFormat:      probe.hdrFormat,
+		duration:       probe.duration,
+		dataKey:        dataKey,
+		progress:       progress,
+		sourceChecksum: stringOrEmpty(dbVideo.StagingChecksumSHA256),
+		resume:         resume,
+	})
+	if err != nil {
+		return database.Video{}, err
+	}
+	return cfg.finishVideoPipeline(ctx, dbVideo, in, storageClass, objName, probe, result)
+}
+
+// finishVideoPipeline points the video at the processed files the
+// pipeline uploaded, along with thumbnail candidates cut from in.
+func (cfg *apiConfig) finishVideoPipeline(ctx context.Context, dbVideo database.Video, in mediaInput, storageClass types.StorageClass, objName string, probe videoProbe, result transcodeResult) (database.Video, error) {
+	// Store an actual URL again in the video_url column, but this time, use the cloudfront URL. Use your distribution's domain name (including the https:// protocol)
+	videoURL := cfg.objectURL(objName)
+	var checksum, dashURL, dashKey, hdrFormat *string
+	if result.checksum != nil {
+		digest := result.checksum.sha256Hex()
+		checksum = &digest
+	}
+	if result.dashKey != "" {
+		u := cfg.objectURL(result.dashKey)
+		dashURL, dashKey = &u, &result.dashKey
+	}
+	if probe.hdrFormat != "" {
+		hdrFormat = &probe.hdrFormat
+	}
+
+	// Candidate frames are a nicety, so a video without them is still ready
+	thumbnailed := dbVideo
+	candidates, err := cfg.generateThumbnailCandidates(ctx, dbVideo, in)
+	if err != nil {
+		log.Printf("Couldn't generate thumbnail candidates for video %s: %v", dbVideo.ID, err)
+	} else if dbVideo.ThumbnailURL == nil && len(candidates) > 0 {
+		err := cfg.applyThumbnailAsset(&thumbnailed, candidates[len(candidates)/2].URL, defaultThumbnailCrop)
+		if err != nil {
+			log.Printf("Couldn't set default thumbnail for video %s: %v", dbVideo.ID, err)
+		}
+	}
+
+	// Only the fields the pipeline owns are written, onto the latest copy
+	// of the video, so edits made while it ran are kept
+	staged := dbVideo
+	dbVideo, err = cfg.saveVideoChanges(ctx, dbVideo, func(v *database.Video) {
+		v.StagingKey = staged.StagingKey
+		v.StagingChecksumSHA256 = staged.StagingChecksumSHA256
+		v.OriginalFilename = staged.OriginalFilename
+		v.VideoURL = &videoURL
+		v.VideoKey = &objName
+		v.ChecksumSHA256 = checksum
+		v.DashURL, v.DashKey = dashURL, dashKey
+		v.StorageClass = string(storageClass)
+		v.HDRFormat = hdrFormat
+		if v.ThumbnailURL == nil {
+			v.ThumbnailURL = thumbnailed.ThumbnailURL
+			v.ThumbnailSourceURL = thumbnailed.ThumbnailSourceURL
+			v.ThumbnailSquareURL = thumbnailed.ThumbnailSquareURL
+			v.ThumbnailCrop = thumbnailed.ThumbnailCrop
+		}
+	})
+	if err != nil {
+		return database.Video{}, &pipelineError{"db_update", http.StatusInternalServerError, "Couldn't update video URL in database", err}
+	}
+	return dbVideo, nil
+}
+
+// videoProbe is what the pipeline learns about an upload before
+// transcoding it.
+type videoProbe struct {
+	aspectRatio string
+	// hdrFormat is a database.HDRFormat* value, empty for SDR
+	hdrFormat string
+	// duration is in seconds, 0 if unknown
+	duration float64
+}
+
+// probeVideo probes the video once a transcode slot is free.
+func (cfg *apiConfig) probeVideo(ctx context.Context, in mediaInput) (videoProbe, error) {
+	// Wait for a free transcode slot so concurrent uploads can't start an
+	// unbounded number of ffprobe processes
+	releaseSlot, err := cfg.transcodes.acquire(ctx)
+	if err != nil {
+		return videoProbe{}, &pipelineError{"queue", http.StatusServiceUnavailable, "Upload cancelled while waiting to process", err}
+	}
+	defer releaseSlot()
+
+	probeCtx, cancelProbe := context.WithTimeout(ctx, cfg.ffprobeTimeout)
+	defer cancelProbe()
+	info, err := cfg.probe(probeCtx, in)
+	if err != nil {
+		return videoProbe{}, &pipelineError{"probe", http.StatusInternalServerError, "Couldn't probe video", err}
+	}
+	return videoProbe{
+		aspectRatio: aspectRatio(info.Width, info.Height),
+		hdrFormat:   hdrFormat(info.ColorTransfer),
+		duration:    info.Duration,
+	}, nil
+}
+
+// aspectRatio names the ratio of a video's dimensions: "16:9", "9:16" or
+// "other".
+func aspectRatio(width, height int) string {
+	ratio := float32(width) / float32(height)
+	if 1.77 < ratio && ratio < 1.78 {
+		return "16:9"
+	} else if 0.56 < ratio && ratio < 0.57 {
+		return "9:16"
+	}
+	return "other"
+}
+
+// hdrFormat maps a video's color transfer to the HDR format using it, or
+// "" for SDR.
+func hdrFormat(colorTransfer string) string {
+	switch colorTransfer {
+	case "smpte2084":
+		return database.HDRFormatPQ
+	case "arib-std-b67":
+		return database.HDRFormatHLG
+	default:
+		return ""
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+// stageOriginal uploads the unprocessed file at path to the staging
+// prefix before it goes through the pipeline, so a failed or outdated
+// result can be reprocessed later. Each video has one staging object;
+// a new upload replaces it. checksum is the digest of the file at path.
+// edit, if not nil, makes the upload's own changes to the video, and is
+// saved along with the staging key.
+func (cfg *apiConfig) stageOriginal(ctx context.Context, video database.Video, edit func(*database.Video), path, mediaType string, checksum fileChecksum) (database.Video, error) {
+	return cfg.stageInput(ctx, video, edit, mediaInput{path: path}, mediaType, checksum)
+}
+
+// stageInput is stageOriginal for a video that may be held in memory.
+func (cfg *apiConfig) stageInput(ctx context.Context, video database.Video, edit func(*database.Video), in mediaInput, mediaType string, checksum fileChecksum) (database.Video, error) {
+	key := fmt.Sprintf("%s%s%s.mp4", video.KeyPrefix, cfg.s3StagingPrefix, video.ID)
+	if err := cfg.putStagingObject(ctx, video, key, in, mediaType, checksum); err != nil {
+		return database.Video{}, err
+	}
+
+	digest := checksum.sha256Hex()
+	return cfg.saveVideoChanges(ctx, video, func(v *database.Video) {
+		if edit != nil {
+			edit(v)
+		}
+		v.StagingKey = &key
+		v.StagingChecksumSHA256 = &digest
+	})
+}
+
+// putStagingObject uploads the video to key, encrypted if video is.
+// checksum is the digest of the video. Only unencrypted videos can be
+// uploaded from memory.
+func (cfg *apiConfig) putStagingObject(ctx context.Context, video database.Video, key string, in mediaInput, mediaType string, checksum fileChecksum) error {
+	dataKey, err := cfg.videoDataKey(ctx, video)
+	if err != nil {
+		return err
+	}
+	if in.data != nil {
+		if dataKey != nil {
+			return errors.New("encrypted videos can't be staged from memory")
+		}
+		return cfg.putObjectBytes(ctx, "s3_put_staging_object", &s3.PutObjectInput{
+			Bucket:      &cfg.s3Bucket,
+			Key:         &key,
+			ContentType: &mediaType,
+		}, in.data, checksum)
+	}
+	path := in.path
+	if dataKey != nil {
+		path, checksum, err = cfg.sealFile(path, dataKey)
+		if err != nil {
+			return err
+		}
+		defer os.Remove(path)
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	return cfg.retry.do(ctx, "s3_put_staging_object", func() error {
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		_, err := cfg.s3Client.PutObject(ctx, cfg.withChecksum(&s3.PutObjectInput{
+			Bucket:      &cfg.s3Bucket,
+			Key:         &key,
+			ContentType: &mediaType,
+			Body:        file,
+		}, checksum))
+		return err
+	})
+}
+
+// downloadStaged copies a video's staging object to a temp file and
+// returns its path, after checking it against the digest recorded when it
+// was staged. The caller removes the file.
+func (cfg *apiConfig) downloadStaged(ctx context.Context, video database.Video) (string, error) {
+	if video.StagingKey == nil {
+		return "", fmt.Errorf("video %s has no staged original", video.ID)
+	}
+	dataKey, err := cfg.videoDataKey(ctx, video)
+	if err != nil {
+		return "", err
+	}
+	path, _, err := cfg.downloadVerified(ctx, *video.StagingKey, video.StagingChecksumSHA256, dataKey)
+	if errors.Is(err, errChecksumMismatch) {
+		return "", fmt.Errorf("staged original of video %s doesn't match its checksum", video.ID)
+	}
+	return path, err
+}
+
+var errChecksumMismatch = errors.New("object doesn't match its checksum")
+
+// downloadVerified copies the object at key to a temp file, decrypting it
+// with dataKey if that isn't nil, and returns its path and checksum. If
+// wantSHA256 is set the contents must match it. The caller removes the
+// file.
+func (cfg *apiConfig) downloadVerified(ctx context.Context, key string, wantSHA256 *string, dataKey []byte) (string, fileChecksum, error) {
+	body, size, err := cfg.openObject(ctx, key, dataKey)
+	if err != nil {
+		return "", fileChecksum{}, err
+	}
+	defer body.Close()
+
+	if err := cfg.checkScratchSpace(size); err != nil {
+		return "", fileChecksum{}, err
+	}
+	tmpFile, err := os.CreateTemp(cfg.scratchDir, "tubely-video-reprocess.mp4")
+	if err != nil {
+		return "", fileChecksum{}, err
+	}
+	defer tmpFile.Close()
+	_, checksum, err := copyWithChecksum(tmpFile, body)
+	if err != nil {
+		os.Remove(tmpFile.Name())
+		return "", fileChecksum{}, err
+	}
+	if wantSHA256 != nil && *wantSHA256 != checksum.sha256Hex() {
+		os.Remove(tmpFile.Name())
+		return "", fileChecksum{}, errChecksumMismatch
+	}
+	return tmpFile.Name(), checksum, nil
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// maxVideoUpdateConflicts is how many times saveVideoChanges reapplies
+// its changes to a video others keep updating before giving up.
+const maxVideoUpdateConflicts = 5
+
+// videoETag identifies a version of a video, for clients to send back in
+// If-Match when they update it.
+func videoETag(video database.Video) string {
+	return fmt.Sprintf(`"%d"`, video.Version)
+}
+
+// checkVideoIfMatch makes an update conditional on the If-Match header,
+// so a client editing a stale copy of video gets a 412 instead of
+// overwriting someone else's changes. Requests without one go ahead. On
+// failure it writes the error response itself and returns false.
+func checkVideoIfMatch(w http.ResponseWriter, r *http.Request, video database.Video) bool {
+	header := r.Header.Get("If-Match")
+	if header == "" {
+		return true
+	}
+	current := videoETag(video)
+	for _, tag := range strings.Split(header, ",") {
+		// Compressed responses carry the weak form of the tag, but it names
+		// the same version either way
+		tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+		if tag == "*" || tag == current {
+			return true
+		}
+	}
+	w.Header().Set("ETag", current)
+	respondWithError(w, http.StatusPreconditionFailed, "Video was changed since you last read it", fmt.Errorf("If-Match %s, current %s", header, current))
+	return false
+}
+
+// respondWithVideoUpdateError reports a failed UpdateVideo, with a 412
+// if the video changed between reading and saving it.
+func respondWithVideoUpdateError(w http.ResponseWriter, msg string, err error) {
+	if errors.Is(err, database.ErrVideoConflict) {
+		respondWithError(w, http.StatusPreconditionFailed, "Video was changed while updating it, try again", err)
+		return
+	}
+	respondWithError(w, http.StatusInternalServerError, msg, err)
+}
+
+// saveVideoChanges saves the changes apply makes to video. If it was
+// updated by someone else in the meantime, apply is run again on the
+// latest copy instead, so background work never overwrites edits made
+// while it ran.
+func (cfg *apiConfig) saveVideoChanges(ctx context.Context, video database.Video, apply func(*database.Video)) (database.Video, error) {
+	apply(&video)
+	for conflicts := 0; ; conflicts++ {
+		var saved database.Video
+		err := cfg.retry.do(ctx, "db_update_video", func() error {
+			var err error
+			saved, err = cfg.db.UpdateVideo(video)
+			return err
+		})
+		if !errors.Is(err, database.ErrVideoConflict) || conflicts == maxVideoUpdateConflicts {
+			return saved, err
+		}
+
+		latest, err := cfg.db.GetVideo(video.ID)
+		if err != nil {
+			return database.Video{}, err
+		}
+		if latest.ID == uuid.Nil {
+			return database.Video{}, fmt.Errorf("video %s was deleted", video.ID)
+		}
+		video = latest
+		apply(&video)
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// errUploadInProgress means another request is already uploading a file
+// for the video.
+var errUploadInProgress = errors.New("another upload of this video is in progress")
+
+// errUploadCancelled is why an upload's context ends when a forced upload
+// took the video over or its owner cancelled it.
+var errUploadCancelled = errors.New("upload was cancelled or replaced by another")
+
+// videoUploads tracks the video uploads running on this instance, so one
+// that's forced out or cancelled stops straight away rather than when its
+// heartbeat next finds the lock gone.
+type videoUploads struct {
+	mu      sync.Mutex
+	running map[uuid.UUID]runningUpload
+}
+
+type runningUpload struct {
+	token  uuid.UUID
+	cancel context.CancelCauseFunc
+}
+
+func newVideoUploads() *videoUploads {
+	return &videoUploads{running: map[uuid.UUID]runningUpload{}}
+}
+
+// add records an upload, cancelling whichever it took over from.
+func (u *videoUploads) add(videoID, token uuid.UUID, cancel context.CancelCauseFunc) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if prev, ok := u.running[videoID]; ok {
+		prev.cancel(errUploadCancelled)
+	}
+	u.running[videoID] = runningUpload{token: token, cancel: cancel}
+}
+
+func (u *videoUploads) remove(videoID, token uuid.UUID) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.running[videoID].token == token {
+		delete(u.running, videoID)
+	}
+}
+
+// cancel stops the video's upload if it's running here, reporting whether
+// it was.
+func (u *videoUploads) cancel(videoID uuid.UUID) bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	prev, ok := u.running[videoID]
+	if ok {
+		prev.cancel(errUploadCancelled)
+		delete(u.running, videoID)
+	}
+	return ok
+}
+
+// lockVideoUpload claims a video for one upload at a time, across
+// instances, so two uploads can't race to replace its file. With force it
+// takes over from an upload already in progress, which is cancelled. The
+// returned context ends if that happens to this upload; the caller runs
+// release once done.
+func (cfg *apiConfig) lockVideoUpload(ctx context.Context, videoID uuid.UUID, force bool) (context.Context, func(), error) {
+	token := uuid.New()
+	ok, err := cfg.db.AcquireVideoUploadLock(videoID, token, cfg.uploadLockTTL, force)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !ok {
+		return nil, nil, errUploadInProgress
+	}
+
+	ctx, cancel := context.WithCancelCause(ctx)
+	cfg.videoUploads.add(videoID, token, cancel)
+	go cfg.keepVideoUploadLock(ctx, videoID, token, cancel)
+
+	release := func() {
+		cfg.videoUploads.remove(videoID, token)
+		cancel(nil)
+		if err := cfg.db.ReleaseVideoUploadLock(videoID, token); err != nil {
+			log.Printf("Couldn't release upload lock of video %s: %v", videoID, err)
+		}
+	}
+	return ctx, release, nil
+}
+
+// keepVideoUploadLock refreshes an upload's lock until ctx ends, and
+// cancels the upload if the lock was taken by another instance.
+func (cfg *apiConfig) keepVideoUploadLock(ctx context.Context, videoID, token uuid.UUID, cancel context.CancelCauseFunc) {
+	ticker := time.NewTicker(cfg.uploadLockTTL / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		held, err := cfg.db.RefreshVideoUploadLock(videoID, token, cfg.uploadLockTTL)
+		if err != nil {
+			log.Printf("Couldn't refresh upload lock of video %s: %v", videoID, err)
+			continue
+		}
+		if !held {
+			cancel(errUploadCancelled)
+			return
+		}
+	}
+}
+
+// claimVideoUpload locks a video for the upload r makes, taking over from
+// one in progress if ?force=true. On failure it writes the error response
+// itself and returns ok == false.
+func (cfg *apiConfig) claimVideoUpload(w http.ResponseWriter, r *http.Request, videoID uuid.UUID) (ctx context.Context, release func(), ok bool) {
+	force := r.URL.Query().Get("force") == "true"
+	ctx, release, err := cfg.lockVideoUpload(r.Context(), videoID, force)
+	if errors.Is(err, errUploadInProgress) {
+		respondWithErrorCode(w, http.StatusConflict, codeUploadInProgress, "Another upload of this video is in progress, cancel it or retry with force=true", err)
+		return nil, nil, false
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't lock video for upload", err)
+		return nil, nil, false
+	}
+	return ctx, release, true
+}
+
+// uploadFailure reports an upload that failed because it was cancelled
+// as such, rather than as whatever error the cancellation caused.
+func uploadFailure(ctx context.Context, err error) error {
+	if cause := context.Cause(ctx); errors.Is(cause, errUploadCancelled) {
+		return &pipelineError{"upload", http.StatusConflict, "Upload was cancelled or replaced by another", fmt.Errorf("%w: %v", cause, err)}
+	}
+	return err
+}
+
+// handlerVideoUploadCancel stops the upload in progress for a video,
+// whichever instance it's running on, leaving the video as it was.
+func (cfg *apiConfig) handlerVideoUploadCancel(w http.ResponseWriter, r *http.Request) {
+	video, userID, ok := cfg.ownVideo(w, r)
+	if !ok {
+		return
+	}
+
+	cancelled := cfg.videoUploads.cancel(video.ID)
+	// Uploads on other instances stop once their heartbeat finds the lock
+	// gone
+	broken, err := cfg.db.BreakVideoUploadLock(video.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't cancel upload", err)
+		return
+	}
+	if !cancelled && !broken {
+		respondWithError(w, http.StatusNotFound, "No upload of this video is in progress", nil)
+		return
+	}
+	cfg.audit(r, userID, "video.upload_cancel", "video", video.ID.String(), "")
+
+	w.WriteHeader(http.StatusNoContent)
+}
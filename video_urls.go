@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+func validVisibility(v string) bool {
+	switch v {
+	case database.VisibilityPublic, database.VisibilityUnlisted, database.VisibilityPrivate:
+		return true
+	default:
+		return false
+	}
+}
+
+// signVideo prepares a video for a response. Non-public videos never
+// expose their CDN URL; VideoURL is swapped for a presigned S3 URL that
+// expires after cfg.signedURLTTL. The DASH manifest refers to its
+// segments by relative URL, which a presigned URL can't cover, so it's
+// withheld from non-public videos; they play through the playback endpoint.
+// So do geo-restricted videos, which get no URLs at all since the playback
+// endpoint is where the viewer's country is checked, and encrypted videos,
+// whose objects only the app can decrypt. Presigned URLs are recorded in
+// the access log against the caller on ctx; see accessContext.
+func (cfg *apiConfig) signVideo(ctx context.Context, video database.Video) (database.Video, error) {
+	if video.GeoRestriction != nil || video.Encrypted {
+		video.VideoURL = nil
+		video.DashURL = nil
+		return video, nil
+	}
+	if video.Visibility == database.VisibilityPublic {
+		return video, nil
+	}
+	video.DashURL = nil
+	if video.VideoURL == nil {
+		return video, nil
+	}
+	key, ok := videoObjectKey(video)
+	if !ok {
+		video.VideoURL = nil
+		return video, nil
+	}
+	signedURL, err := cfg.presignObject(ctx, key)
+	if err != nil {
+		return database.Video{}, fmt.Errorf("couldn't presign video %s: %w", video.ID, err)
+	}
+	video.VideoURL = &signedURL
+	cfg.logAccess(ctx, video.ID, accessPresign, "")
+	return video, nil
+}
+
+// presignObject returns a GET URL for key that expires after cfg.signedURLTTL.
+func (cfg *apiConfig) presignObject(ctx context.Context, key string) (string, error) {
+	req, err := cfg.s3PresignClient.PresignGetObject(ctx, &s3.GetObjectInput{
+		Bucket: &cfg.s3Bucket,
+		Key:    &key,
+	}, s3.WithPresignExpires(cfg.signedURLTTL))
+	if err != nil {
+		return "", err
+	}
+	return req.URL, nil
+}
+
+func (cfg *apiConfig) signVideos(ctx context.Context, videos []database.Video) ([]database.Video, error) {
+	signed := make([]database.Video, 0, len(videos))
+	for _, video := range videos {
+		v, err := cfg.signVideo(ctx, video)
+		if err != nil {
+			return nil, err
+		}
+		signed = append(signed, v)
+	}
+	return signed, nil
+}
+
+// respondWithVideo signs video's URL for the caller and writes it as JSON,
+// with its version as the ETag for conditional updates.
+func (cfg *apiConfig) respondWithVideo(w http.ResponseWriter, r *http.Request, code int, video database.Video) {
+	signed, err := cfg.signVideo(accessContext(r, cfg.optionalUserID(r)), video)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't sign video URL", err)
+		return
+	}
+	w.Header().Set("ETag", videoETag(video))
+	respondWithJSON(w, code, signed)
+}
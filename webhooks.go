@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+const (
+	// deliveries sent per poll of the webhook worker
+	webhookBatchSize = 100
+	// deliveries in flight at once, so one slow endpoint can't hold up the rest
+	webhookConcurrency = 8
+	// bytes of a failed response kept in the delivery log
+	webhookErrorBodyLimit = 512
+)
+
+func newWebhookSecret() string {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return "whsec_" + hex.EncodeToString(b)
+}
+
+// signWebhook returns the Tubely-Signature header for body. Receivers
+// recompute the HMAC over "<t>.<body>" with their secret and should reject
+// old timestamps to stop replays.
+func signWebhook(secret string, t time.Time, body []byte) string {
+	ts := strconv.FormatInt(t.Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(ts + "."))
+	mac.Write(body)
+	return "t=" + ts + ",v1=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// queueWebhooks records a delivery of event for each of the user's
+// endpoints that subscribes to it. The worker sends them.
+func (cfg *apiConfig) queueWebhooks(userID uuid.UUID, event videoEvent) {
+	endpoints, err := cfg.db.GetWebhookEndpoints(userID)
+	if err != nil {
+		log.Printf("Couldn't get webhooks for user %s: %v", userID, err)
+		return
+	}
+	var payload []byte
+	for _, endpoint := range endpoints {
+		if !endpoint.Subscribed(event.Type) {
+			continue
+		}
+		if payload == nil {
+			payload, err = json.Marshal(event)
+			if err != nil {
+				log.Printf("Couldn't encode %s event: %v", event.Type, err)
+				return
+			}
+		}
+		if _, err := cfg.db.CreateWebhookDelivery(endpoint.ID, event.Type, payload); err != nil {
+			log.Printf("Couldn't queue %s webhook for endpoint %s: %v", event.Type, endpoint.ID, err)
+		}
+	}
+}
+
+// deliverDueWebhooks sends every pending delivery whose next attempt is
+// due and records the outcome.
+func (cfg *apiConfig) deliverDueWebhooks(ctx context.Context) error {
+	deliveries, err := cfg.db.GetDueWebhookDeliveries(webhookBatchSize)
+	if err != nil {
+		return err
+	}
+
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, webhookConcurrency)
+	for _, delivery := range deliveries {
+		select {
+		case <-ctx.Done():
+			wg.Wait()
+			return ctx.Err()
+		case sem <- struct{}{}:
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			cfg.attemptWebhook(ctx, delivery)
+		}()
+	}
+	wg.Wait()
+	return nil
+}
+
+func (cfg *apiConfig) attemptWebhook(ctx context.Context, delivery database.WebhookDelivery) {
+	params := database.RecordWebhookAttemptParams{ID: delivery.ID}
+	endpoint, err := cfg.db.GetWebhookEndpoint(delivery.EndpointID)
+	if err != nil {
+		log.Printf("Couldn't get webhook endpoint %s: %v", delivery.EndpointID, err)
+		return
+	}
+	if endpoint.ID == uuid.Nil {
+		params.Status = database.WebhookDeliveryFailed
+		params.Error = "endpoint was deleted"
+	} else {
+		params.ResponseStatus, err = cfg.sendWebhook(ctx, endpoint, delivery)
+		attempt := delivery.Attempts + 1
+		switch {
+		case err == nil:
+			params.Status = database.WebhookDeliverySucceeded
+		case attempt >= cfg.webhookRetry.maxAttempts:
+			params.Status = database.WebhookDeliveryFailed
+			params.Error = err.Error()
+		default:
+			params.Status = database.WebhookDeliveryPending
+			params.Error = err.Error()
+			params.NextAttemptAt = time.Now().Add(cfg.webhookRetry.backoff(attempt))
+		}
+	}
+	if params.Status == database.WebhookDeliveryFailed {
+		log.Printf("Giving up on webhook delivery %s to endpoint %s: %s", delivery.ID, delivery.EndpointID, params.Error)
+	}
+	if err := cfg.db.RecordWebhookAttempt(params); err != nil {
+		log.Printf("Couldn't record webhook delivery %s: %v", delivery.ID, err)
+	}
+}
+
+// sendWebhook posts a signed delivery. Any response outside 2XX is an
+// error; its status is returned alongside so it can be logged.
+func (cfg *apiConfig) sendWebhook(ctx context.Context, endpoint database.WebhookEndpoint, delivery database.WebhookDelivery) (*int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint.URL, bytes.NewReader(delivery.Payload))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "Tubely-Webhooks/1.0")
+	req.Header.Set("Tubely-Event", delivery.Event)
+	req.Header.Set("Tubely-Delivery", delivery.ID.String())
+	req.Header.Set("Tubely-Signature", signWebhook(endpoint.Secret, time.Now(), delivery.Payload))
+
+	resp, err := cfg.webhookClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	status := resp.StatusCode
+	if status < 200 || status >= 300 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, webhookErrorBodyLimit))
+		return &status, fmt.Errorf("endpoint returned status %d: %s", status, strings.TrimSpace(string(body)))
+	}
+	return &status, nil
+}